@@ -3,6 +3,8 @@ package main
 import (
 	"flag"
 	"log"
+	"os"
+	"time"
 
 	"github.com/staple-org/staple/pkg"
 	"github.com/staple-org/staple/pkg/config"
@@ -17,17 +19,64 @@ func init() {
 	flag.StringVar(&config.Opts.Port, "port", "9998", "--port 443")
 	flag.StringVar(&config.Opts.Hostname, "hostname", "", "--hostname staple-clipper.org")
 	flag.StringVar(&config.Opts.GlobalTokenKey, "token-key", "", "--token-key <random-data>")
+	flag.StringVar(&config.Opts.AdminToken, "admin-token", "", "--admin-token <random-data>")
+	flag.StringVar(&config.Opts.TrustedProxies, "trusted-proxies", "", "--trusted-proxies 10.0.0.0/8,127.0.0.1/32")
+	flag.StringVar(&config.Opts.TokenKeys.Dir, "token-key-dir", "", "--token-key-dir /home/user/.server/keys")
+	flag.DurationVar(&config.Opts.TokenKeys.RotationInterval, "token-key-rotation", 0, "--token-key-rotation 720h")
+	flag.DurationVar(&config.Opts.TokenKeys.Grace, "token-key-grace", 96*time.Hour, "--token-key-grace 96h")
 	flag.StringVar(&config.Opts.Database.Hostname, "staple-db-hostname", "localhost", "--staple-db-hostname localhost")
 	flag.StringVar(&config.Opts.Database.Database, "staple-db-database", "staples", "--staple-db-database staples")
 	flag.StringVar(&config.Opts.Database.Username, "staple-db-username", "staple", "--staple-db-username staple")
 	flag.StringVar(&config.Opts.Database.Password, "staple-db-password", "password123", "--staple-db-password password123")
 	flag.StringVar(&config.Opts.Mailer.Domain, "mg-domain", "", "--mg-domain <MG_DOMAIN>")
 	flag.StringVar(&config.Opts.Mailer.APIKey, "mg-api-key", "", "--mg-api-key <MG_API_KEY>")
+	flag.IntVar(&config.Opts.Notifications.Workers, "notification-workers", 4, "--notification-workers 4")
+	flag.IntVar(&config.Opts.Notifications.MaxAttempts, "notification-max-attempts", 10, "--notification-max-attempts 10")
+	flag.DurationVar(&config.Opts.Notifications.Interval, "notification-interval", 30*time.Second, "--notification-interval 30s")
+	flag.DurationVar(&config.Opts.Digests.Interval, "digest-interval", 15*time.Minute, "--digest-interval 15m")
+	flag.StringVar(&config.Opts.SMTP.Host, "smtp-host", "", "--smtp-host mail.example.com")
+	flag.IntVar(&config.Opts.SMTP.Port, "smtp-port", 0, "--smtp-port 587")
+	flag.StringVar(&config.Opts.SMTP.Username, "smtp-username", "", "--smtp-username staple")
+	flag.StringVar(&config.Opts.SMTP.Password, "smtp-password", "", "--smtp-password <SMTP_PASSWORD>")
+	flag.StringVar(&config.Opts.SMTP.Security, "smtp-security", "starttls", "--smtp-security starttls|tls|none")
+	flag.StringVar(&config.Opts.SMTP.From, "smtp-from", "", "--smtp-from 'Staple <no-reply@example.com>'")
+	flag.StringVar(&config.Opts.Mailer.TemplateDir, "mail-template-dir", "", "--mail-template-dir /home/user/.server/mail-templates")
+	flag.StringVar(&config.Opts.RateLimit.Backend, "rate-limit-backend", "memory", "--rate-limit-backend postgres")
+	flag.IntVar(&config.Opts.RateLimit.PerMinute, "rate-limit-per-minute", 10, "--rate-limit-per-minute 10")
+	flag.IntVar(&config.Opts.RateLimit.Burst, "rate-limit-burst", 5, "--rate-limit-burst 5")
+	flag.IntVar(&config.Opts.Lockout.Threshold, "lockout-threshold", 5, "--lockout-threshold 5")
+	flag.DurationVar(&config.Opts.Lockout.Duration, "lockout-duration", 15*time.Minute, "--lockout-duration 15m")
+	flag.IntVar(&config.Opts.PasswordPolicy.MinLength, "password-min-length", 8, "--password-min-length 8")
+	flag.IntVar(&config.Opts.PasswordPolicy.MinClasses, "password-min-classes", 1, "--password-min-classes 3")
+	flag.StringVar(&config.Opts.PasswordPolicy.BreachedDir, "password-breached-dir", "", "--password-breached-dir /home/user/.server/pwned-passwords")
+	flag.DurationVar(&config.Opts.Audit.Retention, "audit-retention", 90*24*time.Hour, "--audit-retention 2160h")
+	flag.DurationVar(&config.Opts.Trash.Retention, "trash-retention", 30*24*time.Hour, "--trash-retention 720h")
+	flag.DurationVar(&config.Opts.AccountDeletion.Grace, "account-deletion-grace", 0, "--account-deletion-grace 720h")
+	flag.DurationVar(&config.Opts.Subscriptions.Interval, "subscription-interval", 30*time.Minute, "--subscription-interval 30m")
+	flag.BoolVar(&config.Opts.Subscriptions.AllowPrivate, "subscription-allow-private", false, "--subscription-allow-private")
+	flag.BoolVar(&config.Opts.Events.Outbox, "event-outbox", false, "--event-outbox")
+	flag.DurationVar(&config.Opts.Webhooks.Interval, "webhook-interval", 30*time.Second, "--webhook-interval 30s")
+	flag.BoolVar(&config.Opts.Webhooks.AllowPrivate, "webhook-allow-private", false, "--webhook-allow-private")
+	flag.StringVar(&config.Opts.Inbound.Listen, "inbound-smtp-listen", "", "--inbound-smtp-listen :2525")
+	flag.StringVar(&config.Opts.Inbound.Domain, "inbound-smtp-domain", "", "--inbound-smtp-domain in.staple-clipper.org")
+	flag.Int64Var(&config.Opts.Inbound.MaxSize, "inbound-smtp-max-size", 10<<20, "--inbound-smtp-max-size 10485760")
+	flag.IntVar(&config.Opts.Inbound.MaxConns, "inbound-smtp-max-connections", 100, "--inbound-smtp-max-connections 100")
+	flag.StringVar(&config.Opts.OIDC.Issuer, "oidc-issuer", "", "--oidc-issuer https://id.example.com")
+	flag.StringVar(&config.Opts.OIDC.ClientID, "oidc-client-id", "", "--oidc-client-id staple")
+	flag.StringVar(&config.Opts.OIDC.ClientSecret, "oidc-client-secret", "", "--oidc-client-secret <OIDC_CLIENT_SECRET>")
+	flag.StringVar(&config.Opts.OIDC.RedirectURL, "oidc-redirect-url", "", "--oidc-redirect-url https://staple-clipper.org/rest/api/1/oidc/callback")
+	flag.BoolVar(&config.Opts.OIDC.AutoProvision, "oidc-auto-provision", false, "--oidc-auto-provision")
 	flag.BoolVar(&config.Opts.Debug, "debug", false, "--debug")
 	flag.Parse()
 }
 
 func main() {
+	if flag.Arg(0) == "export" {
+		if err := pkg.Export(flag.Args()[1:], os.Stdout); err != nil {
+			log.Fatal("Failure exporting staples: ", err)
+		}
+		return
+	}
 	if err := pkg.Serve(); err != nil {
 		log.Fatal("Failure starting Stapler: ", err)
 	}
@@ -5,12 +5,15 @@ go 1.19
 require (
 	github.com/golang-jwt/jwt v3.2.2+incompatible
 	github.com/google/uuid v1.1.1
+	github.com/jackc/pgconn v1.1.0
 	github.com/jackc/pgx/v4 v4.1.2
 	github.com/labstack/echo/v4 v4.9.0
 	github.com/mailgun/mailgun-go v2.0.0+incompatible
 	github.com/rs/zerolog v1.15.0
 	github.com/stretchr/testify v1.7.0
 	golang.org/x/crypto v0.0.0-20210817164053-32db794688a5
+	golang.org/x/net v0.0.0-20211015210444-4f30a5c0130f
+	golang.org/x/text v0.3.7
 )
 
 require (
@@ -20,7 +23,6 @@ require (
 	github.com/facebookgo/subset v0.0.0-20150612182917-8dac2c3c4870 // indirect
 	github.com/gobuffalo/envy v1.8.1 // indirect
 	github.com/jackc/chunkreader/v2 v2.0.0 // indirect
-	github.com/jackc/pgconn v1.1.0 // indirect
 	github.com/jackc/pgio v1.0.0 // indirect
 	github.com/jackc/pgpassfile v1.0.0 // indirect
 	github.com/jackc/pgproto3/v2 v2.0.0 // indirect
@@ -36,9 +38,7 @@ require (
 	github.com/rogpeppe/go-internal v1.3.2 // indirect
 	github.com/valyala/bytebufferpool v1.0.0 // indirect
 	github.com/valyala/fasttemplate v1.2.1 // indirect
-	golang.org/x/net v0.0.0-20211015210444-4f30a5c0130f // indirect
 	golang.org/x/sys v0.0.0-20211103235746-7861aae1554b // indirect
-	golang.org/x/text v0.3.7 // indirect
 	golang.org/x/time v0.0.0-20201208040808-7e3f01d25324 // indirect
 	golang.org/x/xerrors v0.0.0-20191011141410-1b5146add898 // indirect
 	gopkg.in/check.v1 v1.0.0-20190902080502-41f04d3bba15 // indirect
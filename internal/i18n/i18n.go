@@ -0,0 +1,118 @@
+// Package i18n translates the messages shown to users. Messages are written in English in
+// the code and double as the keys of the catalogue, so a message without a translation is
+// shown in English.
+package i18n
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"golang.org/x/text/language"
+)
+
+// Default is the locale of the messages in the code.
+const Default = "en"
+
+//go:embed locales/*.json
+var localeFiles embed.FS
+
+var (
+	// catalogue maps locales to the translations of messages.
+	catalogue = mustLoad()
+	// matcher picks the best supported locale for the languages of a request.
+	matcher = language.NewMatcher(tags())
+)
+
+// mustLoad reads the locale files. Each is named after its locale, such as de.json.
+func mustLoad() map[string]map[string]string {
+	entries, err := localeFiles.ReadDir("locales")
+	if err != nil {
+		panic(err)
+	}
+	c := make(map[string]map[string]string, len(entries))
+	for _, e := range entries {
+		data, err := localeFiles.ReadFile(path.Join("locales", e.Name()))
+		if err != nil {
+			panic(err)
+		}
+		var messages map[string]string
+		if err := json.Unmarshal(data, &messages); err != nil {
+			panic(fmt.Sprintf("locale file %s: %v", e.Name(), err))
+		}
+		c[strings.TrimSuffix(e.Name(), ".json")] = messages
+	}
+	return c
+}
+
+func tags() []language.Tag {
+	ret := []language.Tag{language.Make(Default)}
+	for _, l := range Locales()[1:] {
+		ret = append(ret, language.Make(l))
+	}
+	return ret
+}
+
+// Locales returns the supported locales, the default first.
+func Locales() []string {
+	ret := make([]string, 0, len(catalogue)+1)
+	for l := range catalogue {
+		if l != Default {
+			ret = append(ret, l)
+		}
+	}
+	sort.Strings(ret)
+	return append([]string{Default}, ret...)
+}
+
+// Supported returns the supported locale of a language tag such as de-AT. It reports false
+// if the language isn't supported.
+func Supported(locale string) (string, bool) {
+	tag, err := language.Parse(locale)
+	if err != nil {
+		return "", false
+	}
+	base, _ := tag.Base()
+	for _, l := range Locales() {
+		if l == base.String() {
+			return l, true
+		}
+	}
+	return "", false
+}
+
+// Negotiate returns the supported locale which fits the Accept-Language header best, or
+// the default.
+func Negotiate(acceptLanguage string) string {
+	preferred, _, err := language.ParseAcceptLanguage(acceptLanguage)
+	if err != nil || len(preferred) == 0 {
+		return Default
+	}
+	tag, _, confidence := matcher.Match(preferred...)
+	if confidence == language.No {
+		return Default
+	}
+	base, _ := tag.Base()
+	if l, ok := Supported(base.String()); ok {
+		return l
+	}
+	return Default
+}
+
+// Translate returns the translation of message into locale, or message if there is none.
+func Translate(locale, message string) string {
+	if l, ok := Supported(locale); ok {
+		if t, ok := catalogue[l][message]; ok && t != "" {
+			return t
+		}
+	}
+	return message
+}
+
+// Sprintf formats the translation of format into locale.
+func Sprintf(locale, format string, args ...interface{}) string {
+	return fmt.Sprintf(Translate(locale, format), args...)
+}
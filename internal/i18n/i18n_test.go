@@ -0,0 +1,43 @@
+package i18n
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNegotiate(t *testing.T) {
+	assert.Equal(t, "de", Negotiate("de-AT,de;q=0.9,en;q=0.8"))
+	assert.Equal(t, "en", Negotiate("fr-FR,en;q=0.5"))
+	assert.Equal(t, "de", Negotiate("fr-FR,de;q=0.5"))
+	assert.Equal(t, "en", Negotiate("fr"))
+	assert.Equal(t, "en", Negotiate(""))
+	assert.Equal(t, "en", Negotiate("not a header;;"))
+}
+
+func TestTranslate(t *testing.T) {
+	assert.Equal(t, "Staple nicht gefunden", Translate("de", "staple not found"))
+	assert.Equal(t, "Staple nicht gefunden", Translate("de-CH", "staple not found"))
+	assert.Equal(t, "staple not found", Translate("en", "staple not found"))
+	assert.Equal(t, "staple not found", Translate("fr", "staple not found"))
+	assert.Equal(t, "no translation", Translate("de", "no translation"))
+	assert.Equal(t, "vor 3 Tagen", Sprintf("de", "%d days ago", 3))
+
+	l, ok := Supported("de-DE")
+	assert.True(t, ok)
+	assert.Equal(t, "de", l)
+	_, ok = Supported("xx")
+	assert.False(t, ok)
+	assert.Equal(t, []string{"en", "de"}, Locales())
+}
+
+// Translations have to use the same formatting verbs as their messages.
+func TestCatalogueVerbs(t *testing.T) {
+	verbs := regexp.MustCompile(`%[a-z]`)
+	for locale, messages := range catalogue {
+		for message, translation := range messages {
+			assert.Equal(t, verbs.FindAllString(message, -1), verbs.FindAllString(translation, -1), "%s: %s", locale, message)
+		}
+	}
+}
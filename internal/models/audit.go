@@ -0,0 +1,36 @@
+package models
+
+import "time"
+
+const (
+	// AuditLogin is a successful login. The detail is the method, such as password, totp or oidc.
+	AuditLogin = "login"
+	// AuditLoginFailed is a wrong password, two-factor code or confirm code.
+	AuditLoginFailed = "login_failed"
+	// AuditPasswordChanged is a changed or reset password.
+	AuditPasswordChanged = "password_changed"
+	// AuditTokenCreated is a new API token, feed token or inbox address. The detail says which.
+	AuditTokenCreated = "token_created"
+	// AuditStapleCreated is a staple added to the queue.
+	AuditStapleCreated = "staple_created"
+	// AuditStapleArchived is a staple moved to the archive.
+	AuditStapleArchived = "staple_archived"
+	// AuditStapleDeleted is a staple moved to the trash.
+	AuditStapleDeleted = "staple_deleted"
+	// AuditStapleRestored is a staple taken out of the trash.
+	AuditStapleRestored = "staple_restored"
+)
+
+// AuditEntry records an action of a user in the audit log. Entries are never changed.
+type AuditEntry struct {
+	ID     int64  `json:"id"`
+	UserID string `json:"user_id"`
+	Action string `json:"action"`
+	// StapleID is the staple of a staple action.
+	StapleID int `json:"staple_id,omitempty"`
+	// Detail describes the action, such as the name of a staple or the login method.
+	Detail    string    `json:"detail,omitempty"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	CreatedAt time.Time `json:"created_at"`
+}
@@ -0,0 +1,26 @@
+package models
+
+import "time"
+
+const (
+	// ChatSlack posts to Slack compatible incoming webhooks, which Mattermost and Rocket.Chat offer too.
+	ChatSlack = "slack"
+	// ChatDiscord posts to Discord webhooks.
+	ChatDiscord = "discord"
+	// ChatMatrix sends to a Matrix room with the client-server API.
+	ChatMatrix = "matrix"
+)
+
+// ChatTarget is where a user's notifications of one chat channel are sent.
+type ChatTarget struct {
+	UserID string `json:"-"`
+	// Kind is slack, discord or matrix.
+	Kind string `json:"kind"`
+	// URL is the incoming webhook, or the homeserver for Matrix.
+	URL string `json:"url"`
+	// Room is the id of the Matrix room.
+	Room string `json:"room,omitempty"`
+	// Token is the Matrix access token. It is never returned by the API.
+	Token     string    `json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+}
@@ -0,0 +1,43 @@
+package models
+
+import "time"
+
+const (
+	// DigestOff disables the digest.
+	DigestOff = "off"
+	// DigestDaily sends the digest every day.
+	DigestDaily = "daily"
+	// DigestWeekly sends the digest every Monday.
+	DigestWeekly = "weekly"
+)
+
+// DigestSettings are the settings of a user's queue digest and reading reminder.
+type DigestSettings struct {
+	UserID string `json:"-"`
+	// Frequency is off, daily or weekly.
+	Frequency string `json:"frequency"`
+	// Hour is the local hour of the day from which the digest is sent.
+	Hour int `json:"hour"`
+	// ReminderDays sends a reminder when nothing was read for this many days. Zero disables it.
+	ReminderDays int `json:"reminder_days"`
+	// Timezone is the IANA name of the user's timezone, such as Europe/Berlin.
+	Timezone string `json:"timezone"`
+	// QuietStart and QuietEnd are the local hours between which nothing is sent. The quiet
+	// hours may span midnight; equal hours disable them.
+	QuietStart     int        `json:"quiet_start"`
+	QuietEnd       int        `json:"quiet_end"`
+	LastDigestAt   *time.Time `json:"last_digest_at,omitempty"`
+	LastReminderAt *time.Time `json:"last_reminder_at,omitempty"`
+}
+
+// Quiet reports whether nothing should be sent at the given local hour.
+func (s DigestSettings) Quiet(hour int) bool {
+	switch {
+	case s.QuietStart == s.QuietEnd:
+		return false
+	case s.QuietStart < s.QuietEnd:
+		return hour >= s.QuietStart && hour < s.QuietEnd
+	default:
+		return hour >= s.QuietStart || hour < s.QuietEnd
+	}
+}
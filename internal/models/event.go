@@ -0,0 +1,18 @@
+package models
+
+// Names of the domain events. Webhooks use the same names.
+const (
+	EventStapleCreated     = "staple.created"
+	EventStapleArchived    = "staple.archived"
+	EventStapleDeleted     = "staple.deleted"
+	EventStapleRestored    = "staple.restored"
+	EventQueueEmptied      = "queue.empty"
+	EventQuotaReached      = "quota.reached"
+	EventUserRegistered    = "user.registered"
+	EventPasswordChanged   = "user.password_changed"
+	EventEmailChanged      = "user.email_changed"
+	EventTwoFactorChanged  = "user.two_factor_changed"
+	EventAccountLocked     = "user.locked"
+	EventDeletionScheduled = "user.deletion_scheduled"
+	EventUserDeleted       = "user.deleted"
+)
@@ -0,0 +1,44 @@
+package models
+
+import "time"
+
+const (
+	// NotificationPending is a notification which is waiting for its next attempt.
+	NotificationPending = "pending"
+	// NotificationSent is a notification which was handed to the mail provider.
+	NotificationSent = "sent"
+	// NotificationDead is a notification which was given up after too many attempts.
+	NotificationDead = "dead"
+)
+
+// Notification is a mail to a user in the notification outbox.
+type Notification struct {
+	ID    int    `json:"id"`
+	Email string `json:"email"`
+	Event string `json:"event"`
+	// Channel is the channel the notification is sent through, such as email.
+	Channel string `json:"channel"`
+	// Payload can carry codes and passwords, so it is never returned by the API.
+	Payload string `json:"-"`
+	// Attempts is the number of times sending was tried so far.
+	Attempts int `json:"attempts"`
+	// NextAttemptAt is the time of the next try. It is nil once the notification was sent
+	// or given up.
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty"`
+	SentAt        *time.Time `json:"sent_at,omitempty"`
+	DeadAt        *time.Time `json:"dead_at,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+// Status is pending, sent or dead.
+func (n Notification) Status() string {
+	switch {
+	case n.SentAt != nil:
+		return NotificationSent
+	case n.DeadAt != nil:
+		return NotificationDead
+	default:
+		return NotificationPending
+	}
+}
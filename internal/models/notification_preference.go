@@ -0,0 +1,27 @@
+package models
+
+import "time"
+
+const (
+	// NotifyImmediately sends every notification of an event.
+	NotifyImmediately = "immediate"
+	// NotifyAtMostDaily sends at most one notification of an event a day. Further
+	// notifications of the event within the day are dropped, not batched.
+	NotifyAtMostDaily = "at-most-daily"
+	// NotifyOff sends no notifications of an event.
+	NotifyOff = "off"
+)
+
+// NotificationPreference is how a user wants to be notified of an event.
+type NotificationPreference struct {
+	UserID string `json:"-"`
+	// Event is the key of the event, such as queue-digest.
+	Event string `json:"event"`
+	// Channels are the channels the notifications are sent through, such as email.
+	Channels []string `json:"channels"`
+	// Frequency is immediate, at-most-daily or off.
+	Frequency string `json:"frequency"`
+	// Required is set for security events, which are always sent by email.
+	Required   bool       `json:"required"`
+	LastSentAt *time.Time `json:"-"`
+}
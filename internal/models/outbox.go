@@ -0,0 +1,22 @@
+package models
+
+import "time"
+
+// OutboxRecord is a domain event stored in the same transaction as the change which caused
+// it. It is published once the relay picks it up, so the event isn't lost if the process
+// stops right after the change was committed.
+type OutboxRecord struct {
+	// ID identifies the event. Subscribers use it to recognise events delivered twice.
+	ID     string
+	Name   string
+	UserID string
+	// Payload is the JSON encoded body of the event.
+	Payload    []byte
+	OccurredAt time.Time
+	// Attempts counts the failed attempts to publish the event.
+	Attempts    int
+	LastError   string
+	PublishedAt *time.Time
+	// LockedUntil hides a claimed record from other relays.
+	LockedUntil *time.Time
+}
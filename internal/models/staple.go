@@ -9,4 +9,10 @@ type Staple struct {
 	Content   string    `json:"content"`
 	CreatedAt time.Time `json:"created_at"`
 	Archived  bool      `json:"archived"`
+	// ArchivedAt is the time the staple was archived. It is only known for staples
+	// archived after it was introduced.
+	ArchivedAt *time.Time `json:"archived_at,omitempty"`
+	// DeletedAt is the time the staple was moved to the trash. Staples in the trash are
+	// only listed by the trash.
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
 }
@@ -0,0 +1,53 @@
+package models
+
+import "time"
+
+const (
+	// StatsDaily groups the activity of the statistics by day.
+	StatsDaily = "day"
+	// StatsWeekly groups the activity of the statistics by week, starting on Mondays.
+	StatsWeekly = "week"
+)
+
+// StapleActivity counts what happened to the staples of a user on a day or in a week.
+type StapleActivity struct {
+	// Date is the first day of the period formatted as 2006-01-02.
+	Date     string `json:"date"`
+	Added    int    `json:"added"`
+	Archived int    `json:"archived"`
+	// DeletedUnread counts the staples which were deleted without being archived.
+	DeletedUnread int `json:"deleted_unread"`
+}
+
+// QueueAge counts the staples of the queue which were added between MinDays and MaxDays
+// days ago.
+type QueueAge struct {
+	MinDays int `json:"min_days"`
+	// MaxDays is nil for the oldest staples.
+	MaxDays *int `json:"max_days,omitempty"`
+	Count   int  `json:"count"`
+}
+
+// StapleStats are the reading statistics of a user between two dates.
+type StapleStats struct {
+	// From and To are the first and the last day of the statistics formatted as 2006-01-02.
+	From     string `json:"from"`
+	To       string `json:"to"`
+	Timezone string `json:"timezone"`
+	// Period is day or week.
+	Period        string           `json:"period"`
+	Activity      []StapleActivity `json:"activity"`
+	Added         int              `json:"added"`
+	Archived      int              `json:"archived"`
+	DeletedUnread int              `json:"deleted_unread"`
+	// AverageSecondsInQueue is the average time between adding and archiving the staples
+	// archived in the range.
+	AverageSecondsInQueue int64 `json:"average_seconds_in_queue"`
+	// QueueAges is the age distribution of the queue as it is now.
+	QueueAges []QueueAge `json:"queue_ages"`
+	// CurrentStreak is the number of days in a row something was read up to the last day or
+	// the day before it. LongestStreak is the longest such run within the range.
+	CurrentStreak int       `json:"current_streak"`
+	LongestStreak int       `json:"longest_streak"`
+	GeneratedAt   time.Time `json:"generated_at"`
+}
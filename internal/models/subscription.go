@@ -0,0 +1,22 @@
+package models
+
+import "time"
+
+// Subscription is an external feed whose new entries are added to the queue of a user.
+type Subscription struct {
+	ID     int    `json:"id"`
+	UserID string `json:"-"`
+	URL    string `json:"url"`
+	// Title is the title of the feed as of the last successful poll.
+	Title string `json:"title"`
+	// Policy decides what happens to new entries when the queue is full.
+	Policy string `json:"policy"`
+	// ETag and LastModified are the validators of the last response used for conditional requests.
+	ETag         string `json:"-"`
+	LastModified string `json:"-"`
+	// CheckedAt is the time of the last poll. Zero means the feed hasn't been polled yet.
+	CheckedAt time.Time `json:"checked_at"`
+	// LastError is the error of the last poll or empty if it succeeded.
+	LastError string    `json:"last_error,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
@@ -1,7 +1,11 @@
 package models
 
+import "time"
+
 // User defines a user of the system.
 type User struct {
+	// ID is the stable internal identifier of the user. Unlike the email it never changes.
+	ID string `json:"id"`
 	// Email will be used as username.
 	Email string `json:"email"`
 	// Password
@@ -10,4 +14,33 @@ type User struct {
 	ConfirmCode string `json:"-"`
 	// Maximum number of staples
 	MaxStaples int `json:"max_staples"`
+	// TOTPSecret is the base32 encoded secret used for two-factor authentication.
+	TOTPSecret string `json:"-"`
+	// TOTPEnabled is set once the user confirmed the enrolment with a valid code.
+	TOTPEnabled bool `json:"totp_enabled"`
+	// RecoveryCodes are bcrypt hashes of one-time codes which can be used instead of a TOTP code.
+	RecoveryCodes []string `json:"-"`
+	// TOTPLastStep is the time step of the last accepted TOTP code. Codes of this or an
+	// earlier step are rejected so a code can't be used twice.
+	TOTPLastStep int64 `json:"-"`
+	// FailedLogins is the number of failed login attempts since the last successful one.
+	FailedLogins int `json:"-"`
+	// LockedUntil is the time until which logins are rejected.
+	LockedUntil time.Time `json:"-"`
+	// PendingEmail is the new email address the user wants to change to.
+	PendingEmail string `json:"-"`
+	// EmailChangeCode confirms the ownership of PendingEmail.
+	EmailChangeCode string `json:"-"`
+	// EmailChangeExpires is the time after which EmailChangeCode is no longer accepted.
+	EmailChangeExpires time.Time `json:"-"`
+	// TokensValidAfter rejects all tokens issued before it.
+	TokensValidAfter time.Time `json:"-"`
+	// DeleteAfter is the time after which the account is deleted. Zero means no deletion is scheduled.
+	DeleteAfter time.Time `json:"-"`
+	// FeedToken is the secret part of the URLs of the personal feeds. Empty means no feeds.
+	FeedToken string `json:"-"`
+	// InboxToken is the local part of the secret email address staples can be mailed to. Empty means none.
+	InboxToken string `json:"-"`
+	// Locale is the language of the user's notifications, such as de. Empty means English.
+	Locale string `json:"locale"`
 }
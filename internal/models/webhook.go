@@ -0,0 +1,45 @@
+package models
+
+import "time"
+
+// Webhook is a URL of a user which is called when one of the selected events happens.
+type Webhook struct {
+	ID     int    `json:"id"`
+	UserID string `json:"-"`
+	URL    string `json:"url"`
+	// Events are the names of the events the webhook is called for.
+	Events []string `json:"events"`
+	// Secret signs the payloads. It is only returned when the webhook is created.
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Subscribed reports whether the webhook is called for the event.
+func (w Webhook) Subscribed(event string) bool {
+	for _, e := range w.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookDelivery is a single event sent, or to be sent, to a webhook.
+type WebhookDelivery struct {
+	ID        int    `json:"id"`
+	UserID    string `json:"-"`
+	WebhookID int    `json:"webhook_id"`
+	Event     string `json:"event"`
+	// Payload is the JSON body which is posted to the webhook.
+	Payload string `json:"payload"`
+	// Attempts is the number of requests made so far.
+	Attempts int `json:"attempts"`
+	// NextAttemptAt is the time of the next try. It is nil once the delivery succeeded or
+	// was given up.
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty"`
+	DeliveredAt   *time.Time `json:"delivered_at,omitempty"`
+	// StatusCode is the HTTP status of the last attempt or zero if there was no response.
+	StatusCode int       `json:"status_code,omitempty"`
+	LastError  string    `json:"last_error,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
@@ -0,0 +1,131 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/staple-org/staple/internal/models"
+	"github.com/staple-org/staple/internal/storage"
+	"github.com/staple-org/staple/pkg/config"
+)
+
+const (
+	// auditMaxUserAgent is the number of characters of a user agent which are stored.
+	auditMaxUserAgent = 512
+	// auditMaxDetail is the number of characters of a detail which are stored.
+	auditMaxDetail = 255
+)
+
+// auditActions are the actions which are recorded.
+var auditActions = []string{
+	models.AuditLogin,
+	models.AuditLoginFailed,
+	models.AuditPasswordChanged,
+	models.AuditTokenCreated,
+	models.AuditStapleCreated,
+	models.AuditStapleArchived,
+	models.AuditStapleDeleted,
+	models.AuditStapleRestored,
+}
+
+// ErrInvalidAuditEntry is returned for entries which can't be recorded or listed.
+var ErrInvalidAuditEntry = errors.New("invalid audit entry")
+
+// AuditLog is the append-only log of the account and staple actions of users. Entries
+// older than the retention are purged.
+type AuditLog struct {
+	store     storage.AuditStorer
+	clock     Clock
+	retention time.Duration
+}
+
+// NewAuditLog creates an audit log which keeps its entries forever.
+func NewAuditLog(store storage.AuditStorer) AuditLog {
+	return AuditLog{store: store, clock: time.Now}
+}
+
+// WithClock returns a copy of the log which uses the given clock.
+func (a AuditLog) WithClock(clock Clock) AuditLog {
+	a.clock = clock
+	return a
+}
+
+// WithRetention returns a copy of the log which purges entries older than retention. Zero
+// keeps them forever.
+func (a AuditLog) WithRetention(retention time.Duration) AuditLog {
+	a.retention = retention
+	return a
+}
+
+// Record appends an entry for a user. The time is set by the log.
+func (a AuditLog) Record(entry models.AuditEntry) error {
+	if entry.UserID == "" {
+		return fmt.Errorf("%w: missing user", ErrInvalidAuditEntry)
+	}
+	if !validAuditAction(entry.Action) {
+		return fmt.Errorf("%w: unknown action %q", ErrInvalidAuditEntry, entry.Action)
+	}
+	entry.Detail = truncateRunes(entry.Detail, auditMaxDetail)
+	entry.UserAgent = truncateRunes(entry.UserAgent, auditMaxUserAgent)
+	entry.CreatedAt = a.clock().UTC()
+	return a.store.Append(entry)
+}
+
+// List returns the entries of a user, the newest first.
+func (a AuditLog) List(user models.User, limit, offset int) ([]models.AuditEntry, error) {
+	return a.store.List(user.ID, "", limit, offset)
+}
+
+// ListAll returns the entries of every user, the newest first. Entries can be filtered by
+// user id and action.
+func (a AuditLog) ListAll(userID, action string, limit, offset int) ([]models.AuditEntry, error) {
+	if action != "" && !validAuditAction(action) {
+		return nil, fmt.Errorf("%w: unknown action %q", ErrInvalidAuditEntry, action)
+	}
+	return a.store.List(userID, action, limit, offset)
+}
+
+// Purge removes the entries which are older than the retention.
+func (a AuditLog) Purge() (int64, error) {
+	if a.retention <= 0 {
+		return 0, nil
+	}
+	return a.store.Purge(a.clock().Add(-a.retention))
+}
+
+// RunRetention purges old entries once per interval until ctx is done.
+func (a AuditLog) RunRetention(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if n, err := a.Purge(); err != nil {
+			config.Opts.Logger.Error().Err(err).Msg("Failed to purge the audit log")
+		} else if n > 0 {
+			config.Opts.Logger.Info().Int64("purged", n).Msg("Purged the audit log")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func validAuditAction(action string) bool {
+	for _, a := range auditActions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+// truncateRunes cuts s to at most max characters.
+func truncateRunes(s string, max int) string {
+	if r := []rune(s); len(r) > max {
+		return string(r[:max])
+	}
+	return s
+}
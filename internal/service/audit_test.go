@@ -0,0 +1,63 @@
+package service
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/staple-org/staple/internal/models"
+	"github.com/staple-org/staple/internal/storage"
+)
+
+func TestAuditLog(t *testing.T) {
+	now := time.Date(2020, 2, 19, 10, 0, 0, 0, time.UTC)
+	log := NewAuditLog(storage.NewInMemoryAuditStorer()).WithClock(func() time.Time { return now }).WithRetention(30 * 24 * time.Hour)
+
+	require.NoError(t, log.Record(models.AuditEntry{UserID: "alice", Action: models.AuditLogin, Detail: "password", IP: "192.0.2.1", UserAgent: strings.Repeat("a", 600)}))
+	now = now.Add(24 * time.Hour)
+	require.NoError(t, log.Record(models.AuditEntry{UserID: "bob", Action: models.AuditLoginFailed}))
+	require.NoError(t, log.Record(models.AuditEntry{UserID: "alice", Action: models.AuditStapleDeleted, StapleID: 3, Detail: "gone"}))
+	assert.ErrorIs(t, log.Record(models.AuditEntry{UserID: "alice", Action: "sneeze"}), ErrInvalidAuditEntry)
+	assert.ErrorIs(t, log.Record(models.AuditEntry{Action: models.AuditLogin}), ErrInvalidAuditEntry)
+
+	entries, err := log.List(models.User{ID: "alice"}, 10, 0)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, models.AuditStapleDeleted, entries[0].Action)
+	assert.Equal(t, 3, entries[0].StapleID)
+	assert.Equal(t, now, entries[0].CreatedAt)
+	assert.Equal(t, "192.0.2.1", entries[1].IP)
+	assert.Len(t, entries[1].UserAgent, auditMaxUserAgent)
+
+	entries, err = log.List(models.User{ID: "alice"}, 1, 1)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, models.AuditLogin, entries[0].Action)
+
+	entries, err = log.ListAll("", models.AuditLoginFailed, 10, 0)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "bob", entries[0].UserID)
+	entries, err = log.ListAll("", "", 10, 0)
+	require.NoError(t, err)
+	assert.Len(t, entries, 3)
+	_, err = log.ListAll("", "sneeze", 10, 0)
+	assert.ErrorIs(t, err, ErrInvalidAuditEntry)
+
+	// Entries older than the retention are purged.
+	now = now.Add(29*24*time.Hour + time.Hour)
+	purged, err := log.Purge()
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), purged)
+	entries, err = log.ListAll("", "", 10, 0)
+	require.NoError(t, err)
+	assert.Len(t, entries, 2)
+
+	// Without a retention nothing is purged.
+	purged, err = log.WithRetention(0).Purge()
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), purged)
+}
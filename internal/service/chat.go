@@ -0,0 +1,259 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/staple-org/staple/internal/i18n"
+	"github.com/staple-org/staple/internal/models"
+	"github.com/staple-org/staple/internal/storage"
+	"github.com/staple-org/staple/pkg/config"
+)
+
+// ChatKinds are the chats notifications can be sent to. Each is a notification channel.
+var ChatKinds = []string{models.ChatSlack, models.ChatDiscord, models.ChatMatrix}
+
+const (
+	// chatTimeout bounds a single request to a chat.
+	chatTimeout = 10 * time.Second
+	// chatDiscordMaxLength is the longest message Discord accepts.
+	chatDiscordMaxLength = 2000
+)
+
+// ErrInvalidChatTarget is returned when a chat target can't be saved.
+var ErrInvalidChatTarget = errors.New("invalid chat target")
+
+// ErrChatTargetNotFound is returned when a user has no chat target of a kind.
+var ErrChatTargetNotFound = errors.New("chat target not found")
+
+// chatTestEvent is only sent by SendTest.
+const chatTestEvent Event = "Chat Test"
+
+// chatMessage is a notification as it is posted to a chat.
+type chatMessage struct {
+	Title string
+	Body  string
+}
+
+// chatMessageFor formats the notification of an event for chats in a locale. It reports
+// false for events which aren't sent to chats because they carry codes or passwords.
+func chatMessageFor(locale string, event Event, payload string) (chatMessage, bool) {
+	var title, body string
+	switch event {
+	case Welcome:
+		title, body = "Welcome to Staple", i18n.Translate(locale, "Notifications of your Staple account will be posted here.")
+	case QueueDigest:
+		title, body = "Your Staple queue digest", payload
+	case ReadingReminder:
+		title, body = "Your Staple queue is waiting for you", i18n.Sprintf(locale, "You haven't read anything from your queue in %s days.", payload)
+	case AccountLocked:
+		title, body = "Your Staple account has been locked", i18n.Sprintf(locale, "Your account is locked after too many failed login attempts until %s.", payload)
+	case NewLogin:
+		title, body = "New login to your Staple account", i18n.Sprintf(locale, "Someone just logged in to your account from %s. If this wasn't you, please change your password immediately.", payload)
+	case EmailChangeRequested:
+		title, body = "The email address of your Staple account is being changed", i18n.Sprintf(locale, "A change to %s has been requested. If this wasn't you, please change your password immediately.", payload)
+	case AccountDeletionScheduled:
+		title, body = "Your Staple account will be deleted", i18n.Sprintf(locale, "Your account and all your staples will be deleted on %s.", payload)
+	case AccountDeleted:
+		title, body = "Your Staple account has been deleted", i18n.Translate(locale, "Your account and all your staples have been deleted.")
+	case chatTestEvent:
+		title, body = "Staple", i18n.Translate(locale, "This is a test message from Staple.")
+	default:
+		return chatMessage{}, false
+	}
+	return chatMessage{Title: i18n.Translate(locale, title), Body: body}, true
+}
+
+// Chats manages the chat targets of users and posts notifications to them.
+type Chats struct {
+	store  storage.ChatTargetStorer
+	users  storage.UserStorer
+	client *http.Client
+	clock  Clock
+}
+
+// NewChats creates a chat service. Chats on private and loopback addresses are refused
+// unless config.Opts.Webhooks.AllowPrivate is set, like webhooks.
+func NewChats(store storage.ChatTargetStorer, users storage.UserStorer) Chats {
+	return Chats{
+		store:  store,
+		users:  users,
+		client: newPublicClient(config.Opts.Webhooks.AllowPrivate, chatTimeout),
+		clock:  time.Now,
+	}
+}
+
+// WithHTTPClient returns a copy of the service which posts messages with the given client.
+func (c Chats) WithHTTPClient(client *http.Client) Chats {
+	c.client = client
+	return c
+}
+
+// WithClock returns a copy of the service which uses the given clock.
+func (c Chats) WithClock(clock Clock) Chats {
+	c.clock = clock
+	return c
+}
+
+// Set validates and saves a chat target, replacing the user's target of the same kind.
+func (c Chats) Set(user models.User, target models.ChatTarget) (models.ChatTarget, error) {
+	if !isChatKind(target.Kind) {
+		return models.ChatTarget{}, fmt.Errorf("%w: kind must be one of %s", ErrInvalidChatTarget, strings.Join(ChatKinds, ", "))
+	}
+	u, err := url.Parse(strings.TrimSpace(target.URL))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return models.ChatTarget{}, fmt.Errorf("%w: url must be an absolute http or https url", ErrInvalidChatTarget)
+	}
+	target.URL = u.String()
+	if target.Kind == models.ChatMatrix {
+		if target.Room == "" || target.Token == "" {
+			return models.ChatTarget{}, fmt.Errorf("%w: matrix needs a room and an access token", ErrInvalidChatTarget)
+		}
+		target.URL = strings.TrimSuffix(target.URL, "/")
+	} else {
+		target.Room = ""
+		target.Token = ""
+	}
+	target.UserID = user.ID
+	target.CreatedAt = c.clock().UTC()
+	if err := c.store.Save(target); err != nil {
+		return models.ChatTarget{}, err
+	}
+	return target, nil
+}
+
+// List lists the chat targets of a user.
+func (c Chats) List(user models.User) ([]models.ChatTarget, error) {
+	return c.store.List(user.ID)
+}
+
+// Delete removes the chat target of a kind.
+func (c Chats) Delete(user models.User, kind string) error {
+	return c.store.Delete(user.ID, kind)
+}
+
+// SendTest posts a test message to the chat target of a kind right away.
+func (c Chats) SendTest(user models.User, kind string) error {
+	target, err := c.store.Get(user.ID, kind)
+	if err != nil {
+		return err
+	}
+	if target == nil {
+		return ErrChatTargetNotFound
+	}
+	locale := i18n.Default
+	if stored, err := c.users.Get(user.ID); err == nil && stored != nil {
+		locale = stored.Locale
+	}
+	msg, _ := chatMessageFor(locale, chatTestEvent, "")
+	return c.post(*target, msg, uuid.New().String())
+}
+
+// Notifier returns the Notifier of the chat channel of a kind. Notifications of users
+// without a target of the kind are dropped. It doesn't retry; the notification outbox does.
+func (c Chats) Notifier(kind string) Notifier {
+	return chatNotifier{chats: c, kind: kind}
+}
+
+// chatNotifier posts notifications to the users' chat targets of one kind.
+type chatNotifier struct {
+	chats Chats
+	kind  string
+}
+
+// Notify posts the notification to the user's chat target.
+func (n chatNotifier) Notify(email string, event Event, payload string) error {
+	return n.NotifyOnce(uuid.New().String(), email, event, payload)
+}
+
+// NotifyOnce posts the notification to the user's chat target. Matrix uses the key as the
+// transaction ID, so the homeserver drops retries of a message it already accepted.
+func (n chatNotifier) NotifyOnce(key string, email string, event Event, payload string) error {
+	user, err := n.chats.users.GetByEmail(email)
+	if err != nil || user == nil {
+		return err
+	}
+	msg, ok := chatMessageFor(user.Locale, event, payload)
+	if !ok {
+		return fmt.Errorf("%s notifications are not sent to chats", event)
+	}
+	target, err := n.chats.store.Get(user.ID, n.kind)
+	if err != nil || target == nil {
+		return err
+	}
+	return n.chats.post(*target, msg, key)
+}
+
+// post sends a message in the format of the target's kind. txnID identifies the message
+// to Matrix homeservers.
+func (c Chats) post(target models.ChatTarget, msg chatMessage, txnID string) error {
+	var (
+		method   = http.MethodPost
+		endpoint = target.URL
+		body     interface{}
+	)
+	switch target.Kind {
+	case models.ChatSlack:
+		body = map[string]string{"text": "*" + msg.Title + "*\n" + msg.Body}
+	case models.ChatDiscord:
+		content := "**" + msg.Title + "**\n" + msg.Body
+		if r := []rune(content); len(r) > chatDiscordMaxLength {
+			content = string(r[:chatDiscordMaxLength-1]) + "…"
+		}
+		body = map[string]string{"content": content}
+	case models.ChatMatrix:
+		method = http.MethodPut
+		endpoint = target.URL + "/_matrix/client/v3/rooms/" + url.PathEscape(target.Room) + "/send/m.room.message/" + url.PathEscape(txnID)
+		body = map[string]string{
+			"msgtype":        "m.notice",
+			"body":           msg.Title + "\n" + msg.Body,
+			"format":         "org.matrix.custom.html",
+			"formatted_body": "<strong>" + html.EscapeString(msg.Title) + "</strong><br>" + strings.ReplaceAll(html.EscapeString(msg.Body), "\n", "<br>"),
+		}
+	default:
+		return fmt.Errorf("unknown chat kind %q", target.Kind)
+	}
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", webhookUserAgent)
+	if target.Kind == models.ChatMatrix {
+		req.Header.Set("Authorization", "Bearer "+target.Token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+func isChatKind(kind string) bool {
+	for _, k := range ChatKinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
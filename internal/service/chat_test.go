@@ -0,0 +1,184 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/staple-org/staple/internal/models"
+	"github.com/staple-org/staple/internal/storage"
+)
+
+// chatRequest is a request received by a chat stand-in.
+type chatRequest struct {
+	Method string
+	Path   string
+	Auth   string
+	Body   map[string]string
+}
+
+// newChatServer records requests and answers them with the next status, or 200.
+func newChatServer(t *testing.T, statuses ...int) (*httptest.Server, func() []chatRequest) {
+	var (
+		mu       sync.Mutex
+		requests []chatRequest
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		var fields map[string]string
+		_ = json.Unmarshal(body, &fields)
+		mu.Lock()
+		requests = append(requests, chatRequest{Method: r.Method, Path: r.URL.EscapedPath(), Auth: r.Header.Get("Authorization"), Body: fields})
+		status := http.StatusOK
+		if len(statuses) > 0 {
+			status, statuses = statuses[0], statuses[1:]
+		}
+		mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return server, func() []chatRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]chatRequest(nil), requests...)
+	}
+}
+
+func TestChats_Formats(t *testing.T) {
+	server, requests := newChatServer(t)
+	userStore := storage.NewInMemoryUserStorer()
+	require.NoError(t, userStore.Create("test@test.com", []byte("password")))
+	user, err := userStore.GetByEmail("test@test.com")
+	require.NoError(t, err)
+	chats := NewChats(storage.NewInMemoryChatTargetStorer(), userStore).WithHTTPClient(server.Client())
+
+	_, err = chats.Set(*user, models.ChatTarget{Kind: models.ChatSlack, URL: server.URL + "/hooks/slack"})
+	require.NoError(t, err)
+	_, err = chats.Set(*user, models.ChatTarget{Kind: models.ChatDiscord, URL: server.URL + "/api/webhooks/1/abc"})
+	require.NoError(t, err)
+	_, err = chats.Set(*user, models.ChatTarget{Kind: models.ChatMatrix, URL: server.URL + "/", Room: "!room:staple.test", Token: "secret"})
+	require.NoError(t, err)
+
+	for _, kind := range ChatKinds {
+		require.NoError(t, chats.Notifier(kind).Notify(user.Email, ReadingReminder, "3"))
+	}
+	got := requests()
+	require.Len(t, got, 3)
+	assert.Equal(t, "/hooks/slack", got[0].Path)
+	assert.Equal(t, "*Your Staple queue is waiting for you*\nYou haven't read anything from your queue in 3 days.", got[0].Body["text"])
+	assert.Equal(t, "/api/webhooks/1/abc", got[1].Path)
+	assert.Equal(t, "**Your Staple queue is waiting for you**\nYou haven't read anything from your queue in 3 days.", got[1].Body["content"])
+	assert.Equal(t, http.MethodPut, got[2].Method)
+	assert.True(t, strings.HasPrefix(got[2].Path, "/_matrix/client/v3/rooms/%21room:staple.test/send/m.room.message/"), got[2].Path)
+	assert.Equal(t, "Bearer secret", got[2].Auth)
+	assert.Equal(t, "m.notice", got[2].Body["msgtype"])
+	assert.Equal(t, "<strong>Your Staple queue is waiting for you</strong><br>You haven&#39;t read anything from your queue in 3 days.", got[2].Body["formatted_body"])
+
+	// Codes are never posted, and users without a target of the kind are skipped.
+	assert.Error(t, chats.Notifier(models.ChatSlack).Notify(user.Email, GenerateConfirmCode, "12345"))
+	require.NoError(t, chats.Delete(*user, models.ChatSlack))
+	require.NoError(t, chats.Notifier(models.ChatSlack).Notify(user.Email, ReadingReminder, "3"))
+	require.NoError(t, chats.Notifier(models.ChatSlack).Notify("unknown@test.com", ReadingReminder, "3"))
+	assert.Len(t, requests(), 3)
+	assert.True(t, errors.Is(chats.SendTest(*user, models.ChatSlack), ErrChatTargetNotFound))
+	require.NoError(t, chats.SendTest(*user, models.ChatDiscord))
+	assert.Equal(t, "**Staple**\nThis is a test message from Staple.", requests()[3].Body["content"])
+}
+
+func TestChats_Set(t *testing.T) {
+	chats := NewChats(storage.NewInMemoryChatTargetStorer(), storage.NewInMemoryUserStorer())
+	user := models.User{ID: "user"}
+	for _, target := range []models.ChatTarget{
+		{Kind: "irc", URL: "https://chat.staple.test"},
+		{Kind: models.ChatSlack, URL: "chat.staple.test/hook"},
+		{Kind: models.ChatMatrix, URL: "https://matrix.staple.test", Room: "!room:staple.test"},
+	} {
+		_, err := chats.Set(user, target)
+		assert.True(t, errors.Is(err, ErrInvalidChatTarget), target.Kind)
+	}
+	target, err := chats.Set(user, models.ChatTarget{Kind: models.ChatSlack, URL: "https://chat.staple.test/hook", Token: "ignored"})
+	require.NoError(t, err)
+	assert.Empty(t, target.Token)
+	list, err := chats.List(user)
+	require.NoError(t, err)
+	assert.Len(t, list, 1)
+}
+
+func TestChats_Retries(t *testing.T) {
+	now := time.Date(2020, 2, 13, 19, 7, 13, 0, time.UTC)
+	clock := func() time.Time { return now }
+	server, requests := newChatServer(t, http.StatusTooManyRequests)
+	userStore := storage.NewInMemoryUserStorer()
+	require.NoError(t, userStore.Create("test@test.com", []byte("password")))
+	user, err := userStore.GetByEmail("test@test.com")
+	require.NoError(t, err)
+	chats := NewChats(storage.NewInMemoryChatTargetStorer(), userStore).WithHTTPClient(server.Client())
+	_, err = chats.Set(*user, models.ChatTarget{Kind: models.ChatDiscord, URL: server.URL})
+	require.NoError(t, err)
+	outbox := NewNotificationOutbox(storage.NewInMemoryNotificationStorer(), NewBufferNotifier()).
+		WithChannel(models.ChatDiscord, chats.Notifier(models.ChatDiscord)).
+		WithClock(clock)
+
+	require.NoError(t, outbox.NotifyChannel(models.ChatDiscord, user.Email, QueueDigest, "Your queue is empty."))
+	_, err = outbox.SendDue(1)
+	require.NoError(t, err)
+	list, err := outbox.List(models.NotificationPending, 10, 0)
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+	assert.Equal(t, "unexpected status 429 Too Many Requests", list[0].LastError)
+
+	now = now.Add(notificationBaseBackoff)
+	_, err = outbox.SendDue(1)
+	require.NoError(t, err)
+	list, err = outbox.List(models.NotificationSent, 10, 0)
+	require.NoError(t, err)
+	assert.Len(t, list, 1)
+	assert.Len(t, requests(), 2)
+}
+
+func TestChats_Retries_MatrixTransaction(t *testing.T) {
+	now := time.Date(2020, 2, 13, 19, 7, 13, 0, time.UTC)
+	clock := func() time.Time { return now }
+	server, requests := newChatServer(t, http.StatusBadGateway)
+	userStore := storage.NewInMemoryUserStorer()
+	require.NoError(t, userStore.Create("test@test.com", []byte("password")))
+	user, err := userStore.GetByEmail("test@test.com")
+	require.NoError(t, err)
+	chats := NewChats(storage.NewInMemoryChatTargetStorer(), userStore).WithHTTPClient(server.Client())
+	_, err = chats.Set(*user, models.ChatTarget{Kind: models.ChatMatrix, URL: server.URL, Room: "!room:staple.test", Token: "secret"})
+	require.NoError(t, err)
+	outbox := NewNotificationOutbox(storage.NewInMemoryNotificationStorer(), NewBufferNotifier()).
+		WithChannel(models.ChatMatrix, chats.Notifier(models.ChatMatrix)).
+		WithClock(clock)
+
+	require.NoError(t, outbox.NotifyChannel(models.ChatMatrix, user.Email, QueueDigest, "Your queue is empty."))
+	require.NoError(t, outbox.NotifyChannel(models.ChatMatrix, user.Email, QueueDigest, "Your queue is still empty."))
+	_, err = outbox.SendDue(1)
+	require.NoError(t, err)
+	now = now.Add(notificationBaseBackoff)
+	_, err = outbox.SendDue(1)
+	require.NoError(t, err)
+
+	got := requests()
+	require.Len(t, got, 3)
+	byBody := map[string][]string{}
+	for _, r := range got {
+		assert.Equal(t, http.MethodPut, r.Method)
+		byBody[r.Body["body"]] = append(byBody[r.Body["body"]], r.Path)
+	}
+	retried := byBody["Your Staple queue digest\nYour queue is empty."]
+	require.Len(t, retried, 2)
+	assert.Equal(t, retried[0], retried[1], "a retry uses the same transaction")
+	other := byBody["Your Staple queue digest\nYour queue is still empty."]
+	require.Len(t, other, 1)
+	assert.NotEqual(t, retried[0], other[0])
+}
@@ -0,0 +1,274 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/staple-org/staple/internal/i18n"
+	"github.com/staple-org/staple/internal/models"
+	"github.com/staple-org/staple/internal/storage"
+	"github.com/staple-org/staple/pkg/config"
+)
+
+const (
+	// digestDefaultHour is the local hour from which digests are sent by default.
+	digestDefaultHour = 8
+	// digestMaxReminderDays is the longest period of inactivity a reminder can wait for.
+	digestMaxReminderDays = 365
+	// digestHeadSize is the number of staples from the head of the queue in a digest.
+	digestHeadSize = 3
+	// digestReadLimit is the number of recently archived staples counted as read.
+	digestReadLimit = 1000
+)
+
+// ErrInvalidDigestSettings is returned when digest settings can't be saved.
+var ErrInvalidDigestSettings = errors.New("invalid digest settings")
+
+// Digests sends the queue digests and reading reminders users opted in to. They are sent
+// by SendDue, which the scheduler calls periodically, in the user's timezone and outside
+// of their quiet hours.
+type Digests struct {
+	store    storage.DigestStorer
+	stapler  Staplerer
+	users    UserHandlerer
+	notifier Notifier
+	clock    Clock
+}
+
+// NewDigests creates a digest service which sends through notifier.
+func NewDigests(store storage.DigestStorer, stapler Staplerer, users UserHandlerer, notifier Notifier) Digests {
+	return Digests{store: store, stapler: stapler, users: users, notifier: notifier, clock: time.Now}
+}
+
+// WithClock returns a copy of the service which uses the given clock.
+func (d Digests) WithClock(clock Clock) Digests {
+	d.clock = clock
+	return d
+}
+
+// Settings returns the digest settings of a user. Users who never changed them have
+// everything turned off.
+func (d Digests) Settings(user models.User) (models.DigestSettings, error) {
+	settings, err := d.store.Get(user.ID)
+	if err != nil {
+		return models.DigestSettings{}, err
+	}
+	if settings == nil {
+		return models.DigestSettings{
+			UserID:    user.ID,
+			Frequency: models.DigestOff,
+			Hour:      digestDefaultHour,
+			Timezone:  "UTC",
+		}, nil
+	}
+	return *settings, nil
+}
+
+// UpdateSettings validates and saves the digest settings of a user.
+func (d Digests) UpdateSettings(user models.User, settings models.DigestSettings) (models.DigestSettings, error) {
+	if settings.Frequency == "" {
+		settings.Frequency = models.DigestOff
+	}
+	if settings.Timezone == "" {
+		settings.Timezone = "UTC"
+	}
+	switch settings.Frequency {
+	case models.DigestOff, models.DigestDaily, models.DigestWeekly:
+	default:
+		return models.DigestSettings{}, fmt.Errorf("%w: frequency must be off, daily or weekly", ErrInvalidDigestSettings)
+	}
+	if _, err := time.LoadLocation(settings.Timezone); err != nil {
+		return models.DigestSettings{}, fmt.Errorf("%w: unknown timezone %q", ErrInvalidDigestSettings, settings.Timezone)
+	}
+	for _, hour := range []int{settings.Hour, settings.QuietStart, settings.QuietEnd} {
+		if hour < 0 || hour > 23 {
+			return models.DigestSettings{}, fmt.Errorf("%w: hours must be between 0 and 23", ErrInvalidDigestSettings)
+		}
+	}
+	if settings.ReminderDays < 0 || settings.ReminderDays > digestMaxReminderDays {
+		return models.DigestSettings{}, fmt.Errorf("%w: reminder days must be between 0 and %d", ErrInvalidDigestSettings, digestMaxReminderDays)
+	}
+	settings.UserID = user.ID
+	if err := d.store.Save(settings); err != nil {
+		return models.DigestSettings{}, err
+	}
+	return d.Settings(user)
+}
+
+// SendDue sends every digest and reminder which is due and returns how many were sent.
+// A user whose mail can't be sent doesn't keep the others from getting theirs.
+func (d Digests) SendDue() (int, error) {
+	enabled, err := d.store.Enabled()
+	if err != nil {
+		return 0, err
+	}
+	sent := 0
+	for _, settings := range enabled {
+		n, err := d.send(settings)
+		if err != nil {
+			config.Opts.Logger.Error().Err(err).Str("user", settings.UserID).Msg("Failed to send digest")
+		}
+		sent += n
+	}
+	return sent, nil
+}
+
+// RunScheduler sends due digests and reminders once per interval until ctx is done.
+func (d Digests) RunScheduler(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := d.SendDue(); err != nil {
+			config.Opts.Logger.Error().Err(err).Msg("Failed to send digests")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// send sends the digest and the reminder of a user if they are due.
+func (d Digests) send(settings models.DigestSettings) (int, error) {
+	loc, err := time.LoadLocation(settings.Timezone)
+	if err != nil {
+		loc = time.UTC
+	}
+	now := d.clock().In(loc)
+	if settings.Quiet(now.Hour()) {
+		return 0, nil
+	}
+	user, err := d.users.Profile(models.User{ID: settings.UserID})
+	if err != nil || user == nil {
+		return 0, err
+	}
+	queue, err := d.stapler.List(user)
+	if err != nil {
+		return 0, err
+	}
+	sort.SliceStable(queue, func(i, j int) bool {
+		return queue[i].CreatedAt.Before(queue[j].CreatedAt)
+	})
+	read, err := d.stapler.RecentArchive(user, digestReadLimit)
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	if start, ok := digestPeriodStart(settings, now); ok && (settings.LastDigestAt == nil || settings.LastDigestAt.Before(start)) {
+		since := start.AddDate(0, 0, -1)
+		if settings.Frequency == models.DigestWeekly {
+			since = start.AddDate(0, 0, -7)
+		}
+		if settings.LastDigestAt != nil {
+			since = *settings.LastDigestAt
+		}
+		readSince := 0
+		for _, s := range read {
+			if s.ArchivedAt != nil && s.ArchivedAt.After(since) {
+				readSince++
+			}
+		}
+		// There is nothing to tell users with an empty queue who didn't read anything.
+		if len(queue) > 0 || readSince > 0 {
+			if err := d.notifier.Notify(user.Email, QueueDigest, digestSummary(user.Locale, queue, readSince, now)); err != nil {
+				return sent, err
+			}
+			sent++
+		}
+		if err := d.store.MarkDigestSent(user.ID, now.UTC()); err != nil {
+			return sent, err
+		}
+	}
+
+	if settings.ReminderDays > 0 && len(queue) > 0 {
+		// Users who never read anything are reminded from when their oldest staple was added.
+		lastRead := queue[0].CreatedAt
+		if len(read) > 0 && read[0].ArchivedAt != nil {
+			lastRead = *read[0].ArchivedAt
+		}
+		wait := time.Duration(settings.ReminderDays) * 24 * time.Hour
+		idle := now.Sub(lastRead)
+		if idle >= wait && (settings.LastReminderAt == nil || now.Sub(*settings.LastReminderAt) >= wait) {
+			days := int(idle / (24 * time.Hour))
+			if err := d.notifier.Notify(user.Email, ReadingReminder, strconv.Itoa(days)); err != nil {
+				return sent, err
+			}
+			sent++
+			if err := d.store.MarkReminderSent(user.ID, now.UTC()); err != nil {
+				return sent, err
+			}
+		}
+	}
+	return sent, nil
+}
+
+// digestPeriodStart returns the start of the current digest period in the local time of
+// now: midnight of today for daily digests and of Monday for weekly ones. It reports false
+// if no digest is due yet because the digest hour hasn't been reached.
+func digestPeriodStart(settings models.DigestSettings, now time.Time) (time.Time, bool) {
+	year, month, day := now.Date()
+	start := time.Date(year, month, day, 0, 0, 0, 0, now.Location())
+	switch settings.Frequency {
+	case models.DigestDaily:
+	case models.DigestWeekly:
+		start = start.AddDate(0, 0, -((int(start.Weekday()) + 6) % 7))
+	default:
+		return time.Time{}, false
+	}
+	if now.Before(start.Add(time.Duration(settings.Hour) * time.Hour)) {
+		return time.Time{}, false
+	}
+	return start, true
+}
+
+// digestSummary is the text of a digest in a locale.
+func digestSummary(locale string, queue []models.Staple, read int, now time.Time) string {
+	var b strings.Builder
+	switch len(queue) {
+	case 0:
+		b.WriteString(i18n.Translate(locale, "Your queue is empty."))
+	case 1:
+		b.WriteString(i18n.Sprintf(locale, "Your queue holds 1 staple, added %s.", daysAgo(locale, now, queue[0].CreatedAt)))
+	default:
+		b.WriteString(i18n.Sprintf(locale, "Your queue holds %d staples. The oldest was added %s.", len(queue), daysAgo(locale, now, queue[0].CreatedAt)))
+	}
+	b.WriteString("\n")
+	if len(queue) > 0 {
+		b.WriteString("\n" + i18n.Translate(locale, "Next up:") + "\n")
+		for i, s := range queue {
+			if i == digestHeadSize {
+				break
+			}
+			fmt.Fprintf(&b, "- %s\n", s.Name)
+		}
+	}
+	b.WriteString("\n")
+	switch read {
+	case 0:
+		b.WriteString(i18n.Translate(locale, "You haven't read anything since the last digest."))
+	case 1:
+		b.WriteString(i18n.Translate(locale, "You read 1 staple since the last digest."))
+	default:
+		b.WriteString(i18n.Sprintf(locale, "You read %d staples since the last digest.", read))
+	}
+	return b.String()
+}
+
+// daysAgo describes how long ago t was in days in a locale.
+func daysAgo(locale string, now, t time.Time) string {
+	switch days := int(now.Sub(t) / (24 * time.Hour)); days {
+	case 0:
+		return i18n.Translate(locale, "today")
+	case 1:
+		return i18n.Translate(locale, "yesterday")
+	default:
+		return i18n.Sprintf(locale, "%d days ago", days)
+	}
+}
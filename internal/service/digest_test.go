@@ -0,0 +1,180 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/staple-org/staple/internal/models"
+	"github.com/staple-org/staple/internal/storage"
+)
+
+func TestDigests(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	require.NoError(t, err)
+	// A Monday.
+	now := time.Date(2020, 2, 17, 8, 30, 0, 0, berlin)
+	clock := func() time.Time { return now.UTC() }
+
+	notifier := NewBufferNotifier()
+	users := NewUserHandler(context.Background(), storage.NewInMemoryUserStorer(), notifier)
+	require.NoError(t, users.Register(models.User{Email: "test@test.com", Password: "password123", MaxStaples: 25}))
+	id, err := users.UserID(models.User{Email: "test@test.com"})
+	require.NoError(t, err)
+	user := &models.User{ID: id, MaxStaples: 25}
+
+	stapler := NewStapler(storage.NewInMemoryStapleStorer())
+	for _, s := range []struct {
+		name     string
+		added    time.Duration
+		archived time.Duration
+	}{
+		{name: "third", added: 24 * time.Hour},
+		{name: "first", added: 10 * 24 * time.Hour},
+		{name: "second", added: 5 * 24 * time.Hour},
+		{name: "fourth", added: 2 * time.Hour},
+		{name: "read", added: 30 * 24 * time.Hour, archived: 23 * time.Hour},
+		{name: "read long ago", added: 40 * 24 * time.Hour, archived: 20 * 24 * time.Hour},
+	} {
+		staple := models.Staple{Name: s.name, Content: "https://staple.test/" + s.name, CreatedAt: now.Add(-s.added).UTC()}
+		if s.archived == 0 {
+			require.NoError(t, stapler.Create(staple, user))
+			continue
+		}
+		archivedAt := now.Add(-s.archived).UTC()
+		staple.ArchivedAt = &archivedAt
+		require.NoError(t, stapler.CreateArchived(staple, user))
+	}
+
+	digests := NewDigests(storage.NewInMemoryDigestStorer(), stapler, users, notifier).WithClock(clock)
+	settings, err := digests.Settings(*user)
+	require.NoError(t, err)
+	assert.Equal(t, models.DigestOff, settings.Frequency)
+
+	_, err = digests.UpdateSettings(*user, models.DigestSettings{Frequency: "hourly"})
+	assert.ErrorIs(t, err, ErrInvalidDigestSettings)
+	_, err = digests.UpdateSettings(*user, models.DigestSettings{Frequency: models.DigestDaily, Timezone: "Mars/Olympus"})
+	assert.ErrorIs(t, err, ErrInvalidDigestSettings)
+	_, err = digests.UpdateSettings(*user, models.DigestSettings{Frequency: models.DigestDaily, Hour: 24})
+	assert.ErrorIs(t, err, ErrInvalidDigestSettings)
+	_, err = digests.UpdateSettings(*user, models.DigestSettings{ReminderDays: -1})
+	assert.ErrorIs(t, err, ErrInvalidDigestSettings)
+
+	settings, err = digests.UpdateSettings(*user, models.DigestSettings{
+		Frequency:    models.DigestDaily,
+		Hour:         9,
+		Timezone:     "Europe/Berlin",
+		QuietStart:   22,
+		QuietEnd:     7,
+		ReminderDays: 3,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, id, settings.UserID)
+
+	// Nothing before the digest hour.
+	sent, err := digests.SendDue()
+	require.NoError(t, err)
+	assert.Equal(t, 0, sent)
+
+	now = now.Add(time.Hour)
+	sent, err = digests.SendDue()
+	require.NoError(t, err)
+	assert.Equal(t, 1, sent)
+	assert.Equal(t, `Dear test@test.com
+Here is what is waiting in your Staple queue.
+
+Your queue holds 4 staples. The oldest was added 10 days ago.
+
+Next up:
+- first
+- second
+- third
+
+You read 1 staple since the last digest.`, notifier.Last(QueueDigest).Text)
+
+	// Once per day.
+	now = now.Add(12 * time.Hour)
+	sent, err = digests.SendDue()
+	require.NoError(t, err)
+	assert.Equal(t, 0, sent)
+	// Not during the quiet hours even once the digest is due again.
+	settings.Hour = 5
+	_, err = digests.UpdateSettings(*user, settings)
+	require.NoError(t, err)
+	now = now.Add(9 * time.Hour)
+	assert.Equal(t, 6, now.Hour())
+	sent, err = digests.SendDue()
+	require.NoError(t, err)
+	assert.Equal(t, 0, sent)
+	now = now.Add(time.Hour)
+	sent, err = digests.SendDue()
+	require.NoError(t, err)
+	assert.Equal(t, 1, sent)
+	assert.Contains(t, notifier.Last(QueueDigest).Text, "You haven't read anything since the last digest.")
+
+	// The reminder comes once nothing was read for three days, and again three days later.
+	_, err = digests.UpdateSettings(*user, models.DigestSettings{Frequency: models.DigestOff, Timezone: "Europe/Berlin", ReminderDays: 3})
+	require.NoError(t, err)
+	now = now.Add(25 * time.Hour)
+	sent, err = digests.SendDue()
+	require.NoError(t, err)
+	assert.Equal(t, 0, sent)
+	now = now.Add(time.Hour)
+	sent, err = digests.SendDue()
+	require.NoError(t, err)
+	assert.Equal(t, 1, sent)
+	assert.Contains(t, notifier.Last(ReadingReminder).Text, "You haven't read anything from your Staple queue in 3 days.")
+	now = now.Add(48 * time.Hour)
+	sent, err = digests.SendDue()
+	require.NoError(t, err)
+	assert.Equal(t, 0, sent)
+	now = now.Add(24 * time.Hour)
+	sent, err = digests.SendDue()
+	require.NoError(t, err)
+	assert.Equal(t, 1, sent)
+	assert.Contains(t, notifier.Last(ReadingReminder).Text, "in 6 days.")
+}
+
+func TestDigestPeriodStart(t *testing.T) {
+	// A Wednesday.
+	now := time.Date(2020, 2, 19, 10, 0, 0, 0, time.UTC)
+	start, ok := digestPeriodStart(models.DigestSettings{Frequency: models.DigestWeekly, Hour: 8}, now)
+	assert.True(t, ok)
+	assert.Equal(t, time.Date(2020, 2, 17, 0, 0, 0, 0, time.UTC), start)
+	start, ok = digestPeriodStart(models.DigestSettings{Frequency: models.DigestDaily, Hour: 8}, now)
+	assert.True(t, ok)
+	assert.Equal(t, time.Date(2020, 2, 19, 0, 0, 0, 0, time.UTC), start)
+	_, ok = digestPeriodStart(models.DigestSettings{Frequency: models.DigestDaily, Hour: 11}, now)
+	assert.False(t, ok)
+	_, ok = digestPeriodStart(models.DigestSettings{Frequency: models.DigestOff}, now)
+	assert.False(t, ok)
+}
+
+func TestDigestSettings_Quiet(t *testing.T) {
+	overnight := models.DigestSettings{QuietStart: 22, QuietEnd: 7}
+	assert.True(t, overnight.Quiet(23))
+	assert.True(t, overnight.Quiet(0))
+	assert.False(t, overnight.Quiet(7))
+	assert.False(t, overnight.Quiet(12))
+	lunch := models.DigestSettings{QuietStart: 12, QuietEnd: 14}
+	assert.True(t, lunch.Quiet(13))
+	assert.False(t, lunch.Quiet(14))
+	assert.False(t, models.DigestSettings{}.Quiet(3))
+}
+
+func TestDigestSummary_Locale(t *testing.T) {
+	now := time.Date(2020, 2, 19, 10, 0, 0, 0, time.UTC)
+	queue := []models.Staple{{Name: "first", CreatedAt: now.AddDate(0, 0, -1)}}
+	assert.Equal(t, `In deiner Warteschlange liegt 1 Staple, hinzugefügt gestern.
+
+Als Nächstes:
+- first
+
+Du hast seit der letzten Zusammenfassung 2 Staples gelesen.`, digestSummary("de", queue, 2, now))
+	assert.Equal(t, `Your queue is empty.
+
+You haven't read anything since the last digest.`, digestSummary("", nil, 0, now))
+}
@@ -0,0 +1,396 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/staple-org/staple/internal/models"
+	"github.com/staple-org/staple/internal/storage"
+	"github.com/staple-org/staple/pkg/config"
+)
+
+// AllEvents subscribes a handler to every event.
+const AllEvents = "*"
+
+const (
+	// outboxBatchSize is the number of outbox records published per run.
+	outboxBatchSize = 100
+	// outboxMaxAttempts is the number of failed attempts after which a record is left alone.
+	outboxMaxAttempts = 10
+	// outboxLease is how long claimed records are hidden from other relays. It has to be
+	// longer than publishing a batch can take.
+	outboxLease = 5 * time.Minute
+	// outboxRetention is how long published records are kept.
+	outboxRetention = 7 * 24 * time.Hour
+)
+
+// DomainEvent is something which happened to a user or a staple. Events are published on
+// an EventBus after the change has been stored.
+type DomainEvent interface {
+	EventName() string
+	Meta() EventMeta
+}
+
+// EventMeta is common to all events. It isn't part of the JSON body of an event.
+type EventMeta struct {
+	// ID identifies the event. An event delivered twice has the same id.
+	ID         string    `json:"-"`
+	UserID     string    `json:"-"`
+	OccurredAt time.Time `json:"-"`
+}
+
+// Meta returns the metadata of the event.
+func (m EventMeta) Meta() EventMeta {
+	return m
+}
+
+// newEventMeta creates the metadata of a new event of a user.
+func newEventMeta(userID string, now time.Time) EventMeta {
+	return EventMeta{ID: uuid.New().String(), UserID: userID, OccurredAt: now.UTC()}
+}
+
+// StapleCreated is published when a staple is added to the queue or the archive. The id
+// of the staple is only known if the event went through the outbox.
+type StapleCreated struct {
+	EventMeta
+	Staple models.Staple `json:"staple"`
+}
+
+// EventName returns the name of the event.
+func (StapleCreated) EventName() string { return models.EventStapleCreated }
+
+// StapleArchived is published when a staple of the queue is archived.
+type StapleArchived struct {
+	EventMeta
+	Staple models.Staple `json:"staple"`
+}
+
+// EventName returns the name of the event.
+func (StapleArchived) EventName() string { return models.EventStapleArchived }
+
+// StapleDeleted is published when a staple is moved to the trash.
+type StapleDeleted struct {
+	EventMeta
+	Staple models.Staple `json:"staple"`
+}
+
+// EventName returns the name of the event.
+func (StapleDeleted) EventName() string { return models.EventStapleDeleted }
+
+// StapleRestored is published when a staple is taken out of the trash.
+type StapleRestored struct {
+	EventMeta
+	Staple models.Staple `json:"staple"`
+}
+
+// EventName returns the name of the event.
+func (StapleRestored) EventName() string { return models.EventStapleRestored }
+
+// QueueEmptied is published when the last staple of the queue is archived or deleted.
+type QueueEmptied struct {
+	EventMeta
+}
+
+// EventName returns the name of the event.
+func (QueueEmptied) EventName() string { return models.EventQueueEmptied }
+
+// QuotaReached is published when the queue reaches the maximum number of staples.
+type QuotaReached struct {
+	EventMeta
+	MaxStaples int `json:"max_staples"`
+	Count      int `json:"count"`
+}
+
+// EventName returns the name of the event.
+func (QuotaReached) EventName() string { return models.EventQuotaReached }
+
+// UserRegistered is published when a user signs up.
+type UserRegistered struct {
+	EventMeta
+	Email string `json:"email"`
+}
+
+// EventName returns the name of the event.
+func (UserRegistered) EventName() string { return models.EventUserRegistered }
+
+// PasswordChanged is published when a user changes their password or it is reset.
+type PasswordChanged struct {
+	EventMeta
+	Reset bool `json:"reset"`
+}
+
+// EventName returns the name of the event.
+func (PasswordChanged) EventName() string { return models.EventPasswordChanged }
+
+// EmailChanged is published when a user confirmed a new email address.
+type EmailChanged struct {
+	EventMeta
+	OldEmail string `json:"old_email"`
+	NewEmail string `json:"new_email"`
+}
+
+// EventName returns the name of the event.
+func (EmailChanged) EventName() string { return models.EventEmailChanged }
+
+// TwoFactorChanged is published when two-factor authentication is enabled or disabled.
+type TwoFactorChanged struct {
+	EventMeta
+	Enabled bool `json:"enabled"`
+}
+
+// EventName returns the name of the event.
+func (TwoFactorChanged) EventName() string { return models.EventTwoFactorChanged }
+
+// AccountLockedOut is published when an account is locked after too many failed logins.
+type AccountLockedOut struct {
+	EventMeta
+	Until time.Time `json:"until"`
+}
+
+// EventName returns the name of the event.
+func (AccountLockedOut) EventName() string { return models.EventAccountLocked }
+
+// DeletionScheduled is published when a user requests the deletion of their account.
+type DeletionScheduled struct {
+	EventMeta
+	DeleteAfter time.Time `json:"delete_after"`
+}
+
+// EventName returns the name of the event.
+func (DeletionScheduled) EventName() string { return models.EventDeletionScheduled }
+
+// UserDeleted is published after an account and its data have been deleted.
+type UserDeleted struct {
+	EventMeta
+	Email string `json:"email"`
+}
+
+// EventName returns the name of the event.
+func (UserDeleted) EventName() string { return models.EventUserDeleted }
+
+// eventTypes creates an empty event for every name so outbox records can be decoded.
+var eventTypes = map[string]func(EventMeta) DomainEvent{
+	models.EventStapleCreated:     func(m EventMeta) DomainEvent { return &StapleCreated{EventMeta: m} },
+	models.EventStapleArchived:    func(m EventMeta) DomainEvent { return &StapleArchived{EventMeta: m} },
+	models.EventStapleDeleted:     func(m EventMeta) DomainEvent { return &StapleDeleted{EventMeta: m} },
+	models.EventStapleRestored:    func(m EventMeta) DomainEvent { return &StapleRestored{EventMeta: m} },
+	models.EventQueueEmptied:      func(m EventMeta) DomainEvent { return &QueueEmptied{EventMeta: m} },
+	models.EventQuotaReached:      func(m EventMeta) DomainEvent { return &QuotaReached{EventMeta: m} },
+	models.EventUserRegistered:    func(m EventMeta) DomainEvent { return &UserRegistered{EventMeta: m} },
+	models.EventPasswordChanged:   func(m EventMeta) DomainEvent { return &PasswordChanged{EventMeta: m} },
+	models.EventEmailChanged:      func(m EventMeta) DomainEvent { return &EmailChanged{EventMeta: m} },
+	models.EventTwoFactorChanged:  func(m EventMeta) DomainEvent { return &TwoFactorChanged{EventMeta: m} },
+	models.EventAccountLocked:     func(m EventMeta) DomainEvent { return &AccountLockedOut{EventMeta: m} },
+	models.EventDeletionScheduled: func(m EventMeta) DomainEvent { return &DeletionScheduled{EventMeta: m} },
+	models.EventUserDeleted:       func(m EventMeta) DomainEvent { return &UserDeleted{EventMeta: m} },
+}
+
+// decodeEvent turns an outbox record back into a typed event.
+func decodeEvent(record models.OutboxRecord) (DomainEvent, error) {
+	newEvent, ok := eventTypes[record.Name]
+	if !ok {
+		return nil, fmt.Errorf("unknown event %q", record.Name)
+	}
+	event := newEvent(EventMeta{ID: record.ID, UserID: record.UserID, OccurredAt: record.OccurredAt})
+	if err := json.Unmarshal(record.Payload, event); err != nil {
+		return nil, err
+	}
+	// Handlers switch on the value types.
+	switch e := event.(type) {
+	case *StapleCreated:
+		return *e, nil
+	case *StapleArchived:
+		return *e, nil
+	case *StapleDeleted:
+		return *e, nil
+	case *StapleRestored:
+		return *e, nil
+	case *QueueEmptied:
+		return *e, nil
+	case *QuotaReached:
+		return *e, nil
+	case *UserRegistered:
+		return *e, nil
+	case *PasswordChanged:
+		return *e, nil
+	case *EmailChanged:
+		return *e, nil
+	case *TwoFactorChanged:
+		return *e, nil
+	case *AccountLockedOut:
+		return *e, nil
+	case *DeletionScheduled:
+		return *e, nil
+	case *UserDeleted:
+		return *e, nil
+	}
+	return event, nil
+}
+
+// EventHandler handles a published event.
+type EventHandler func(event DomainEvent) error
+
+// EventBus passes events to the handlers subscribed to them. Synchronous handlers run in
+// the order they subscribed before Publish returns and their errors are returned.
+// Asynchronous handlers run in their own goroutine; their errors are logged. The zero
+// value drops every event.
+type EventBus struct {
+	mu      *sync.RWMutex
+	sync    map[string][]EventHandler
+	async   map[string][]EventHandler
+	running *sync.WaitGroup
+}
+
+// NewEventBus creates an event bus without subscribers.
+func NewEventBus() EventBus {
+	return EventBus{
+		mu:      &sync.RWMutex{},
+		sync:    make(map[string][]EventHandler),
+		async:   make(map[string][]EventHandler),
+		running: &sync.WaitGroup{},
+	}
+}
+
+// Subscribe adds a handler which runs before Publish returns. Use AllEvents as the name to
+// receive every event.
+func (b EventBus) Subscribe(name string, handler EventHandler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.sync[name] = append(b.sync[name], handler)
+}
+
+// SubscribeAsync adds a handler which runs in its own goroutine. Events may reach it in any
+// order and are lost if the process stops before it finished.
+func (b EventBus) SubscribeAsync(name string, handler EventHandler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.async[name] = append(b.async[name], handler)
+}
+
+// Publish passes the event to its subscribers. All synchronous handlers run even if one
+// fails; the first error is returned.
+func (b EventBus) Publish(event DomainEvent) error {
+	if b.mu == nil {
+		return nil
+	}
+	name := event.EventName()
+	b.mu.RLock()
+	syncHandlers := append(append([]EventHandler(nil), b.sync[name]...), b.sync[AllEvents]...)
+	asyncHandlers := append(append([]EventHandler(nil), b.async[name]...), b.async[AllEvents]...)
+	b.mu.RUnlock()
+
+	for _, h := range asyncHandlers {
+		b.running.Add(1)
+		go func(h EventHandler) {
+			defer b.running.Done()
+			if err := safeHandle(h, event); err != nil {
+				config.Opts.Logger.Error().Err(err).Str("event", name).Str("event_id", event.Meta().ID).Msg("Event handler failed")
+			}
+		}(h)
+	}
+	var first error
+	for _, h := range syncHandlers {
+		if err := safeHandle(h, event); err != nil {
+			config.Opts.Logger.Error().Err(err).Str("event", name).Str("event_id", event.Meta().ID).Msg("Event handler failed")
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+// Wait blocks until all asynchronous handlers which are running have returned.
+func (b EventBus) Wait() {
+	if b.running != nil {
+		b.running.Wait()
+	}
+}
+
+func (b EventBus) active() bool {
+	return b.mu != nil
+}
+
+// safeHandle turns a panicking handler into an error so one handler can't take down the
+// publisher.
+func safeHandle(h EventHandler, event DomainEvent) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("event handler panicked: %v", r)
+		}
+	}()
+	return h(event)
+}
+
+// OutboxRelay publishes the events storers recorded in the outbox. Records are only marked
+// as published once every synchronous handler succeeded, so handlers have to cope with
+// events delivered more than once. Only the staple lifecycle is recorded; user events and
+// QueueEmptied and QuotaReached are published directly by the services.
+type OutboxRelay struct {
+	store storage.OutboxStorer
+	bus   EventBus
+	clock Clock
+}
+
+// NewOutboxRelay creates a relay which publishes the outbox on bus.
+func NewOutboxRelay(store storage.OutboxStorer, bus EventBus) OutboxRelay {
+	return OutboxRelay{store: store, bus: bus, clock: time.Now}
+}
+
+// WithClock returns a copy of the relay which uses the given clock.
+func (r OutboxRelay) WithClock(clock Clock) OutboxRelay {
+	r.clock = clock
+	return r
+}
+
+// RelayPending publishes pending records, the oldest first, and returns how many were
+// published. Records which can't be decoded or whose handlers fail are retried later.
+func (r OutboxRelay) RelayPending() (int, error) {
+	records, err := r.store.Claim(r.clock().UTC(), outboxLease, outboxMaxAttempts, outboxBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	published := 0
+	for _, record := range records {
+		event, err := decodeEvent(record)
+		if err == nil {
+			err = r.bus.Publish(event)
+		}
+		if err != nil {
+			if err := r.store.MarkFailed(record.ID, err.Error()); err != nil {
+				return published, err
+			}
+			continue
+		}
+		if err := r.store.MarkPublished(record.ID, r.clock().UTC()); err != nil {
+			return published, err
+		}
+		published++
+	}
+	return published, nil
+}
+
+// RunRelay publishes the outbox once per interval until ctx is done. Published records are
+// removed after a week.
+func (r OutboxRelay) RunRelay(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := r.RelayPending(); err != nil {
+			config.Opts.Logger.Error().Err(err).Msg("Failed to publish the event outbox")
+		}
+		if _, err := r.store.Purge(r.clock().Add(-outboxRetention)); err != nil {
+			config.Opts.Logger.Error().Err(err).Msg("Failed to purge the event outbox")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/staple-org/staple/internal/models"
+	"github.com/staple-org/staple/internal/storage"
+)
+
+// eventRecorder collects the names of the events it handles.
+type eventRecorder struct {
+	mu    sync.Mutex
+	names []string
+}
+
+func (r *eventRecorder) handle(event DomainEvent) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.names = append(r.names, event.EventName())
+	return nil
+}
+
+func (r *eventRecorder) get() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.names...)
+}
+
+func TestEventBus_Publish(t *testing.T) {
+	bus := NewEventBus()
+	var order []string
+	bus.Subscribe(models.EventStapleCreated, func(DomainEvent) error {
+		order = append(order, "first")
+		return errors.New("boom")
+	})
+	bus.Subscribe(models.EventStapleCreated, func(DomainEvent) error {
+		order = append(order, "second")
+		return nil
+	})
+	bus.Subscribe(models.EventStapleCreated, func(DomainEvent) error {
+		panic("handler bug")
+	})
+	all := &eventRecorder{}
+	bus.Subscribe(AllEvents, all.handle)
+	async := &eventRecorder{}
+	bus.SubscribeAsync(models.EventStapleCreated, async.handle)
+
+	err := bus.Publish(StapleCreated{EventMeta: newEventMeta("user", time.Now()), Staple: models.Staple{Name: "a"}})
+	assert.EqualError(t, err, "boom")
+	assert.Equal(t, []string{"first", "second"}, order, "every synchronous handler runs in order")
+	assert.NoError(t, bus.Publish(QueueEmptied{EventMeta: newEventMeta("user", time.Now())}))
+	assert.Equal(t, []string{models.EventStapleCreated, models.EventQueueEmptied}, all.get())
+
+	bus.Wait()
+	assert.Equal(t, []string{models.EventStapleCreated}, async.get())
+
+	// The zero value drops events.
+	assert.NoError(t, EventBus{}.Publish(QueueEmptied{}))
+}
+
+func TestStapler_Events(t *testing.T) {
+	bus := NewEventBus()
+	rec := &eventRecorder{}
+	bus.Subscribe(AllEvents, rec.handle)
+	stapler := NewStapler(storage.NewInMemoryStapleStorer()).WithEvents(bus)
+	u := &models.User{ID: "user", MaxStaples: 1}
+
+	assert.NoError(t, stapler.Create(models.Staple{Name: "a"}, u))
+	var full *QueueFullError
+	assert.ErrorAs(t, stapler.Create(models.Staple{Name: "b"}, u), &full)
+	assert.NoError(t, stapler.CreateArchived(models.Staple{Name: "c"}, u))
+	list, _ := stapler.List(u)
+	assert.NoError(t, stapler.Archive(u, list[0].ID))
+	assert.NoError(t, stapler.Create(models.Staple{Name: "d"}, u))
+	list, _ = stapler.List(u)
+	assert.NoError(t, stapler.Delete(u, list[0].ID))
+	assert.Equal(t, []string{
+		models.EventStapleCreated,
+		models.EventQuotaReached,
+		models.EventStapleCreated,
+		models.EventStapleArchived,
+		models.EventQueueEmptied,
+		models.EventStapleCreated,
+		models.EventQuotaReached,
+		models.EventStapleDeleted,
+		models.EventQueueEmptied,
+	}, rec.get())
+}
+
+func TestUserHandler_Events(t *testing.T) {
+	bus := NewEventBus()
+	rec := &eventRecorder{}
+	bus.Subscribe(AllEvents, rec.handle)
+	var registered UserRegistered
+	bus.Subscribe(models.EventUserRegistered, func(e DomainEvent) error {
+		registered = e.(UserRegistered)
+		return nil
+	})
+	userHandler := NewUserHandler(context.Background(), storage.NewInMemoryUserStorer(), NewBufferNotifier()).WithEvents(bus)
+
+	u := models.User{Email: "test@test.com", Password: "password"}
+	assert.NoError(t, userHandler.Register(u))
+	id, err := userHandler.UserID(u)
+	assert.NoError(t, err)
+	assert.Equal(t, id, registered.UserID)
+	assert.Equal(t, "test@test.com", registered.Email)
+	assert.NoError(t, userHandler.ChangePassword(models.User{ID: id}, "new-password"))
+	assert.Equal(t, []string{models.EventUserRegistered, models.EventPasswordChanged}, rec.get())
+
+	// Errors of the welcome mail fail the registration like before.
+	failing := NewEventBus()
+	failing.Subscribe(models.EventUserRegistered, func(DomainEvent) error { return errors.New("mail down") })
+	userHandler = userHandler.WithEvents(failing)
+	assert.EqualError(t, userHandler.Register(models.User{Email: "other@test.com", Password: "password"}), "mail down")
+}
+
+func TestOutboxRelay(t *testing.T) {
+	store := storage.NewInMemoryOutboxStorer()
+	bus := NewEventBus()
+	var archived []StapleArchived
+	fail := true
+	bus.Subscribe(models.EventStapleArchived, func(e DomainEvent) error {
+		if fail {
+			return errors.New("not yet")
+		}
+		archived = append(archived, e.(StapleArchived))
+		return nil
+	})
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	relay := NewOutboxRelay(store, bus).WithClock(func() time.Time { return now })
+
+	assert.NoError(t, store.Add(models.OutboxRecord{ID: "1", Name: models.EventStapleArchived, UserID: "user", Payload: []byte(`{"staple": {"id": 7, "name": "a"}}`), OccurredAt: now}))
+	assert.NoError(t, store.Add(models.OutboxRecord{ID: "2", Name: "staple.unknown", UserID: "user", Payload: []byte(`{}`), OccurredAt: now}))
+
+	n, err := relay.RelayPending()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	fail = false
+	n, err = relay.RelayPending()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Len(t, archived, 1)
+	assert.Equal(t, "1", archived[0].ID)
+	assert.Equal(t, "user", archived[0].UserID)
+	assert.Equal(t, 7, archived[0].Staple.ID)
+
+	n, err = relay.RelayPending()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n, "published records aren't published again")
+	pending, _ := store.Claim(now, outboxLease, outboxMaxAttempts, outboxBatchSize)
+	assert.Len(t, pending, 1)
+	assert.Equal(t, 3, pending[0].Attempts)
+	assert.Contains(t, pending[0].LastError, "unknown event")
+
+	purged, err := store.Purge(now.Add(time.Second))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), purged)
+}
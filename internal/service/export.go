@@ -0,0 +1,351 @@
+package service
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/staple-org/staple/internal/models"
+)
+
+// ExportFormat is the format staples are exported in.
+type ExportFormat string
+
+const (
+	// ExportJSON is a list of staples which can be imported again.
+	ExportJSON ExportFormat = "json"
+	// ExportCSV is a CSV file with a header row.
+	ExportCSV ExportFormat = "csv"
+	// ExportHTML is a Netscape bookmark file which browsers can import.
+	ExportHTML ExportFormat = "html"
+	// ExportMarkdown is a list of links grouped by queue and archive.
+	ExportMarkdown ExportFormat = "markdown"
+)
+
+// ExportScope selects which staples are exported.
+type ExportScope string
+
+const (
+	// ExportQueue exports the staples in the queue.
+	ExportQueue ExportScope = "queue"
+	// ExportArchive exports the archived staples.
+	ExportArchive ExportScope = "archive"
+	// ExportAll exports the queue and the archive.
+	ExportAll ExportScope = "all"
+)
+
+// ContentType returns the media type of the format.
+func (f ExportFormat) ContentType() string {
+	switch f {
+	case ExportJSON:
+		return "application/json; charset=utf-8"
+	case ExportCSV:
+		return "text/csv; charset=utf-8"
+	case ExportHTML:
+		return "text/html; charset=utf-8"
+	case ExportMarkdown:
+		return "text/markdown; charset=utf-8"
+	}
+	return "application/octet-stream"
+}
+
+// Extension returns the file extension of the format without the dot.
+func (f ExportFormat) Extension() string {
+	if f == ExportMarkdown {
+		return "md"
+	}
+	return string(f)
+}
+
+// ValidateExport checks the format and the scope of an export. Empty values default
+// to JSON and all staples.
+func ValidateExport(format ExportFormat, scope ExportScope) (ExportFormat, ExportScope, error) {
+	if format == "" {
+		format = ExportJSON
+	}
+	if scope == "" {
+		scope = ExportAll
+	}
+	switch format {
+	case ExportJSON, ExportCSV, ExportHTML, ExportMarkdown:
+	default:
+		return "", "", fmt.Errorf("unsupported export format %q", format)
+	}
+	switch scope {
+	case ExportQueue, ExportArchive, ExportAll:
+	default:
+		return "", "", fmt.Errorf("unsupported export scope %q", scope)
+	}
+	return format, scope, nil
+}
+
+// Export writes the staples of a user in the given format to w. The queue comes first
+// in FIFO order followed by the archive. Staples are written as they are read from the
+// storage so large archives aren't held in memory.
+func (p Stapler) Export(user *models.User, format ExportFormat, scope ExportScope, w io.Writer) error {
+	format, scope, err := ValidateExport(format, scope)
+	if err != nil {
+		return err
+	}
+	buf := bufio.NewWriter(w)
+	ew := newExportWriter(format, buf)
+	if err := ew.begin(); err != nil {
+		return err
+	}
+	if err := p.storer.Walk(user.ID, func(staple models.Staple) error {
+		if scope == ExportQueue && staple.Archived || scope == ExportArchive && !staple.Archived {
+			return nil
+		}
+		return ew.write(staple)
+	}); err != nil {
+		return err
+	}
+	if err := ew.end(); err != nil {
+		return err
+	}
+	return buf.Flush()
+}
+
+// exportWriter writes staples in one of the export formats. write is called with the
+// queue first and then the archive.
+type exportWriter interface {
+	begin() error
+	write(staple models.Staple) error
+	end() error
+}
+
+func newExportWriter(format ExportFormat, w *bufio.Writer) exportWriter {
+	switch format {
+	case ExportCSV:
+		return &csvExportWriter{w: csv.NewWriter(w)}
+	case ExportHTML:
+		return &htmlExportWriter{w: w}
+	case ExportMarkdown:
+		return &markdownExportWriter{w: w}
+	}
+	return &jsonExportWriter{w: w}
+}
+
+// jsonExportWriter writes a JSON array of staples.
+type jsonExportWriter struct {
+	w     *bufio.Writer
+	count int
+}
+
+func (j *jsonExportWriter) begin() error {
+	_, err := j.w.WriteString("[")
+	return err
+}
+
+func (j *jsonExportWriter) write(staple models.Staple) error {
+	data, err := json.Marshal(staple)
+	if err != nil {
+		return err
+	}
+	if j.count > 0 {
+		if _, err := j.w.WriteString(","); err != nil {
+			return err
+		}
+	}
+	j.count++
+	if _, err := j.w.WriteString("\n"); err != nil {
+		return err
+	}
+	_, err = j.w.Write(data)
+	return err
+}
+
+func (j *jsonExportWriter) end() error {
+	_, err := j.w.WriteString("\n]\n")
+	return err
+}
+
+// csvExportWriter writes a CSV file which can be imported again since it has a url column.
+type csvExportWriter struct {
+	w *csv.Writer
+}
+
+func (c *csvExportWriter) begin() error {
+	return c.w.Write([]string{"title", "url", "time_added", "status", "created_at", "archived_at"})
+}
+
+func (c *csvExportWriter) write(staple models.Staple) error {
+	status := "unread"
+	if staple.Archived {
+		status = "archive"
+	}
+	archivedAt := ""
+	if staple.ArchivedAt != nil {
+		archivedAt = staple.ArchivedAt.UTC().Format(time.RFC3339)
+	}
+	return c.w.Write([]string{
+		escapeCSVCell(staple.Name),
+		escapeCSVCell(staple.Content),
+		strconv.FormatInt(staple.CreatedAt.Unix(), 10),
+		status,
+		staple.CreatedAt.UTC().Format(time.RFC3339),
+		archivedAt,
+	})
+}
+
+func (c *csvExportWriter) end() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// csvFormulaChars start cells which spreadsheets evaluate as formulas.
+const csvFormulaChars = "=+-@\t\r"
+
+// escapeCSVCell prefixes a cell which a spreadsheet would evaluate as a formula with a
+// single quote so it is shown as text.
+func escapeCSVCell(s string) string {
+	if s != "" && strings.IndexByte(csvFormulaChars, s[0]) >= 0 {
+		return "'" + s
+	}
+	return s
+}
+
+// unescapeCSVCell removes the quote escapeCSVCell added.
+func unescapeCSVCell(s string) string {
+	if len(s) > 1 && s[0] == '\'' && strings.IndexByte(csvFormulaChars, s[1]) >= 0 {
+		return s[1:]
+	}
+	return s
+}
+
+// htmlExportWriter writes a Netscape bookmark file with a folder for the queue and one
+// for the archive. Staples whose content isn't a link are written as descriptions.
+type htmlExportWriter struct {
+	w      *bufio.Writer
+	folder string
+}
+
+func (h *htmlExportWriter) begin() error {
+	_, err := h.w.WriteString(`<!DOCTYPE NETSCAPE-Bookmark-file-1>
+<!-- This is an automatically generated file.
+     It will be read and overwritten.
+     DO NOT EDIT! -->
+<META HTTP-EQUIV="Content-Type" CONTENT="text/html; charset=UTF-8">
+<TITLE>Bookmarks</TITLE>
+<H1>Bookmarks</H1>
+<DL><p>
+`)
+	return err
+}
+
+func (h *htmlExportWriter) write(staple models.Staple) error {
+	folder := "Queue"
+	if staple.Archived {
+		folder = "Archive"
+	}
+	if folder != h.folder {
+		if h.folder != "" {
+			if _, err := h.w.WriteString("    </DL><p>\n"); err != nil {
+				return err
+			}
+		}
+		h.folder = folder
+		if _, err := fmt.Fprintf(h.w, "    <DT><H3>%s</H3>\n    <DL><p>\n", folder); err != nil {
+			return err
+		}
+	}
+	href := staple.Content
+	description := ""
+	if !isLink(href) {
+		href, description = "", staple.Content
+	}
+	archived := ""
+	if staple.ArchivedAt != nil {
+		archived = fmt.Sprintf(` ARCHIVED_DATE="%d"`, staple.ArchivedAt.Unix())
+	}
+	if _, err := fmt.Fprintf(h.w, `        <DT><A HREF="%s" ADD_DATE="%d"%s>%s</A>`+"\n",
+		html.EscapeString(href), staple.CreatedAt.Unix(), archived, html.EscapeString(staple.Name)); err != nil {
+		return err
+	}
+	if description != "" {
+		if _, err := fmt.Fprintf(h.w, "        <DD>%s\n", html.EscapeString(description)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *htmlExportWriter) end() error {
+	if h.folder != "" {
+		if _, err := h.w.WriteString("    </DL><p>\n"); err != nil {
+			return err
+		}
+	}
+	_, err := h.w.WriteString("</DL><p>\n")
+	return err
+}
+
+// markdownExportWriter writes a list of links with a heading for the queue and the archive.
+type markdownExportWriter struct {
+	w      *bufio.Writer
+	folder string
+}
+
+func (m *markdownExportWriter) begin() error {
+	return nil
+}
+
+func (m *markdownExportWriter) write(staple models.Staple) error {
+	folder := "Queue"
+	if staple.Archived {
+		folder = "Archive"
+	}
+	if folder != m.folder {
+		prefix := ""
+		if m.folder != "" {
+			prefix = "\n"
+		}
+		m.folder = folder
+		if _, err := fmt.Fprintf(m.w, "%s# %s\n\n", prefix, folder); err != nil {
+			return err
+		}
+	}
+	date := staple.CreatedAt.UTC().Format("2006-01-02")
+	if staple.ArchivedAt != nil {
+		date += ", archived " + staple.ArchivedAt.UTC().Format("2006-01-02")
+	}
+	name := markdownEscaper.Replace(staple.Name)
+	if isLink(staple.Content) {
+		_, err := fmt.Fprintf(m.w, "- [%s](<%s>) — %s\n", name, staple.Content, date)
+		return err
+	}
+	if _, err := fmt.Fprintf(m.w, "- %s — %s\n", name, date); err != nil {
+		return err
+	}
+	if strings.TrimSpace(staple.Content) == "" {
+		return nil
+	}
+	for _, line := range strings.Split(strings.TrimSpace(staple.Content), "\n") {
+		if _, err := fmt.Fprintf(m.w, "  > %s\n", strings.TrimRight(line, "\r")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *markdownExportWriter) end() error {
+	return nil
+}
+
+var markdownEscaper = strings.NewReplacer(`\`, `\\`, `[`, `\[`, `]`, `\]`, "\n", " ")
+
+// isLink reports whether the content of a staple is a single absolute URL.
+func isLink(content string) bool {
+	if strings.ContainsAny(content, " \t\r\n<>") {
+		return false
+	}
+	u, err := url.Parse(content)
+	return err == nil && u.IsAbs() && u.Host != ""
+}
@@ -0,0 +1,181 @@
+package service
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/staple-org/staple/internal/models"
+	"github.com/staple-org/staple/internal/storage"
+)
+
+// exportArchivedAt is the time the archived staple of newExportStapler was archived.
+var exportArchivedAt = time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+
+func newExportStapler(t *testing.T) (Stapler, *models.User) {
+	stapler := NewStapler(storage.NewInMemoryStapleStorer())
+	u := &models.User{ID: "5f0b7a9e-8e3c-4c1e-9a57-2d0f4c3b6a11", MaxStaples: 10}
+	for _, s := range []models.Staple{
+		{Name: "Newer", Content: "https://example.com/newer?a=1&b=2", CreatedAt: time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)},
+		{Name: "Read <this>", Content: "https://example.com/read", CreatedAt: time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC), Archived: true, ArchivedAt: &exportArchivedAt},
+		{Name: "Older [note]", Content: "just some text\nover two lines", CreatedAt: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)},
+	} {
+		if s.Archived {
+			assert.NoError(t, stapler.CreateArchived(s, u))
+		} else {
+			assert.NoError(t, stapler.Create(s, u))
+		}
+	}
+	return stapler, u
+}
+
+func TestStapler_Export_JSON(t *testing.T) {
+	stapler, u := newExportStapler(t)
+	var buf bytes.Buffer
+	err := stapler.Export(u, ExportJSON, ExportAll, &buf)
+	assert.NoError(t, err)
+	var staples []models.Staple
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &staples))
+	assert.Len(t, staples, 3)
+	assert.Equal(t, "Older [note]", staples[0].Name)
+	assert.Equal(t, "Newer", staples[1].Name)
+	assert.True(t, staples[2].Archived)
+
+	buf.Reset()
+	err = stapler.Export(u, ExportJSON, ExportArchive, &buf)
+	assert.NoError(t, err)
+	items, errs, err := ParseImport(ImportAuto, buf.Bytes())
+	assert.NoError(t, err)
+	assert.Empty(t, errs)
+	assert.Len(t, items, 1)
+	assert.Equal(t, "Read <this>", items[0].Staple.Name)
+	assert.Equal(t, exportArchivedAt, *items[0].Staple.ArchivedAt)
+
+	buf.Reset()
+	err = NewStapler(storage.NewInMemoryStapleStorer()).Export(u, ExportJSON, ExportAll, &buf)
+	assert.NoError(t, err)
+	assert.JSONEq(t, "[]", buf.String())
+}
+
+func TestStapler_Export_CSV(t *testing.T) {
+	stapler, u := newExportStapler(t)
+	var buf bytes.Buffer
+	err := stapler.Export(u, ExportCSV, ExportQueue, &buf)
+	assert.NoError(t, err)
+	records, err := csv.NewReader(&buf).ReadAll()
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{
+		{"title", "url", "time_added", "status", "created_at", "archived_at"},
+		{"Older [note]", "just some text\nover two lines", "1577836800", "unread", "2020-01-01T00:00:00Z", ""},
+		{"Newer", "https://example.com/newer?a=1&b=2", "1577923200", "unread", "2020-01-02T00:00:00Z", ""},
+	}, records)
+
+	buf.Reset()
+	err = stapler.Export(u, ExportCSV, ExportArchive, &buf)
+	assert.NoError(t, err)
+	items, errs, err := ParseImport(ImportCSV, buf.Bytes())
+	assert.NoError(t, err)
+	assert.Empty(t, errs)
+	assert.Len(t, items, 1)
+	assert.True(t, items[0].Staple.Archived)
+	assert.Equal(t, exportArchivedAt, *items[0].Staple.ArchivedAt)
+}
+
+func TestStapler_Export_CSVFormulas(t *testing.T) {
+	stapler := NewStapler(storage.NewInMemoryStapleStorer())
+	u := &models.User{ID: "5f0b7a9e-8e3c-4c1e-9a57-2d0f4c3b6a11", MaxStaples: 10}
+	assert.NoError(t, stapler.Create(models.Staple{Name: `=HYPERLINK("https://evil.test")`, Content: "https://example.com/a", CreatedAt: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}, u))
+	assert.NoError(t, stapler.Create(models.Staple{Name: "-1+1", Content: "@SUM(A1)", CreatedAt: time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)}, u))
+	var buf bytes.Buffer
+	err := stapler.Export(u, ExportCSV, ExportAll, &buf)
+	assert.NoError(t, err)
+	records, err := csv.NewReader(bytes.NewReader(buf.Bytes())).ReadAll()
+	assert.NoError(t, err)
+	assert.Equal(t, `'=HYPERLINK("https://evil.test")`, records[1][0])
+	assert.Equal(t, "'-1+1", records[2][0])
+	assert.Equal(t, "'@SUM(A1)", records[2][1])
+
+	// the quotes are removed again on import
+	items, _, err := ParseImport(ImportCSV, buf.Bytes())
+	assert.NoError(t, err)
+	assert.NotEmpty(t, items)
+	assert.Equal(t, `=HYPERLINK("https://evil.test")`, items[0].Staple.Name)
+}
+
+func TestStapler_Export_HTML(t *testing.T) {
+	stapler, u := newExportStapler(t)
+	var buf bytes.Buffer
+	err := stapler.Export(u, ExportHTML, ExportAll, &buf)
+	assert.NoError(t, err)
+	out := buf.String()
+	assert.Contains(t, out, "<!DOCTYPE NETSCAPE-Bookmark-file-1>")
+	assert.Contains(t, out, `<DT><A HREF="https://example.com/newer?a=1&amp;b=2" ADD_DATE="1577923200">Newer</A>`)
+	assert.Contains(t, out, "<DD>just some text\nover two lines")
+	assert.Contains(t, out, "Read &lt;this&gt;")
+
+	items, errs, err := ParseImport(ImportAuto, buf.Bytes())
+	assert.NoError(t, err)
+	assert.Len(t, errs, 1, "staples without a link can't be imported as bookmarks")
+	assert.Len(t, items, 2)
+	assert.Equal(t, "https://example.com/newer?a=1&b=2", items[0].Staple.Content)
+	assert.False(t, items[0].Staple.Archived)
+	assert.Equal(t, "Read <this>", items[1].Staple.Name)
+	assert.True(t, items[1].Staple.Archived)
+	assert.Equal(t, exportArchivedAt, *items[1].Staple.ArchivedAt)
+}
+
+func TestStapler_Export_Markdown(t *testing.T) {
+	stapler, u := newExportStapler(t)
+	var buf bytes.Buffer
+	err := stapler.Export(u, ExportMarkdown, ExportAll, &buf)
+	assert.NoError(t, err)
+	assert.Equal(t, `# Queue
+
+- Older \[note\] — 2020-01-01
+  > just some text
+  > over two lines
+- [Newer](<https://example.com/newer?a=1&b=2>) — 2020-01-02
+
+# Archive
+
+- [Read <this>](<https://example.com/read>) — 2019-01-01, archived 2019-06-01
+`, buf.String())
+}
+
+func TestStapler_Export_RoundTrip(t *testing.T) {
+	for _, format := range []ExportFormat{ExportJSON, ExportCSV, ExportHTML} {
+		t.Run(string(format), func(tt *testing.T) {
+			stapler, u := newExportStapler(tt)
+			var buf bytes.Buffer
+			assert.NoError(tt, stapler.Export(u, format, ExportArchive, &buf))
+
+			imported := NewStapler(storage.NewInMemoryStapleStorer())
+			importer := NewImporter(imported)
+			job, err := importer.Start(*u, ImportFormat(format), buf.Bytes(), OverflowArchive)
+			assert.NoError(tt, err)
+			job = waitForImport(tt, importer, *u, job.ID)
+			assert.Equal(tt, 1, job.Archived)
+			archive, err := imported.ShowArchive(u)
+			assert.NoError(tt, err)
+			if assert.Len(tt, archive, 1) && assert.NotNil(tt, archive[0].ArchivedAt) {
+				assert.Equal(tt, exportArchivedAt, *archive[0].ArchivedAt)
+			}
+		})
+	}
+}
+
+func TestStapler_Export_Errors(t *testing.T) {
+	stapler, u := newExportStapler(t)
+	var buf bytes.Buffer
+	assert.Error(t, stapler.Export(u, "pdf", ExportAll, &buf))
+	assert.Error(t, stapler.Export(u, ExportJSON, "trash", &buf))
+
+	store := storage.NewInMemoryStapleStorer()
+	store.Err = errors.New("boom")
+	assert.EqualError(t, NewStapler(store).Export(u, ExportJSON, ExportAll, &buf), "boom")
+}
@@ -0,0 +1,229 @@
+package service
+
+import (
+	"encoding/xml"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/staple-org/staple/internal/models"
+)
+
+// FeedKind selects which staples a personal feed shows.
+type FeedKind string
+
+const (
+	// FeedNext only shows the head of the queue so the feed keeps the FIFO order.
+	FeedNext FeedKind = "next"
+	// FeedArchive shows the most recently archived staples.
+	FeedArchive FeedKind = "archive"
+)
+
+// feedArchiveSize is the number of staples in the archive feed.
+const feedArchiveSize = 50
+
+// Feed is a personal feed of a user which can be written as Atom or RSS.
+type Feed struct {
+	ID    string
+	Title string
+	// Updated is the newest update of an entry. It is zero if the feed has no entries.
+	Updated time.Time
+	Entries []FeedEntry
+}
+
+// FeedEntry is a staple in a feed.
+type FeedEntry struct {
+	ID    string
+	Title string
+	// Link is the content of the staple if it is a link.
+	Link      string
+	Content   string
+	Published time.Time
+	Updated   time.Time
+}
+
+// BuildFeed creates the feed of the given kind for a user. Entry ids are derived from the
+// user and the staple so they don't change when the feed token is regenerated.
+func BuildFeed(stapler Staplerer, user *models.User, kind FeedKind) (Feed, error) {
+	feed := Feed{ID: feedURN(user.ID, string(kind))}
+	var staples []models.Staple
+	switch kind {
+	case FeedNext:
+		feed.Title = "Staple: next up"
+		next, err := stapler.GetNext(user)
+		if err != nil {
+			return Feed{}, err
+		}
+		if next != nil {
+			staples = append(staples, *next)
+		}
+	case FeedArchive:
+		feed.Title = "Staple: archive"
+		archive, err := stapler.RecentArchive(user, feedArchiveSize)
+		if err != nil {
+			return Feed{}, err
+		}
+		staples = archive
+	}
+	for _, s := range staples {
+		entry := FeedEntry{
+			ID:        feedURN(user.ID, strconv.Itoa(s.ID)),
+			Title:     s.Name,
+			Content:   s.Content,
+			Published: s.CreatedAt.UTC(),
+			Updated:   s.CreatedAt.UTC(),
+		}
+		if s.ArchivedAt != nil {
+			entry.Updated = s.ArchivedAt.UTC()
+		}
+		if isLink(s.Content) {
+			entry.Link = s.Content
+		}
+		if entry.Updated.After(feed.Updated) {
+			feed.Updated = entry.Updated
+		}
+		feed.Entries = append(feed.Entries, entry)
+	}
+	return feed, nil
+}
+
+func feedURN(userID, name string) string {
+	return uuid.NewSHA1(uuid.NameSpaceURL, []byte("staple:"+userID+":"+name)).URN()
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Author  atomPerson  `xml:"author"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	ID        string     `xml:"id"`
+	Title     string     `xml:"title"`
+	Published string     `xml:"published"`
+	Updated   string     `xml:"updated"`
+	Links     []atomLink `xml:"link"`
+	Content   atomText   `xml:"content"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+// WriteAtom writes the feed as Atom 1.0. self is the URL the feed is served from.
+func (f Feed) WriteAtom(w io.Writer, self string) error {
+	feed := atomFeed{
+		ID:      f.ID,
+		Title:   f.Title,
+		Updated: feedTime(f.Updated).Format(time.RFC3339),
+		Author:  atomPerson{Name: "Staple"},
+		Links:   []atomLink{{Rel: "self", Type: "application/atom+xml", Href: self}},
+	}
+	for _, e := range f.Entries {
+		entry := atomEntry{
+			ID:        e.ID,
+			Title:     e.Title,
+			Published: e.Published.Format(time.RFC3339),
+			Updated:   e.Updated.Format(time.RFC3339),
+			Content:   atomText{Type: "text", Body: e.Content},
+		}
+		if e.Link != "" {
+			entry.Links = []atomLink{{Rel: "alternate", Href: e.Link}}
+		}
+		feed.Entries = append(feed.Entries, entry)
+	}
+	return writeXML(w, feed)
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Atom    string     `xml:"xmlns:atom,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	Self          atomLink  `xml:"atom:link"`
+	LastBuildDate string    `xml:"lastBuildDate"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string  `xml:"title"`
+	Link        string  `xml:"link,omitempty"`
+	Description string  `xml:"description"`
+	GUID        rssGUID `xml:"guid"`
+	PubDate     string  `xml:"pubDate"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+// WriteRSS writes the feed as RSS 2.0. self is the URL the feed is served from.
+func (f Feed) WriteRSS(w io.Writer, self string) error {
+	feed := rssFeed{
+		Version: "2.0",
+		Atom:    "http://www.w3.org/2005/Atom",
+		Channel: rssChannel{
+			Title:         f.Title,
+			Link:          self,
+			Description:   f.Title,
+			Self:          atomLink{Rel: "self", Type: "application/rss+xml", Href: self},
+			LastBuildDate: feedTime(f.Updated).Format(time.RFC1123Z),
+		},
+	}
+	for _, e := range f.Entries {
+		feed.Channel.Items = append(feed.Channel.Items, rssItem{
+			Title:       e.Title,
+			Link:        e.Link,
+			Description: e.Content,
+			GUID:        rssGUID{Value: e.ID},
+			PubDate:     e.Updated.Format(time.RFC1123Z),
+		})
+	}
+	return writeXML(w, feed)
+}
+
+// feedTime returns the time feeds without entries use as their update time. It never
+// changes so an empty feed always renders the same.
+func feedTime(t time.Time) time.Time {
+	if t.IsZero() {
+		return time.Unix(0, 0).UTC()
+	}
+	return t
+}
+
+func writeXML(w io.Writer, v interface{}) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
@@ -0,0 +1,96 @@
+package service
+
+import (
+	"bytes"
+	"encoding/xml"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/staple-org/staple/internal/models"
+	"github.com/staple-org/staple/internal/storage"
+)
+
+func TestBuildFeed(t *testing.T) {
+	stapler := NewStapler(storage.NewInMemoryStapleStorer())
+	u := &models.User{ID: "5f0b7a9e-8e3c-4c1e-9a57-2d0f4c3b6a11", MaxStaples: 10}
+
+	feed, err := BuildFeed(stapler, u, FeedNext)
+	assert.NoError(t, err)
+	assert.Empty(t, feed.Entries)
+	assert.True(t, feed.Updated.IsZero())
+
+	for _, s := range []models.Staple{
+		{Name: "Second", Content: "https://example.com/second", CreatedAt: time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)},
+		{Name: "First", Content: "some notes", CreatedAt: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)},
+	} {
+		assert.NoError(t, stapler.Create(s, u))
+	}
+	feed, err = BuildFeed(stapler, u, FeedNext)
+	assert.NoError(t, err)
+	assert.Len(t, feed.Entries, 1, "only the head of the queue is exposed")
+	assert.Equal(t, "First", feed.Entries[0].Title)
+	assert.Empty(t, feed.Entries[0].Link)
+	assert.Equal(t, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), feed.Updated)
+	firstID := feed.Entries[0].ID
+
+	assert.NoError(t, stapler.Archive(u, 1))
+	feed, err = BuildFeed(stapler, u, FeedNext)
+	assert.NoError(t, err)
+	assert.Equal(t, "Second", feed.Entries[0].Title)
+	assert.Equal(t, "https://example.com/second", feed.Entries[0].Link)
+
+	feed, err = BuildFeed(stapler, u, FeedArchive)
+	assert.NoError(t, err)
+	assert.Len(t, feed.Entries, 1)
+	assert.Equal(t, firstID, feed.Entries[0].ID)
+	assert.True(t, feed.Entries[0].Updated.After(feed.Entries[0].Published), "archived entries are updated when they were archived")
+}
+
+func TestFeed_Write(t *testing.T) {
+	published := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	feed := Feed{
+		ID:      "urn:uuid:1",
+		Title:   "Staple: next up",
+		Updated: published,
+		Entries: []FeedEntry{{ID: "urn:uuid:2", Title: "Fish & <chips>", Link: "https://example.com/?a=1&b=2", Content: "https://example.com/?a=1&b=2", Published: published, Updated: published}},
+	}
+
+	var buf bytes.Buffer
+	assert.NoError(t, feed.WriteAtom(&buf, "https://staple.example/feeds/t/next.atom"))
+	var atom struct {
+		XMLName xml.Name `xml:"http://www.w3.org/2005/Atom feed"`
+		ID      string   `xml:"id"`
+		Updated string   `xml:"updated"`
+		Entries []struct {
+			Title string `xml:"title"`
+			Link  struct {
+				Href string `xml:"href,attr"`
+			} `xml:"link"`
+		} `xml:"entry"`
+	}
+	assert.NoError(t, xml.Unmarshal(buf.Bytes(), &atom))
+	assert.Equal(t, "urn:uuid:1", atom.ID)
+	assert.Equal(t, "2020-01-01T00:00:00Z", atom.Updated)
+	assert.Equal(t, "Fish & <chips>", atom.Entries[0].Title)
+	assert.Equal(t, "https://example.com/?a=1&b=2", atom.Entries[0].Link.Href)
+
+	buf.Reset()
+	assert.NoError(t, feed.WriteRSS(&buf, "https://staple.example/feeds/t/next.rss"))
+	var rss struct {
+		Version string `xml:"version,attr"`
+		Channel struct {
+			Link  string `xml:"link"`
+			Items []struct {
+				Title   string `xml:"title"`
+				GUID    string `xml:"guid"`
+				PubDate string `xml:"pubDate"`
+			} `xml:"item"`
+		} `xml:"channel"`
+	}
+	assert.NoError(t, xml.Unmarshal(buf.Bytes(), &rss))
+	assert.Equal(t, "2.0", rss.Version)
+	assert.Equal(t, "urn:uuid:2", rss.Channel.Items[0].GUID)
+	assert.Equal(t, "Wed, 01 Jan 2020 00:00:00 +0000", rss.Channel.Items[0].PubDate)
+}
@@ -0,0 +1,209 @@
+package service
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/staple-org/staple/internal/models"
+)
+
+// importJobRetention is how long finished import jobs can be queried.
+const importJobRetention = 24 * time.Hour
+
+// OverflowPolicy decides what happens to imported items which don't fit into the queue.
+type OverflowPolicy string
+
+const (
+	// OverflowArchive puts items which don't fit into the queue into the archive.
+	OverflowArchive OverflowPolicy = "archive"
+	// OverflowReport skips items which don't fit into the queue and reports them as errors.
+	OverflowReport OverflowPolicy = "report"
+)
+
+// ImportStatus is the state of an import job.
+type ImportStatus string
+
+const (
+	// ImportRunning means the job is still creating staples.
+	ImportRunning ImportStatus = "running"
+	// ImportDone means all items have been processed.
+	ImportDone ImportStatus = "done"
+	// ImportFailed means the job stopped before all items were processed.
+	ImportFailed ImportStatus = "failed"
+)
+
+// ImportJob reports the progress of an import.
+type ImportJob struct {
+	ID     string       `json:"id"`
+	Status ImportStatus `json:"status"`
+	// Total is the number of items found in the file including the ones which failed to parse.
+	Total     int `json:"total"`
+	Processed int `json:"processed"`
+	// Queued is the number of items added to the queue.
+	Queued int `json:"queued"`
+	// Archived is the number of items added to the archive.
+	Archived   int           `json:"archived"`
+	Errors     []ImportError `json:"errors"`
+	StartedAt  time.Time     `json:"started_at"`
+	FinishedAt *time.Time    `json:"finished_at,omitempty"`
+
+	userID string
+}
+
+// Importer imports staples from other services in the background and keeps track of the jobs.
+type Importer struct {
+	stapler Staplerer
+	clock   Clock
+
+	mu   sync.Mutex
+	jobs map[string]*ImportJob
+}
+
+// NewImporter creates an importer which creates staples with the given stapler.
+func NewImporter(stapler Staplerer) *Importer {
+	return &Importer{
+		stapler: stapler,
+		clock:   time.Now,
+		jobs:    make(map[string]*ImportJob),
+	}
+}
+
+// Start parses the data and starts creating the staples in the background. The user needs
+// an ID and MaxStaples. Items are created oldest first so their FIFO order is kept. Parse
+// errors of the whole file are returned right away.
+func (i *Importer) Start(user models.User, format ImportFormat, data []byte, overflow OverflowPolicy) (ImportJob, error) {
+	switch overflow {
+	case "":
+		overflow = OverflowArchive
+	case OverflowArchive, OverflowReport:
+	default:
+		return ImportJob{}, errors.New("unknown overflow policy: " + string(overflow))
+	}
+	items, parseErrors, err := ParseImport(format, data)
+	if err != nil {
+		return ImportJob{}, err
+	}
+	now := i.clock().UTC()
+	for n := range items {
+		if items[n].Staple.CreatedAt.IsZero() {
+			items[n].Staple.CreatedAt = now
+		}
+	}
+	sort.SliceStable(items, func(a, b int) bool {
+		return items[a].Staple.CreatedAt.Before(items[b].Staple.CreatedAt)
+	})
+
+	job := &ImportJob{
+		ID:        uuid.New().String(),
+		Status:    ImportRunning,
+		Total:     len(items) + len(parseErrors),
+		Processed: len(parseErrors),
+		Errors:    parseErrors,
+		StartedAt: now,
+		userID:    user.ID,
+	}
+	i.mu.Lock()
+	i.prune()
+	i.jobs[job.ID] = job
+	snapshot := job.snapshot()
+	i.mu.Unlock()
+
+	go i.run(job, user, items, overflow)
+	return snapshot, nil
+}
+
+// Job returns the current state of an import job of a user.
+func (i *Importer) Job(user models.User, id string) (ImportJob, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	job, ok := i.jobs[id]
+	if !ok || job.userID != user.ID {
+		return ImportJob{}, false
+	}
+	return job.snapshot(), true
+}
+
+func (i *Importer) run(job *ImportJob, user models.User, items []ImportItem, overflow OverflowPolicy) {
+	queued, err := i.stapler.List(&user)
+	if err != nil {
+		i.finish(job, err)
+		return
+	}
+	free := user.MaxStaples - len(queued)
+	for _, item := range items {
+		staple := item.Staple
+		if !staple.Archived {
+			if free > 0 {
+				free--
+			} else if overflow == OverflowArchive {
+				staple.Archived = true
+			} else {
+				i.update(job, func() {
+					job.Errors = append(job.Errors, ImportError{Item: item.Item, Name: staple.Name, Message: "queue is full"})
+				})
+				continue
+			}
+		}
+		if staple.Archived {
+			err = i.stapler.CreateArchived(staple, &user)
+		} else {
+			err = i.stapler.Create(staple, &user)
+		}
+		i.update(job, func() {
+			switch {
+			case err != nil:
+				job.Errors = append(job.Errors, ImportError{Item: item.Item, Name: staple.Name, Message: err.Error()})
+			case staple.Archived:
+				job.Archived++
+			default:
+				job.Queued++
+			}
+		})
+	}
+	i.finish(job, nil)
+}
+
+// update changes the job while holding the lock and counts the item as processed.
+func (i *Importer) update(job *ImportJob, f func()) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	f()
+	job.Processed++
+}
+
+func (i *Importer) finish(job *ImportJob, err error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	now := i.clock().UTC()
+	job.FinishedAt = &now
+	job.Status = ImportDone
+	if err != nil {
+		job.Status = ImportFailed
+		job.Errors = append(job.Errors, ImportError{Message: err.Error()})
+	}
+}
+
+// prune removes jobs which finished longer than the retention ago. Callers must hold the lock.
+func (i *Importer) prune() {
+	cutoff := i.clock().Add(-importJobRetention)
+	for id, job := range i.jobs {
+		if job.FinishedAt != nil && job.FinishedAt.Before(cutoff) {
+			delete(i.jobs, id)
+		}
+	}
+}
+
+// snapshot copies the job so it can be read without holding the lock.
+func (j *ImportJob) snapshot() ImportJob {
+	s := *j
+	s.Errors = append([]ImportError(nil), j.Errors...)
+	if j.FinishedAt != nil {
+		finished := *j.FinishedAt
+		s.FinishedAt = &finished
+	}
+	return s
+}
@@ -0,0 +1,310 @@
+package service
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+
+	"github.com/staple-org/staple/internal/models"
+)
+
+// ImportFormat is the format of a file which is imported.
+type ImportFormat string
+
+const (
+	// ImportAuto detects the format from the content.
+	ImportAuto ImportFormat = ""
+	// ImportHTML is a Netscape bookmark file as exported by browsers and Pocket.
+	ImportHTML ImportFormat = "html"
+	// ImportCSV is a Pocket or Instapaper CSV export.
+	ImportCSV ImportFormat = "csv"
+	// ImportJSON is a Staple account export or a list of staples.
+	ImportJSON ImportFormat = "json"
+)
+
+// maxStapleNameLength is the length of the name column.
+const maxStapleNameLength = 255
+
+// ImportItem is a staple parsed from an import file.
+type ImportItem struct {
+	// Item is the one based position of the item in the file.
+	Item   int
+	Staple models.Staple
+}
+
+// ImportError describes an item which couldn't be imported.
+type ImportError struct {
+	// Item is the one based position of the item in the file.
+	Item    int    `json:"item"`
+	Name    string `json:"name,omitempty"`
+	Message string `json:"message"`
+}
+
+// ParseImport parses an export of another service into staples. Items which can't be
+// parsed are reported as errors and skipped. Archived items are marked as archived.
+func ParseImport(format ImportFormat, data []byte) ([]ImportItem, []ImportError, error) {
+	if format == ImportAuto {
+		format = detectImportFormat(data)
+	}
+	switch format {
+	case ImportHTML:
+		return parseBookmarkHTML(data)
+	case ImportCSV:
+		return parseImportCSV(data)
+	case ImportJSON:
+		return parseImportJSON(data)
+	}
+	return nil, nil, fmt.Errorf("unsupported import format %q", format)
+}
+
+func detectImportFormat(data []byte) ImportFormat {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 {
+		return ImportCSV
+	}
+	switch trimmed[0] {
+	case '{', '[':
+		return ImportJSON
+	case '<':
+		return ImportHTML
+	}
+	return ImportCSV
+}
+
+// parseBookmarkHTML parses Netscape bookmark files. Pocket uses the same format with
+// an "Unread" and a "Read Archive" heading and a time_added attribute instead of add_date.
+// Staple's own export adds an archived_date attribute to archived staples.
+func parseBookmarkHTML(data []byte) ([]ImportItem, []ImportError, error) {
+	items := make([]ImportItem, 0)
+	importErrors := make([]ImportError, 0)
+	z := html.NewTokenizer(bytes.NewReader(data))
+	var (
+		heading   strings.Builder
+		inHeading bool
+		archived  bool
+		inLink    bool
+		href      string
+		added     string
+		archiveAt string
+		title     strings.Builder
+		item      int
+	)
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			if err := z.Err(); err != io.EOF {
+				return nil, nil, err
+			}
+			return items, importErrors, nil
+		case html.StartTagToken:
+			name, hasAttr := z.TagName()
+			switch string(name) {
+			case "h1", "h2", "h3":
+				inHeading = true
+				heading.Reset()
+			case "a":
+				inLink = true
+				href, added, archiveAt = "", "", ""
+				title.Reset()
+				for hasAttr {
+					var key, val []byte
+					key, val, hasAttr = z.TagAttr()
+					switch strings.ToLower(string(key)) {
+					case "href":
+						href = string(val)
+					case "add_date", "time_added":
+						added = string(val)
+					case "archived_date":
+						archiveAt = string(val)
+					}
+				}
+			}
+		case html.TextToken:
+			if inLink {
+				title.Write(z.Text())
+			} else if inHeading {
+				heading.Write(z.Text())
+			}
+		case html.EndTagToken:
+			name, _ := z.TagName()
+			switch string(name) {
+			case "h1", "h2", "h3":
+				inHeading = false
+				archived = isArchiveFolder(heading.String())
+			case "a":
+				if !inLink {
+					continue
+				}
+				inLink = false
+				item++
+				staple, err := newImportedStaple(title.String(), href, added, archived)
+				if err == nil && archived && archiveAt != "" {
+					staple.ArchivedAt, err = parseUnixTime(archiveAt)
+				}
+				if err != nil {
+					importErrors = append(importErrors, ImportError{Item: item, Name: title.String(), Message: err.Error()})
+					continue
+				}
+				items = append(items, ImportItem{Item: item, Staple: staple})
+			}
+		}
+	}
+}
+
+// parseImportCSV parses Pocket and Instapaper CSV exports. Columns are found by their
+// header so both formats and their variations are supported.
+//
+//	Pocket:     title,url,time_added,tags,status
+//	Instapaper: URL,Title,Selection,Folder,Timestamp
+func parseImportCSV(data []byte) ([]ImportItem, []ImportError, error) {
+	r := csv.NewReader(bytes.NewReader(data))
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read csv header: %w", err)
+	}
+	columns := make(map[string]int, len(header))
+	for i, h := range header {
+		columns[strings.ToLower(strings.TrimSpace(h))] = i
+	}
+	if _, ok := columns["url"]; !ok {
+		return nil, nil, errors.New("csv has no url column")
+	}
+	field := func(record []string, names ...string) string {
+		for _, n := range names {
+			if i, ok := columns[n]; ok && i < len(record) {
+				return unescapeCSVCell(strings.TrimSpace(record[i]))
+			}
+		}
+		return ""
+	}
+
+	items := make([]ImportItem, 0)
+	importErrors := make([]ImportError, 0)
+	for item := 1; ; item++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			importErrors = append(importErrors, ImportError{Item: item, Message: err.Error()})
+			continue
+		}
+		title := field(record, "title")
+		archived := strings.EqualFold(field(record, "status"), "archive") || isArchiveFolder(field(record, "folder"))
+		staple, err := newImportedStaple(title, field(record, "url"), field(record, "time_added", "timestamp"), archived)
+		if archivedAt := field(record, "archived_at"); err == nil && archived && archivedAt != "" {
+			var t time.Time
+			if t, err = time.Parse(time.RFC3339, archivedAt); err != nil {
+				err = fmt.Errorf("invalid archive time %q", archivedAt)
+			} else {
+				t = t.UTC()
+				staple.ArchivedAt = &t
+			}
+		}
+		if err != nil {
+			importErrors = append(importErrors, ImportError{Item: item, Name: title, Message: err.Error()})
+			continue
+		}
+		if selection := field(record, "selection"); selection != "" {
+			staple.Content += "\n\n" + selection
+		}
+		items = append(items, ImportItem{Item: item, Staple: staple})
+	}
+	return items, importErrors, nil
+}
+
+// parseImportJSON parses the account export of Staple or a plain list of staples.
+func parseImportJSON(data []byte) ([]ImportItem, []ImportError, error) {
+	var list []models.Staple
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(trimmed, &list); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		var export struct {
+			Queue   []models.Staple `json:"queue"`
+			Archive []models.Staple `json:"archive"`
+		}
+		if err := json.Unmarshal(trimmed, &export); err != nil {
+			return nil, nil, err
+		}
+		for i := range export.Archive {
+			export.Archive[i].Archived = true
+		}
+		list = append(export.Queue, export.Archive...)
+	}
+
+	items := make([]ImportItem, 0, len(list))
+	importErrors := make([]ImportError, 0)
+	for i, s := range list {
+		if strings.TrimSpace(s.Name) == "" && strings.TrimSpace(s.Content) == "" {
+			importErrors = append(importErrors, ImportError{Item: i + 1, Message: "staple has neither name nor content"})
+			continue
+		}
+		if s.Name == "" {
+			s.Name = s.Content
+		}
+		s.ID = 0
+		s.Name = truncateName(s.Name)
+		items = append(items, ImportItem{Item: i + 1, Staple: s})
+	}
+	return items, importErrors, nil
+}
+
+// newImportedStaple creates a staple from a saved link. The link becomes the content
+// and the title the name. added is a unix timestamp in seconds.
+func newImportedStaple(title, link, added string, archived bool) (models.Staple, error) {
+	link = strings.TrimSpace(link)
+	if link == "" {
+		return models.Staple{}, errors.New("missing url")
+	}
+	title = strings.TrimSpace(title)
+	if title == "" {
+		title = link
+	}
+	staple := models.Staple{
+		Name:     truncateName(title),
+		Content:  link,
+		Archived: archived,
+	}
+	if added != "" {
+		t, err := parseUnixTime(added)
+		if err != nil {
+			return models.Staple{}, err
+		}
+		staple.CreatedAt = *t
+	}
+	return staple, nil
+}
+
+// parseUnixTime parses a unix timestamp in seconds.
+func parseUnixTime(s string) (*time.Time, error) {
+	seconds, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timestamp %q", s)
+	}
+	t := time.Unix(seconds, 0).UTC()
+	return &t, nil
+}
+
+func isArchiveFolder(name string) bool {
+	name = strings.ToLower(strings.TrimSpace(name))
+	return name == "archive" || name == "read archive"
+}
+
+func truncateName(name string) string {
+	if r := []rune(name); len(r) > maxStapleNameLength {
+		return string(r[:maxStapleNameLength])
+	}
+	return name
+}
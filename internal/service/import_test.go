@@ -0,0 +1,154 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/staple-org/staple/internal/models"
+	"github.com/staple-org/staple/internal/storage"
+)
+
+const netscapeBookmarks = `<!DOCTYPE NETSCAPE-Bookmark-file-1>
+<META HTTP-EQUIV="Content-Type" CONTENT="text/html; charset=UTF-8">
+<TITLE>Bookmarks</TITLE>
+<H1>Bookmarks</H1>
+<DL><p>
+    <DT><H3 ADD_DATE="1500000000">Reading</H3>
+    <DL><p>
+        <DT><A HREF="https://example.com/b" ADD_DATE="1500000200">Second &amp; newer</A>
+        <DT><A HREF="https://example.com/a" ADD_DATE="1500000100">First</A>
+        <DT><A ADD_DATE="1500000300">No link</A>
+    </DL><p>
+</DL><p>`
+
+const pocketHTML = `<!DOCTYPE html>
+<html><head><title>Pocket Export</title></head><body>
+<h1>Unread</h1>
+<ul>
+<li><a href="https://example.com/unread" time_added="1600000000" tags="">Unread article</a></li>
+</ul>
+<h1>Read Archive</h1>
+<ul>
+<li><a href="https://example.com/read" time_added="1500000000" tags="">Read article</a></li>
+</ul>
+</body></html>`
+
+const pocketCSV = `title,url,time_added,tags,status
+Unread article,https://example.com/unread,1600000000,,unread
+Read article,https://example.com/read,1500000000,,archive
+Broken,https://example.com/broken,yesterday,,unread
+`
+
+const instapaperCSV = `URL,Title,Selection,Folder,Timestamp
+https://example.com/unread,Unread article,A quote,Unread,1600000000
+https://example.com/read,Read article,,Archive,1500000000
+`
+
+const stapleJSON = `{"profile":{"id":"1"},"queue":[{"name":"Queued","id":3,"content":"text","created_at":"2020-01-01T00:00:00Z"}],"archive":[{"name":"Done","id":1,"content":"more","created_at":"2019-01-01T00:00:00Z","archived":true},{"id":2}]}`
+
+func TestParseImport(t *testing.T) {
+	items, errs, err := ParseImport(ImportAuto, []byte(netscapeBookmarks))
+	assert.NoError(t, err)
+	assert.Len(t, items, 2)
+	assert.Equal(t, "Second & newer", items[0].Staple.Name)
+	assert.Equal(t, "https://example.com/b", items[0].Staple.Content)
+	assert.Equal(t, time.Unix(1500000200, 0).UTC(), items[0].Staple.CreatedAt)
+	assert.False(t, items[0].Staple.Archived)
+	assert.Equal(t, []ImportError{{Item: 3, Name: "No link", Message: "missing url"}}, errs)
+
+	items, errs, err = ParseImport(ImportHTML, []byte(pocketHTML))
+	assert.NoError(t, err)
+	assert.Empty(t, errs)
+	assert.Len(t, items, 2)
+	assert.False(t, items[0].Staple.Archived)
+	assert.True(t, items[1].Staple.Archived)
+	assert.Equal(t, time.Unix(1500000000, 0).UTC(), items[1].Staple.CreatedAt)
+
+	items, errs, err = ParseImport(ImportAuto, []byte(pocketCSV))
+	assert.NoError(t, err)
+	assert.Len(t, items, 2)
+	assert.Equal(t, "Unread article", items[0].Staple.Name)
+	assert.False(t, items[0].Staple.Archived)
+	assert.True(t, items[1].Staple.Archived)
+	assert.Equal(t, []ImportError{{Item: 3, Name: "Broken", Message: `invalid timestamp "yesterday"`}}, errs)
+
+	items, errs, err = ParseImport(ImportCSV, []byte(instapaperCSV))
+	assert.NoError(t, err)
+	assert.Empty(t, errs)
+	assert.Len(t, items, 2)
+	assert.Equal(t, "https://example.com/unread\n\nA quote", items[0].Staple.Content)
+	assert.False(t, items[0].Staple.Archived)
+	assert.True(t, items[1].Staple.Archived)
+
+	items, errs, err = ParseImport(ImportAuto, []byte(stapleJSON))
+	assert.NoError(t, err)
+	assert.Len(t, items, 2)
+	assert.Equal(t, "Queued", items[0].Staple.Name)
+	assert.Equal(t, 0, items[0].Staple.ID)
+	assert.True(t, items[1].Staple.Archived)
+	assert.Equal(t, []ImportError{{Item: 3, Message: "staple has neither name nor content"}}, errs)
+
+	_, _, err = ParseImport(ImportCSV, []byte("name,link\nfoo,bar\n"))
+	assert.EqualError(t, err, "csv has no url column")
+	_, _, err = ParseImport("xml", nil)
+	assert.EqualError(t, err, `unsupported import format "xml"`)
+}
+
+func waitForImport(t *testing.T, importer *Importer, user models.User, id string) ImportJob {
+	var job ImportJob
+	assert.Eventually(t, func() bool {
+		var ok bool
+		job, ok = importer.Job(user, id)
+		return ok && job.Status != ImportRunning
+	}, time.Second, 5*time.Millisecond)
+	return job
+}
+
+func TestImporter_Overflow(t *testing.T) {
+	const bookmarks = `<DL>
+<DT><A HREF="https://example.com/3" ADD_DATE="1500000300">Third</A>
+<DT><A HREF="https://example.com/1" ADD_DATE="1500000100">First</A>
+<DT><A HREF="https://example.com/2" ADD_DATE="1500000200">Second</A>
+</DL>`
+	u := models.User{ID: "user-1", MaxStaples: 2}
+
+	store := storage.NewInMemoryStapleStorer()
+	stapler := NewStapler(store)
+	importer := NewImporter(stapler)
+	job, err := importer.Start(u, ImportAuto, []byte(bookmarks), OverflowArchive)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, job.Total)
+	job = waitForImport(t, importer, u, job.ID)
+	assert.Equal(t, ImportDone, job.Status)
+	assert.Equal(t, 3, job.Processed)
+	assert.Equal(t, 2, job.Queued)
+	assert.Equal(t, 1, job.Archived)
+	assert.Empty(t, job.Errors)
+	// the oldest items make it into the queue in the order they were saved
+	next, err := stapler.GetNext(&u)
+	assert.NoError(t, err)
+	assert.Equal(t, "First", next.Name)
+	archive, err := stapler.ShowArchive(&u)
+	assert.NoError(t, err)
+	assert.Len(t, archive, 1)
+	assert.Equal(t, "Third", archive[0].Name)
+	assert.Equal(t, time.Unix(1500000300, 0).UTC(), *archive[0].ArchivedAt)
+
+	// other users can't see the job
+	_, ok := importer.Job(models.User{ID: "user-2"}, job.ID)
+	assert.False(t, ok)
+
+	stapler = NewStapler(storage.NewInMemoryStapleStorer())
+	importer = NewImporter(stapler)
+	job, err = importer.Start(u, ImportHTML, []byte(bookmarks), OverflowReport)
+	assert.NoError(t, err)
+	job = waitForImport(t, importer, u, job.ID)
+	assert.Equal(t, 2, job.Queued)
+	assert.Equal(t, 0, job.Archived)
+	assert.Equal(t, []ImportError{{Item: 1, Name: "Third", Message: "queue is full"}}, job.Errors)
+
+	_, err = importer.Start(u, ImportHTML, []byte(bookmarks), "drop")
+	assert.EqualError(t, err, "unknown overflow policy: drop")
+}
@@ -0,0 +1,178 @@
+package service
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/charset"
+
+	"github.com/staple-org/staple/internal/models"
+)
+
+// maxInboundParts limits the number of MIME parts which are looked at.
+const maxInboundParts = 50
+
+// inboundURL matches the first http or https URL in a text body.
+var inboundURL = regexp.MustCompile(`https?://[^\s<>"'()\[\]]+`)
+
+// ParseInboundMail creates a staple from a mail sent to an inbox address. The subject
+// becomes the name. The content is the first URL of the body, or the text body if it
+// doesn't contain one. HTML bodies are only used if there is no plain text alternative.
+func ParseInboundMail(r io.Reader, now time.Time) (models.Staple, error) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return models.Staple{}, err
+	}
+	dec := mime.WordDecoder{CharsetReader: charset.NewReaderLabel}
+	subject, err := dec.DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		subject = msg.Header.Get("Subject")
+	}
+	subject = strings.TrimSpace(subject)
+
+	text, htmlBody, err := readMailBody(msg.Header, msg.Body, 0)
+	if err != nil {
+		return models.Staple{}, err
+	}
+	links := []string(nil)
+	if text == "" && htmlBody != "" {
+		text, links = htmlText(htmlBody)
+	}
+	content := inboundURL.FindString(text)
+	if content == "" && len(links) > 0 {
+		content = links[0]
+	}
+	content = strings.TrimRight(content, ".,;:!?")
+	if content == "" {
+		content = strings.TrimSpace(text)
+	}
+	if subject == "" && content == "" {
+		return models.Staple{}, errors.New("mail has neither subject nor body")
+	}
+	name := subject
+	if name == "" {
+		name = strings.SplitN(content, "\n", 2)[0]
+	}
+	return models.Staple{
+		Name:      truncateName(name),
+		Content:   content,
+		CreatedAt: now,
+	}, nil
+}
+
+// mailHeader is the part of a MIME header readMailBody needs.
+type mailHeader interface {
+	Get(key string) string
+}
+
+// readMailBody returns the first text/plain and the first text/html body of a message,
+// descending into multipart bodies.
+func readMailBody(header mailHeader, body io.Reader, parts int) (text string, htmlBody string, err error) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", map[string]string{}
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for parts < maxInboundParts {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return text, htmlBody, err
+			}
+			parts++
+			if strings.HasPrefix(strings.ToLower(part.Header.Get("Content-Disposition")), "attachment") {
+				continue
+			}
+			t, h, err := readMailBody(part.Header, part, parts)
+			if err != nil {
+				return text, htmlBody, err
+			}
+			if text == "" {
+				text = t
+			}
+			if htmlBody == "" {
+				htmlBody = h
+			}
+		}
+		return text, htmlBody, nil
+	}
+	if mediaType != "text/plain" && mediaType != "text/html" {
+		return "", "", nil
+	}
+
+	switch strings.ToLower(strings.TrimSpace(header.Get("Content-Transfer-Encoding"))) {
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	}
+	if cs := params["charset"]; cs != "" {
+		if decoded, err := charset.NewReaderLabel(cs, body); err == nil {
+			body = decoded
+		}
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return "", "", err
+	}
+	if mediaType == "text/html" {
+		return "", string(data), nil
+	}
+	return strings.TrimSpace(string(data)), "", nil
+}
+
+// htmlText extracts the text and the links of an HTML body.
+func htmlText(body string) (string, []string) {
+	var (
+		text  strings.Builder
+		links []string
+		skip  int
+	)
+	z := html.NewTokenizer(strings.NewReader(body))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return strings.TrimSpace(text.String()), links
+		case html.StartTagToken:
+			name, hasAttr := z.TagName()
+			switch string(name) {
+			case "script", "style":
+				skip++
+			case "a":
+				for hasAttr {
+					var key, val []byte
+					key, val, hasAttr = z.TagAttr()
+					if string(key) == "href" && inboundURL.Match(val) {
+						links = append(links, string(val))
+					}
+				}
+			case "br", "p", "div":
+				text.WriteString("\n")
+			}
+		case html.EndTagToken:
+			name, _ := z.TagName()
+			if s := string(name); (s == "script" || s == "style") && skip > 0 {
+				skip--
+			}
+		case html.TextToken:
+			if skip == 0 {
+				text.Write(bytes.TrimSpace(z.Text()))
+				text.WriteString(" ")
+			}
+		}
+	}
+}
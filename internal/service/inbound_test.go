@@ -0,0 +1,62 @@
+package service
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseInboundMail(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, tc := range []struct {
+		name    string
+		mail    string
+		want    string
+		content string
+	}{
+		{
+			name: "plain text with url",
+			mail: "From: me@example.com\r\nSubject: Read later\r\n\r\nHave a look at https://example.com/article.\r\n",
+			want: "Read later", content: "https://example.com/article",
+		},
+		{
+			name: "plain text without url",
+			mail: "Subject: Note\r\n\r\nBuy milk\r\n",
+			want: "Note", content: "Buy milk",
+		},
+		{
+			name: "multipart alternative",
+			mail: "Subject: =?UTF-8?B?R3LDvMOfZQ==?=\r\n" +
+				"MIME-Version: 1.0\r\n" +
+				"Content-Type: multipart/alternative; boundary=b\r\n\r\n" +
+				"--b\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n" +
+				"Gr=C3=BC=C3=9Fe, see https://example.com/a=3Db\r\n" +
+				"--b\r\nContent-Type: text/html\r\n\r\n<a href=\"https://example.com/html\">link</a>\r\n" +
+				"--b--\r\n",
+			want: "Grüße", content: "https://example.com/a=b",
+		},
+		{
+			name: "html only",
+			mail: "Subject: Html\r\nContent-Type: text/html\r\n\r\n<p>Click <a href=\"https://example.com/html\">here</a></p>\r\n",
+			want: "Html", content: "https://example.com/html",
+		},
+		{
+			name: "no subject",
+			mail: "Content-Type: text/plain\r\n\r\nhttps://example.com/only\r\n",
+			want: "https://example.com/only", content: "https://example.com/only",
+		},
+	} {
+		t.Run(tc.name, func(tt *testing.T) {
+			staple, err := ParseInboundMail(strings.NewReader(tc.mail), now)
+			assert.NoError(tt, err)
+			assert.Equal(tt, tc.want, staple.Name)
+			assert.Equal(tt, tc.content, staple.Content)
+			assert.Equal(tt, now, staple.CreatedAt)
+		})
+	}
+
+	_, err := ParseInboundMail(strings.NewReader("Subject: \r\n\r\n"), now)
+	assert.Error(t, err)
+}
@@ -0,0 +1,267 @@
+package service
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"io/fs"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/staple-org/staple/internal/i18n"
+	"github.com/staple-org/staple/internal/storage"
+)
+
+//go:embed mail_templates
+var embeddedMailTemplates embed.FS
+
+// mailTemplateNames maps events to the names of their template files. Every event has a
+// <name>.txt template which defines "subject" and renders the text body, and a <name>.html
+// template which renders the HTML body with the "header" and "footer" of layout.html.
+var mailTemplateNames = map[Event]string{
+	Welcome:                  "welcome",
+	PasswordReset:            "password-reset",
+	GenerateConfirmCode:      "confirm-code",
+	AccountLocked:            "account-locked",
+	NewLogin:                 "new-login",
+	ConfirmEmailChange:       "confirm-email-change",
+	EmailChangeRequested:     "email-change-requested",
+	AccountDeletionScheduled: "account-deletion-scheduled",
+	AccountDeleted:           "account-deleted",
+	QueueDigest:              "queue-digest",
+	ReadingReminder:          "reading-reminder",
+}
+
+// Mail is a rendered notification.
+type Mail struct {
+	Event   Event
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+	// Locale is the language the mail was rendered in.
+	Locale string
+}
+
+// MailData is what the templates are rendered with.
+type MailData struct {
+	Email   string
+	Payload string
+	// Subject is the rendered subject. It is empty while the subject itself is rendered.
+	Subject string
+}
+
+type mailTemplate struct {
+	text *texttemplate.Template
+	html *htmltemplate.Template
+}
+
+// MailRenderer renders the notifications of every Notifier from the templates embedded in
+// the binary. Templates in an override directory take precedence over the embedded ones
+// with the same file name. Translated templates are in a directory named after their
+// locale, such as de/welcome.txt; files which aren't translated are taken in English.
+type MailRenderer struct {
+	// templates maps locales to the templates of every event.
+	templates map[string]map[Event]mailTemplate
+	// users looks up the locale of the recipients. Without it every mail is in English.
+	users storage.UserStorer
+}
+
+// defaultMailRenderer uses the embedded templates only.
+var defaultMailRenderer = mustMailRenderer(NewMailRenderer(""))
+
+func mustMailRenderer(r MailRenderer, err error) MailRenderer {
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// NewMailRenderer parses the templates of every event in every locale. Files in dir replace
+// the embedded files of the same name; dir may be empty.
+func NewMailRenderer(dir string) (MailRenderer, error) {
+	readFile := func(name string) ([]byte, error) {
+		if dir != "" {
+			data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+			if err == nil {
+				return data, nil
+			}
+			if !errors.Is(err, fs.ErrNotExist) {
+				return nil, err
+			}
+		}
+		return embeddedMailTemplates.ReadFile("mail_templates/" + name)
+	}
+	r := MailRenderer{templates: make(map[string]map[Event]mailTemplate)}
+	for _, locale := range i18n.Locales() {
+		read := readFile
+		if locale != i18n.Default {
+			read = func(name string) ([]byte, error) {
+				data, err := readFile(locale + "/" + name)
+				if errors.Is(err, fs.ErrNotExist) {
+					return readFile(name)
+				}
+				return data, err
+			}
+		}
+		templates, err := parseMailTemplates(read)
+		if err != nil && locale != i18n.Default {
+			return MailRenderer{}, fmt.Errorf("%s templates: %w", locale, err)
+		}
+		if err != nil {
+			return MailRenderer{}, err
+		}
+		r.templates[locale] = templates
+	}
+	return r, nil
+}
+
+// parseMailTemplates parses the templates of every event with the files returned by read.
+func parseMailTemplates(read func(name string) ([]byte, error)) (map[Event]mailTemplate, error) {
+	layout, err := read("layout.html")
+	if err != nil {
+		return nil, err
+	}
+	templates := make(map[Event]mailTemplate, len(mailTemplateNames))
+	for event, name := range mailTemplateNames {
+		text, err := read(name + ".txt")
+		if err != nil {
+			return nil, err
+		}
+		t, err := texttemplate.New(name + ".txt").Option("missingkey=error").Parse(string(text))
+		if err != nil {
+			return nil, err
+		}
+		if t.Lookup("subject") == nil {
+			return nil, fmt.Errorf("%s.txt doesn't define a subject", name)
+		}
+		html, err := read(name + ".html")
+		if err != nil {
+			return nil, err
+		}
+		h, err := htmltemplate.New(name + ".html").Option("missingkey=error").Parse(string(layout))
+		if err != nil {
+			return nil, err
+		}
+		if _, err := h.Parse(string(html)); err != nil {
+			return nil, err
+		}
+		templates[event] = mailTemplate{text: t, html: h}
+	}
+	return templates, nil
+}
+
+// WithUsers returns a copy of the renderer which renders mails in the locale of the user
+// with the recipient address.
+func (r MailRenderer) WithUsers(users storage.UserStorer) MailRenderer {
+	r.users = users
+	return r
+}
+
+// Render renders the notification of an event for the given address in the locale of its
+// user. Addresses which don't belong to a user, such as a new address which is still to be
+// confirmed, get English mails.
+func (r MailRenderer) Render(email string, event Event, payload string) (Mail, error) {
+	locale := i18n.Default
+	if r.users != nil {
+		user, err := r.users.GetByEmail(email)
+		if err != nil {
+			return Mail{}, err
+		}
+		if user != nil && user.Locale != "" {
+			locale = user.Locale
+		}
+	}
+	return r.RenderLocale(locale, email, event, payload)
+}
+
+// RenderLocale renders the notification of an event for the given address in a locale.
+// Unsupported locales are rendered in English.
+func (r MailRenderer) RenderLocale(locale string, email string, event Event, payload string) (Mail, error) {
+	locale, ok := i18n.Supported(locale)
+	if !ok {
+		locale = i18n.Default
+	}
+	tmpl, ok := r.templates[locale][event]
+	if !ok {
+		return Mail{}, fmt.Errorf("no mail template for event %q", event)
+	}
+	data := MailData{Email: email, Payload: payload}
+	var subject, text, html bytes.Buffer
+	if err := tmpl.text.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return Mail{}, err
+	}
+	// Subjects are a single line.
+	data.Subject = strings.Join(strings.Fields(subject.String()), " ")
+	if err := tmpl.text.Execute(&text, data); err != nil {
+		return Mail{}, err
+	}
+	if err := tmpl.html.Execute(&html, data); err != nil {
+		return Mail{}, err
+	}
+	return Mail{
+		Event:   event,
+		To:      email,
+		Subject: data.Subject,
+		Text:    strings.TrimRight(text.String(), " \r\n"),
+		HTML:    html.String(),
+		Locale:  locale,
+	}, nil
+}
+
+// WriteMessage writes the mail as a multipart/alternative message with a text and an HTML
+// part, ready to be sent over SMTP.
+func (m Mail) WriteMessage(w io.Writer, from string, date time.Time) error {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	header := func(key, value string) {
+		fmt.Fprintf(&buf, "%s: %s\r\n", key, value)
+	}
+	header("From", from)
+	header("To", m.To)
+	header("Subject", mime.QEncoding.Encode("utf-8", m.Subject))
+	header("Date", date.Format(time.RFC1123Z))
+	if m.Locale != "" {
+		header("Content-Language", m.Locale)
+	}
+	header("MIME-Version", "1.0")
+	header("Content-Type", "multipart/alternative; boundary="+mw.Boundary())
+	buf.WriteString("\r\n")
+	for _, part := range []struct {
+		contentType string
+		body        string
+	}{
+		{"text/plain; charset=utf-8", m.Text},
+		{"text/html; charset=utf-8", m.HTML},
+	} {
+		pw, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return err
+		}
+		qw := quotedprintable.NewWriter(pw)
+		if _, err := qw.Write([]byte(part.body)); err != nil {
+			return err
+		}
+		if err := qw.Close(); err != nil {
+			return err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return err
+	}
+	_, err := buf.WriteTo(w)
+	return err
+}
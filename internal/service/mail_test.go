@@ -0,0 +1,192 @@
+package service
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/staple-org/staple/internal/i18n"
+	"github.com/staple-org/staple/internal/storage"
+)
+
+func TestMailRenderer_Render(t *testing.T) {
+	for event := range mailTemplateNames {
+		m, err := defaultMailRenderer.Render("test@test.com", event, "<payload>")
+		require.NoError(t, err, event)
+		assert.NotEmpty(t, m.Subject, event)
+		assert.Contains(t, m.Text, "Dear test@test.com", event)
+		assert.Contains(t, m.HTML, "<title>"+m.Subject+"</title>", event)
+		assert.NotContains(t, m.HTML, "<payload>", event)
+	}
+
+	m, err := defaultMailRenderer.Render("test@test.com", PasswordReset, "secret")
+	require.NoError(t, err)
+	assert.Equal(t, "Your Staple password has been reset", m.Subject)
+	assert.Equal(t, `Dear test@test.com
+Your password has been successfully reset to: secret. Please change as soon as possible.`, m.Text)
+	assert.Contains(t, m.HTML, "secret")
+
+	_, err = defaultMailRenderer.Render("test@test.com", Event("Unknown"), "")
+	assert.EqualError(t, err, `no mail template for event "Unknown"`)
+}
+
+func TestMailRenderer_Locales(t *testing.T) {
+	for event := range mailTemplateNames {
+		m, err := defaultMailRenderer.RenderLocale("de", "test@test.com", event, "<payload>")
+		require.NoError(t, err, event)
+		assert.Equal(t, "de", m.Locale, event)
+		assert.Contains(t, m.Text, "Hallo test@test.com", event)
+		assert.Contains(t, m.HTML, `<html lang="de">`, event)
+	}
+
+	users := storage.NewInMemoryUserStorer()
+	require.NoError(t, users.Create("test@test.com", []byte("password")))
+	user, err := users.GetByEmail("test@test.com")
+	require.NoError(t, err)
+	user.Locale = "de"
+	require.NoError(t, users.Update(user.ID, *user))
+	r := defaultMailRenderer.WithUsers(users)
+
+	m, err := r.Render("test@test.com", Welcome, "")
+	require.NoError(t, err)
+	assert.Equal(t, "Willkommen bei Staple", m.Subject)
+	// Unknown addresses and locales fall back to English.
+	m, err = r.Render("new@test.com", ConfirmEmailChange, "12345")
+	require.NoError(t, err)
+	assert.Equal(t, "Confirm your new email address", m.Subject)
+	m, err = r.RenderLocale("fr", "test@test.com", Welcome, "")
+	require.NoError(t, err)
+	assert.Equal(t, "en", m.Locale)
+
+	// Translations can be overridden like the English templates.
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "de"), 0o700))
+	err = os.WriteFile(filepath.Join(dir, "de", "welcome.txt"), []byte(`{{define "subject"}}Servus{{end}}Willkommen!`), 0o600)
+	require.NoError(t, err)
+	r, err = NewMailRenderer(dir)
+	require.NoError(t, err)
+	m, err = r.RenderLocale("de", "test@test.com", Welcome, "")
+	require.NoError(t, err)
+	assert.Equal(t, "Servus", m.Subject)
+	m, err = r.RenderLocale("de", "test@test.com", AccountDeleted, "")
+	require.NoError(t, err)
+	assert.Equal(t, "Dein Staple-Konto wurde gelöscht", m.Subject)
+
+	var buf bytes.Buffer
+	require.NoError(t, m.WriteMessage(&buf, "no-reply@staple.test", time.Now()))
+	msg, err := mail.ReadMessage(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, "de", msg.Header.Get("Content-Language"))
+}
+
+// TestMailTemplates_Translated makes sure no template silently falls back to English.
+func TestMailTemplates_Translated(t *testing.T) {
+	for _, locale := range i18n.Locales() {
+		if locale == i18n.Default {
+			continue
+		}
+		files := []string{"layout.html"}
+		for _, name := range mailTemplateNames {
+			files = append(files, name+".txt", name+".html")
+		}
+		for _, file := range files {
+			_, err := embeddedMailTemplates.ReadFile("mail_templates/" + locale + "/" + file)
+			assert.NoError(t, err, locale+"/"+file)
+		}
+	}
+}
+
+func TestMailRenderer_Override(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "welcome.txt"), []byte(`{{define "subject"}}Hello {{.Email}}{{end}}Welcome aboard!`), 0o600)
+	require.NoError(t, err)
+
+	r, err := NewMailRenderer(dir)
+	require.NoError(t, err)
+	m, err := r.Render("test@test.com", Welcome, "")
+	require.NoError(t, err)
+	assert.Equal(t, "Hello test@test.com", m.Subject)
+	assert.Equal(t, "Welcome aboard!", m.Text)
+	// The HTML isn't overridden.
+	assert.Contains(t, m.HTML, "Thank you for signing up to Staple.")
+
+	// Other events keep the embedded templates.
+	m, err = r.Render("test@test.com", AccountDeleted, "")
+	require.NoError(t, err)
+	assert.Equal(t, "Your Staple account has been deleted", m.Subject)
+
+	err = os.WriteFile(filepath.Join(dir, "welcome.txt"), []byte(`Welcome aboard!`), 0o600)
+	require.NoError(t, err)
+	_, err = NewMailRenderer(dir)
+	assert.EqualError(t, err, "welcome.txt doesn't define a subject")
+
+	err = os.WriteFile(filepath.Join(dir, "welcome.txt"), []byte(`{{define "subject"}}{{end}}{{.Email`), 0o600)
+	require.NoError(t, err)
+	_, err = NewMailRenderer(dir)
+	assert.Error(t, err)
+}
+
+func TestMail_WriteMessage(t *testing.T) {
+	m, err := defaultMailRenderer.Render("test@test.com", ConfirmEmailChange, "12345")
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	date := time.Date(2020, 2, 13, 19, 7, 13, 0, time.UTC)
+	err = m.WriteMessage(&buf, "no-reply@staple.test", date)
+	require.NoError(t, err)
+
+	msg, err := mail.ReadMessage(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, "no-reply@staple.test", msg.Header.Get("From"))
+	assert.Equal(t, "test@test.com", msg.Header.Get("To"))
+	assert.Equal(t, "Confirm your new email address", msg.Header.Get("Subject"))
+	sent, err := msg.Header.Date()
+	require.NoError(t, err)
+	assert.True(t, date.Equal(sent))
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	require.NoError(t, err)
+	assert.Equal(t, "multipart/alternative", mediaType)
+
+	parts := map[string]string{}
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		contentType, _, err := mime.ParseMediaType(p.Header.Get("Content-Type"))
+		require.NoError(t, err)
+		body, err := io.ReadAll(quotedprintable.NewReader(p))
+		require.NoError(t, err)
+		parts[contentType] = strings.ReplaceAll(string(body), "\r\n", "\n")
+	}
+	assert.Equal(t, m.Text, parts["text/plain"])
+	assert.Equal(t, strings.TrimSpace(m.HTML), strings.TrimSpace(parts["text/html"]))
+}
+
+func TestBufferNotifier(t *testing.T) {
+	notifier := NewBufferNotifier()
+	assert.NoError(t, notifier.Notify("test@test.com", Welcome, ""))
+	assert.NoError(t, notifier.Notify("test@test.com", GenerateConfirmCode, "11111"))
+	assert.NoError(t, notifier.Notify("test@test.com", GenerateConfirmCode, "22222"))
+	assert.Error(t, notifier.Notify("test@test.com", Event("Unknown"), ""))
+
+	assert.Len(t, notifier.Mails(), 3)
+	assert.Equal(t, Welcome, notifier.Mails()[0].Event)
+	assert.Contains(t, notifier.Last(GenerateConfirmCode).Text, "22222")
+	assert.Contains(t, notifier.Text(), "Thank you for signing up to Staple.")
+	assert.Equal(t, Mail{}, notifier.Last(AccountDeleted))
+}
@@ -0,0 +1,265 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/staple-org/staple/internal/models"
+	"github.com/staple-org/staple/internal/storage"
+)
+
+// ChannelEmail is the channel which sends notifications by email. Every user has it.
+const ChannelEmail = "email"
+
+// ErrInvalidNotificationPreferences is returned when notification preferences can't be saved.
+var ErrInvalidNotificationPreferences = errors.New("invalid notification preferences")
+
+// preferenceEvents are the events users have preferences for, in the order they are listed.
+var preferenceEvents = []Event{
+	Welcome,
+	QueueDigest,
+	ReadingReminder,
+	AccountLocked,
+	NewLogin,
+	EmailChangeRequested,
+	AccountDeletionScheduled,
+	AccountDeleted,
+	PasswordReset,
+	GenerateConfirmCode,
+	ConfirmEmailChange,
+}
+
+// securityEvents can't be turned off. They are always sent by email right away, and
+// possibly through further channels.
+var securityEvents = map[Event]bool{
+	AccountLocked:            true,
+	NewLogin:                 true,
+	EmailChangeRequested:     true,
+	AccountDeletionScheduled: true,
+	AccountDeleted:           true,
+	PasswordReset:            true,
+	GenerateConfirmCode:      true,
+	ConfirmEmailChange:       true,
+}
+
+// secretEvents carry codes or passwords, so they are only ever sent by email.
+var secretEvents = map[Event]bool{
+	PasswordReset:       true,
+	GenerateConfirmCode: true,
+	ConfirmEmailChange:  true,
+}
+
+// ChannelNotifier sends notifications through named channels.
+type ChannelNotifier interface {
+	NotifyChannel(channel string, email string, event Event, payload string) error
+}
+
+// Channels sends notifications right away with the Notifier of their channel.
+type Channels map[string]Notifier
+
+// NotifyChannel sends a notification with the notifier of the named channel.
+func (c Channels) NotifyChannel(channel string, email string, event Event, payload string) error {
+	notifier, ok := c[channel]
+	if !ok {
+		return fmt.Errorf("unknown notification channel %q", channel)
+	}
+	return notifier.Notify(email, event, payload)
+}
+
+// NotificationDispatcher is a Notifier which routes every event to the channels the user
+// enabled for it. Users without preferences for an event get it by email right away.
+type NotificationDispatcher struct {
+	store  storage.NotificationPreferenceStorer
+	users  storage.UserStorer
+	sender ChannelNotifier
+	// channels are the names of the channels users can choose from.
+	channels []string
+	clock    Clock
+}
+
+// NewNotificationDispatcher creates a dispatcher which sends through sender. Users can
+// choose from email and the given channels.
+func NewNotificationDispatcher(store storage.NotificationPreferenceStorer, users storage.UserStorer, sender ChannelNotifier, channels ...string) NotificationDispatcher {
+	names := []string{ChannelEmail}
+	for _, c := range channels {
+		if c != ChannelEmail {
+			names = append(names, c)
+		}
+	}
+	return NotificationDispatcher{store: store, users: users, sender: sender, channels: names, clock: time.Now}
+}
+
+// WithClock returns a copy of the dispatcher which uses the given clock.
+func (d NotificationDispatcher) WithClock(clock Clock) NotificationDispatcher {
+	d.clock = clock
+	return d
+}
+
+// Channels returns the names of the channels users can choose from.
+func (d NotificationDispatcher) Channels() []string {
+	return append([]string(nil), d.channels...)
+}
+
+// Notify sends the notification through the channels the user enabled for the event.
+func (d NotificationDispatcher) Notify(email string, event Event, payload string) error {
+	if secretEvents[event] {
+		return d.sender.NotifyChannel(ChannelEmail, email, event, payload)
+	}
+	pref := defaultPreference(event)
+	user, err := d.users.GetByEmail(email)
+	if err != nil {
+		return err
+	}
+	if user != nil {
+		stored, err := d.store.List(user.ID)
+		if err != nil {
+			return err
+		}
+		for _, p := range stored {
+			if p.Event == pref.Event {
+				pref = enforcePreference(event, p)
+			}
+		}
+	}
+	now := d.clock().UTC()
+	switch pref.Frequency {
+	case models.NotifyOff:
+		return nil
+	case models.NotifyAtMostDaily:
+		if pref.LastSentAt != nil && now.Sub(*pref.LastSentAt) < 24*time.Hour {
+			return nil
+		}
+	}
+	for _, channel := range pref.Channels {
+		// Channels which were configured once but aren't anymore are skipped.
+		if !d.hasChannel(channel) {
+			continue
+		}
+		if err := d.sender.NotifyChannel(channel, email, event, payload); err != nil {
+			return err
+		}
+	}
+	if user != nil && pref.Frequency == models.NotifyAtMostDaily {
+		return d.store.MarkSent(user.ID, pref.Event, now)
+	}
+	return nil
+}
+
+// Preferences returns the notification preferences of a user for every event.
+func (d NotificationDispatcher) Preferences(user models.User) ([]models.NotificationPreference, error) {
+	stored, err := d.store.List(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	byEvent := make(map[string]models.NotificationPreference, len(stored))
+	for _, p := range stored {
+		byEvent[p.Event] = p
+	}
+	prefs := make([]models.NotificationPreference, 0, len(preferenceEvents))
+	for _, event := range preferenceEvents {
+		pref := defaultPreference(event)
+		if p, ok := byEvent[pref.Event]; ok {
+			pref = enforcePreference(event, p)
+		}
+		pref.UserID = user.ID
+		prefs = append(prefs, pref)
+	}
+	return prefs, nil
+}
+
+// UpdatePreferences validates and saves the given preferences of a user. Events which
+// aren't given keep their preferences.
+func (d NotificationDispatcher) UpdatePreferences(user models.User, prefs []models.NotificationPreference) ([]models.NotificationPreference, error) {
+	valid := make([]models.NotificationPreference, 0, len(prefs))
+	for _, pref := range prefs {
+		event, ok := eventByKey(pref.Event)
+		if !ok {
+			return nil, fmt.Errorf("%w: unknown event %q", ErrInvalidNotificationPreferences, pref.Event)
+		}
+		if pref.Frequency == "" {
+			pref.Frequency = models.NotifyImmediately
+		}
+		switch pref.Frequency {
+		case models.NotifyImmediately, models.NotifyAtMostDaily, models.NotifyOff:
+		default:
+			return nil, fmt.Errorf("%w: frequency must be immediate, at-most-daily or off", ErrInvalidNotificationPreferences)
+		}
+		channels := make([]string, 0, len(pref.Channels))
+		seen := make(map[string]bool, len(pref.Channels))
+		for _, c := range pref.Channels {
+			if !d.hasChannel(c) {
+				return nil, fmt.Errorf("%w: unknown channel %q", ErrInvalidNotificationPreferences, c)
+			}
+			if !seen[c] {
+				seen[c] = true
+				channels = append(channels, c)
+			}
+		}
+		if len(channels) == 0 && pref.Frequency != models.NotifyOff {
+			return nil, fmt.Errorf("%w: %s needs at least one channel", ErrInvalidNotificationPreferences, pref.Event)
+		}
+		if secretEvents[event] && (len(channels) != 1 || !seen[ChannelEmail] || pref.Frequency != models.NotifyImmediately) {
+			return nil, fmt.Errorf("%w: %s is only sent by email", ErrInvalidNotificationPreferences, pref.Event)
+		}
+		if securityEvents[event] && (!seen[ChannelEmail] || pref.Frequency != models.NotifyImmediately) {
+			return nil, fmt.Errorf("%w: %s can't be turned off", ErrInvalidNotificationPreferences, pref.Event)
+		}
+		valid = append(valid, models.NotificationPreference{
+			UserID:    user.ID,
+			Event:     pref.Event,
+			Channels:  channels,
+			Frequency: pref.Frequency,
+		})
+	}
+	if err := d.store.Save(user.ID, valid); err != nil {
+		return nil, err
+	}
+	return d.Preferences(user)
+}
+
+func (d NotificationDispatcher) hasChannel(name string) bool {
+	for _, c := range d.channels {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultPreference sends an event by email right away.
+func defaultPreference(event Event) models.NotificationPreference {
+	return models.NotificationPreference{
+		Event:     mailTemplateNames[event],
+		Channels:  []string{ChannelEmail},
+		Frequency: models.NotifyImmediately,
+		Required:  securityEvents[event],
+	}
+}
+
+// enforcePreference makes sure a stored preference of a security event still sends it by
+// email right away.
+func enforcePreference(event Event, pref models.NotificationPreference) models.NotificationPreference {
+	if !securityEvents[event] {
+		return pref
+	}
+	pref.Required = true
+	pref.Frequency = models.NotifyImmediately
+	for _, c := range pref.Channels {
+		if c == ChannelEmail {
+			return pref
+		}
+	}
+	pref.Channels = append([]string{ChannelEmail}, pref.Channels...)
+	return pref
+}
+
+// eventByKey returns the event of a key such as queue-digest.
+func eventByKey(key string) (Event, bool) {
+	for _, event := range preferenceEvents {
+		if mailTemplateNames[event] == key {
+			return event, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,90 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/staple-org/staple/internal/models"
+	"github.com/staple-org/staple/internal/storage"
+)
+
+func TestNotificationDispatcher(t *testing.T) {
+	now := time.Date(2020, 2, 13, 19, 7, 13, 0, time.UTC)
+	clock := func() time.Time { return now }
+	email, chat := NewBufferNotifier(), NewBufferNotifier()
+	userStore := storage.NewInMemoryUserStorer()
+	dispatcher := NewNotificationDispatcher(storage.NewInMemoryNotificationPreferenceStorer(), userStore, Channels{ChannelEmail: email, "chat": chat}, "chat").WithClock(clock)
+	users := NewUserHandler(context.Background(), userStore, dispatcher)
+	user := models.User{Email: "test@test.com", Password: "password123", MaxStaples: 25}
+	require.NoError(t, users.Register(user))
+	var err error
+	user.ID, err = users.UserID(user)
+	require.NoError(t, err)
+
+	// Without preferences everything is sent by email.
+	require.NoError(t, dispatcher.Notify(user.Email, ReadingReminder, "3"))
+	assert.Len(t, email.Mails(), 2)
+	assert.Empty(t, chat.Mails())
+
+	prefs, err := dispatcher.UpdatePreferences(user, []models.NotificationPreference{
+		{Event: "reading-reminder", Channels: []string{"chat"}, Frequency: models.NotifyAtMostDaily},
+		{Event: "queue-digest", Frequency: models.NotifyOff},
+		{Event: "account-locked", Channels: []string{"email", "chat", "chat"}},
+	})
+	require.NoError(t, err)
+	require.Len(t, prefs, len(preferenceEvents))
+	assert.Equal(t, models.NotificationPreference{UserID: user.ID, Event: "welcome", Channels: []string{ChannelEmail}, Frequency: models.NotifyImmediately}, prefs[0])
+	assert.Equal(t, models.NotifyOff, prefs[1].Frequency)
+	assert.Equal(t, []string{"chat"}, prefs[2].Channels)
+	assert.Equal(t, []string{"email", "chat"}, prefs[3].Channels)
+	assert.True(t, prefs[3].Required)
+
+	// At most daily events are sent once a day, further ones are dropped, and they only go
+	// through the chosen channels.
+	require.NoError(t, dispatcher.Notify(user.Email, ReadingReminder, "3"))
+	require.NoError(t, dispatcher.Notify(user.Email, ReadingReminder, "3"))
+	assert.Len(t, chat.Mails(), 1)
+	now = now.Add(24 * time.Hour)
+	require.NoError(t, dispatcher.Notify(user.Email, ReadingReminder, "4"))
+	assert.Len(t, chat.Mails(), 2)
+
+	require.NoError(t, dispatcher.Notify(user.Email, QueueDigest, "summary"))
+	require.NoError(t, dispatcher.Notify(user.Email, AccountLocked, "15m0s"))
+	assert.Len(t, email.Mails(), 3)
+	assert.Len(t, chat.Mails(), 3)
+	assert.Equal(t, AccountLocked, chat.Mails()[2].Event)
+
+	// Codes are only sent by email, and unknown addresses get the defaults.
+	require.NoError(t, dispatcher.Notify(user.Email, GenerateConfirmCode, "12345"))
+	require.NoError(t, dispatcher.Notify("new@test.com", ConfirmEmailChange, "12345"))
+	assert.Len(t, email.Mails(), 5)
+	assert.Len(t, chat.Mails(), 3)
+}
+
+func TestNotificationDispatcher_UpdatePreferences(t *testing.T) {
+	dispatcher := NewNotificationDispatcher(storage.NewInMemoryNotificationPreferenceStorer(), storage.NewInMemoryUserStorer(), Channels{}, "chat")
+	user := models.User{ID: "user"}
+	for _, pref := range []models.NotificationPreference{
+		{Event: "unknown", Channels: []string{"email"}},
+		{Event: "welcome", Channels: []string{"pigeon"}},
+		{Event: "welcome", Channels: []string{"email"}, Frequency: "hourly"},
+		{Event: "welcome"},
+		{Event: "account-locked", Channels: []string{"chat"}},
+		{Event: "account-deleted", Channels: []string{"email"}, Frequency: models.NotifyOff},
+		{Event: "new-login", Channels: []string{"chat"}},
+		{Event: "welcome", Channels: []string{"email"}, Frequency: "daily"},
+		{Event: "password-reset", Channels: []string{"email", "chat"}},
+	} {
+		_, err := dispatcher.UpdatePreferences(user, []models.NotificationPreference{pref})
+		assert.True(t, errors.Is(err, ErrInvalidNotificationPreferences), pref.Event)
+	}
+	prefs, err := dispatcher.UpdatePreferences(user, []models.NotificationPreference{{Event: "welcome", Frequency: models.NotifyOff}})
+	require.NoError(t, err)
+	assert.Equal(t, models.NotifyOff, prefs[0].Frequency)
+	assert.Empty(t, prefs[0].Channels)
+}
@@ -0,0 +1,258 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/staple-org/staple/internal/models"
+	"github.com/staple-org/staple/internal/storage"
+	"github.com/staple-org/staple/pkg/config"
+)
+
+const (
+	// NotificationMaxAttempts is the default number of attempts after which a notification
+	// is given up.
+	NotificationMaxAttempts = 10
+	// notificationBaseBackoff is the wait before the first retry. It doubles with every attempt.
+	notificationBaseBackoff = 30 * time.Second
+	// notificationMaxBackoff caps the wait between two attempts.
+	notificationMaxBackoff = time.Hour
+	// notificationLease is how long a claimed notification is hidden from other workers. It
+	// has to be longer than sending a mail can take.
+	notificationLease = 5 * time.Minute
+	// notificationBatchSize is the number of due notifications claimed per run.
+	notificationBatchSize = 100
+	// notificationSentRetention is how long sent notifications are kept.
+	notificationSentRetention = 7 * 24 * time.Hour
+	// notificationDeadRetention is how long given up notifications are kept for inspection.
+	notificationDeadRetention = 30 * 24 * time.Hour
+)
+
+// ErrNotificationNotFound is returned when a notification doesn't exist or can't be re-driven.
+var ErrNotificationNotFound = errors.New("notification not found")
+
+// NotificationOutbox is a Notifier which stores notifications and sends them with the
+// Notifier of their channel in the background. A failing mail provider therefore doesn't
+// fail the request which caused the notification, and failed notifications are retried
+// with exponential backoff until they are given up after a number of attempts.
+type NotificationOutbox struct {
+	store       storage.NotificationStorer
+	channels    Channels
+	clock       Clock
+	maxAttempts int
+	// wake is signalled when new notifications are waiting.
+	wake chan struct{}
+}
+
+// NewNotificationOutbox creates an outbox which sends email notifications with notifier.
+func NewNotificationOutbox(store storage.NotificationStorer, notifier Notifier) NotificationOutbox {
+	return NotificationOutbox{
+		store:       store,
+		channels:    Channels{ChannelEmail: notifier},
+		clock:       time.Now,
+		maxAttempts: NotificationMaxAttempts,
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+// WithClock returns a copy of the outbox which uses the given clock.
+func (o NotificationOutbox) WithClock(clock Clock) NotificationOutbox {
+	o.clock = clock
+	return o
+}
+
+// WithMaxAttempts returns a copy of the outbox which gives notifications up after n attempts.
+func (o NotificationOutbox) WithMaxAttempts(n int) NotificationOutbox {
+	if n > 0 {
+		o.maxAttempts = n
+	}
+	return o
+}
+
+// WithChannel returns a copy of the outbox which sends notifications of the named channel
+// with notifier.
+func (o NotificationOutbox) WithChannel(name string, notifier Notifier) NotificationOutbox {
+	channels := make(Channels, len(o.channels)+1)
+	for k, v := range o.channels {
+		channels[k] = v
+	}
+	channels[name] = notifier
+	o.channels = channels
+	return o
+}
+
+// Notify stores an email notification. It is sent by the workers right away.
+func (o NotificationOutbox) Notify(email string, event Event, payload string) error {
+	return o.NotifyChannel(ChannelEmail, email, event, payload)
+}
+
+// NotifyChannel stores a notification for the named channel. It is sent by the workers
+// right away.
+func (o NotificationOutbox) NotifyChannel(channel string, email string, event Event, payload string) error {
+	if _, ok := o.channels[channel]; !ok {
+		return fmt.Errorf("unknown notification channel %q", channel)
+	}
+	now := o.clock().UTC()
+	if _, err := o.store.Enqueue(models.Notification{
+		Email:         email,
+		Event:         string(event),
+		Channel:       channel,
+		Payload:       payload,
+		NextAttemptAt: &now,
+		CreatedAt:     now,
+	}); err != nil {
+		return err
+	}
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// SendDue claims due notifications and sends them with the given number of workers. It
+// returns how many notifications were attempted.
+func (o NotificationOutbox) SendDue(workers int) (int, error) {
+	due, err := o.store.Claim(o.clock().UTC(), notificationLease, notificationBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	queue := make(chan models.Notification)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range queue {
+				if err := o.attempt(n); err != nil {
+					config.Opts.Logger.Error().Err(err).Int("notification", n.ID).Msg("Failed to store notification attempt")
+				}
+			}
+		}()
+	}
+	for _, n := range due {
+		queue <- n
+	}
+	close(queue)
+	wg.Wait()
+	return len(due), nil
+}
+
+// RunWorkers sends due notifications once per interval, and right after new ones are
+// stored, until ctx is done. Sent and given up notifications are removed after a while.
+func (o NotificationOutbox) RunWorkers(ctx context.Context, workers int, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for {
+			n, err := o.SendDue(workers)
+			if err != nil {
+				config.Opts.Logger.Error().Err(err).Msg("Failed to send notifications")
+			}
+			if err != nil || n < notificationBatchSize {
+				break
+			}
+		}
+		now := o.clock()
+		if _, err := o.store.Purge(now.Add(-notificationSentRetention), now.Add(-notificationDeadRetention)); err != nil {
+			config.Opts.Logger.Error().Err(err).Msg("Failed to purge the notification outbox")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-o.wake:
+		}
+	}
+}
+
+// List returns notifications with the given status, or all of them if status is empty,
+// the newest first.
+func (o NotificationOutbox) List(status string, limit, offset int) ([]models.Notification, error) {
+	return o.store.List(status, limit, offset)
+}
+
+// Redrive makes a notification which was given up due again. Notifications of secret
+// events lose their payload when they are given up, so they can't be re-driven.
+func (o NotificationOutbox) Redrive(id int) (models.Notification, error) {
+	stored, err := o.store.Get(id)
+	if err != nil {
+		return models.Notification{}, err
+	}
+	if stored == nil || secretEvents[Event(stored.Event)] {
+		return models.Notification{}, ErrNotificationNotFound
+	}
+	n, err := o.store.Redrive(id, o.clock().UTC())
+	if err != nil {
+		return models.Notification{}, err
+	}
+	if n == nil {
+		return models.Notification{}, ErrNotificationNotFound
+	}
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+	return *n, nil
+}
+
+// send sends a notification with the Notifier of its channel. Idempotent notifiers get a
+// key which stays the same across retries and re-drives of the notification.
+func (o NotificationOutbox) send(n models.Notification) error {
+	notifier, ok := o.channels[n.Channel]
+	if !ok {
+		return fmt.Errorf("unknown notification channel %q", n.Channel)
+	}
+	if once, ok := notifier.(IdempotentNotifier); ok {
+		key := fmt.Sprintf("staple-%d-%d", n.ID, n.CreatedAt.UnixNano())
+		return once.NotifyOnce(key, n.Email, Event(n.Event), n.Payload)
+	}
+	return notifier.Notify(n.Email, Event(n.Event), n.Payload)
+}
+
+// attempt sends a notification and stores the outcome. The payload isn't kept once
+// a notification is sent, nor once a notification of a secret event is given up, because
+// it may hold a code or a password.
+func (o NotificationOutbox) attempt(n models.Notification) error {
+	n.Attempts++
+	n.LastError = ""
+	err := o.send(n)
+	now := o.clock().UTC()
+	switch {
+	case err == nil:
+		n.SentAt = &now
+		n.NextAttemptAt = nil
+		n.Payload = ""
+	case n.Attempts >= o.maxAttempts:
+		config.Opts.Logger.Error().Err(err).Int("notification", n.ID).Str("event", n.Event).Str("channel", n.Channel).Msg("Giving up notification")
+		n.LastError = err.Error()
+		n.DeadAt = &now
+		n.NextAttemptAt = nil
+		if secretEvents[Event(n.Event)] {
+			n.Payload = ""
+		}
+	default:
+		n.LastError = err.Error()
+		next := now.Add(notificationBackoff(n.Attempts))
+		n.NextAttemptAt = &next
+	}
+	return o.store.Update(n)
+}
+
+// notificationBackoff is the wait after the given number of failed attempts.
+func notificationBackoff(attempts int) time.Duration {
+	wait := notificationBaseBackoff
+	for i := 1; i < attempts; i++ {
+		wait *= 2
+		if wait >= notificationMaxBackoff {
+			return notificationMaxBackoff
+		}
+	}
+	return wait
+}
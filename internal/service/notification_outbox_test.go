@@ -0,0 +1,179 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/staple-org/staple/internal/models"
+	"github.com/staple-org/staple/internal/storage"
+)
+
+// flakyNotifier fails until it is told to work.
+type flakyNotifier struct {
+	mu     sync.Mutex
+	err    error
+	buffer *BufferNotifier
+}
+
+func (f *flakyNotifier) setErr(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.err = err
+}
+
+func (f *flakyNotifier) Notify(email string, event Event, payload string) error {
+	f.mu.Lock()
+	err := f.err
+	f.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return f.buffer.Notify(email, event, payload)
+}
+
+func TestNotificationOutbox(t *testing.T) {
+	now := time.Date(2020, 2, 13, 19, 7, 13, 0, time.UTC)
+	clock := func() time.Time { return now }
+	store := storage.NewInMemoryNotificationStorer()
+	notifier := &flakyNotifier{err: errors.New("mail provider is down"), buffer: NewBufferNotifier()}
+	outbox := NewNotificationOutbox(store, notifier).WithClock(clock).WithMaxAttempts(3)
+
+	// Registering doesn't fail while the mail provider is down.
+	users := NewUserHandler(context.Background(), storage.NewInMemoryUserStorer(), outbox)
+	err := users.Register(models.User{Email: "test@test.com", Password: "password123", MaxStaples: 25})
+	require.NoError(t, err)
+
+	n, err := outbox.SendDue(2)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	list, err := outbox.List(models.NotificationPending, 10, 0)
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+	assert.Equal(t, 1, list[0].Attempts)
+	assert.Equal(t, "mail provider is down", list[0].LastError)
+	assert.Equal(t, now.Add(notificationBaseBackoff), *list[0].NextAttemptAt)
+
+	// Nothing is due before the backoff has passed.
+	n, err = outbox.SendDue(2)
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	// Given up after the last attempt.
+	now = now.Add(notificationBaseBackoff)
+	_, err = outbox.SendDue(2)
+	require.NoError(t, err)
+	now = now.Add(2 * notificationBaseBackoff)
+	_, err = outbox.SendDue(2)
+	require.NoError(t, err)
+	dead, err := outbox.List(models.NotificationDead, 10, 0)
+	require.NoError(t, err)
+	require.Len(t, dead, 1)
+	assert.Equal(t, 3, dead[0].Attempts)
+	assert.Nil(t, dead[0].NextAttemptAt)
+	assert.Equal(t, models.NotificationDead, dead[0].Status())
+
+	// Re-driven once the provider works again.
+	notifier.setErr(nil)
+	_, err = outbox.Redrive(12345)
+	assert.Equal(t, ErrNotificationNotFound, err)
+	redriven, err := outbox.Redrive(dead[0].ID)
+	require.NoError(t, err)
+	assert.Equal(t, 0, redriven.Attempts)
+	n, err = outbox.SendDue(2)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	sent, err := outbox.List(models.NotificationSent, 10, 0)
+	require.NoError(t, err)
+	require.Len(t, sent, 1)
+	assert.Equal(t, now, *sent[0].SentAt)
+	assert.Empty(t, sent[0].Payload)
+	assert.Contains(t, notifier.buffer.Last(Welcome).Text, "Thank you for signing up to Staple.")
+
+	// Sent notifications can't be re-driven and are purged after the retention.
+	_, err = outbox.Redrive(sent[0].ID)
+	assert.Equal(t, ErrNotificationNotFound, err)
+	purged, err := store.Purge(now.Add(time.Second), now)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), purged)
+
+	// Secret payloads aren't kept once given up, and can't be re-driven.
+	notifier.setErr(errors.New("mail provider is down"))
+	err = outbox.Notify("test@test.com", PasswordReset, "new-password")
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		now = now.Add(notificationMaxBackoff)
+		_, err = outbox.SendDue(2)
+		require.NoError(t, err)
+	}
+	dead, err = outbox.List(models.NotificationDead, 10, 0)
+	require.NoError(t, err)
+	require.Len(t, dead, 1)
+	assert.Empty(t, dead[0].Payload)
+	_, err = outbox.Redrive(dead[0].ID)
+	assert.Equal(t, ErrNotificationNotFound, err)
+}
+
+func TestNotificationOutbox_Workers(t *testing.T) {
+	store := storage.NewInMemoryNotificationStorer()
+	notifier := NewBufferNotifier()
+	outbox := NewNotificationOutbox(store, notifier)
+	for i := 0; i < 20; i++ {
+		require.NoError(t, outbox.Notify("test@test.com", GenerateConfirmCode, "12345"))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		outbox.RunWorkers(ctx, 4, time.Hour)
+		close(done)
+	}()
+	assert.Eventually(t, func() bool {
+		return len(notifier.Mails()) == 20
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// New notifications wake the workers up.
+	require.NoError(t, outbox.Notify("test@test.com", AccountDeleted, ""))
+	assert.Eventually(t, func() bool {
+		return notifier.Last(AccountDeleted).Event == AccountDeleted
+	}, 5*time.Second, 10*time.Millisecond)
+	cancel()
+	<-done
+
+	// Claimed notifications are hidden from other workers.
+	require.NoError(t, outbox.Notify("test@test.com", Welcome, ""))
+	claimed, err := store.Claim(time.Now(), notificationLease, 10)
+	require.NoError(t, err)
+	assert.Len(t, claimed, 1)
+	claimed, err = store.Claim(time.Now(), notificationLease, 10)
+	require.NoError(t, err)
+	assert.Empty(t, claimed)
+}
+
+func TestNotificationBackoff(t *testing.T) {
+	assert.Equal(t, 30*time.Second, notificationBackoff(1))
+	assert.Equal(t, 60*time.Second, notificationBackoff(2))
+	assert.Equal(t, 16*time.Minute, notificationBackoff(6))
+	assert.Equal(t, notificationMaxBackoff, notificationBackoff(20))
+}
+
+func TestNotificationOutbox_Channels(t *testing.T) {
+	email, chat := NewBufferNotifier(), NewBufferNotifier()
+	outbox := NewNotificationOutbox(storage.NewInMemoryNotificationStorer(), email).WithChannel("chat", chat)
+
+	require.NoError(t, outbox.Notify("test@test.com", Welcome, ""))
+	require.NoError(t, outbox.NotifyChannel("chat", "test@test.com", QueueDigest, "summary"))
+	assert.EqualError(t, outbox.NotifyChannel("pigeon", "test@test.com", Welcome, ""), `unknown notification channel "pigeon"`)
+
+	n, err := outbox.SendDue(1)
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	require.Len(t, email.Mails(), 1)
+	assert.Equal(t, Welcome, email.Mails()[0].Event)
+	require.Len(t, chat.Mails(), 1)
+	assert.Equal(t, QueueDigest, chat.Mails()[0].Event)
+}
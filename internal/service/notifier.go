@@ -1,9 +1,9 @@
 package service
 
 import (
-	"bytes"
 	"fmt"
-	"time"
+	"strings"
+	"sync"
 
 	"github.com/mailgun/mailgun-go"
 
@@ -24,6 +24,22 @@ var (
 	GenerateConfirmCode Event = "Confirm Code"
 	// Welcome template for new sign-ups.
 	Welcome Event = "Welcome"
+	// AccountLocked is an event that happens when an account is locked after too many failed attempts.
+	AccountLocked Event = "Account Locked"
+	// NewLogin is an event which informs the user about a successful login to their account.
+	NewLogin Event = "New Login"
+	// ConfirmEmailChange is an event which sends a confirm code to a new email address.
+	ConfirmEmailChange Event = "Confirm Email Change"
+	// EmailChangeRequested is an event which informs the current address about a requested change.
+	EmailChangeRequested Event = "Email Change Requested"
+	// AccountDeletionScheduled is an event which informs the user that their account will be deleted.
+	AccountDeletionScheduled Event = "Account Deletion Scheduled"
+	// AccountDeleted is an event which confirms that an account and all its data has been deleted.
+	AccountDeleted Event = "Account Deleted"
+	// QueueDigest is the periodic summary of the queue users opted in to.
+	QueueDigest Event = "Queue Digest"
+	// ReadingReminder is sent when a user hasn't read anything for a while.
+	ReadingReminder Event = "Reading Reminder"
 )
 
 // Notifier notifies the user of some event.
@@ -31,22 +47,28 @@ type Notifier interface {
 	Notify(email string, event Event, payload string) error
 }
 
+// IdempotentNotifier is a Notifier whose receiver can drop a notification it already
+// accepted. The key is the same for every attempt of a notification.
+type IdempotentNotifier interface {
+	Notifier
+	NotifyOnce(key string, email string, event Event, payload string) error
+}
+
 // EmailNotifier is an email based notification entity.
-type EmailNotifier struct{}
+type EmailNotifier struct {
+	renderer MailRenderer
+}
 
-// NewEmailNotifier creates a new email notifier.
+// NewEmailNotifier creates a new email notifier which renders the embedded templates.
 func NewEmailNotifier() EmailNotifier {
-	return EmailNotifier{}
+	return EmailNotifier{renderer: defaultMailRenderer}
 }
 
-var (
-	welcomeTemplate = `Dear %s
-Thank you for signing up to Staple. Enjoy your queue based bookmarks!`
-	passwordResetTemplate = `Dear %s
-Your password has been successfully reset to: %s. Please change as soon as possible.`
-	confirmCodeTemplate = `Dear %s
-Please enter the following code into the confirm code window: %s`
-)
+// WithRenderer returns a copy of the notifier which renders mails with r.
+func (e EmailNotifier) WithRenderer(r MailRenderer) EmailNotifier {
+	e.renderer = r
+	return e
+}
 
 // Notify attempts to send out an email using mailgun contaning the new password.
 // Does not need to be a pointer receiver because it isn't storing anything.
@@ -54,49 +76,76 @@ func (e EmailNotifier) Notify(email string, event Event, payload string) error {
 	domain := config.Opts.Mailer.Domain
 	apiKey := config.Opts.Mailer.APIKey
 	sender := fmt.Sprintf("no-reply@%s", domain)
-	subject := fmt.Sprintf("[%s] %s Notification", time.Now().Format("2006-01-02"), event)
+
+	mail, err := e.renderer.Render(email, event, payload)
+	if err != nil {
+		return err
+	}
 
 	if domain == "" && apiKey == "" {
 		config.Opts.Logger.Warn().Msg("[WARNING] Mailgun not set up. Falling back to console output...")
-		config.Opts.Logger.Info().Str("email", email).Str("subject", subject).Str("payload", payload).Msg("A notification attempt was made for user.")
+		config.Opts.Logger.Info().Str("email", email).Str("subject", mail.Subject).Str("payload", payload).Msg("A notification attempt was made for user.")
 		return nil
 	}
 
-	var body string
-	switch event {
-	case PasswordReset:
-		body = fmt.Sprintf(passwordResetTemplate, email, payload)
-	case GenerateConfirmCode:
-		body = fmt.Sprintf(confirmCodeTemplate, email, payload)
-	case Welcome:
-		body = fmt.Sprintf(welcomeTemplate, email)
-	}
-
 	mg := mailgun.NewMailgun(domain, apiKey)
-	message := mg.NewMessage(sender, subject, body, email)
-	_, _, err := mg.Send(message)
+	message := mg.NewMessage(sender, mail.Subject, mail.Text, email)
+	message.SetHtml(mail.HTML)
+	_, _, err = mg.Send(message)
 	return err
 }
 
-// BufferNotifier uses a byte buffer for notifications.
+// BufferNotifier keeps the rendered notifications in memory.
 type BufferNotifier struct {
-	buffer bytes.Buffer
+	renderer MailRenderer
+	mu       sync.Mutex
+	mails    []Mail
 }
 
 // NewBufferNotifier creates a new notifier.
 func NewBufferNotifier() *BufferNotifier {
-	return &BufferNotifier{}
+	return &BufferNotifier{renderer: defaultMailRenderer}
 }
 
-// Notify uses a buffer to store notifications for a user.
+// Notify renders the notification and stores it.
 func (b *BufferNotifier) Notify(email string, event Event, payload string) error {
-	var body string
-	switch event {
-	case PasswordReset:
-		body = fmt.Sprintf(passwordResetTemplate, email, payload)
-	case GenerateConfirmCode:
-		body = fmt.Sprintf(confirmCodeTemplate, email, payload)
+	mail, err := b.renderer.Render(email, event, payload)
+	if err != nil {
+		return err
 	}
-	b.buffer.WriteString(body)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.mails = append(b.mails, mail)
 	return nil
 }
+
+// Mails returns every notification in the order they were sent.
+func (b *BufferNotifier) Mails() []Mail {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]Mail(nil), b.mails...)
+}
+
+// Last returns the latest notification of an event.
+func (b *BufferNotifier) Last(event Event) Mail {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i := len(b.mails) - 1; i >= 0; i-- {
+		if b.mails[i].Event == event {
+			return b.mails[i]
+		}
+	}
+	return Mail{}
+}
+
+// Text returns the text bodies of every notification.
+func (b *BufferNotifier) Text() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var body strings.Builder
+	for _, mail := range b.mails {
+		body.WriteString(mail.Text)
+		body.WriteString("\n")
+	}
+	return body.String()
+}
@@ -0,0 +1,333 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+
+	"github.com/staple-org/staple/internal/models"
+	"github.com/staple-org/staple/internal/storage"
+)
+
+// OIDCConfig configures an OpenID Connect relying party.
+type OIDCConfig struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	// AutoProvision creates a Staple user on the first login of an unknown identity.
+	AutoProvision bool
+}
+
+// jwksRefetchInterval is the minimum time between two fetches of the provider's key set, so
+// tokens with unknown key ids can't make Staple hammer the provider.
+const jwksRefetchInterval = time.Minute
+
+// oidcDiscovery is the subset of the provider metadata which Staple needs.
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// IDTokenClaims are the verified claims of an ID token.
+type IDTokenClaims struct {
+	Issuer        string
+	Subject       string
+	Email         string
+	EmailVerified bool
+}
+
+// OIDCAuthenticator logs in users with an external OpenID Connect provider using the
+// authorization code flow with PKCE and links the external identity to a Staple user.
+type OIDCAuthenticator struct {
+	config      OIDCConfig
+	client      *http.Client
+	identities  storage.IdentityStorer
+	userHandler UserHandlerer
+	cache       *oidcCache
+}
+
+// oidcCache holds the discovered provider metadata and keys shared between copies
+// of an authenticator.
+type oidcCache struct {
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]*rsa.PublicKey
+	// keysFetched is when the key set was fetched last.
+	keysFetched time.Time
+}
+
+// NewOIDCAuthenticator creates a new OpenID Connect authenticator. Provider metadata is
+// discovered on first use.
+func NewOIDCAuthenticator(config OIDCConfig, client *http.Client, identities storage.IdentityStorer, userHandler UserHandlerer) OIDCAuthenticator {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	return OIDCAuthenticator{
+		config:      config,
+		client:      client,
+		identities:  identities,
+		userHandler: userHandler,
+		cache:       &oidcCache{keys: make(map[string]*rsa.PublicKey)},
+	}
+}
+
+// NewPKCEVerifier generates a random code verifier as defined in RFC 7636.
+func NewPKCEVerifier() (string, error) {
+	return randomURLSafe(32)
+}
+
+// PKCEChallenge derives the S256 code challenge from a verifier.
+func PKCEChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthCodeURL returns the URL of the provider the user has to be redirected to.
+func (o OIDCAuthenticator) AuthCodeURL(state, nonce, verifier string) (string, error) {
+	d, err := o.discover()
+	if err != nil {
+		return "", err
+	}
+	v := url.Values{}
+	v.Set("response_type", "code")
+	v.Set("client_id", o.config.ClientID)
+	v.Set("redirect_uri", o.config.RedirectURL)
+	v.Set("scope", "openid email profile")
+	v.Set("state", state)
+	v.Set("nonce", nonce)
+	v.Set("code_challenge", PKCEChallenge(verifier))
+	v.Set("code_challenge_method", "S256")
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return d.AuthorizationEndpoint + sep + v.Encode(), nil
+}
+
+// Exchange trades an authorization code for an ID token and verifies it.
+func (o OIDCAuthenticator) Exchange(code, verifier, nonce string) (*IDTokenClaims, error) {
+	d, err := o.discover()
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", o.config.RedirectURL)
+	form.Set("client_id", o.config.ClientID)
+	form.Set("code_verifier", verifier)
+	req, err := http.NewRequest(http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if o.config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(o.config.ClientID), url.QueryEscape(o.config.ClientSecret))
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint returned status %d", resp.StatusCode)
+	}
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return nil, err
+	}
+	if tokens.IDToken == "" {
+		return nil, errors.New("token response did not contain an id_token")
+	}
+	return o.VerifyIDToken(tokens.IDToken, nonce)
+}
+
+// VerifyIDToken validates the signature of an ID token against the provider's keys
+// and checks issuer, audience, expiry and nonce.
+func (o OIDCAuthenticator) VerifyIDToken(raw, nonce string) (*IDTokenClaims, error) {
+	d, err := o.discover()
+	if err != nil {
+		return nil, err
+	}
+	token, err := jwt.Parse(raw, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		kid, _ := token.Header["kid"].(string)
+		return o.key(d, kid)
+	})
+	if err != nil {
+		return nil, err
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, errors.New("invalid id token claims")
+	}
+	if !claims.VerifyIssuer(d.Issuer, true) {
+		return nil, errors.New("id token issuer mismatch")
+	}
+	if !claims.VerifyAudience(o.config.ClientID, true) {
+		return nil, errors.New("id token audience mismatch")
+	}
+	if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return nil, errors.New("id token is expired")
+	}
+	if n, _ := claims["nonce"].(string); n != nonce {
+		return nil, errors.New("id token nonce mismatch")
+	}
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		return nil, errors.New("id token is missing the subject")
+	}
+	email, _ := claims["email"].(string)
+	verified, _ := claims["email_verified"].(bool)
+	return &IDTokenClaims{
+		Issuer:        d.Issuer,
+		Subject:       subject,
+		Email:         email,
+		EmailVerified: verified,
+	}, nil
+}
+
+// Login resolves the Staple user for an external identity. Unknown identities are linked to an
+// existing user with the same verified email, or provisioned if auto provisioning is allowed.
+func (o OIDCAuthenticator) Login(claims IDTokenClaims) (*models.User, error) {
+	id, err := o.identities.Find(claims.Issuer, claims.Subject)
+	if err != nil {
+		return nil, err
+	}
+	if id != "" {
+		return &models.User{ID: id}, nil
+	}
+	if claims.Email == "" || !claims.EmailVerified {
+		return nil, errors.New("identity provider did not supply a verified email")
+	}
+	user := models.User{Email: claims.Email}
+	ok, err := o.userHandler.IsRegistered(user)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		if !o.config.AutoProvision {
+			return nil, errors.New("user not found")
+		}
+		if err := o.userHandler.Provision(user); err != nil {
+			return nil, err
+		}
+	}
+	if user.ID, err = o.userHandler.UserID(user); err != nil {
+		return nil, err
+	}
+	if err := o.identities.Link(claims.Issuer, claims.Subject, user.ID); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (o OIDCAuthenticator) discover() (*oidcDiscovery, error) {
+	o.cache.mu.Lock()
+	defer o.cache.mu.Unlock()
+	if o.cache.discovery != nil {
+		return o.cache.discovery, nil
+	}
+	resp, err := o.client.Get(strings.TrimSuffix(o.config.Issuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discovery returned status %d", resp.StatusCode)
+	}
+	d := &oidcDiscovery{}
+	if err := json.NewDecoder(resp.Body).Decode(d); err != nil {
+		return nil, err
+	}
+	if d.Issuer != o.config.Issuer {
+		return nil, fmt.Errorf("discovered issuer %q does not match %q", d.Issuer, o.config.Issuer)
+	}
+	o.cache.discovery = d
+	return d, nil
+}
+
+// key returns the public key with the given key id. The key set is refetched if the
+// key is unknown to support key rotation at the provider, but at most once per
+// jwksRefetchInterval.
+func (o OIDCAuthenticator) key(d *oidcDiscovery, kid string) (*rsa.PublicKey, error) {
+	o.cache.mu.Lock()
+	defer o.cache.mu.Unlock()
+	if k, ok := o.cache.keys[kid]; ok {
+		return k, nil
+	}
+	now := time.Now()
+	if now.Sub(o.cache.keysFetched) < jwksRefetchInterval {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	o.cache.keysFetched = now
+	resp, err := o.client.Get(d.JWKSURI)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("jwks endpoint returned status %d", resp.StatusCode)
+	}
+	var set struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, err
+	}
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		o.cache.keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	if k, ok := o.cache.keys[kid]; ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("unknown key id %q", kid)
+}
+
+// randomURLSafe generates n random bytes encoded as unpadded base64url.
+func randomURLSafe(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,84 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/staple-org/staple/internal/models"
+	"github.com/staple-org/staple/internal/storage"
+)
+
+func TestOIDCAuthenticator_Login(t *testing.T) {
+	userHandler := NewUserHandler(context.Background(), storage.NewInMemoryUserStorer(), NewBufferNotifier())
+	identities := storage.NewInMemoryIdentityStorer()
+	auth := NewOIDCAuthenticator(OIDCConfig{Issuer: "https://id.test", ClientID: "staple"}, nil, identities, userHandler)
+
+	err := userHandler.Register(models.User{Email: "test@test.com", Password: "password"})
+	assert.NoError(t, err)
+
+	// unverified emails are never linked to existing users
+	_, err = auth.Login(IDTokenClaims{Issuer: "https://id.test", Subject: "1", Email: "test@test.com"})
+	assert.EqualError(t, err, "identity provider did not supply a verified email")
+
+	// unknown users are not provisioned unless configured
+	_, err = auth.Login(IDTokenClaims{Issuer: "https://id.test", Subject: "2", Email: "new@test.com", EmailVerified: true})
+	assert.EqualError(t, err, "user not found")
+
+	user, err := auth.Login(IDTokenClaims{Issuer: "https://id.test", Subject: "1", Email: "test@test.com", EmailVerified: true})
+	assert.NoError(t, err)
+	id, err := userHandler.UserID(models.User{Email: "test@test.com"})
+	assert.NoError(t, err)
+	assert.Equal(t, id, user.ID)
+	linked, err := identities.Find("https://id.test", "1")
+	assert.NoError(t, err)
+	assert.Equal(t, id, linked)
+
+	// linked identities log in as the same user
+	user, err = auth.Login(IDTokenClaims{Issuer: "https://id.test", Subject: "1"})
+	assert.NoError(t, err)
+	assert.Equal(t, id, user.ID)
+}
+
+func TestOIDCAuthenticator_KeyRefetch(t *testing.T) {
+	fetches := 0
+	var server *httptest.Server
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{"issuer": server.URL, "jwks_uri": server.URL + "/jwks"})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"keys": []interface{}{}})
+	})
+	server = httptest.NewServer(mux)
+	defer server.Close()
+	auth := NewOIDCAuthenticator(OIDCConfig{Issuer: server.URL, ClientID: "staple"}, server.Client(), storage.NewInMemoryIdentityStorer(), nil)
+	d, err := auth.discover()
+	assert.NoError(t, err)
+
+	// unknown key ids only refetch the key set once per interval
+	for i := 0; i < 3; i++ {
+		_, err = auth.key(d, "unknown")
+		assert.EqualError(t, err, `unknown key id "unknown"`)
+	}
+	assert.Equal(t, 1, fetches)
+
+	auth.cache.keysFetched = time.Now().Add(-jwksRefetchInterval)
+	_, err = auth.key(d, "unknown")
+	assert.Error(t, err)
+	assert.Equal(t, 2, fetches)
+}
+
+func TestPKCEChallenge(t *testing.T) {
+	verifier, err := NewPKCEVerifier()
+	assert.NoError(t, err)
+	assert.Len(t, verifier, 43)
+	assert.Len(t, PKCEChallenge(verifier), 43)
+	assert.NotEqual(t, verifier, PKCEChallenge(verifier))
+}
@@ -0,0 +1,184 @@
+package service
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+const (
+	// defaultPasswordMinLength is the minimum password length if none is configured.
+	defaultPasswordMinLength = 8
+	// passwordMaxLength is the longest password bcrypt can hash without truncating it.
+	passwordMaxLength = 72
+	// hibpPrefixLength is the length of the hash prefix used for k-anonymity range files.
+	hibpPrefixLength = 5
+)
+
+// Codes of password policy violations. They are stable and can be used by clients
+// to show localised messages.
+const (
+	ViolationEmpty         = "empty"
+	ViolationTooShort      = "too_short"
+	ViolationTooLong       = "too_long"
+	ViolationTooFewClasses = "too_few_character_classes"
+	ViolationMatchesEmail  = "matches_email"
+	ViolationBreached      = "breached"
+)
+
+// PasswordViolation describes a single rule a password broke.
+type PasswordViolation struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// PasswordPolicyError is returned if a password doesn't satisfy the password policy.
+type PasswordPolicyError struct {
+	Violations []PasswordViolation
+}
+
+// Error joins the messages of all violations.
+func (e *PasswordPolicyError) Error() string {
+	messages := make([]string, 0, len(e.Violations))
+	for _, v := range e.Violations {
+		messages = append(messages, v.Message)
+	}
+	return strings.Join(messages, "; ")
+}
+
+// BreachChecker checks whether a password appeared in a known data breach.
+type BreachChecker interface {
+	Breached(password string) (bool, error)
+}
+
+// PasswordPolicy defines the rules a new password has to follow.
+type PasswordPolicy struct {
+	MinLength int
+	// MinClasses is the number of character classes out of lower case, upper case,
+	// digits and symbols a password has to contain.
+	MinClasses int
+	// Breaches is optional. If set, breached passwords are rejected.
+	Breaches BreachChecker
+}
+
+// DefaultPasswordPolicy is used if no policy is configured.
+var DefaultPasswordPolicy = PasswordPolicy{
+	MinLength:  defaultPasswordMinLength,
+	MinClasses: 1,
+}
+
+// Validate checks a password of the user with the given email against the policy. All
+// violations are collected. A *PasswordPolicyError is returned if there are any.
+func (p PasswordPolicy) Validate(email, password string) error {
+	if password == "" {
+		return &PasswordPolicyError{Violations: []PasswordViolation{{Code: ViolationEmpty, Message: "password cannot be empty"}}}
+	}
+	violations := make([]PasswordViolation, 0)
+	length := len([]rune(password))
+	if length < p.MinLength {
+		violations = append(violations, PasswordViolation{
+			Code:    ViolationTooShort,
+			Message: fmt.Sprintf("password must be at least %d characters long", p.MinLength),
+		})
+	}
+	if len(password) > passwordMaxLength {
+		violations = append(violations, PasswordViolation{
+			Code:    ViolationTooLong,
+			Message: fmt.Sprintf("password must not be longer than %d bytes", passwordMaxLength),
+		})
+	}
+	if classes := characterClasses(password); classes < p.MinClasses {
+		violations = append(violations, PasswordViolation{
+			Code:    ViolationTooFewClasses,
+			Message: fmt.Sprintf("password must contain at least %d of lower case letters, upper case letters, digits and symbols", p.MinClasses),
+		})
+	}
+	if email != "" && strings.EqualFold(password, email) {
+		violations = append(violations, PasswordViolation{
+			Code:    ViolationMatchesEmail,
+			Message: "password must not be the email address",
+		})
+	}
+	if p.Breaches != nil {
+		breached, err := p.Breaches.Breached(password)
+		if err != nil {
+			return err
+		}
+		if breached {
+			violations = append(violations, PasswordViolation{
+				Code:    ViolationBreached,
+				Message: "password appeared in a data breach",
+			})
+		}
+	}
+	if len(violations) > 0 {
+		return &PasswordPolicyError{Violations: violations}
+	}
+	return nil
+}
+
+// characterClasses counts the different kinds of characters in a password.
+func characterClasses(password string) int {
+	var lower, upper, digit, symbol int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			symbol = 1
+		}
+	}
+	return lower + upper + digit + symbol
+}
+
+// HIBPChecker looks up passwords in a local copy of the Have I Been Pwned password
+// range files. The directory contains one file per five character SHA-1 prefix named
+// <PREFIX>.txt with lines of the form <SUFFIX>:<COUNT>. Only the range of the prefix is
+// read, so the password is never compared against the whole list at once.
+type HIBPChecker struct {
+	dir string
+}
+
+// NewHIBPChecker creates a checker which reads range files from dir.
+func NewHIBPChecker(dir string) HIBPChecker {
+	return HIBPChecker{dir: dir}
+}
+
+// Breached returns true if the password's hash is listed in its range file. A missing
+// range file means no password with that prefix is known.
+func (h HIBPChecker) Breached(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:hibpPrefixLength], hash[hibpPrefixLength:]
+	f, err := os.Open(filepath.Join(h.dir, prefix+".txt"))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		candidate := line
+		count := ""
+		if i := strings.IndexByte(line, ':'); i >= 0 {
+			candidate, count = line[:i], line[i+1:]
+		}
+		// Padding entries added by the API have a count of zero.
+		if strings.EqualFold(candidate, suffix) && count != "0" {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
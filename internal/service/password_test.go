@@ -0,0 +1,83 @@
+package service
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/staple-org/staple/internal/models"
+	"github.com/staple-org/staple/internal/storage"
+)
+
+func violationCodes(err error) []string {
+	var policyErr *PasswordPolicyError
+	if !errors.As(err, &policyErr) {
+		return nil
+	}
+	codes := make([]string, 0, len(policyErr.Violations))
+	for _, v := range policyErr.Violations {
+		codes = append(codes, v.Code)
+	}
+	return codes
+}
+
+func TestPasswordPolicy_Validate(t *testing.T) {
+	policy := PasswordPolicy{MinLength: 10, MinClasses: 3}
+
+	assert.Equal(t, []string{ViolationEmpty}, violationCodes(policy.Validate("test@test.com", "")))
+	assert.Equal(t, []string{ViolationTooShort, ViolationTooFewClasses}, violationCodes(policy.Validate("test@test.com", "short")))
+	assert.Equal(t, []string{ViolationTooLong}, violationCodes(policy.Validate("test@test.com", "Aa1"+strings.Repeat("a", 70))))
+	assert.Equal(t, []string{ViolationMatchesEmail}, violationCodes(policy.Validate("Test1@test.com", "test1@TEST.com")))
+	assert.NoError(t, policy.Validate("test@test.com", "correct-Horse-battery"))
+
+	err := policy.Validate("test@test.com", "short")
+	assert.EqualError(t, err, "password must be at least 10 characters long; password must contain at least 3 of lower case letters, upper case letters, digits and symbols")
+}
+
+func TestHIBPChecker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hibp")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	sum := sha1.Sum([]byte("P@ssw0rd123"))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	padding := sha1.Sum([]byte("Padding-Only-1"))
+	paddingHash := strings.ToUpper(hex.EncodeToString(padding[:]))
+	ranges := map[string]string{
+		hash[:5]:        "0018A45C4D1DEF81644B54AB7F969B88D65:1\r\n" + hash[5:] + ":3645804\r\n",
+		paddingHash[:5]: paddingHash[5:] + ":0\r\n",
+	}
+	for prefix, content := range ranges {
+		err = ioutil.WriteFile(filepath.Join(dir, prefix+".txt"), []byte(content), 0600)
+		assert.NoError(t, err)
+	}
+
+	checker := NewHIBPChecker(dir)
+	breached, err := checker.Breached("P@ssw0rd123")
+	assert.NoError(t, err)
+	assert.True(t, breached)
+	breached, err = checker.Breached("Padding-Only-1")
+	assert.NoError(t, err)
+	assert.False(t, breached)
+	// no range file for the prefix
+	breached, err = checker.Breached("Unknown-Password-42")
+	assert.NoError(t, err)
+	assert.False(t, breached)
+
+	policy := PasswordPolicy{MinLength: 8, MinClasses: 3, Breaches: checker}
+	userHandler := NewUserHandler(context.Background(), storage.NewInMemoryUserStorer(), NewBufferNotifier()).WithPasswordPolicy(policy)
+	err = userHandler.Register(models.User{Email: "test@test.com", Password: "P@ssw0rd123"})
+	assert.Equal(t, []string{ViolationBreached}, violationCodes(err))
+	err = userHandler.Register(models.User{Email: "test@test.com", Password: "Unknown-Password-42"})
+	assert.NoError(t, err)
+	err = userHandler.ChangePassword(models.User{Email: "test@test.com"}, "P@ssw0rd123")
+	assert.Equal(t, []string{ViolationBreached}, violationCodes(err))
+}
@@ -0,0 +1,74 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/staple-org/staple/internal/storage"
+	"github.com/staple-org/staple/pkg/config"
+)
+
+// RateLimiter decides whether an action identified by a key, like an IP address or
+// an email, is allowed to happen right now.
+type RateLimiter interface {
+	Allow(key string) (ok bool, retryAfter time.Duration, err error)
+}
+
+// TokenBucketLimiter is a token bucket based rate limiter. Every key has a bucket of
+// burst tokens which refills at rate tokens per second.
+type TokenBucketLimiter struct {
+	store storage.RateLimitStorer
+	rate  float64
+	burst int
+	clock Clock
+}
+
+// NewTokenBucketLimiter creates a new rate limiter which allows perMinute actions
+// per minute with bursts of up to burst actions.
+func NewTokenBucketLimiter(store storage.RateLimitStorer, perMinute int, burst int) TokenBucketLimiter {
+	return TokenBucketLimiter{
+		store: store,
+		rate:  float64(perMinute) / 60,
+		burst: burst,
+		clock: time.Now,
+	}
+}
+
+// WithClock returns a copy of the limiter which uses the given clock.
+func (l TokenBucketLimiter) WithClock(clock Clock) TokenBucketLimiter {
+	l.clock = clock
+	return l
+}
+
+// Allow takes a token from the bucket of the given key.
+func (l TokenBucketLimiter) Allow(key string) (bool, time.Duration, error) {
+	return l.store.Take(key, l.rate, l.burst, l.clock())
+}
+
+// Prune removes the buckets which have refilled completely, since they are no different
+// from new ones. Buckets which never refill are kept.
+func (l TokenBucketLimiter) Prune() (int64, error) {
+	if l.rate <= 0 {
+		return 0, nil
+	}
+	refill := time.Duration(float64(l.burst) / l.rate * float64(time.Second))
+	return l.store.Prune(l.clock().Add(-refill))
+}
+
+// RunPruning prunes idle buckets once per interval until ctx is done.
+func (l TokenBucketLimiter) RunPruning(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if n, err := l.Prune(); err != nil {
+			config.Opts.Logger.Error().Err(err).Msg("Failed to prune rate limit buckets")
+		} else if n > 0 {
+			config.Opts.Logger.Debug().Int64("pruned", n).Msg("Pruned rate limit buckets")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
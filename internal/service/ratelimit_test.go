@@ -0,0 +1,59 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/staple-org/staple/internal/storage"
+)
+
+func TestTokenBucketLimiter_Allow(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	limiter := NewTokenBucketLimiter(storage.NewInMemoryRateLimitStorer(), 60, 2).WithClock(func() time.Time { return now })
+
+	for i := 0; i < 2; i++ {
+		ok, _, err := limiter.Allow("ip:127.0.0.1")
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	}
+	ok, retryAfter, err := limiter.Allow("ip:127.0.0.1")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, time.Second, retryAfter)
+
+	// other keys have their own bucket
+	ok, _, err = limiter.Allow("email:test@test.com")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// the bucket refills over time
+	now = now.Add(time.Second)
+	ok, _, err = limiter.Allow("ip:127.0.0.1")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestTokenBucketLimiter_Prune(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	limiter := NewTokenBucketLimiter(storage.NewInMemoryRateLimitStorer(), 60, 2).WithClock(func() time.Time { return now })
+	_, _, err := limiter.Allow("ip:127.0.0.1")
+	assert.NoError(t, err)
+	_, _, err = limiter.Allow("ip:127.0.0.1")
+	assert.NoError(t, err)
+
+	// The bucket isn't full again yet.
+	now = now.Add(time.Second)
+	n, err := limiter.Prune()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), n)
+
+	now = now.Add(2 * time.Second)
+	n, err = limiter.Prune()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+	ok, _, err := limiter.Allow("ip:127.0.0.1")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
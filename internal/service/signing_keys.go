@@ -0,0 +1,399 @@
+package service
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+
+	"github.com/staple-org/staple/pkg/config"
+)
+
+const (
+	// keyCreatedHeader is the PEM header which records when a key was created.
+	keyCreatedHeader = "Created"
+	// keyReloadInterval is the minimum time between reloads triggered by unknown key ids.
+	keyReloadInterval = 10 * time.Second
+)
+
+// SigningKey is a key which signs and verifies tokens.
+type SigningKey struct {
+	ID      string
+	Method  jwt.SigningMethod
+	Private interface{}
+	Public  interface{}
+	Created time.Time
+}
+
+// JSONWebKey is the public part of a signing key as defined in RFC 7517.
+type JSONWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+}
+
+// KeySet holds the keys used for signing tokens. The newest key signs new tokens. Older
+// keys keep verifying tokens for a grace period after they have been superseded.
+type KeySet struct {
+	dir   string
+	grace time.Duration
+	clock Clock
+
+	mu         sync.RWMutex
+	keys       []SigningKey
+	lastReload time.Time
+}
+
+// NewKeySet creates a key set from the given keys which isn't backed by a directory.
+func NewKeySet(grace time.Duration, keys ...SigningKey) *KeySet {
+	k := &KeySet{grace: grace, clock: time.Now}
+	k.set(keys)
+	return k
+}
+
+// NewHMACKeySet creates a key set with a single shared secret. Tokens without a key id
+// are verified with this key.
+func NewHMACKeySet(secret string) *KeySet {
+	return NewKeySet(0, SigningKey{
+		Method:  jwt.SigningMethodHS256,
+		Private: []byte(secret),
+		Public:  []byte(secret),
+	})
+}
+
+// LoadKeySet loads all PEM encoded private keys from a directory. The file name without
+// the extension is used as the key id. Ed25519 and RSA keys are supported.
+func LoadKeySet(dir string, grace time.Duration) (*KeySet, error) {
+	k := &KeySet{dir: dir, grace: grace, clock: time.Now}
+	if err := k.Reload(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// WithClock sets the clock of the key set.
+func (k *KeySet) WithClock(clock Clock) *KeySet {
+	k.clock = clock
+	return k
+}
+
+// Reload reads the keys from the directory again.
+func (k *KeySet) Reload() error {
+	if k.dir == "" {
+		return nil
+	}
+	files, err := filepath.Glob(filepath.Join(k.dir, "*.pem"))
+	if err != nil {
+		return err
+	}
+	keys := make([]SigningKey, 0, len(files))
+	for _, f := range files {
+		key, err := loadSigningKey(f)
+		if err != nil {
+			return fmt.Errorf("failed to load signing key %s: %w", f, err)
+		}
+		keys = append(keys, key)
+	}
+	k.mu.Lock()
+	k.lastReload = k.clock()
+	k.mu.Unlock()
+	k.set(keys)
+	return nil
+}
+
+// Rotate generates a new Ed25519 key which immediately becomes the signing key and removes
+// keys whose grace period has passed.
+func (k *KeySet) Rotate() (SigningKey, error) {
+	if k.dir == "" {
+		return SigningKey{}, errors.New("key set is not backed by a directory")
+	}
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return SigningKey{}, err
+	}
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return SigningKey{}, err
+	}
+	now := k.clock().UTC()
+	key := SigningKey{
+		ID:      now.Format("20060102T150405Z") + "-" + hex.EncodeToString(suffix),
+		Method:  jwt.SigningMethodEdDSA,
+		Private: private,
+		Public:  public,
+		Created: now,
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return SigningKey{}, err
+	}
+	f, err := os.OpenFile(filepath.Join(k.dir, key.ID+".pem"), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return SigningKey{}, err
+	}
+	block := &pem.Block{
+		Type:    "PRIVATE KEY",
+		Headers: map[string]string{keyCreatedHeader: now.Format(time.RFC3339)},
+		Bytes:   der,
+	}
+	if err := pem.Encode(f, block); err != nil {
+		f.Close()
+		return SigningKey{}, err
+	}
+	if err := f.Close(); err != nil {
+		return SigningKey{}, err
+	}
+	if err := k.Reload(); err != nil {
+		return SigningKey{}, err
+	}
+	for _, expired := range k.expired() {
+		if err := os.Remove(filepath.Join(k.dir, expired.ID+".pem")); err != nil && !os.IsNotExist(err) {
+			return SigningKey{}, err
+		}
+	}
+	return key, k.Reload()
+}
+
+// RotateIfOlderThan rotates the signing key if it was created more than interval ago.
+func (k *KeySet) RotateIfOlderThan(interval time.Duration) (bool, error) {
+	current, err := k.SigningKey()
+	if err == nil && k.clock().Sub(current.Created) < interval {
+		return false, nil
+	}
+	if _, err := k.Rotate(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// SigningKey returns the newest key.
+func (k *KeySet) SigningKey() (SigningKey, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if len(k.keys) == 0 {
+		return SigningKey{}, errors.New("no signing key available")
+	}
+	return k.keys[len(k.keys)-1], nil
+}
+
+// VerificationKey returns the key with the given id if it's still allowed to verify tokens.
+// Unknown ids trigger a reload so keys rotated by another replica are picked up.
+func (k *KeySet) VerificationKey(kid string) (SigningKey, error) {
+	if key, ok := k.find(kid); ok {
+		return key, nil
+	}
+	k.mu.RLock()
+	reload := k.dir != "" && k.clock().Sub(k.lastReload) >= keyReloadInterval
+	k.mu.RUnlock()
+	if reload {
+		if err := k.Reload(); err != nil {
+			return SigningKey{}, err
+		}
+		if key, ok := k.find(kid); ok {
+			return key, nil
+		}
+	}
+	return SigningKey{}, fmt.Errorf("unknown key id %q", kid)
+}
+
+// JWKS returns the public keys which are currently valid for verification. Shared
+// secrets are never published.
+func (k *KeySet) JWKS() []JSONWebKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	jwks := make([]JSONWebKey, 0, len(k.keys))
+	for i, key := range k.keys {
+		if !k.valid(i) {
+			continue
+		}
+		switch pub := key.Public.(type) {
+		case ed25519.PublicKey:
+			jwks = append(jwks, JSONWebKey{
+				Kty: "OKP",
+				Kid: key.ID,
+				Use: "sig",
+				Alg: key.Method.Alg(),
+				Crv: "Ed25519",
+				X:   base64.RawURLEncoding.EncodeToString(pub),
+			})
+		case *rsa.PublicKey:
+			jwks = append(jwks, JSONWebKey{
+				Kty: "RSA",
+				Kid: key.ID,
+				Use: "sig",
+				Alg: key.Method.Alg(),
+				N:   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+			})
+		}
+	}
+	return jwks
+}
+
+// Sign signs the claims with the current signing key.
+func (k *KeySet) Sign(claims jwt.Claims) (string, error) {
+	key, err := k.SigningKey()
+	if err != nil {
+		return "", err
+	}
+	token := jwt.NewWithClaims(key.Method, claims)
+	if key.ID != "" {
+		token.Header["kid"] = key.ID
+	}
+	return token.SignedString(key.Private)
+}
+
+// KeyFunc looks up the verification key for a token by its key id.
+func (k *KeySet) KeyFunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	key, err := k.VerificationKey(kid)
+	if err != nil {
+		return nil, err
+	}
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	return key.Public, nil
+}
+
+func (k *KeySet) set(keys []SigningKey) {
+	sort.SliceStable(keys, func(i, j int) bool {
+		if keys[i].Created.Equal(keys[j].Created) {
+			return keys[i].ID < keys[j].ID
+		}
+		return keys[i].Created.Before(keys[j].Created)
+	})
+	k.mu.Lock()
+	k.keys = keys
+	k.mu.Unlock()
+}
+
+func (k *KeySet) find(kid string) (SigningKey, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	for i, key := range k.keys {
+		if key.ID == kid && k.valid(i) {
+			return key, true
+		}
+	}
+	return SigningKey{}, false
+}
+
+// valid reports whether the key at index i may still verify tokens. Callers must hold the lock.
+func (k *KeySet) valid(i int) bool {
+	if i == len(k.keys)-1 {
+		return true
+	}
+	supersededAt := k.keys[i+1].Created
+	return k.clock().Before(supersededAt.Add(k.grace))
+}
+
+func (k *KeySet) expired() []SigningKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	expired := make([]SigningKey, 0)
+	for i, key := range k.keys {
+		if !k.valid(i) {
+			expired = append(expired, key)
+		}
+	}
+	return expired
+}
+
+func loadSigningKey(path string) (SigningKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return SigningKey{}, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return SigningKey{}, errors.New("no PEM data found")
+	}
+	key := SigningKey{ID: strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))}
+	if created, ok := block.Headers[keyCreatedHeader]; ok {
+		if key.Created, err = time.Parse(time.RFC3339, created); err != nil {
+			return SigningKey{}, err
+		}
+	} else {
+		info, err := os.Stat(path)
+		if err != nil {
+			return SigningKey{}, err
+		}
+		key.Created = info.ModTime()
+	}
+
+	var private interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		private, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		private, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return SigningKey{}, fmt.Errorf("unsupported PEM type %q", block.Type)
+	}
+	if err != nil {
+		return SigningKey{}, err
+	}
+	switch p := private.(type) {
+	case ed25519.PrivateKey:
+		key.Method = jwt.SigningMethodEdDSA
+		key.Private = p
+		key.Public = p.Public()
+	case *rsa.PrivateKey:
+		key.Method = jwt.SigningMethodRS256
+		key.Private = p
+		key.Public = &p.PublicKey
+	default:
+		return SigningKey{}, fmt.Errorf("unsupported key type %T", private)
+	}
+	return key, nil
+}
+
+// RunRotation rotates the signing key once it is older than interval until ctx is done. It also
+// reloads the directory regularly to pick up keys rotated by other replicas.
+func (k *KeySet) RunRotation(ctx context.Context, interval time.Duration) {
+	check := interval / 10
+	if check > time.Hour {
+		check = time.Hour
+	}
+	if check < time.Minute {
+		check = time.Minute
+	}
+	ticker := time.NewTicker(check)
+	defer ticker.Stop()
+	for {
+		if err := k.Reload(); err != nil {
+			config.Opts.Logger.Error().Err(err).Msg("Failed to reload signing keys")
+		} else if rotated, err := k.RotateIfOlderThan(interval); err != nil {
+			config.Opts.Logger.Error().Err(err).Msg("Failed to rotate signing key")
+		} else if rotated {
+			config.Opts.Logger.Info().Msg("Rotated token signing key")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeySet_Rotate(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	keys, err := LoadKeySet(dir, time.Hour)
+	assert.NoError(t, err)
+	keys.WithClock(func() time.Time { return now })
+
+	_, err = keys.SigningKey()
+	assert.EqualError(t, err, "no signing key available")
+
+	rotated, err := keys.RotateIfOlderThan(24 * time.Hour)
+	assert.NoError(t, err)
+	assert.True(t, rotated)
+	first, err := keys.SigningKey()
+	assert.NoError(t, err)
+	assert.Equal(t, "EdDSA", first.Method.Alg())
+
+	token, err := keys.Sign(jwt.MapClaims{"email": "test@test.com"})
+	assert.NoError(t, err)
+
+	// not old enough to rotate yet
+	now = now.Add(time.Hour)
+	rotated, err = keys.RotateIfOlderThan(24 * time.Hour)
+	assert.NoError(t, err)
+	assert.False(t, rotated)
+
+	now = now.Add(24 * time.Hour)
+	rotated, err = keys.RotateIfOlderThan(24 * time.Hour)
+	assert.NoError(t, err)
+	assert.True(t, rotated)
+	second, err := keys.SigningKey()
+	assert.NoError(t, err)
+	assert.NotEqual(t, first.ID, second.ID)
+
+	// the old key still verifies during the grace period
+	_, err = jwt.Parse(token, keys.KeyFunc)
+	assert.NoError(t, err)
+	assert.Len(t, keys.JWKS(), 2)
+
+	// and is removed once it has passed
+	now = now.Add(2 * time.Hour)
+	_, err = jwt.Parse(token, keys.KeyFunc)
+	assert.Error(t, err)
+	assert.Len(t, keys.JWKS(), 1)
+	_, err = keys.Rotate()
+	assert.NoError(t, err)
+	files, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	assert.NoError(t, err)
+	assert.Len(t, files, 2)
+}
+
+func TestKeySet_LoadRSA(t *testing.T) {
+	dir := t.TempDir()
+	private, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	data := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(private)})
+	err = ioutil.WriteFile(filepath.Join(dir, "staple-1.pem"), data, 0600)
+	assert.NoError(t, err)
+
+	keys, err := LoadKeySet(dir, time.Hour)
+	assert.NoError(t, err)
+	token, err := keys.Sign(jwt.MapClaims{"email": "test@test.com"})
+	assert.NoError(t, err)
+	parsed, err := jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
+		return &private.PublicKey, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "staple-1", parsed.Header["kid"])
+	assert.Equal(t, "RS256", parsed.Header["alg"])
+
+	jwks := keys.JWKS()
+	assert.Len(t, jwks, 1)
+	assert.Equal(t, "RSA", jwks[0].Kty)
+	assert.Equal(t, "staple-1", jwks[0].Kid)
+
+	// tokens signed with a different algorithm for the same key id are rejected
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"email": "test@test.com"})
+	forged.Header["kid"] = "staple-1"
+	raw, err := forged.SignedString([]byte("secret"))
+	assert.NoError(t, err)
+	_, err = jwt.Parse(raw, keys.KeyFunc)
+	assert.Error(t, err)
+}
@@ -0,0 +1,237 @@
+package service
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SMTPSecurity is how the connection to the SMTP server is secured.
+type SMTPSecurity string
+
+const (
+	// SMTPStartTLS upgrades a plain connection with STARTTLS and fails if the server doesn't offer it.
+	SMTPStartTLS SMTPSecurity = "starttls"
+	// SMTPImplicitTLS connects with TLS right away, usually on port 465.
+	SMTPImplicitTLS SMTPSecurity = "tls"
+	// SMTPPlain doesn't encrypt the connection. Credentials are only sent to localhost.
+	SMTPPlain SMTPSecurity = "none"
+)
+
+const (
+	// smtpTimeout bounds connecting and every message sent over a connection.
+	smtpTimeout = 30 * time.Second
+	// smtpIdleTimeout is how long an unused connection is kept open for the next message.
+	smtpIdleTimeout = time.Minute
+)
+
+// SMTPConfig configures the SMTPNotifier.
+type SMTPConfig struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	Security SMTPSecurity
+	// From is the sender address of the notifications.
+	From string
+	// TLS is used for STARTTLS and implicit TLS. By default the server certificate is
+	// verified against the system roots and Host.
+	TLS *tls.Config
+}
+
+// SMTPNotifier sends notifications through an SMTP server. The connection is kept open
+// and reused by the following notifications until it has been idle for a minute.
+type SMTPNotifier struct {
+	config SMTPConfig
+	// sender is the envelope address of From.
+	sender   string
+	renderer MailRenderer
+	clock    Clock
+
+	mu       sync.Mutex
+	conn     net.Conn
+	client   *smtp.Client
+	lastUsed time.Time
+}
+
+// NewSMTPNotifier creates a notifier which sends mail through the configured server.
+func NewSMTPNotifier(cfg SMTPConfig) (*SMTPNotifier, error) {
+	if cfg.Host == "" {
+		return nil, errors.New("smtp host is required")
+	}
+	if cfg.From == "" {
+		return nil, errors.New("smtp from address is required")
+	}
+	from, err := mail.ParseAddress(cfg.From)
+	if err != nil {
+		return nil, fmt.Errorf("invalid smtp from address: %w", err)
+	}
+	switch cfg.Security {
+	case SMTPStartTLS, SMTPImplicitTLS, SMTPPlain:
+	case "":
+		cfg.Security = SMTPStartTLS
+	default:
+		return nil, fmt.Errorf("unknown smtp security: %s", cfg.Security)
+	}
+	if cfg.Port == 0 {
+		cfg.Port = 587
+		if cfg.Security == SMTPImplicitTLS {
+			cfg.Port = 465
+		}
+	}
+	return &SMTPNotifier{config: cfg, sender: from.Address, renderer: defaultMailRenderer, clock: time.Now}, nil
+}
+
+// WithRenderer sets the renderer of the notifier.
+func (s *SMTPNotifier) WithRenderer(r MailRenderer) *SMTPNotifier {
+	s.renderer = r
+	return s
+}
+
+// WithClock sets the clock of the notifier.
+func (s *SMTPNotifier) WithClock(clock Clock) *SMTPNotifier {
+	s.clock = clock
+	return s
+}
+
+// Notify renders the notification and sends it to the user.
+func (s *SMTPNotifier) Notify(email string, event Event, payload string) error {
+	m, err := s.renderer.Render(email, event, payload)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reused := s.client != nil
+	if reused && s.clock().Sub(s.lastUsed) > smtpIdleTimeout {
+		s.closeLocked()
+		reused = false
+	}
+	if s.client == nil {
+		if err := s.dial(); err != nil {
+			return err
+		}
+	}
+	err = s.send(m)
+	var reply *textproto.Error
+	if err != nil && reused && !errors.As(err, &reply) {
+		// The server may have closed the idle connection; try once more on a new one.
+		s.closeLocked()
+		if err := s.dial(); err != nil {
+			return err
+		}
+		err = s.send(m)
+	}
+	if err != nil {
+		s.closeLocked()
+		return err
+	}
+	s.lastUsed = s.clock()
+	return nil
+}
+
+// Close quits the open connection, if any.
+func (s *SMTPNotifier) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client == nil {
+		return nil
+	}
+	err := s.client.Quit()
+	s.closeLocked()
+	return err
+}
+
+func (s *SMTPNotifier) closeLocked() {
+	if s.client != nil {
+		_ = s.client.Close()
+	}
+	s.client = nil
+	s.conn = nil
+}
+
+func (s *SMTPNotifier) tlsConfig() *tls.Config {
+	if s.config.TLS != nil {
+		return s.config.TLS.Clone()
+	}
+	return &tls.Config{ServerName: s.config.Host, MinVersion: tls.VersionTLS12}
+}
+
+func (s *SMTPNotifier) dial() error {
+	addr := net.JoinHostPort(s.config.Host, strconv.Itoa(s.config.Port))
+	dialer := &net.Dialer{Timeout: smtpTimeout}
+	var (
+		conn net.Conn
+		err  error
+	)
+	if s.config.Security == SMTPImplicitTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, s.tlsConfig())
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	if err := conn.SetDeadline(time.Now().Add(smtpTimeout)); err != nil {
+		_ = conn.Close()
+		return err
+	}
+	client, err := smtp.NewClient(conn, s.config.Host)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	if s.config.Security == SMTPStartTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			_ = client.Close()
+			return errors.New("smtp server doesn't support STARTTLS")
+		}
+		if err := client.StartTLS(s.tlsConfig()); err != nil {
+			_ = client.Close()
+			return err
+		}
+	}
+	if s.config.Username != "" {
+		if ok, _ := client.Extension("AUTH"); !ok {
+			_ = client.Close()
+			return errors.New("smtp server doesn't support AUTH")
+		}
+		auth := smtp.PlainAuth("", s.config.Username, s.config.Password, s.config.Host)
+		if err := client.Auth(auth); err != nil {
+			_ = client.Close()
+			return err
+		}
+	}
+	s.conn = conn
+	s.client = client
+	return nil
+}
+
+func (s *SMTPNotifier) send(m Mail) error {
+	if err := s.conn.SetDeadline(time.Now().Add(smtpTimeout)); err != nil {
+		return err
+	}
+	if err := s.client.Mail(s.sender); err != nil {
+		return err
+	}
+	if err := s.client.Rcpt(m.To); err != nil {
+		return err
+	}
+	w, err := s.client.Data()
+	if err != nil {
+		return err
+	}
+	if err := m.WriteMessage(w, s.config.From, s.clock()); err != nil {
+		_ = w.Close()
+		return err
+	}
+	return w.Close()
+}
@@ -0,0 +1,287 @@
+package service
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"net"
+	"net/mail"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSMTPServer accepts mail just well enough for net/smtp.
+type fakeSMTPServer struct {
+	listener net.Listener
+	tls      *tls.Config
+	// startTLS offers STARTTLS on plain connections.
+	startTLS bool
+
+	mu          sync.Mutex
+	connections int
+	auth        []string
+	messages    []string
+	senders     []string
+	// dropAfter closes every connection after this many messages.
+	dropAfter int
+}
+
+func newTestCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func newFakeSMTPServer(t *testing.T, implicitTLS, startTLS bool) (*fakeSMTPServer, *x509.CertPool) {
+	cert, pool := newTestCertificate(t)
+	s := &fakeSMTPServer{
+		tls:      &tls.Config{Certificates: []tls.Certificate{cert}},
+		startTLS: startTLS,
+	}
+	var err error
+	if implicitTLS {
+		s.listener, err = tls.Listen("tcp", "127.0.0.1:0", s.tls)
+	} else {
+		s.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	}
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = s.listener.Close() })
+	go func() {
+		for {
+			conn, err := s.listener.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.connections++
+			s.mu.Unlock()
+			go s.handle(conn)
+		}
+	}()
+	return s, pool
+}
+
+func (s *fakeSMTPServer) port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (s *fakeSMTPServer) handle(conn net.Conn) {
+	defer conn.Close()
+	_, secure := conn.(*tls.Conn)
+	r := bufio.NewReader(conn)
+	reply := func(line string) {
+		_, _ = conn.Write([]byte(line + "\r\n"))
+	}
+	reply("220 fake ESMTP")
+	sent := 0
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch verb {
+		case "EHLO":
+			if s.startTLS && !secure {
+				reply("250-fake")
+				reply("250-STARTTLS")
+			} else {
+				reply("250-fake")
+			}
+			reply("250 AUTH PLAIN")
+		case "STARTTLS":
+			reply("220 go ahead")
+			tlsConn := tls.Server(conn, s.tls)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn, secure = tlsConn, true
+			r = bufio.NewReader(conn)
+		case "AUTH":
+			fields := strings.Fields(line)
+			credentials, _ := base64.StdEncoding.DecodeString(fields[len(fields)-1])
+			s.mu.Lock()
+			s.auth = append(s.auth, string(credentials))
+			s.mu.Unlock()
+			reply("235 ok")
+		case "MAIL":
+			s.mu.Lock()
+			s.senders = append(s.senders, line)
+			s.mu.Unlock()
+			reply("250 ok")
+		case "RCPT":
+			if strings.Contains(line, "rejected@") {
+				reply("550 no such user")
+				continue
+			}
+			reply("250 ok")
+		case "DATA":
+			reply("354 go ahead")
+			var message strings.Builder
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				message.WriteString(strings.TrimPrefix(line, "."))
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, message.String())
+			dropAfter := s.dropAfter
+			s.mu.Unlock()
+			reply("250 queued")
+			sent++
+			if dropAfter > 0 && sent >= dropAfter {
+				return
+			}
+		case "RSET", "NOOP":
+			reply("250 ok")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 unknown command")
+		}
+	}
+}
+
+func (s *fakeSMTPServer) stats() (connections int, messages []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.connections, append([]string(nil), s.messages...)
+}
+
+func TestSMTPNotifier_StartTLS(t *testing.T) {
+	server, pool := newFakeSMTPServer(t, false, true)
+	notifier, err := NewSMTPNotifier(SMTPConfig{
+		Host:     "127.0.0.1",
+		Port:     server.port(),
+		Username: "staple",
+		Password: "secret",
+		From:     "Staple <no-reply@staple.test>",
+		TLS:      &tls.Config{RootCAs: pool, ServerName: "127.0.0.1"},
+	})
+	require.NoError(t, err)
+	defer notifier.Close()
+
+	require.NoError(t, notifier.Notify("test@test.com", GenerateConfirmCode, "12345"))
+	require.NoError(t, notifier.Notify("other@test.com", Welcome, ""))
+
+	// Both mails are sent over the same authenticated connection.
+	connections, messages := server.stats()
+	assert.Equal(t, 1, connections)
+	require.Len(t, messages, 2)
+	server.mu.Lock()
+	assert.Equal(t, []string{"\x00staple\x00secret"}, server.auth)
+	assert.True(t, strings.HasPrefix(server.senders[0], "MAIL FROM:<no-reply@staple.test>"))
+	server.mu.Unlock()
+
+	msg, err := mail.ReadMessage(strings.NewReader(messages[0]))
+	require.NoError(t, err)
+	assert.Equal(t, "test@test.com", msg.Header.Get("To"))
+	assert.Equal(t, "Staple <no-reply@staple.test>", msg.Header.Get("From"))
+	assert.Equal(t, "Your Staple confirm code", msg.Header.Get("Subject"))
+	assert.True(t, strings.HasPrefix(msg.Header.Get("Content-Type"), "multipart/alternative"))
+}
+
+func TestSMTPNotifier_ImplicitTLS(t *testing.T) {
+	server, pool := newFakeSMTPServer(t, true, false)
+	notifier, err := NewSMTPNotifier(SMTPConfig{
+		Host:     "127.0.0.1",
+		Port:     server.port(),
+		Security: SMTPImplicitTLS,
+		From:     "no-reply@staple.test",
+		TLS:      &tls.Config{RootCAs: pool, ServerName: "127.0.0.1"},
+	})
+	require.NoError(t, err)
+	defer notifier.Close()
+
+	require.NoError(t, notifier.Notify("test@test.com", AccountDeleted, ""))
+	_, messages := server.stats()
+	require.Len(t, messages, 1)
+	assert.Contains(t, messages[0], "Subject: Your Staple account has been deleted")
+
+	// Rejected recipients are reported without retrying.
+	err = notifier.Notify("rejected@test.com", AccountDeleted, "")
+	assert.EqualError(t, err, `550 "no such user"`)
+	connections, _ := server.stats()
+	assert.Equal(t, 1, connections)
+}
+
+func TestSMTPNotifier_Reconnect(t *testing.T) {
+	server, _ := newFakeSMTPServer(t, false, false)
+	server.dropAfter = 1
+	now := time.Now()
+	notifier, err := NewSMTPNotifier(SMTPConfig{
+		Host:     "127.0.0.1",
+		Port:     server.port(),
+		Security: SMTPPlain,
+		From:     "no-reply@staple.test",
+	})
+	require.NoError(t, err)
+	notifier.WithClock(func() time.Time { return now })
+	defer notifier.Close()
+
+	// The server closed the connection after the first mail.
+	require.NoError(t, notifier.Notify("test@test.com", Welcome, ""))
+	require.NoError(t, notifier.Notify("test@test.com", Welcome, ""))
+	connections, messages := server.stats()
+	assert.Equal(t, 2, connections)
+	assert.Len(t, messages, 2)
+
+	// Idle connections aren't reused.
+	server.mu.Lock()
+	server.dropAfter = 0
+	server.mu.Unlock()
+	now = now.Add(2 * smtpIdleTimeout)
+	require.NoError(t, notifier.Notify("test@test.com", Welcome, ""))
+	connections, _ = server.stats()
+	assert.Equal(t, 3, connections)
+}
+
+func TestSMTPNotifier_Config(t *testing.T) {
+	server, _ := newFakeSMTPServer(t, false, false)
+	notifier, err := NewSMTPNotifier(SMTPConfig{Host: "127.0.0.1", Port: server.port(), From: "no-reply@staple.test"})
+	require.NoError(t, err)
+	err = notifier.Notify("test@test.com", Welcome, "")
+	assert.EqualError(t, err, "smtp server doesn't support STARTTLS")
+
+	_, err = NewSMTPNotifier(SMTPConfig{Host: "127.0.0.1", From: "no-reply@staple.test", Security: "ssl"})
+	assert.EqualError(t, err, "unknown smtp security: ssl")
+	_, err = NewSMTPNotifier(SMTPConfig{Host: "127.0.0.1"})
+	assert.EqualError(t, err, "smtp from address is required")
+
+	notifier, err = NewSMTPNotifier(SMTPConfig{Host: "mail.staple.test", From: "no-reply@staple.test", Security: SMTPImplicitTLS})
+	require.NoError(t, err)
+	assert.Equal(t, 465, notifier.config.Port)
+}
@@ -2,66 +2,162 @@ package service
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"time"
 
 	"github.com/staple-org/staple/internal/models"
 	"github.com/staple-org/staple/internal/storage"
+	"github.com/staple-org/staple/pkg/config"
 )
 
 // Staplerer describes a stapler service which takes care of managing
 // the user's staples.
 type Staplerer interface {
 	Create(staple models.Staple, user *models.User) (err error)
+	CreateArchived(staple models.Staple, user *models.User) (err error)
 	Delete(user *models.User, id int) (err error)
 	Get(user *models.User, id int) (staple *models.Staple, err error)
 	GetNext(user *models.User) (staple *models.Staple, err error)
 	List(user *models.User) (staples []models.Staple, err error)
 	Archive(user *models.User, id int) (err error)
 	ShowArchive(use *models.User) ([]models.Staple, error)
+	All(user *models.User) ([]models.Staple, error)
+	Export(user *models.User, format ExportFormat, scope ExportScope, w io.Writer) error
+	RecentArchive(user *models.User, limit int) ([]models.Staple, error)
+	Trash(user *models.User) ([]models.Staple, error)
+	Restore(user *models.User, id int) (*models.Staple, error)
 }
 
+// QueueFullError is returned when a staple is created in a queue which already holds the
+// maximum number of staples.
+type QueueFullError struct {
+	Max   int
+	Count int
+}
+
+func (e *QueueFullError) Error() string {
+	return fmt.Sprintf("cannot create more staples than %d; current count is: %d", e.Max, e.Count)
+}
+
+// ErrNotInTrash is returned when a staple which isn't in the trash is restored.
+var ErrNotInTrash = errors.New("staple is not in the trash")
+
 // Stapler defines a stapler which stores the staples in Postgres DB.
 type Stapler struct {
-	ctx    context.Context
-	storer storage.StapleStorer
+	ctx            context.Context
+	storer         storage.StapleStorer
+	events         EventBus
+	clock          Clock
+	trashRetention time.Duration
 }
 
 // NewStapler creates a new Postgres based Stapler which will have a connection to a DB.
+// Deleted staples are kept in the trash forever.
 func NewStapler(storer storage.StapleStorer) Stapler {
-	return Stapler{ctx: context.Background(), storer: storer}
+	return Stapler{ctx: context.Background(), storer: storer, clock: time.Now}
+}
+
+// WithEvents returns a copy of the stapler which publishes the staple lifecycle on bus.
+// Created, archived, deleted and restored staples are left to the outbox relay if the
+// storer records them itself. QueueEmptied and QuotaReached are always published right
+// after the change, so they are lost if the process stops in between.
+func (p Stapler) WithEvents(bus EventBus) Stapler {
+	p.events = bus
+	return p
+}
+
+// WithClock returns a copy of the stapler which uses the given clock for its events.
+func (p Stapler) WithClock(clock Clock) Stapler {
+	p.clock = clock
+	return p
 }
 
-// Create creates a new Staple for the given user.
+// WithTrashRetention returns a copy of the stapler which purges staples that have been in
+// the trash for longer than retention. Zero keeps them forever.
+func (p Stapler) WithTrashRetention(retention time.Duration) Stapler {
+	p.trashRetention = retention
+	return p
+}
+
+// Create adds a new Staple to the queue of the given user unless the queue is full.
 // noinspection GoErrorStringFormat
 func (p Stapler) Create(staple models.Staple, user *models.User) error {
+	staple.Archived = false
+	staple.ArchivedAt = nil
 	list, err := p.List(user)
 	if err != nil {
 		return err
 	}
 	if len(list) >= user.MaxStaples {
-		return fmt.Errorf("cannot create more staples than %d; current count is: %d", user.MaxStaples, len(list))
+		return &QueueFullError{Max: user.MaxStaples, Count: len(list)}
+	}
+	if err := p.storer.Create(staple, user.ID); err != nil {
+		return err
+	}
+	p.publishStaple(StapleCreated{EventMeta: p.newMeta(user), Staple: staple})
+	if len(list)+1 == user.MaxStaples {
+		p.publish(QuotaReached{EventMeta: p.newMeta(user), MaxStaples: user.MaxStaples, Count: len(list) + 1})
+	}
+	return nil
+}
+
+// CreateArchived adds a new Staple straight to the archive of the given user. Archived
+// staples don't count against the maximum number of staples, so this is only meant for
+// imports and for feeds which overflow into the archive. Staples without an archive time
+// are taken as archived when they were created.
+func (p Stapler) CreateArchived(staple models.Staple, user *models.User) error {
+	archivedAt := p.clock()
+	if staple.ArchivedAt != nil {
+		archivedAt = *staple.ArchivedAt
+	} else if !staple.CreatedAt.IsZero() {
+		archivedAt = staple.CreatedAt
+	}
+	archivedAt = archivedAt.UTC()
+	staple.Archived = true
+	staple.ArchivedAt = &archivedAt
+	if err := p.storer.Create(staple, user.ID); err != nil {
+		return err
 	}
-	return p.storer.Create(staple, user.Email)
+	p.publishStaple(StapleCreated{EventMeta: p.newMeta(user), Staple: staple})
+	return nil
 }
 
-// Delete deletes a given staple for a user.
+// Delete moves a given staple of a user to the trash.
 func (p Stapler) Delete(user *models.User, id int) (err error) {
-	return p.storer.Delete(user.Email, id)
+	if !p.events.active() {
+		return p.storer.Delete(user.ID, id)
+	}
+	staple, err := p.storer.Get(user.ID, id)
+	if err != nil {
+		return err
+	}
+	if err := p.storer.Delete(user.ID, id); err != nil {
+		return err
+	}
+	if staple != nil {
+		p.publishStaple(StapleDeleted{EventMeta: p.newMeta(user), Staple: *staple})
+		if !staple.Archived {
+			p.publishIfQueueEmpty(user)
+		}
+	}
+	return nil
 }
 
 // GetNext will retrieve the oldest entry from the list that is not archived.
 func (p Stapler) GetNext(user *models.User) (*models.Staple, error) {
-	return p.storer.Oldest(user.Email)
+	return p.storer.Oldest(user.ID)
 }
 
 // Get retrieves a Staple for a given user with ID.
 func (p Stapler) Get(user *models.User, id int) (*models.Staple, error) {
-	return p.storer.Get(user.Email, id)
+	return p.storer.Get(user.ID, id)
 }
 
 // List lists all staples for a given user.
 func (p Stapler) List(user *models.User) ([]models.Staple, error) {
-	list, err := p.storer.List(user.Email)
+	list, err := p.storer.List(user.ID)
 	if err != nil {
 		return nil, err
 	}
@@ -71,12 +167,147 @@ func (p Stapler) List(user *models.User) ([]models.Staple, error) {
 // Archive will archive a staple which isn't removed but rather not shown in the queue.
 // Archived Staples can be retrieved and vewied in any order.
 func (p Stapler) Archive(user *models.User, id int) error {
-	return p.storer.Archive(user.Email, id)
+	if !p.events.active() {
+		return p.storer.Archive(user.ID, id)
+	}
+	before, err := p.storer.Get(user.ID, id)
+	if err != nil {
+		return err
+	}
+	if err := p.storer.Archive(user.ID, id); err != nil {
+		return err
+	}
+	if before == nil || before.Archived {
+		return nil
+	}
+	staple, err := p.storer.Get(user.ID, id)
+	if err != nil || staple == nil {
+		staple = before
+	}
+	p.publishStaple(StapleArchived{EventMeta: p.newMeta(user), Staple: *staple})
+	p.publishIfQueueEmpty(user)
+	return nil
 }
 
 // ShowArchive returns the list of archived staples for a given user.
 // This must support pagination.
 // For now return everything and the frontend will paginate.
 func (p Stapler) ShowArchive(user *models.User) ([]models.Staple, error) {
-	return p.storer.ShowArchive(user.Email)
+	return p.storer.ShowArchive(user.ID)
+}
+
+// All returns every staple of a user including the archived ones and their content.
+func (p Stapler) All(user *models.User) ([]models.Staple, error) {
+	return p.storer.All(user.ID)
+}
+
+// RecentArchive returns up to limit archived staples with their content, the most recently
+// archived first.
+func (p Stapler) RecentArchive(user *models.User, limit int) ([]models.Staple, error) {
+	return p.storer.RecentArchive(user.ID, limit)
+}
+
+// Trash returns the staples in the trash of a user, the most recently deleted first.
+func (p Stapler) Trash(user *models.User) ([]models.Staple, error) {
+	return p.storer.Trash(user.ID)
+}
+
+// Restore takes a staple out of the trash. A staple of the queue is back at the position it
+// had before it was deleted and counts against the maximum number of staples again.
+func (p Stapler) Restore(user *models.User, id int) (*models.Staple, error) {
+	trash, err := p.storer.Trash(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	var trashed *models.Staple
+	for i := range trash {
+		if trash[i].ID == id {
+			trashed = &trash[i]
+			break
+		}
+	}
+	if trashed == nil {
+		return nil, fmt.Errorf("%w: %d", ErrNotInTrash, id)
+	}
+	count := 0
+	if !trashed.Archived {
+		list, err := p.List(user)
+		if err != nil {
+			return nil, err
+		}
+		if len(list) >= user.MaxStaples {
+			return nil, &QueueFullError{Max: user.MaxStaples, Count: len(list)}
+		}
+		count = len(list)
+	}
+	staple, err := p.storer.Restore(user.ID, id)
+	if err != nil {
+		return nil, err
+	}
+	// Restored or purged in the meantime.
+	if staple == nil {
+		return nil, fmt.Errorf("%w: %d", ErrNotInTrash, id)
+	}
+	p.publishStaple(StapleRestored{EventMeta: p.newMeta(user), Staple: *staple})
+	if !staple.Archived && count+1 == user.MaxStaples {
+		p.publish(QuotaReached{EventMeta: p.newMeta(user), MaxStaples: user.MaxStaples, Count: count + 1})
+	}
+	return staple, nil
+}
+
+// PurgeTrash removes the staples which have been in the trash for longer than the retention.
+func (p Stapler) PurgeTrash() (int64, error) {
+	if p.trashRetention <= 0 {
+		return 0, nil
+	}
+	return p.storer.PurgeTrash(p.clock().Add(-p.trashRetention))
+}
+
+// RunTrashPurge purges the trash once per interval until ctx is done.
+func (p Stapler) RunTrashPurge(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if n, err := p.PurgeTrash(); err != nil {
+			config.Opts.Logger.Error().Err(err).Msg("Failed to purge the trash")
+		} else if n > 0 {
+			config.Opts.Logger.Info().Int64("purged", n).Msg("Purged the trash")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p Stapler) newMeta(user *models.User) EventMeta {
+	return newEventMeta(user.ID, p.clock())
+}
+
+// publish publishes an event. The change has been stored already, so failing handlers are
+// only logged by the bus.
+func (p Stapler) publish(event DomainEvent) {
+	_ = p.events.Publish(event)
+}
+
+// publishStaple publishes a created, archived, deleted or restored staple unless the storer
+// recorded it in the outbox already.
+func (p Stapler) publishStaple(event DomainEvent) {
+	if recorder, ok := p.storer.(storage.EventRecorder); ok && recorder.RecordsEvents() {
+		return
+	}
+	p.publish(event)
+}
+
+// publishIfQueueEmpty publishes QueueEmptied after the last staple of the queue was removed.
+func (p Stapler) publishIfQueueEmpty(user *models.User) {
+	next, err := p.storer.Oldest(user.ID)
+	if err != nil {
+		config.Opts.Logger.Error().Err(err).Msg("Failed to check whether the queue is empty")
+		return
+	}
+	if next == nil {
+		p.publish(QueueEmptied{EventMeta: p.newMeta(user)})
+	}
 }
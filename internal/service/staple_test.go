@@ -139,6 +139,25 @@ func TestStapler_Create_Error_MaxStaples(t *testing.T) {
 	assert.EqualError(t, err, "cannot create more staples than 0; current count is: 0")
 }
 
+func TestStapler_CreateArchived(t *testing.T) {
+	store := storage.NewInMemoryStapleStorer()
+	stapler := NewStapler(store)
+	u := models.User{ID: "user", MaxStaples: 0}
+	createdAt := time.Date(1980, 1, 1, 1, 1, 1, 0, time.UTC)
+	staple := models.Staple{Name: "test-staple", Content: "test-content", CreatedAt: createdAt, Archived: true}
+
+	// only CreateArchived skips the maximum number of staples
+	err := stapler.Create(staple, &u)
+	assert.EqualError(t, err, "cannot create more staples than 0; current count is: 0")
+	err = stapler.CreateArchived(models.Staple{Name: "test-staple", Content: "test-content", CreatedAt: createdAt}, &u)
+	assert.NoError(t, err)
+	archive, err := stapler.ShowArchive(&u)
+	assert.NoError(t, err)
+	assert.Len(t, archive, 1)
+	assert.True(t, archive[0].Archived)
+	assert.Equal(t, createdAt, *archive[0].ArchivedAt)
+}
+
 func TestStapler_Create_Error_FromStorage(t *testing.T) {
 	store := storage.NewInMemoryStapleStorer()
 	store.Err = fmt.Errorf("unable to store staple")
@@ -154,3 +173,68 @@ func TestStapler_Create_Error_FromStorage(t *testing.T) {
 	err := stapler.Create(staple, &u)
 	assert.EqualError(t, err, "unable to store staple")
 }
+
+func TestStapler_Trash(t *testing.T) {
+	store := storage.NewInMemoryStapleStorer()
+	bus := NewEventBus()
+	var restored []models.Staple
+	bus.Subscribe(models.EventStapleRestored, func(event DomainEvent) error {
+		restored = append(restored, event.(StapleRestored).Staple)
+		return nil
+	})
+	stapler := NewStapler(store).WithEvents(bus)
+	u := models.User{ID: "user", MaxStaples: 3}
+	for i, name := range []string{"first", "second", "third"} {
+		err := stapler.Create(models.Staple{Name: name, CreatedAt: time.Date(1980, 1, i+1, 0, 0, 0, 0, time.UTC)}, &u)
+		assert.NoError(t, err)
+	}
+
+	// Deleting the head of the queue moves it to the trash.
+	assert.NoError(t, stapler.Delete(&u, 0))
+	next, err := stapler.GetNext(&u)
+	assert.NoError(t, err)
+	assert.Equal(t, "second", next.Name)
+	trash, err := stapler.Trash(&u)
+	assert.NoError(t, err)
+	if assert.Len(t, trash, 1) {
+		assert.Equal(t, "first", trash[0].Name)
+		assert.NotNil(t, trash[0].DeletedAt)
+	}
+
+	// The trash doesn't count against the maximum number of staples.
+	assert.NoError(t, stapler.Create(models.Staple{Name: "fourth", CreatedAt: time.Date(1980, 1, 4, 0, 0, 0, 0, time.UTC)}, &u))
+	_, err = stapler.Restore(&u, 0)
+	var full *QueueFullError
+	assert.ErrorAs(t, err, &full)
+
+	// A restored staple is back at its old position.
+	assert.NoError(t, stapler.Delete(&u, 3))
+	got, err := stapler.Restore(&u, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "first", got.Name)
+	assert.Nil(t, got.DeletedAt)
+	next, err = stapler.GetNext(&u)
+	assert.NoError(t, err)
+	assert.Equal(t, "first", next.Name)
+	if assert.Len(t, restored, 1) {
+		assert.Equal(t, 0, restored[0].ID)
+	}
+	_, err = stapler.Restore(&u, 0)
+	assert.ErrorIs(t, err, ErrNotInTrash)
+	_, err = stapler.Restore(&u, 42)
+	assert.ErrorIs(t, err, ErrNotInTrash)
+
+	// The trash is kept forever without a retention.
+	n, err := stapler.PurgeTrash()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), n)
+	later := stapler.WithTrashRetention(time.Hour).WithClock(func() time.Time { return time.Now().Add(2 * time.Hour) })
+	n, err = later.PurgeTrash()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+	trash, err = stapler.Trash(&u)
+	assert.NoError(t, err)
+	assert.Empty(t, trash)
+	_, err = stapler.Restore(&u, 3)
+	assert.ErrorIs(t, err, ErrNotInTrash)
+}
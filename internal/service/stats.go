@@ -0,0 +1,275 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/staple-org/staple/internal/models"
+	"github.com/staple-org/staple/internal/storage"
+)
+
+const (
+	// statsDefaultDays is the number of days up to today covered by default.
+	statsDefaultDays = 30
+	// statsMaxDays is the longest range statistics are computed for.
+	statsMaxDays = 366
+	// statsCacheTTL is how long computed statistics are reused. Changes to the staples of a
+	// user clear their statistics earlier, but only on the replica which saw the change.
+	statsCacheTTL = time.Minute
+	// statsDateLayout is the format of the dates of a range.
+	statsDateLayout = "2006-01-02"
+)
+
+// statsQueueAgeDays are the ages in days at which the queue age distribution is split.
+var statsQueueAgeDays = []int{1, 7, 30, 90}
+
+// ErrInvalidStatsRange is returned when statistics are requested for an invalid range.
+var ErrInvalidStatsRange = errors.New("invalid stats range")
+
+// StatsRange selects the statistics of a user. From and To are inclusive dates formatted
+// as 2006-01-02 in Timezone. Empty fields default to the last 30 days in UTC by day.
+type StatsRange struct {
+	From     string
+	To       string
+	Period   string
+	Timezone string
+}
+
+// Stats computes the reading statistics of users. Statistics are cached for a short while
+// per user and range.
+type Stats struct {
+	store storage.StatsStorer
+	clock Clock
+	ttl   time.Duration
+	cache *statsCache
+}
+
+// NewStats creates a statistics service which computes with store.
+func NewStats(store storage.StatsStorer) Stats {
+	return Stats{store: store, clock: time.Now, ttl: statsCacheTTL, cache: newStatsCache()}
+}
+
+// WithClock returns a copy of the service which uses the given clock.
+func (s Stats) WithClock(clock Clock) Stats {
+	s.clock = clock
+	return s
+}
+
+// WithCacheTTL returns a copy of the service which reuses statistics for ttl. Zero turns
+// the cache off.
+func (s Stats) WithCacheTTL(ttl time.Duration) Stats {
+	s.ttl = ttl
+	return s
+}
+
+// SubscribeTo records the staples deleted and restored on bus and clears the cached statistics of users
+// whose staples change. The handlers are synchronous so an event from the outbox is only
+// marked as published once its deletion is recorded.
+func (s Stats) SubscribeTo(bus EventBus) {
+	for _, name := range []string{models.EventStapleCreated, models.EventStapleArchived, models.EventStapleDeleted, models.EventStapleRestored} {
+		bus.Subscribe(name, s.handle)
+	}
+}
+
+func (s Stats) handle(event DomainEvent) error {
+	meta := event.Meta()
+	switch e := event.(type) {
+	case StapleDeleted:
+		if err := s.store.RecordDeletion(meta.ID, meta.UserID, e.Staple, meta.OccurredAt); err != nil {
+			return err
+		}
+	case StapleRestored:
+		if err := s.store.ForgetDeletion(meta.UserID, e.Staple.ID); err != nil {
+			return err
+		}
+	}
+	s.cache.clear(meta.UserID)
+	return nil
+}
+
+// Get returns the statistics of a user in a range.
+func (s Stats) Get(user models.User, r StatsRange) (models.StapleStats, error) {
+	if r.Period == "" {
+		r.Period = models.StatsDaily
+	}
+	if r.Timezone == "" {
+		r.Timezone = "UTC"
+	}
+	if r.Period != models.StatsDaily && r.Period != models.StatsWeekly {
+		return models.StapleStats{}, fmt.Errorf("%w: period must be day or week", ErrInvalidStatsRange)
+	}
+	loc, err := time.LoadLocation(r.Timezone)
+	if err != nil {
+		return models.StapleStats{}, fmt.Errorf("%w: unknown timezone %q", ErrInvalidStatsRange, r.Timezone)
+	}
+	now := s.clock().In(loc)
+	to := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+	if r.To != "" {
+		if to, err = time.ParseInLocation(statsDateLayout, r.To, loc); err != nil {
+			return models.StapleStats{}, fmt.Errorf("%w: to must be a date such as 2006-01-02", ErrInvalidStatsRange)
+		}
+	}
+	from := to.AddDate(0, 0, 1-statsDefaultDays)
+	if r.From != "" {
+		if from, err = time.ParseInLocation(statsDateLayout, r.From, loc); err != nil {
+			return models.StapleStats{}, fmt.Errorf("%w: from must be a date such as 2006-01-02", ErrInvalidStatsRange)
+		}
+	}
+	if to.Before(from) {
+		return models.StapleStats{}, fmt.Errorf("%w: from is after to", ErrInvalidStatsRange)
+	}
+	if !from.AddDate(0, 0, statsMaxDays).After(to) {
+		return models.StapleStats{}, fmt.Errorf("%w: the range is longer than %d days", ErrInvalidStatsRange, statsMaxDays)
+	}
+	r.From, r.To = from.Format(statsDateLayout), to.Format(statsDateLayout)
+
+	if stats, ok := s.cache.get(user.ID, r, now); ok {
+		return stats, nil
+	}
+	stats, err := s.compute(user, r, from, to, now)
+	if err != nil {
+		return models.StapleStats{}, err
+	}
+	if s.ttl > 0 {
+		s.cache.set(user.ID, r, stats, now.Add(s.ttl))
+	}
+	return stats, nil
+}
+
+// compute computes the statistics between the local midnights from and to, inclusive.
+func (s Stats) compute(user models.User, r StatsRange, from, to, now time.Time) (models.StapleStats, error) {
+	end := to.AddDate(0, 0, 1)
+	active, err := s.store.Activity(user.ID, from, end, from.Location())
+	if err != nil {
+		return models.StapleStats{}, err
+	}
+	inQueue, err := s.store.TimeInQueue(user.ID, from, end)
+	if err != nil {
+		return models.StapleStats{}, err
+	}
+	bounds := make([]time.Duration, len(statsQueueAgeDays))
+	for i, days := range statsQueueAgeDays {
+		bounds[i] = time.Duration(days) * 24 * time.Hour
+	}
+	counts, err := s.store.QueueAges(user.ID, now, bounds)
+	if err != nil {
+		return models.StapleStats{}, err
+	}
+
+	stats := models.StapleStats{
+		From:                  r.From,
+		To:                    r.To,
+		Timezone:              r.Timezone,
+		Period:                r.Period,
+		Activity:              make([]models.StapleActivity, 0),
+		AverageSecondsInQueue: int64(inQueue / time.Second),
+		QueueAges:             make([]models.QueueAge, 0, len(counts)),
+		GeneratedAt:           now.UTC(),
+	}
+	for i, count := range counts {
+		age := models.QueueAge{Count: count}
+		if i > 0 {
+			age.MinDays = statsQueueAgeDays[i-1]
+		}
+		if i < len(statsQueueAgeDays) {
+			maxDays := statsQueueAgeDays[i]
+			age.MaxDays = &maxDays
+		}
+		stats.QueueAges = append(stats.QueueAges, age)
+	}
+
+	byDate := make(map[string]models.StapleActivity, len(active))
+	for _, a := range active {
+		byDate[a.Date] = a
+	}
+	streak := 0
+	for day := from; day.Before(end); day = day.AddDate(0, 0, 1) {
+		a := byDate[day.Format(statsDateLayout)]
+		stats.Added += a.Added
+		stats.Archived += a.Archived
+		stats.DeletedUnread += a.DeletedUnread
+		// Nothing read on the last day doesn't end the current streak yet.
+		switch {
+		case a.Archived > 0:
+			streak++
+			stats.CurrentStreak = streak
+		case day.Equal(to):
+		default:
+			streak = 0
+			stats.CurrentStreak = 0
+		}
+		if streak > stats.LongestStreak {
+			stats.LongestStreak = streak
+		}
+
+		start := day
+		if r.Period == models.StatsWeekly {
+			start = day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+		}
+		date := start.Format(statsDateLayout)
+		if n := len(stats.Activity); n == 0 || stats.Activity[n-1].Date != date {
+			stats.Activity = append(stats.Activity, models.StapleActivity{Date: date})
+		}
+		period := &stats.Activity[len(stats.Activity)-1]
+		period.Added += a.Added
+		period.Archived += a.Archived
+		period.DeletedUnread += a.DeletedUnread
+	}
+	return stats, nil
+}
+
+// statsEntry is cached statistics.
+type statsEntry struct {
+	stats   models.StapleStats
+	expires time.Time
+}
+
+// statsCache keeps computed statistics per user and range.
+type statsCache struct {
+	mu      sync.Mutex
+	entries map[string]map[StatsRange]statsEntry
+}
+
+func newStatsCache() *statsCache {
+	return &statsCache{entries: make(map[string]map[StatsRange]statsEntry)}
+}
+
+func (c *statsCache) get(userID string, r StatsRange, now time.Time) (models.StapleStats, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[userID][r]
+	if !ok || !now.Before(entry.expires) {
+		return models.StapleStats{}, false
+	}
+	return entry.stats, true
+}
+
+// set caches statistics and drops every expired entry, so users who stopped asking for
+// statistics don't keep them in memory.
+func (c *statsCache) set(userID string, r StatsRange, stats models.StapleStats, expires time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, entries := range c.entries {
+		for key, entry := range entries {
+			if !stats.GeneratedAt.Before(entry.expires) {
+				delete(entries, key)
+			}
+		}
+		if len(entries) == 0 {
+			delete(c.entries, id)
+		}
+	}
+	if c.entries[userID] == nil {
+		c.entries[userID] = make(map[StatsRange]statsEntry)
+	}
+	c.entries[userID][r] = statsEntry{stats: stats, expires: expires}
+}
+
+// clear drops the statistics of a user.
+func (c *statsCache) clear(userID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, userID)
+}
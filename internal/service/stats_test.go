@@ -0,0 +1,176 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/staple-org/staple/internal/models"
+	"github.com/staple-org/staple/internal/storage"
+)
+
+func TestStats(t *testing.T) {
+	// A Wednesday.
+	now := time.Date(2020, 2, 19, 10, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	bus := NewEventBus()
+	staples := storage.NewInMemoryStapleStorer()
+	stapler := NewStapler(staples).WithEvents(bus).WithClock(clock)
+	stats := NewStats(storage.NewInMemoryStatsStorer(staples)).WithClock(clock)
+	stats.SubscribeTo(bus)
+	user := &models.User{ID: "user", MaxStaples: 25}
+
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2020, 2, day, hour, minute, 0, 0, time.UTC)
+	}
+	for _, s := range []struct {
+		name     string
+		created  time.Time
+		archived time.Time
+	}{
+		{name: "week old", created: at(10, 9, 0), archived: at(17, 9, 0)},
+		{name: "quick", created: at(16, 12, 0), archived: at(18, 12, 0)},
+		{name: "late night", created: at(15, 23, 30), archived: at(16, 23, 30)},
+		{name: "yesterday", created: at(18, 8, 0)},
+		{name: "today", created: at(19, 8, 0)},
+		{name: "old", created: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{name: "skipped", created: at(12, 10, 0)},
+	} {
+		staple := models.Staple{Name: s.name, CreatedAt: s.created}
+		if s.archived.IsZero() {
+			require.NoError(t, stapler.Create(staple, user))
+			continue
+		}
+		archivedAt := s.archived
+		staple.ArchivedAt = &archivedAt
+		require.NoError(t, stapler.CreateArchived(staple, user))
+	}
+	now = at(19, 9, 0)
+	require.NoError(t, stapler.Delete(user, 6))
+	now = at(19, 10, 0)
+
+	got, err := stats.Get(*user, StatsRange{From: "2020-02-10", To: "2020-02-19"})
+	require.NoError(t, err)
+	assert.Equal(t, "2020-02-10", got.From)
+	assert.Equal(t, "2020-02-19", got.To)
+	assert.Equal(t, "UTC", got.Timezone)
+	assert.Equal(t, models.StatsDaily, got.Period)
+	require.Len(t, got.Activity, 10)
+	assert.Equal(t, models.StapleActivity{Date: "2020-02-16", Added: 1, Archived: 1}, got.Activity[6])
+	assert.Equal(t, models.StapleActivity{Date: "2020-02-19", Added: 1, DeletedUnread: 1}, got.Activity[9])
+	assert.Equal(t, 6, got.Added)
+	assert.Equal(t, 3, got.Archived)
+	assert.Equal(t, 1, got.DeletedUnread)
+	assert.Equal(t, int64((10*24*time.Hour/3)/time.Second), got.AverageSecondsInQueue)
+	assert.Equal(t, 3, got.CurrentStreak)
+	assert.Equal(t, 3, got.LongestStreak)
+	one, seven, thirty, ninety := 1, 7, 30, 90
+	assert.Equal(t, []models.QueueAge{
+		{MinDays: 0, MaxDays: &one, Count: 1},
+		{MinDays: 1, MaxDays: &seven, Count: 1},
+		{MinDays: 7, MaxDays: &thirty, Count: 0},
+		{MinDays: 30, MaxDays: &ninety, Count: 1},
+		{MinDays: 90, Count: 0},
+	}, got.QueueAges)
+
+	weekly, err := stats.Get(*user, StatsRange{From: "2020-02-10", To: "2020-02-19", Period: models.StatsWeekly})
+	require.NoError(t, err)
+	assert.Equal(t, []models.StapleActivity{
+		{Date: "2020-02-10", Added: 4, Archived: 1},
+		{Date: "2020-02-17", Added: 2, Archived: 2, DeletedUnread: 1},
+	}, weekly.Activity)
+
+	// Days are local to the timezone.
+	berlin, err := stats.Get(*user, StatsRange{From: "2020-02-10", To: "2020-02-19", Timezone: "Europe/Berlin"})
+	require.NoError(t, err)
+	assert.Equal(t, models.StapleActivity{Date: "2020-02-16", Added: 2}, berlin.Activity[6])
+	assert.Equal(t, models.StapleActivity{Date: "2020-02-17", Archived: 2}, berlin.Activity[7])
+	assert.Equal(t, 2, berlin.CurrentStreak)
+
+	// The last 30 days by default.
+	defaults, err := stats.Get(*user, StatsRange{})
+	require.NoError(t, err)
+	assert.Equal(t, "2020-01-21", defaults.From)
+	assert.Equal(t, "2020-02-19", defaults.To)
+	assert.Len(t, defaults.Activity, 30)
+
+	// Cached until the staples change or the cache expires.
+	require.NoError(t, staples.Create(models.Staple{Name: "behind the back", CreatedAt: now}, user.ID))
+	got, err = stats.Get(*user, StatsRange{From: "2020-02-10", To: "2020-02-19"})
+	require.NoError(t, err)
+	assert.Equal(t, 6, got.Added)
+	now = now.Add(statsCacheTTL)
+	got, err = stats.Get(*user, StatsRange{From: "2020-02-10", To: "2020-02-19"})
+	require.NoError(t, err)
+	assert.Equal(t, 7, got.Added)
+	require.NoError(t, stapler.Create(models.Staple{Name: "new", CreatedAt: now}, user))
+	got, err = stats.Get(*user, StatsRange{From: "2020-02-10", To: "2020-02-19"})
+	require.NoError(t, err)
+	assert.Equal(t, 8, got.Added)
+
+	for _, r := range []StatsRange{
+		{Period: "month"},
+		{Timezone: "Mars/Olympus"},
+		{From: "yesterday"},
+		{To: "2020-02-30"},
+		{From: "2020-02-19", To: "2020-02-18"},
+		{From: "2019-02-18", To: "2020-02-19"},
+	} {
+		_, err := stats.Get(*user, r)
+		assert.ErrorIs(t, err, ErrInvalidStatsRange, "%+v", r)
+	}
+	_, err = stats.Get(*user, StatsRange{From: "2019-02-19", To: "2020-02-19"})
+	assert.NoError(t, err)
+}
+
+func TestStats_Streaks(t *testing.T) {
+	now := time.Date(2020, 2, 19, 10, 0, 0, 0, time.UTC)
+	staples := storage.NewInMemoryStapleStorer()
+	stats := NewStats(storage.NewInMemoryStatsStorer(staples)).WithClock(func() time.Time { return now }).WithCacheTTL(0)
+	for _, day := range []int{1, 2, 3, 4, 10, 11, 17, 18, 19} {
+		archivedAt := time.Date(2020, 2, day, 12, 0, 0, 0, time.UTC)
+		require.NoError(t, staples.Create(models.Staple{CreatedAt: archivedAt.Add(-time.Hour), Archived: true, ArchivedAt: &archivedAt}, "user"))
+	}
+	got, err := stats.Get(models.User{ID: "user"}, StatsRange{From: "2020-02-01", To: "2020-02-19"})
+	require.NoError(t, err)
+	assert.Equal(t, 3, got.CurrentStreak)
+	assert.Equal(t, 4, got.LongestStreak)
+
+	// Ends when a day before the last one was missed.
+	got, err = stats.Get(models.User{ID: "user"}, StatsRange{From: "2020-02-01", To: "2020-02-13"})
+	require.NoError(t, err)
+	assert.Equal(t, 0, got.CurrentStreak)
+	got, err = stats.Get(models.User{ID: "user"}, StatsRange{From: "2020-02-01", To: "2020-02-12"})
+	require.NoError(t, err)
+	assert.Equal(t, 2, got.CurrentStreak)
+}
+
+func TestStats_Trash(t *testing.T) {
+	now := time.Date(2020, 2, 19, 10, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	bus := NewEventBus()
+	staples := storage.NewInMemoryStapleStorer()
+	stapler := NewStapler(staples).WithEvents(bus).WithClock(clock)
+	stats := NewStats(storage.NewInMemoryStatsStorer(staples)).WithClock(clock)
+	stats.SubscribeTo(bus)
+	user := &models.User{ID: "user", MaxStaples: 25}
+	require.NoError(t, stapler.Create(models.Staple{Name: "mis-click", CreatedAt: now.Add(-time.Hour)}, user))
+
+	// A staple in the trash is deleted unread until it is restored.
+	require.NoError(t, stapler.Delete(user, 0))
+	got, err := stats.Get(*user, StatsRange{})
+	require.NoError(t, err)
+	assert.Equal(t, 1, got.Added)
+	assert.Equal(t, 1, got.DeletedUnread)
+	assert.Equal(t, 0, got.QueueAges[0].Count)
+
+	_, err = stapler.Restore(user, 0)
+	require.NoError(t, err)
+	got, err = stats.Get(*user, StatsRange{})
+	require.NoError(t, err)
+	assert.Equal(t, 1, got.Added)
+	assert.Equal(t, 0, got.DeletedUnread)
+	assert.Equal(t, 1, got.QueueAges[0].Count)
+}
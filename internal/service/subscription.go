@@ -0,0 +1,378 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/staple-org/staple/internal/models"
+	"github.com/staple-org/staple/internal/storage"
+	"github.com/staple-org/staple/pkg/config"
+)
+
+const (
+	// maxFeedSize is the largest feed document which is read.
+	maxFeedSize = 5 << 20
+	// feedFetchTimeout bounds a single request for a feed.
+	feedFetchTimeout = 30 * time.Second
+	// subscriptionUserAgent identifies the poller to feed servers.
+	subscriptionUserAgent = "Staple feed subscriber (+https://github.com/staple-org/staple)"
+)
+
+// SubscriptionPolicy decides what happens to new entries of a subscription when the queue is full.
+type SubscriptionPolicy string
+
+const (
+	// SubscriptionWait keeps new entries until the queue has room again so none are lost.
+	SubscriptionWait SubscriptionPolicy = "wait"
+	// SubscriptionSkip drops new entries which don't fit into the queue.
+	SubscriptionSkip SubscriptionPolicy = "skip"
+	// SubscriptionArchive puts new entries which don't fit into the queue into the archive.
+	SubscriptionArchive SubscriptionPolicy = "archive"
+)
+
+// ErrInvalidFeed is returned when a subscription can't be created because the URL or the
+// document it points to isn't a usable feed.
+var ErrInvalidFeed = errors.New("invalid feed")
+
+// Subscriber polls external feeds the users subscribed to and adds new entries to their queues.
+type Subscriber struct {
+	store   storage.SubscriptionStorer
+	stapler Staplerer
+	users   UserHandlerer
+	client  *http.Client
+	clock   Clock
+}
+
+// NewSubscriber creates a subscriber which adds staples with the given stapler. Feeds on
+// private and loopback addresses are refused unless config.Opts.Subscriptions.AllowPrivate is set.
+func NewSubscriber(store storage.SubscriptionStorer, stapler Staplerer, users UserHandlerer) Subscriber {
+	return Subscriber{
+		store:   store,
+		stapler: stapler,
+		users:   users,
+		client:  newPublicClient(config.Opts.Subscriptions.AllowPrivate, feedFetchTimeout),
+		clock:   time.Now,
+	}
+}
+
+// WithHTTPClient returns a copy of the subscriber which fetches feeds with the given client.
+func (s Subscriber) WithHTTPClient(client *http.Client) Subscriber {
+	s.client = client
+	return s
+}
+
+// WithClock returns a copy of the subscriber which uses the given clock.
+func (s Subscriber) WithClock(clock Clock) Subscriber {
+	s.clock = clock
+	return s
+}
+
+// Subscribe subscribes the user to a feed. The feed is fetched right away to check that it
+// is a feed; the entries it currently contains are remembered as seen so only entries
+// published from now on are added to the queue.
+func (s Subscriber) Subscribe(user models.User, feedURL string, policy SubscriptionPolicy) (models.Subscription, error) {
+	policy, err := validateSubscriptionPolicy(policy)
+	if err != nil {
+		return models.Subscription{}, err
+	}
+	u, err := url.Parse(strings.TrimSpace(feedURL))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return models.Subscription{}, fmt.Errorf("%w: url must be an absolute http or https url", ErrInvalidFeed)
+	}
+	now := s.clock().UTC()
+	sub := models.Subscription{
+		UserID:    user.ID,
+		URL:       u.String(),
+		Policy:    string(policy),
+		CheckedAt: now,
+		CreatedAt: now,
+	}
+	feed, notModified, err := s.fetch(&sub)
+	if err != nil {
+		return models.Subscription{}, fmt.Errorf("%w: %s", ErrInvalidFeed, err)
+	}
+	if notModified {
+		return models.Subscription{}, fmt.Errorf("%w: unexpected 304 response", ErrInvalidFeed)
+	}
+	sub.Title = feed.Title
+	sub, err = s.store.Create(sub)
+	if err != nil {
+		return models.Subscription{}, err
+	}
+	keys := make([]string, 0, len(feed.Entries))
+	for _, e := range feed.Entries {
+		keys = append(keys, e.Key)
+	}
+	if err := s.store.MarkSeen(sub.ID, keys, now); err != nil {
+		return models.Subscription{}, err
+	}
+	return sub, nil
+}
+
+// Subscriptions lists the subscriptions of a user.
+func (s Subscriber) Subscriptions(user models.User) ([]models.Subscription, error) {
+	return s.store.List(user.ID)
+}
+
+// SetPolicy changes what happens to new entries of a subscription when the queue is full.
+func (s Subscriber) SetPolicy(user models.User, id int, policy SubscriptionPolicy) (models.Subscription, error) {
+	policy, err := validateSubscriptionPolicy(policy)
+	if err != nil {
+		return models.Subscription{}, err
+	}
+	sub, err := s.store.Get(user.ID, id)
+	if err != nil {
+		return models.Subscription{}, err
+	}
+	if sub == nil {
+		return models.Subscription{}, errors.New("subscription not found")
+	}
+	sub.Policy = string(policy)
+	return *sub, s.store.Update(*sub)
+}
+
+// Unsubscribe removes a subscription. Staples which were already added are kept.
+func (s Subscriber) Unsubscribe(user models.User, id int) error {
+	return s.store.Delete(user.ID, id)
+}
+
+// Poll fetches a subscribed feed and adds its new entries to the queue of the user, oldest
+// first. It returns the number of staples added. The outcome is stored with the subscription.
+func (s Subscriber) Poll(sub models.Subscription) (int, error) {
+	added, err := s.poll(&sub)
+	sub.CheckedAt = s.clock().UTC()
+	sub.LastError = ""
+	if err != nil {
+		sub.LastError = err.Error()
+	}
+	if updateErr := s.store.Update(sub); updateErr != nil && err == nil {
+		err = updateErr
+	}
+	return added, err
+}
+
+func (s Subscriber) poll(sub *models.Subscription) (int, error) {
+	user, err := s.users.Profile(models.User{ID: sub.UserID})
+	if err != nil {
+		return 0, err
+	}
+	// The validators are only stored once every entry has been handled. Otherwise the
+	// next request would be answered with 304 and the remaining entries never retried.
+	previous := *sub
+	feed, notModified, err := s.fetch(sub)
+	if err != nil || notModified {
+		return 0, err
+	}
+	if feed.Title != "" {
+		sub.Title = feed.Title
+	}
+	entries := oldestFirst(feed.Entries)
+	keys := make([]string, 0, len(entries))
+	for _, e := range entries {
+		keys = append(keys, e.Key)
+	}
+	seen, err := s.store.Seen(sub.ID, keys)
+	if err != nil {
+		sub.ETag, sub.LastModified = previous.ETag, previous.LastModified
+		return 0, err
+	}
+
+	added := 0
+	now := s.clock().UTC()
+	for _, e := range entries {
+		if seen[e.Key] {
+			continue
+		}
+		seen[e.Key] = true
+		staple := newFeedStaple(e, now)
+		err := s.stapler.Create(staple, user)
+		var full *QueueFullError
+		if errors.As(err, &full) {
+			switch SubscriptionPolicy(sub.Policy) {
+			case SubscriptionSkip:
+				err = nil
+			case SubscriptionArchive:
+				err = s.stapler.CreateArchived(staple, user)
+				if err == nil {
+					added++
+				}
+			default:
+				sub.ETag, sub.LastModified = previous.ETag, previous.LastModified
+				return added, nil
+			}
+		} else if err == nil {
+			added++
+		}
+		if err != nil {
+			sub.ETag, sub.LastModified = previous.ETag, previous.LastModified
+			return added, err
+		}
+		if err := s.store.MarkSeen(sub.ID, []string{e.Key}, now); err != nil {
+			sub.ETag, sub.LastModified = previous.ETag, previous.LastModified
+			return added, err
+		}
+	}
+	return added, nil
+}
+
+// PollDue polls every subscription which hasn't been polled for interval and returns how
+// many were polled. Errors of single feeds are stored with the subscription and logged.
+func (s Subscriber) PollDue(interval time.Duration) (int, error) {
+	due, err := s.store.Due(s.clock().Add(-interval))
+	if err != nil {
+		return 0, err
+	}
+	for _, sub := range due {
+		added, err := s.Poll(sub)
+		if err != nil {
+			config.Opts.Logger.Warn().Err(err).Int("subscription", sub.ID).Str("url", sub.URL).Msg("Failed to poll feed")
+			continue
+		}
+		if added > 0 {
+			config.Opts.Logger.Debug().Int("subscription", sub.ID).Int("added", added).Msg("Added staples from feed")
+		}
+	}
+	return len(due), nil
+}
+
+// RunPolling polls every subscription once per interval until ctx is done.
+func (s Subscriber) RunPolling(ctx context.Context, interval time.Duration) {
+	tick := interval
+	if tick > time.Minute {
+		tick = time.Minute
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	for {
+		if _, err := s.PollDue(interval); err != nil {
+			config.Opts.Logger.Error().Err(err).Msg("Failed to poll subscriptions")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// fetch requests the feed of a subscription conditionally and stores the new validators in it.
+func (s Subscriber) fetch(sub *models.Subscription) (externalFeed, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), feedFetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, sub.URL, nil)
+	if err != nil {
+		return externalFeed{}, false, err
+	}
+	req.Header.Set("User-Agent", subscriptionUserAgent)
+	req.Header.Set("Accept", "application/atom+xml, application/rss+xml, application/feed+json, application/xml;q=0.9, application/json;q=0.9, */*;q=0.8")
+	if sub.ETag != "" {
+		req.Header.Set("If-None-Match", sub.ETag)
+	}
+	if sub.LastModified != "" {
+		req.Header.Set("If-Modified-Since", sub.LastModified)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return externalFeed{}, false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return externalFeed{}, true, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return externalFeed{}, false, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxFeedSize+1))
+	if err != nil {
+		return externalFeed{}, false, err
+	}
+	if len(data) > maxFeedSize {
+		return externalFeed{}, false, errors.New("feed is too large")
+	}
+	feed, err := parseExternalFeed(data)
+	if err != nil {
+		return externalFeed{}, false, err
+	}
+	sub.ETag = resp.Header.Get("ETag")
+	sub.LastModified = resp.Header.Get("Last-Modified")
+	return feed, false, nil
+}
+
+// oldestFirst orders entries by their publication date. Feeds list the newest entry first,
+// so entries without dates are reversed.
+func oldestFirst(entries []externalEntry) []externalEntry {
+	ordered := make([]externalEntry, 0, len(entries))
+	dated := true
+	for i := len(entries) - 1; i >= 0; i-- {
+		ordered = append(ordered, entries[i])
+		dated = dated && !entries[i].Published.IsZero()
+	}
+	if dated {
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return ordered[i].Published.Before(ordered[j].Published)
+		})
+	}
+	return ordered
+}
+
+// newFeedStaple creates a staple from a feed entry. The link becomes the content; entries
+// without a link keep their text. The staple joins the end of the queue.
+func newFeedStaple(e externalEntry, now time.Time) models.Staple {
+	content := e.Link
+	if content == "" {
+		content = e.Content
+	}
+	name := e.Title
+	if name == "" {
+		name = e.Key
+	}
+	return models.Staple{
+		Name:      truncateName(name),
+		Content:   content,
+		CreatedAt: now,
+	}
+}
+
+func validateSubscriptionPolicy(policy SubscriptionPolicy) (SubscriptionPolicy, error) {
+	switch policy {
+	case "":
+		return SubscriptionWait, nil
+	case SubscriptionWait, SubscriptionSkip, SubscriptionArchive:
+		return policy, nil
+	}
+	return "", fmt.Errorf("%w: unknown policy %q", ErrInvalidFeed, policy)
+}
+
+// newPublicClient creates a client for requests to URLs supplied by users, like feeds and
+// webhooks. Unless allowPrivate is set it refuses to connect to loopback, private and
+// link-local addresses so these URLs can't be used to reach internal services.
+func newPublicClient(allowPrivate bool, timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	if !allowPrivate {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+				return fmt.Errorf("refusing to connect to %s", host)
+			}
+			return nil
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	transport.Proxy = nil
+	return &http.Client{Transport: transport, Timeout: timeout}
+}
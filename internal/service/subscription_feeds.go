@@ -0,0 +1,208 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html/charset"
+)
+
+// externalFeed is an RSS, Atom or JSON Feed document.
+type externalFeed struct {
+	Title   string
+	Entries []externalEntry
+}
+
+// externalEntry is an entry of an external feed.
+type externalEntry struct {
+	// Key identifies the entry. It is the guid or id and falls back to the link.
+	Key       string
+	Title     string
+	Link      string
+	Content   string
+	Published time.Time
+}
+
+// parseExternalFeed parses RSS 2.0, Atom and JSON Feed documents. Entries without an id
+// and without a link are dropped since they can't be de-duplicated.
+func parseExternalFeed(data []byte) (externalFeed, error) {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) > 0 && trimmed[0] == '{' {
+		return parseJSONFeed(trimmed)
+	}
+	dec := xml.NewDecoder(bytes.NewReader(trimmed))
+	dec.CharsetReader = charset.NewReaderLabel
+	dec.Strict = false
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return externalFeed{}, errors.New("not a feed")
+		}
+		if err != nil {
+			return externalFeed{}, err
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch start.Name.Local {
+		case "rss":
+			return parseRSS(dec, start)
+		case "feed":
+			return parseAtom(dec, start)
+		}
+		return externalFeed{}, errors.New("unsupported feed format: " + start.Name.Local)
+	}
+}
+
+func parseRSS(dec *xml.Decoder, start xml.StartElement) (externalFeed, error) {
+	var doc struct {
+		Channel struct {
+			Title string `xml:"title"`
+			Items []struct {
+				Title       string `xml:"title"`
+				Link        string `xml:"link"`
+				GUID        string `xml:"guid"`
+				Description string `xml:"description"`
+				PubDate     string `xml:"pubDate"`
+			} `xml:"item"`
+		} `xml:"channel"`
+	}
+	if err := dec.DecodeElement(&doc, &start); err != nil {
+		return externalFeed{}, err
+	}
+	feed := externalFeed{Title: strings.TrimSpace(doc.Channel.Title)}
+	for _, item := range doc.Channel.Items {
+		feed.add(externalEntry{
+			Key:       strings.TrimSpace(item.GUID),
+			Title:     item.Title,
+			Link:      strings.TrimSpace(item.Link),
+			Content:   item.Description,
+			Published: parseFeedTime(item.PubDate),
+		})
+	}
+	return feed, nil
+}
+
+func parseAtom(dec *xml.Decoder, start xml.StartElement) (externalFeed, error) {
+	var doc struct {
+		Title   string `xml:"title"`
+		Entries []struct {
+			ID    string `xml:"id"`
+			Title string `xml:"title"`
+			Links []struct {
+				Rel  string `xml:"rel,attr"`
+				Href string `xml:"href,attr"`
+			} `xml:"link"`
+			Content   string `xml:"content"`
+			Summary   string `xml:"summary"`
+			Published string `xml:"published"`
+			Updated   string `xml:"updated"`
+		} `xml:"entry"`
+	}
+	if err := dec.DecodeElement(&doc, &start); err != nil {
+		return externalFeed{}, err
+	}
+	feed := externalFeed{Title: strings.TrimSpace(doc.Title)}
+	for _, e := range doc.Entries {
+		entry := externalEntry{
+			Key:       strings.TrimSpace(e.ID),
+			Title:     e.Title,
+			Content:   e.Content,
+			Published: parseFeedTime(e.Published),
+		}
+		if entry.Content == "" {
+			entry.Content = e.Summary
+		}
+		if entry.Published.IsZero() {
+			entry.Published = parseFeedTime(e.Updated)
+		}
+		for _, l := range e.Links {
+			if l.Rel == "" || l.Rel == "alternate" {
+				entry.Link = strings.TrimSpace(l.Href)
+				break
+			}
+		}
+		feed.add(entry)
+	}
+	return feed, nil
+}
+
+func parseJSONFeed(data []byte) (externalFeed, error) {
+	var doc struct {
+		Version string `json:"version"`
+		Title   string `json:"title"`
+		Items   []struct {
+			ID            json.RawMessage `json:"id"`
+			URL           string          `json:"url"`
+			ExternalURL   string          `json:"external_url"`
+			Title         string          `json:"title"`
+			ContentText   string          `json:"content_text"`
+			ContentHTML   string          `json:"content_html"`
+			DatePublished string          `json:"date_published"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return externalFeed{}, err
+	}
+	if !strings.HasPrefix(doc.Version, "https://jsonfeed.org/version/") {
+		return externalFeed{}, errors.New("not a JSON Feed")
+	}
+	feed := externalFeed{Title: strings.TrimSpace(doc.Title)}
+	for _, item := range doc.Items {
+		// Version 1 allowed numeric ids.
+		id := strings.Trim(strings.TrimSpace(string(item.ID)), `"`)
+		entry := externalEntry{
+			Key:       id,
+			Title:     item.Title,
+			Link:      strings.TrimSpace(item.URL),
+			Content:   item.ContentText,
+			Published: parseFeedTime(item.DatePublished),
+		}
+		if entry.Link == "" {
+			entry.Link = strings.TrimSpace(item.ExternalURL)
+		}
+		if entry.Content == "" {
+			entry.Content = item.ContentHTML
+		}
+		feed.add(entry)
+	}
+	return feed, nil
+}
+
+// add appends an entry if it can be identified.
+func (f *externalFeed) add(e externalEntry) {
+	e.Title = strings.TrimSpace(e.Title)
+	if e.Key == "" {
+		e.Key = e.Link
+	}
+	if e.Key == "" {
+		return
+	}
+	f.Entries = append(f.Entries, e)
+}
+
+var feedTimeLayouts = []string{
+	time.RFC3339,
+	time.RFC1123Z,
+	time.RFC1123,
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	"Mon, 2 Jan 2006 15:04:05 MST",
+	"2 Jan 2006 15:04:05 -0700",
+}
+
+// parseFeedTime parses the date formats used by feeds. It returns zero for unknown formats.
+func parseFeedTime(value string) time.Time {
+	value = strings.TrimSpace(value)
+	for _, layout := range feedTimeLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t.UTC()
+		}
+	}
+	return time.Time{}
+}
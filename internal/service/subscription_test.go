@@ -0,0 +1,219 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/staple-org/staple/internal/models"
+	"github.com/staple-org/staple/internal/storage"
+)
+
+// testFeedServer serves an RSS feed whose items can be changed by the test. It answers
+// conditional requests with 304 while the feed is unchanged.
+type testFeedServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	items    []string
+	version  int
+	requests int
+	notMod   int
+}
+
+func newTestFeedServer() *testFeedServer {
+	f := &testFeedServer{}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.requests++
+		etag := fmt.Sprintf(`"v%d"`, f.version)
+		if r.Header.Get("If-None-Match") == etag {
+			f.notMod++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Content-Type", "application/rss+xml")
+		var items strings.Builder
+		// Newest first, like real feeds.
+		for i := len(f.items) - 1; i >= 0; i-- {
+			fmt.Fprintf(&items, "<item><title>%[1]s</title><link>https://blog.example/%[1]s</link><guid>%[1]s</guid></item>", f.items[i])
+		}
+		fmt.Fprintf(w, `<?xml version="1.0"?><rss version="2.0"><channel><title>Blog</title>%s</channel></rss>`, items.String())
+	}))
+	return f
+}
+
+func (f *testFeedServer) publish(items ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.items = append(f.items, items...)
+	f.version++
+}
+
+func newTestSubscriber(t *testing.T, maxStaples int) (Subscriber, Stapler, *models.User) {
+	users := NewUserHandler(context.Background(), storage.NewInMemoryUserStorer(), NewBufferNotifier())
+	u := models.User{Email: "test@test.com", Password: "password"}
+	assert.NoError(t, users.Register(u))
+	id, err := users.UserID(u)
+	assert.NoError(t, err)
+	u.ID = id
+	assert.NoError(t, users.SetMaximumStaples(u, maxStaples))
+	u.MaxStaples = maxStaples
+	stapler := NewStapler(storage.NewInMemoryStapleStorer())
+	subscriber := NewSubscriber(storage.NewInMemorySubscriptionStorer(), stapler, users).WithHTTPClient(http.DefaultClient)
+	return subscriber, stapler, &u
+}
+
+func TestSubscriber_Poll(t *testing.T) {
+	feed := newTestFeedServer()
+	defer feed.Close()
+	feed.publish("old")
+	subscriber, stapler, u := newTestSubscriber(t, 10)
+
+	sub, err := subscriber.Subscribe(*u, feed.URL, "")
+	assert.NoError(t, err)
+	assert.Equal(t, "Blog", sub.Title)
+	assert.Equal(t, string(SubscriptionWait), sub.Policy)
+	_, err = subscriber.Subscribe(*u, feed.URL, "")
+	assert.ErrorIs(t, err, storage.ErrSubscriptionExists)
+
+	added, err := subscriber.Poll(sub)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, added, "entries which existed when subscribing are skipped")
+	assert.Equal(t, 1, feed.notMod, "the second request is conditional")
+
+	feed.publish("first", "second")
+	subs, err := subscriber.Subscriptions(*u)
+	assert.NoError(t, err)
+	added, err = subscriber.Poll(subs[0])
+	assert.NoError(t, err)
+	assert.Equal(t, 2, added)
+	next, err := stapler.GetNext(u)
+	assert.NoError(t, err)
+	assert.Equal(t, "first", next.Name)
+	assert.Equal(t, "https://blog.example/first", next.Content)
+
+	// The same entries again, for example after the server lost its ETag.
+	feed.publish()
+	subs, _ = subscriber.Subscriptions(*u)
+	added, err = subscriber.Poll(subs[0])
+	assert.NoError(t, err)
+	assert.Equal(t, 0, added, "entries are de-duplicated by guid")
+	list, _ := stapler.List(u)
+	assert.Len(t, list, 2)
+}
+
+func TestSubscriber_Poll_FullQueue(t *testing.T) {
+	for _, tc := range []struct {
+		policy   SubscriptionPolicy
+		added    int
+		queued   int
+		archived int
+	}{
+		{policy: SubscriptionSkip, added: 1, queued: 1, archived: 0},
+		{policy: SubscriptionArchive, added: 3, queued: 1, archived: 2},
+		{policy: SubscriptionWait, added: 1, queued: 1, archived: 0},
+	} {
+		t.Run(string(tc.policy), func(tt *testing.T) {
+			feed := newTestFeedServer()
+			defer feed.Close()
+			subscriber, stapler, u := newTestSubscriber(tt, 1)
+			sub, err := subscriber.Subscribe(*u, feed.URL, tc.policy)
+			assert.NoError(tt, err)
+
+			feed.publish("a", "b", "c")
+			added, err := subscriber.Poll(sub)
+			assert.NoError(tt, err)
+			assert.Equal(tt, tc.added, added)
+			queue, _ := stapler.List(u)
+			archive, _ := stapler.ShowArchive(u)
+			assert.Len(tt, queue, tc.queued)
+			assert.Len(tt, archive, tc.archived)
+
+			// Make room in the queue and poll again.
+			assert.NoError(tt, stapler.Archive(u, queue[0].ID))
+			subs, _ := subscriber.Subscriptions(*u)
+			added, err = subscriber.Poll(subs[0])
+			assert.NoError(tt, err)
+			if tc.policy == SubscriptionWait {
+				assert.Equal(tt, 1, added, "waiting entries are added once there is room")
+				next, _ := stapler.GetNext(u)
+				assert.Equal(tt, "b", next.Name)
+			} else {
+				assert.Equal(tt, 0, added)
+			}
+		})
+	}
+}
+
+func TestSubscriber_Subscribe_Errors(t *testing.T) {
+	subscriber, _, u := newTestSubscriber(t, 10)
+	_, err := subscriber.Subscribe(*u, "ftp://example.com/feed", "")
+	assert.ErrorIs(t, err, ErrInvalidFeed)
+	_, err = subscriber.Subscribe(*u, "https://example.com/feed", "sometimes")
+	assert.ErrorIs(t, err, ErrInvalidFeed)
+
+	page := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "<html><body>not a feed</body></html>")
+	}))
+	defer page.Close()
+	_, err = subscriber.Subscribe(*u, page.URL, "")
+	assert.ErrorIs(t, err, ErrInvalidFeed)
+
+	// The default client refuses to connect to loopback addresses.
+	feed := newTestFeedServer()
+	defer feed.Close()
+	_, err = subscriber.WithHTTPClient(newPublicClient(false, feedFetchTimeout)).Subscribe(*u, feed.URL, "")
+	assert.ErrorIs(t, err, ErrInvalidFeed)
+	assert.Contains(t, err.Error(), "refusing to connect")
+}
+
+func TestParseExternalFeed(t *testing.T) {
+	atom := `<?xml version="1.0" encoding="utf-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+  <title>Atom Blog</title>
+  <entry><id>tag:blog,2020:2</id><title>Newer</title><link rel="alternate" href="https://blog.example/2"/><published>2020-01-02T00:00:00Z</published></entry>
+  <entry><id>tag:blog,2020:1</id><title>Older</title><link href="https://blog.example/1"/><updated>2020-01-01T00:00:00Z</updated></entry>
+</feed>`
+	feed, err := parseExternalFeed([]byte(atom))
+	assert.NoError(t, err)
+	assert.Equal(t, "Atom Blog", feed.Title)
+	assert.Len(t, feed.Entries, 2)
+	entries := oldestFirst(feed.Entries)
+	assert.Equal(t, "tag:blog,2020:1", entries[0].Key)
+	assert.Equal(t, "https://blog.example/1", entries[0].Link)
+
+	jsonFeed := `{"version": "https://jsonfeed.org/version/1.1", "title": "JSON Blog", "items": [
+		{"id": "2", "url": "https://blog.example/2", "title": "Newer", "date_published": "2020-01-02T00:00:00Z"},
+		{"id": 1, "content_text": "A note without a link", "date_published": "2020-01-01T00:00:00Z"}
+	]}`
+	feed, err = parseExternalFeed([]byte(jsonFeed))
+	assert.NoError(t, err)
+	assert.Equal(t, "JSON Blog", feed.Title)
+	entries = oldestFirst(feed.Entries)
+	assert.Equal(t, "1", entries[0].Key)
+	staple := newFeedStaple(entries[0], time.Unix(0, 0))
+	assert.Equal(t, "1", staple.Name)
+	assert.Equal(t, "A note without a link", staple.Content)
+
+	rss := `<rss version="2.0"><channel><title>RSS Blog</title>
+<item><title>No guid</title><link>https://blog.example/no-guid</link><pubDate>Thu, 02 Jan 2020 00:00:00 +0000</pubDate></item>
+<item><title>Nothing to identify</title></item>
+</channel></rss>`
+	feed, err = parseExternalFeed([]byte(rss))
+	assert.NoError(t, err)
+	assert.Len(t, feed.Entries, 1)
+	assert.Equal(t, "https://blog.example/no-guid", feed.Entries[0].Key)
+	assert.Equal(t, time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC), feed.Entries[0].Published)
+
+	_, err = parseExternalFeed([]byte(`{"items": []}`))
+	assert.Error(t, err)
+}
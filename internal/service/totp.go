@@ -0,0 +1,108 @@
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// totpPeriod is the time step defined by RFC 6238.
+	totpPeriod = 30 * time.Second
+	// totpDigits is the number of digits a generated code has.
+	totpDigits = 6
+	// totpSkew is the number of time steps before and after the current one which are
+	// still accepted to allow for clock drift between the server and the user's device.
+	totpSkew = 1
+	// totpIssuer is displayed by authenticator apps next to the account name.
+	totpIssuer = "Staple"
+)
+
+// Clock returns the current time. It is injected into services which depend on time
+// so they can be tested with a fixed time.
+type Clock func() time.Time
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateTOTPSecret generates a new random base32 encoded secret for TOTP.
+func GenerateTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+// TOTPURI builds an otpauth URI which can be displayed as a QR code to enrol
+// an authenticator app.
+func TOTPURI(email, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", totpIssuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprintf("%d", totpDigits))
+	v.Set("period", fmt.Sprintf("%d", int(totpPeriod.Seconds())))
+	label := url.PathEscape(totpIssuer + ":" + email)
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
+
+// GenerateTOTPCode generates the code for a secret at a given time.
+func GenerateTOTPCode(secret string, t time.Time) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+	if err != nil {
+		return "", err
+	}
+	return hotp(key, uint64(totpStep(t)), totpDigits), nil
+}
+
+// ValidateTOTPCode checks a code against a secret at a given time allowing for
+// a small amount of clock drift. Codes of lastStep or an earlier time step are rejected
+// so a code can only be used once. The time step of an accepted code is returned and
+// has to be stored as the next lastStep.
+func ValidateTOTPCode(secret, code string, t time.Time, lastStep int64) (int64, bool) {
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	for i := -totpSkew; i <= totpSkew; i++ {
+		at := t.Add(time.Duration(i) * totpPeriod)
+		if totpStep(at) <= lastStep {
+			continue
+		}
+		expected, err := GenerateTOTPCode(secret, at)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return totpStep(at), true
+		}
+	}
+	return 0, false
+}
+
+// totpStep is the RFC 6238 time step of t.
+func totpStep(t time.Time) int64 {
+	return t.Unix() / int64(totpPeriod.Seconds())
+}
+
+// hotp implements RFC 4226.
+func hotp(key []byte, counter uint64, digits int) string {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, counter)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(buf)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, value%mod)
+}
@@ -0,0 +1,56 @@
+package service
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHOTP_RFC6238Vectors(t *testing.T) {
+	key := []byte("12345678901234567890")
+	vectors := map[int64]string{
+		59:          "94287082",
+		1111111109:  "07081804",
+		1111111111:  "14050471",
+		1234567890:  "89005924",
+		2000000000:  "69279037",
+		20000000000: "65353130",
+	}
+	for ts, want := range vectors {
+		assert.Equal(t, want, hotp(key, uint64(ts/30), 8))
+	}
+}
+
+func TestValidateTOTPCode(t *testing.T) {
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+	now := time.Unix(59, 0)
+	code, err := GenerateTOTPCode(secret, now)
+	assert.NoError(t, err)
+	assert.Equal(t, "287082", code)
+
+	step, ok := ValidateTOTPCode(secret, code, now, 0)
+	assert.True(t, ok)
+	assert.Equal(t, int64(1), step)
+	_, ok = ValidateTOTPCode(secret, code, now.Add(totpPeriod), 0)
+	assert.True(t, ok)
+	_, ok = ValidateTOTPCode(secret, code, now.Add(3*totpPeriod), 0)
+	assert.False(t, ok)
+	_, ok = ValidateTOTPCode(secret, "12345", now, 0)
+	assert.False(t, ok)
+
+	// codes of the last accepted step or an earlier one are replays
+	_, ok = ValidateTOTPCode(secret, code, now, step)
+	assert.False(t, ok)
+	_, ok = ValidateTOTPCode(secret, code, now.Add(totpPeriod), step)
+	assert.False(t, ok)
+}
+
+func TestTOTPURI(t *testing.T) {
+	uri := TOTPURI("test@test.com", "SECRET")
+	assert.True(t, strings.HasPrefix(uri, "otpauth://totp/Staple:test@test.com?"))
+	assert.Contains(t, uri, "secret=SECRET")
+	assert.Contains(t, uri, "issuer=Staple")
+}
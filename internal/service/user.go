@@ -3,21 +3,52 @@ package service
 import (
 	"context"
 	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base32"
 	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+	"time"
+	"unicode"
 
 	"github.com/google/uuid"
 	"github.com/staple-org/staple/pkg/config"
 	"golang.org/x/crypto/bcrypt"
 
+	"github.com/staple-org/staple/internal/i18n"
 	"github.com/staple-org/staple/internal/models"
 	"github.com/staple-org/staple/internal/storage"
 )
 
-const letters = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz-"
+// ErrUnsupportedLocale is returned when a user chooses a language there are no translations for.
+var ErrUnsupportedLocale = errors.New("unsupported locale")
+
+const (
+	letters = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz-"
+	// recoveryCodeCount is the number of recovery codes generated when enabling two-factor authentication.
+	recoveryCodeCount = 10
+	// recoveryCodeLength is the length of a single recovery code.
+	recoveryCodeLength = 10
+	// defaultLockoutThreshold is the number of failed attempts after which an account is locked.
+	defaultLockoutThreshold = 5
+	// defaultLockoutDuration is the time an account stays locked.
+	defaultLockoutDuration = 15 * time.Minute
+	// loginDelayBase is the delay after the first failed attempt. It doubles with every
+	// further failure until the account is locked.
+	loginDelayBase = time.Second
+	// emailChangeExpiry is the time the user has to confirm a new email address.
+	emailChangeExpiry = 24 * time.Hour
+	// feedTokenBytes is the number of random bytes of a feed token.
+	feedTokenBytes = 32
+	// inboxTokenBytes is the number of random bytes of an inbox token.
+	inboxTokenBytes = 15
+)
 
 // UserHandlerer defines a service which can manage users.
 type UserHandlerer interface {
 	Register(user models.User) error
+	Provision(user models.User) error
 	Delete(user models.User) error
 	ResetPassword(user models.User) error
 	IsRegistered(user models.User) (ok bool, err error)
@@ -26,7 +57,31 @@ type UserHandlerer interface {
 	VerifyConfirmCode(user models.User) (bool, error)
 	SetMaximumStaples(user models.User, maxStaples int) error
 	GetMaximumStaples(user models.User) (int, error)
+	SetLocale(user models.User, locale string) error
+	GetLocale(user models.User) (string, error)
 	ChangePassword(user models.User, newPassword string) error
+	EnrollTOTP(user models.User) (secret string, uri string, err error)
+	ConfirmTOTP(user models.User, code string) (recoveryCodes []string, err error)
+	DisableTOTP(user models.User, code string) error
+	IsTOTPEnabled(user models.User) (bool, error)
+	VerifyTOTP(user models.User, code string) (bool, error)
+	LockedFor(user models.User) (time.Duration, error)
+	RecordLoginFailure(user models.User) (time.Duration, error)
+	NotifyLogin(user models.User, ip string) error
+	ResetLoginFailures(user models.User) error
+	RequestEmailChange(user models.User, newEmail string) error
+	ConfirmEmailChange(user models.User, code string) (newEmail string, err error)
+	TokenValid(id string, issuedAt time.Time) (bool, error)
+	UserID(user models.User) (string, error)
+	Profile(user models.User) (*models.User, error)
+	RequestDeletion(user models.User) (deleteAfter time.Time, err error)
+	CancelDeletion(user models.User) error
+	FeedToken(user models.User) (string, error)
+	RegenerateFeedToken(user models.User) (string, error)
+	FeedUser(token string) (*models.User, error)
+	InboxToken(user models.User) (string, error)
+	RegenerateInboxToken(user models.User) (string, error)
+	InboxUser(token string) (*models.User, error)
 }
 
 // UserHandler defines a storage using user handler.
@@ -34,10 +89,34 @@ type UserHandler struct {
 	ctx      context.Context
 	store    storage.UserStorer
 	notifier Notifier
+	clock    Clock
+	policy   PasswordPolicy
+	events   EventBus
 }
 
 // Register registers a user.
+// The password has to satisfy the password policy.
 func (u UserHandler) Register(user models.User) error {
+	if err := u.policy.Validate(user.Email, user.Password); err != nil {
+		return err
+	}
+	return u.create(user)
+}
+
+// Provision registers a user who logs in with an external identity. The user gets a random
+// password which they can't log in with until they reset it. Since nobody knows it, it
+// isn't checked against the password policy.
+func (u UserHandler) Provision(user models.User) error {
+	password, err := randomString(32)
+	if err != nil {
+		return err
+	}
+	user.Password = password
+	return u.create(user)
+}
+
+// create stores a new user and welcomes them.
+func (u UserHandler) create(user models.User) error {
 	hashPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
 	if err != nil {
 		return err
@@ -47,12 +126,24 @@ func (u UserHandler) Register(user models.User) error {
 	if err != nil {
 		return err
 	}
-	return u.notifier.Notify(user.Email, Welcome, "")
+	storedUser, err := u.store.GetByEmail(user.Email)
+	if err != nil {
+		return err
+	}
+	if storedUser == nil {
+		return errors.New("user not found after registering")
+	}
+	// The welcome mail is sent by a synchronous subscriber, so its errors are returned.
+	return u.events.Publish(UserRegistered{EventMeta: u.newMeta(storedUser.ID), Email: storedUser.Email})
 }
 
 // Delete removes a user.
 func (u UserHandler) Delete(user models.User) error {
-	if ok, _ := u.IsRegistered(user); !ok {
+	storedUser, err := u.find(user)
+	if err != nil {
+		return err
+	}
+	if storedUser == nil {
 		return errors.New("user not found")
 	}
 	if ok, err := u.PasswordMatch(user); !ok {
@@ -60,34 +151,35 @@ func (u UserHandler) Delete(user models.User) error {
 	} else if err != nil {
 		return err
 	}
-	return u.store.Delete(user.Email)
+	if err := u.store.Delete(storedUser.ID); err != nil {
+		return err
+	}
+	u.publish(UserDeleted{EventMeta: u.newMeta(storedUser.ID), Email: storedUser.Email})
+	return nil
 }
 
 // ResetPassword generates a new password for a user and send it via email.
 // This happens after the confirmation was successfull.
 func (u UserHandler) ResetPassword(user models.User) error {
 	// get the stored user based on the provided email.
-	storedUser, err := u.store.Get(user.Email)
+	storedUser, err := u.find(user)
 	if err != nil {
 		return err
 	}
-	bytes := make([]byte, 20)
-	if _, err := rand.Read(bytes); err != nil {
+	newPassword, err := randomString(20)
+	if err != nil {
 		return err
 	}
-	for i, b := range bytes {
-		bytes[i] = letters[b%byte(len(letters))]
-	}
-	newPassword := string(bytes)
-	hashPassword, err := bcrypt.GenerateFromPassword(bytes, bcrypt.DefaultCost)
+	hashPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
 	if err != nil {
 		return err
 	}
 	storedUser.Password = string(hashPassword)
 	storedUser.ConfirmCode = ""
-	if err := u.store.Update(storedUser.Email, *storedUser); err != nil {
+	if err := u.store.Update(storedUser.ID, *storedUser); err != nil {
 		return err
 	}
+	u.publish(PasswordChanged{EventMeta: u.newMeta(storedUser.ID), Reset: true})
 
 	return u.notifier.Notify(storedUser.Email, PasswordReset, newPassword)
 }
@@ -98,13 +190,13 @@ func (u UserHandler) SendConfirmCode(user models.User) error {
 	if err != nil {
 		return err
 	}
-	storedUser, err := u.store.Get(user.Email)
+	storedUser, err := u.find(user)
 	if err != nil {
 		return err
 	}
 
 	storedUser.ConfirmCode = confirmUUID.String()
-	if err := u.store.Update(storedUser.Email, *storedUser); err != nil {
+	if err := u.store.Update(storedUser.ID, *storedUser); err != nil {
 		return err
 	}
 	return u.notifier.Notify(storedUser.Email, GenerateConfirmCode, storedUser.ConfirmCode)
@@ -113,14 +205,14 @@ func (u UserHandler) SendConfirmCode(user models.User) error {
 // VerifyConfirmCode will match the confirm code with a stored code for an email address.
 // If the match is successful the code is removed and the password is reset.
 func (u UserHandler) VerifyConfirmCode(user models.User) (ok bool, err error) {
-	storedUser, err := u.store.Get(user.Email)
+	storedUser, err := u.find(user)
 	if err != nil {
 		return false, err
 	}
 	if storedUser == nil {
 		return false, errors.New("user not found")
 	}
-	if user.ConfirmCode == storedUser.ConfirmCode && user.Email == storedUser.Email {
+	if user.ConfirmCode == storedUser.ConfirmCode {
 		if err := u.ResetPassword(user); err != nil {
 			return false, err
 		}
@@ -131,7 +223,7 @@ func (u UserHandler) VerifyConfirmCode(user models.User) (ok bool, err error) {
 
 // IsRegistered checks if a user exists in the system.
 func (u UserHandler) IsRegistered(user models.User) (ok bool, err error) {
-	storedUser, err := u.store.Get(user.Email)
+	storedUser, err := u.find(user)
 	if err != nil {
 		return false, err
 	}
@@ -145,7 +237,7 @@ func (u UserHandler) IsRegistered(user models.User) (ok bool, err error) {
 func (u UserHandler) PasswordMatch(user models.User) (ok bool, err error) {
 	plain := []byte(user.Password)
 
-	storedUser, err := u.store.Get(user.Email)
+	storedUser, err := u.find(user)
 	if err != nil {
 		return false, err
 	}
@@ -166,42 +258,50 @@ func (u UserHandler) SetMaximumStaples(user models.User, maxStaples int) error {
 	if maxStaples <= 0 || maxStaples > 100 {
 		return errors.New("invalid staple setting")
 	}
-	storedUser, err := u.store.Get(user.Email)
+	storedUser, err := u.find(user)
 	if err != nil {
 		return err
 	}
 	storedUser.MaxStaples = maxStaples
-	if err := u.store.Update(user.Email, *storedUser); err != nil {
+	if err := u.store.Update(storedUser.ID, *storedUser); err != nil {
 		return err
 	}
 	return nil
 }
 
-// ChangePassword changes the user's password to a new given string.
+// ChangePassword changes the user's password to a new given string. The new password
+// has to satisfy the password policy.
 func (u UserHandler) ChangePassword(user models.User, newPassword string) error {
 	if newPassword == "" {
-		return errors.New("password cannot be empty")
+		return u.policy.Validate("", newPassword)
 	}
-	storedUser, err := u.store.Get(user.Email)
+	storedUser, err := u.find(user)
 	if err != nil {
 		config.Opts.Logger.Error().Err(err).Msg("Error while getting user")
 		return err
 	}
+	if storedUser == nil {
+		return errors.New("user not found")
+	}
+	if err := u.policy.Validate(storedUser.Email, newPassword); err != nil {
+		return err
+	}
 	hashPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
 	if err != nil {
 		return err
 	}
 	storedUser.Password = string(hashPassword)
-	if err := u.store.Update(user.Email, *storedUser); err != nil {
+	if err := u.store.Update(storedUser.ID, *storedUser); err != nil {
 		config.Opts.Logger.Error().Err(err).Msg("Error while storing user")
 		return err
 	}
+	u.publish(PasswordChanged{EventMeta: u.newMeta(storedUser.ID)})
 	return nil
 }
 
 // GetMaximumStaples returns the maximum allowed configured staples for a user.
 func (u UserHandler) GetMaximumStaples(user models.User) (staples int, err error) {
-	storedUser, err := u.store.Get(user.Email)
+	storedUser, err := u.find(user)
 	if err != nil {
 		return 0, err
 	}
@@ -211,11 +311,631 @@ func (u UserHandler) GetMaximumStaples(user models.User) (staples int, err error
 	return storedUser.MaxStaples, nil
 }
 
-// NewUserHandler creates a new user handler.
+// SetLocale sets the language of the user's notifications. Regional variants such as de-AT
+// are stored as their language.
+func (u UserHandler) SetLocale(user models.User, locale string) error {
+	supported, ok := i18n.Supported(locale)
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrUnsupportedLocale, locale)
+	}
+	storedUser, err := u.find(user)
+	if err != nil {
+		return err
+	}
+	if storedUser == nil {
+		return errors.New("user not found")
+	}
+	storedUser.Locale = supported
+	return u.store.Update(storedUser.ID, *storedUser)
+}
+
+// GetLocale returns the language of the user's notifications.
+func (u UserHandler) GetLocale(user models.User) (string, error) {
+	storedUser, err := u.find(user)
+	if err != nil {
+		return "", err
+	}
+	if storedUser == nil || storedUser.Locale == "" {
+		return i18n.Default, nil
+	}
+	return storedUser.Locale, nil
+}
+
+// NewUserHandler creates a new user handler. It publishes its events on a bus of its own
+// until WithEvents is used.
 func NewUserHandler(ctx context.Context, store storage.UserStorer, notifier Notifier) UserHandler {
-	return UserHandler{
+	u := UserHandler{
 		ctx:      ctx,
 		store:    store,
 		notifier: notifier,
+		clock:    time.Now,
+		policy:   DefaultPasswordPolicy,
+	}
+	return u.WithEvents(NewEventBus())
+}
+
+// WithEvents returns a copy of the user handler which publishes its events on bus. The
+// welcome mail is subscribed to bus, so call it once per bus. User events don't go through
+// the outbox; they are published right after the change and lost if the process stops in
+// between.
+func (u UserHandler) WithEvents(bus EventBus) UserHandler {
+	u.events = bus
+	notifier := u.notifier
+	bus.Subscribe(models.EventUserRegistered, func(event DomainEvent) error {
+		if e, ok := event.(UserRegistered); ok {
+			return notifier.Notify(e.Email, Welcome, "")
+		}
+		return nil
+	})
+	return u
+}
+
+// WithClock returns a copy of the user handler which uses the given clock
+// for time based operations like TOTP validation.
+func (u UserHandler) WithClock(clock Clock) UserHandler {
+	u.clock = clock
+	return u
+}
+
+// WithPasswordPolicy returns a copy of the user handler which validates new
+// passwords against the given policy.
+func (u UserHandler) WithPasswordPolicy(policy PasswordPolicy) UserHandler {
+	u.policy = policy
+	return u
+}
+
+// randomString generates a random string of length n from letters.
+func randomString(n int) (string, error) {
+	bytes := make([]byte, n)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	for i, b := range bytes {
+		bytes[i] = letters[b%byte(len(letters))]
+	}
+	return string(bytes), nil
+}
+
+// EnrollTOTP generates a new TOTP secret for the user. The secret is stored but two-factor
+// authentication is only enabled once the user confirmed it with a valid code.
+func (u UserHandler) EnrollTOTP(user models.User) (string, string, error) {
+	storedUser, err := u.find(user)
+	if err != nil {
+		return "", "", err
+	}
+	if storedUser == nil {
+		return "", "", errors.New("user not found")
+	}
+	if storedUser.TOTPEnabled {
+		return "", "", errors.New("two-factor authentication is already enabled")
+	}
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		return "", "", err
+	}
+	storedUser.TOTPSecret = secret
+	if err := u.store.Update(storedUser.ID, *storedUser); err != nil {
+		return "", "", err
+	}
+	return secret, TOTPURI(storedUser.Email, secret), nil
+}
+
+// ConfirmTOTP enables two-factor authentication if the code matches the enrolled secret.
+// It returns a set of plain text recovery codes which are only ever shown once.
+func (u UserHandler) ConfirmTOTP(user models.User, code string) ([]string, error) {
+	storedUser, err := u.find(user)
+	if err != nil {
+		return nil, err
+	}
+	if storedUser == nil {
+		return nil, errors.New("user not found")
+	}
+	if storedUser.TOTPSecret == "" {
+		return nil, errors.New("two-factor authentication enrolment has not been started")
+	}
+	if storedUser.TOTPEnabled {
+		return nil, errors.New("two-factor authentication is already enabled")
+	}
+	step, ok := ValidateTOTPCode(storedUser.TOTPSecret, code, u.clock(), storedUser.TOTPLastStep)
+	if !ok {
+		return nil, errors.New("invalid code")
+	}
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		c, err := randomString(recoveryCodeLength)
+		if err != nil {
+			return nil, err
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(c), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, err
+		}
+		codes[i] = c
+		hashes[i] = string(hash)
+	}
+	storedUser.TOTPEnabled = true
+	storedUser.TOTPLastStep = step
+	storedUser.RecoveryCodes = hashes
+	if err := u.store.Update(storedUser.ID, *storedUser); err != nil {
+		return nil, err
+	}
+	u.publish(TwoFactorChanged{EventMeta: u.newMeta(storedUser.ID), Enabled: true})
+	return codes, nil
+}
+
+// DisableTOTP turns off two-factor authentication. A valid code or recovery code is required.
+func (u UserHandler) DisableTOTP(user models.User, code string) error {
+	ok, err := u.VerifyTOTP(user, code)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("invalid code")
+	}
+	storedUser, err := u.find(user)
+	if err != nil {
+		return err
+	}
+	storedUser.TOTPEnabled = false
+	storedUser.TOTPSecret = ""
+	storedUser.TOTPLastStep = 0
+	storedUser.RecoveryCodes = nil
+	if err := u.store.Update(storedUser.ID, *storedUser); err != nil {
+		return err
+	}
+	u.publish(TwoFactorChanged{EventMeta: u.newMeta(storedUser.ID), Enabled: false})
+	return nil
+}
+
+// IsTOTPEnabled returns whether the user has confirmed two-factor authentication.
+func (u UserHandler) IsTOTPEnabled(user models.User) (bool, error) {
+	storedUser, err := u.find(user)
+	if err != nil {
+		return false, err
+	}
+	if storedUser == nil {
+		return false, errors.New("user not found")
+	}
+	return storedUser.TOTPEnabled, nil
+}
+
+// VerifyTOTP checks a TOTP code or a recovery code for a user. Both can only be used once:
+// a matching recovery code is consumed, and TOTP codes of the time step of the last
+// accepted code or an earlier one are rejected.
+func (u UserHandler) VerifyTOTP(user models.User, code string) (bool, error) {
+	storedUser, err := u.find(user)
+	if err != nil {
+		return false, err
+	}
+	if storedUser == nil {
+		return false, errors.New("user not found")
+	}
+	if !storedUser.TOTPEnabled {
+		return false, errors.New("two-factor authentication is not enabled")
+	}
+	if step, ok := ValidateTOTPCode(storedUser.TOTPSecret, code, u.clock(), storedUser.TOTPLastStep); ok {
+		storedUser.TOTPLastStep = step
+		if err := u.store.Update(storedUser.ID, *storedUser); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	for i, hash := range storedUser.RecoveryCodes {
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(code)) == nil {
+			storedUser.RecoveryCodes = append(storedUser.RecoveryCodes[:i:i], storedUser.RecoveryCodes[i+1:]...)
+			if err := u.store.Update(storedUser.ID, *storedUser); err != nil {
+				return false, err
+			}
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// NotifyLogin informs the user about a successful login from the given address.
+func (u UserHandler) NotifyLogin(user models.User, ip string) error {
+	storedUser, err := u.find(user)
+	if err != nil {
+		return err
+	}
+	if storedUser == nil {
+		return errors.New("user not found")
+	}
+	return u.notifier.Notify(storedUser.Email, NewLogin, ip)
+}
+
+// LockedFor returns how long logins for the user are still rejected. Zero means
+// the user isn't locked.
+func (u UserHandler) LockedFor(user models.User) (time.Duration, error) {
+	storedUser, err := u.find(user)
+	if err != nil {
+		return 0, err
+	}
+	if storedUser == nil {
+		return 0, nil
+	}
+	now := u.clock()
+	if now.Before(storedUser.LockedUntil) {
+		return storedUser.LockedUntil.Sub(now), nil
+	}
+	return 0, nil
+}
+
+// RecordLoginFailure counts a failed attempt to log in or confirm a code. Every failure
+// delays the next attempt progressively until the threshold is reached at which point the
+// account is locked and the user is notified. It returns the time the user has to wait.
+func (u UserHandler) RecordLoginFailure(user models.User) (time.Duration, error) {
+	storedUser, err := u.find(user)
+	if err != nil {
+		return 0, err
+	}
+	if storedUser == nil {
+		return 0, nil
+	}
+	threshold := config.Opts.Lockout.Threshold
+	if threshold <= 0 {
+		threshold = defaultLockoutThreshold
+	}
+	lockout := config.Opts.Lockout.Duration
+	if lockout <= 0 {
+		lockout = defaultLockoutDuration
+	}
+
+	storedUser.FailedLogins++
+	delay := lockout
+	if storedUser.FailedLogins < threshold {
+		delay = loginDelayBase << uint(storedUser.FailedLogins-1)
+	}
+	storedUser.LockedUntil = u.clock().Add(delay)
+	if err := u.store.Update(storedUser.ID, *storedUser); err != nil {
+		return 0, err
+	}
+	if storedUser.FailedLogins >= threshold {
+		config.Opts.Logger.Warn().Str("email", storedUser.Email).Int("failures", storedUser.FailedLogins).Msg("Account locked after too many failed attempts")
+		u.publish(AccountLockedOut{EventMeta: u.newMeta(storedUser.ID), Until: storedUser.LockedUntil.UTC()})
+		if err := u.notifier.Notify(storedUser.Email, AccountLocked, storedUser.LockedUntil.UTC().Format(time.RFC1123)); err != nil {
+			return delay, err
+		}
+	}
+	return delay, nil
+}
+
+// ResetLoginFailures clears failed attempts after a successful login.
+func (u UserHandler) ResetLoginFailures(user models.User) error {
+	storedUser, err := u.find(user)
+	if err != nil {
+		return err
+	}
+	if storedUser == nil || (storedUser.FailedLogins == 0 && storedUser.LockedUntil.IsZero()) {
+		return nil
+	}
+	storedUser.FailedLogins = 0
+	storedUser.LockedUntil = time.Time{}
+	return u.store.Update(storedUser.ID, *storedUser)
+}
+
+// RequestEmailChange starts changing the email address of a user. The password has to match.
+// A confirm code is sent to the new address and the current address is informed about the change.
+func (u UserHandler) RequestEmailChange(user models.User, newEmail string) error {
+	newEmail = strings.TrimSpace(newEmail)
+	if !validEmail(newEmail) {
+		return errors.New("invalid email address")
+	}
+	storedUser, err := u.find(user)
+	if err != nil {
+		return err
+	}
+	if storedUser == nil {
+		return errors.New("user not found")
+	}
+	if strings.EqualFold(newEmail, storedUser.Email) {
+		return errors.New("new email address is the same as the current one")
+	}
+	if ok, err := u.PasswordMatch(user); !ok {
+		return errors.New("password did not match")
+	} else if err != nil {
+		return err
+	}
+	if ok, err := u.IsRegistered(models.User{Email: newEmail}); err != nil {
+		return err
+	} else if ok {
+		return storage.ErrEmailTaken
+	}
+	code, err := uuid.NewRandom()
+	if err != nil {
+		return err
+	}
+	storedUser.PendingEmail = newEmail
+	storedUser.EmailChangeCode = code.String()
+	storedUser.EmailChangeExpires = u.clock().Add(emailChangeExpiry)
+	if err := u.store.Update(storedUser.ID, *storedUser); err != nil {
+		return err
+	}
+	if err := u.notifier.Notify(newEmail, ConfirmEmailChange, storedUser.EmailChangeCode); err != nil {
+		return err
+	}
+	return u.notifier.Notify(storedUser.Email, EmailChangeRequested, newEmail)
+}
+
+// ConfirmEmailChange changes the email address of the user to the pending one if the code
+// matches. All tokens issued before the change are revoked.
+func (u UserHandler) ConfirmEmailChange(user models.User, code string) (string, error) {
+	storedUser, err := u.find(user)
+	if err != nil {
+		return "", err
+	}
+	if storedUser == nil {
+		return "", errors.New("user not found")
+	}
+	if storedUser.PendingEmail == "" || storedUser.EmailChangeCode == "" {
+		return "", errors.New("no email change pending")
+	}
+	if u.clock().After(storedUser.EmailChangeExpires) {
+		return "", errors.New("confirm code expired")
+	}
+	if subtle.ConstantTimeCompare([]byte(code), []byte(storedUser.EmailChangeCode)) != 1 {
+		return "", errors.New("confirm code did not match")
+	}
+	newUser := *storedUser
+	newUser.Email = storedUser.PendingEmail
+	newUser.PendingEmail = ""
+	newUser.EmailChangeCode = ""
+	newUser.EmailChangeExpires = time.Time{}
+	newUser.TokensValidAfter = u.clock()
+	if err := u.store.Update(storedUser.ID, newUser); err != nil {
+		return "", err
+	}
+	u.publish(EmailChanged{EventMeta: u.newMeta(storedUser.ID), OldEmail: storedUser.Email, NewEmail: newUser.Email})
+	return newUser.Email, nil
+}
+
+// TokenValid checks that the user a token was issued for still exists and the token
+// hasn't been revoked since it was issued.
+func (u UserHandler) TokenValid(id string, issuedAt time.Time) (bool, error) {
+	storedUser, err := u.store.Get(id)
+	if err != nil {
+		return false, err
+	}
+	if storedUser == nil {
+		return false, nil
+	}
+	// Tokens only carry seconds.
+	return issuedAt.Unix() >= storedUser.TokensValidAfter.Unix(), nil
+}
+
+// UserID returns the id of a user identified by email. It returns an empty
+// string if the user doesn't exist.
+func (u UserHandler) UserID(user models.User) (string, error) {
+	storedUser, err := u.find(user)
+	if err != nil {
+		return "", err
+	}
+	if storedUser == nil {
+		return "", nil
+	}
+	return storedUser.ID, nil
+}
+
+// Profile returns the stored user. Callers must not expose secrets like the password hash.
+func (u UserHandler) Profile(user models.User) (*models.User, error) {
+	storedUser, err := u.find(user)
+	if err != nil {
+		return nil, err
+	}
+	if storedUser == nil {
+		return nil, errors.New("user not found")
+	}
+	profile := *storedUser
+	return &profile, nil
+}
+
+// RequestDeletion deletes the account and all its staples. The password has to match. If a
+// grace period is configured the deletion is only scheduled and can be cancelled until the
+// returned time. Otherwise the account is deleted immediately and the zero time is returned.
+func (u UserHandler) RequestDeletion(user models.User) (time.Time, error) {
+	storedUser, err := u.find(user)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if storedUser == nil {
+		return time.Time{}, errors.New("user not found")
+	}
+	if ok, err := u.PasswordMatch(user); !ok {
+		return time.Time{}, errors.New("password did not match")
+	} else if err != nil {
+		return time.Time{}, err
+	}
+	grace := config.Opts.AccountDeletion.Grace
+	if grace <= 0 {
+		if err := u.store.Delete(storedUser.ID); err != nil {
+			return time.Time{}, err
+		}
+		u.publish(UserDeleted{EventMeta: u.newMeta(storedUser.ID), Email: storedUser.Email})
+		return time.Time{}, u.notifier.Notify(storedUser.Email, AccountDeleted, "")
+	}
+	if !storedUser.DeleteAfter.IsZero() {
+		return storedUser.DeleteAfter, nil
+	}
+	storedUser.DeleteAfter = u.clock().Add(grace)
+	if err := u.store.Update(storedUser.ID, *storedUser); err != nil {
+		return time.Time{}, err
+	}
+	u.publish(DeletionScheduled{EventMeta: u.newMeta(storedUser.ID), DeleteAfter: storedUser.DeleteAfter.UTC()})
+	return storedUser.DeleteAfter, u.notifier.Notify(storedUser.Email, AccountDeletionScheduled, storedUser.DeleteAfter.UTC().Format(time.RFC1123))
+}
+
+// CancelDeletion cancels a scheduled deletion.
+func (u UserHandler) CancelDeletion(user models.User) error {
+	storedUser, err := u.find(user)
+	if err != nil {
+		return err
+	}
+	if storedUser == nil {
+		return errors.New("user not found")
+	}
+	if storedUser.DeleteAfter.IsZero() {
+		return errors.New("no deletion scheduled")
+	}
+	storedUser.DeleteAfter = time.Time{}
+	return u.store.Update(storedUser.ID, *storedUser)
+}
+
+// FeedToken returns the secret token of the personal feeds of the user. A token is
+// created the first time the feeds are requested.
+func (u UserHandler) FeedToken(user models.User) (string, error) {
+	storedUser, err := u.find(user)
+	if err != nil {
+		return "", err
+	}
+	if storedUser == nil {
+		return "", errors.New("user not found")
+	}
+	if storedUser.FeedToken != "" {
+		return storedUser.FeedToken, nil
+	}
+	return u.RegenerateFeedToken(user)
+}
+
+// RegenerateFeedToken replaces the feed token of the user. Feed URLs with the old token
+// stop working.
+func (u UserHandler) RegenerateFeedToken(user models.User) (string, error) {
+	storedUser, err := u.find(user)
+	if err != nil {
+		return "", err
+	}
+	if storedUser == nil {
+		return "", errors.New("user not found")
+	}
+	token, err := randomURLSafe(feedTokenBytes)
+	if err != nil {
+		return "", err
+	}
+	storedUser.FeedToken = token
+	if err := u.store.Update(storedUser.ID, *storedUser); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// FeedUser returns the user owning a feed token or nil if the token is unknown.
+func (u UserHandler) FeedUser(token string) (*models.User, error) {
+	return u.store.GetByFeedToken(token)
+}
+
+// InboxToken returns the local part of the secret address staples can be mailed to. A
+// token is created the first time it is requested.
+func (u UserHandler) InboxToken(user models.User) (string, error) {
+	storedUser, err := u.find(user)
+	if err != nil {
+		return "", err
+	}
+	if storedUser == nil {
+		return "", errors.New("user not found")
+	}
+	if storedUser.InboxToken != "" {
+		return storedUser.InboxToken, nil
+	}
+	return u.RegenerateInboxToken(user)
+}
+
+// RegenerateInboxToken replaces the inbox token of the user. Mail to the old address is rejected.
+func (u UserHandler) RegenerateInboxToken(user models.User) (string, error) {
+	storedUser, err := u.find(user)
+	if err != nil {
+		return "", err
+	}
+	if storedUser == nil {
+		return "", errors.New("user not found")
+	}
+	b := make([]byte, inboxTokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	// Lower case only since mail servers may change the case of the local part.
+	storedUser.InboxToken = strings.ToLower(base32.StdEncoding.EncodeToString(b))
+	if err := u.store.Update(storedUser.ID, *storedUser); err != nil {
+		return "", err
+	}
+	return storedUser.InboxToken, nil
+}
+
+// InboxUser returns the user owning an inbox token or nil if the token is unknown.
+func (u UserHandler) InboxUser(token string) (*models.User, error) {
+	return u.store.GetByInboxToken(strings.ToLower(token))
+}
+
+// PurgeDeletions deletes all accounts whose grace period has passed and returns how
+// many were deleted.
+func (u UserHandler) PurgeDeletions() (int, error) {
+	ids, err := u.store.DueForDeletion(u.clock())
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	for _, id := range ids {
+		storedUser, err := u.store.Get(id)
+		if err != nil {
+			return deleted, err
+		}
+		if storedUser == nil {
+			continue
+		}
+		if err := u.store.Delete(id); err != nil {
+			return deleted, err
+		}
+		deleted++
+		u.publish(UserDeleted{EventMeta: u.newMeta(id), Email: storedUser.Email})
+		if err := u.notifier.Notify(storedUser.Email, AccountDeleted, ""); err != nil {
+			config.Opts.Logger.Error().Err(err).Str("id", id).Msg("Failed to notify user about the deletion")
+		}
+	}
+	return deleted, nil
+}
+
+// RunDeletionPurge purges accounts whose deletion is due every interval until ctx is done.
+func (u UserHandler) RunDeletionPurge(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if deleted, err := u.PurgeDeletions(); err != nil {
+			config.Opts.Logger.Error().Err(err).Msg("Failed to purge deleted accounts")
+		} else if deleted > 0 {
+			config.Opts.Logger.Info().Int("deleted", deleted).Msg("Purged deleted accounts")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (u UserHandler) newMeta(userID string) EventMeta {
+	return newEventMeta(userID, u.clock())
+}
+
+// publish publishes an event about a change which has been stored already, so failing
+// handlers are only logged by the bus.
+func (u UserHandler) publish(event DomainEvent) {
+	_ = u.events.Publish(event)
+}
+
+// validEmail reports whether s is a bare email address. Display names, comments and
+// control characters are rejected since the address ends up in mail headers.
+func validEmail(s string) bool {
+	if strings.IndexFunc(s, unicode.IsControl) >= 0 {
+		return false
+	}
+	addr, err := mail.ParseAddress(s)
+	return err == nil && addr.Address == s
+}
+
+// find looks up the stored user by id. Users which haven't logged in yet, for
+// example while resetting a password, only carry an email and are looked up by it.
+func (u UserHandler) find(user models.User) (*models.User, error) {
+	if user.ID != "" {
+		return u.store.Get(user.ID)
 	}
+	return u.store.GetByEmail(user.Email)
 }
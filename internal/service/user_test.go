@@ -4,9 +4,11 @@ import (
 	"context"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/staple-org/staple/internal/models"
 	"github.com/staple-org/staple/internal/storage"
+	"github.com/staple-org/staple/pkg/config"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -169,7 +171,7 @@ func TestUserHandler_ResetPassword(t *testing.T) {
 	assert.False(t, ok)
 
 	// Verify that the notifier sent out the new password
-	body := notifier.buffer.String()
+	body := notifier.Last(PasswordReset).Text
 	assert.NotEmpty(t, body)
 
 	var newPassword string
@@ -219,7 +221,7 @@ func TestUserHandler_SendConfirmCode(t *testing.T) {
 	err = userHandler.SendConfirmCode(u)
 	assert.NoError(t, err)
 
-	body := notifier.buffer.String()
+	body := notifier.Last(GenerateConfirmCode).Text
 	var code string
 	_, _ = fmt.Sscanf(body, `Dear test@test.com
 Please enter the following code into the confirm code window: %s`, &code)
@@ -228,3 +230,275 @@ Please enter the following code into the confirm code window: %s`, &code)
 	assert.NoError(t, err)
 	assert.True(t, ok)
 }
+
+func TestUserHandler_TOTP(t *testing.T) {
+	store := storage.NewInMemoryUserStorer()
+	notifier := NewBufferNotifier()
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	userHandler := NewUserHandler(context.Background(), store, notifier).WithClock(func() time.Time { return now })
+
+	u := models.User{
+		Email:    "test@test.com",
+		Password: "password",
+	}
+	err := userHandler.Register(u)
+	assert.NoError(t, err)
+
+	secret, uri, err := userHandler.EnrollTOTP(u)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, secret)
+	assert.Contains(t, uri, secret)
+
+	// not enabled until confirmed
+	ok, err := userHandler.IsTOTPEnabled(u)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	_, err = userHandler.ConfirmTOTP(u, "000000")
+	assert.EqualError(t, err, "invalid code")
+
+	code, err := GenerateTOTPCode(secret, now)
+	assert.NoError(t, err)
+	recoveryCodes, err := userHandler.ConfirmTOTP(u, code)
+	assert.NoError(t, err)
+	assert.Len(t, recoveryCodes, recoveryCodeCount)
+
+	ok, err = userHandler.IsTOTPEnabled(u)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// a code from a different time window is rejected
+	later, err := GenerateTOTPCode(secret, now.Add(5*time.Minute))
+	assert.NoError(t, err)
+	ok, err = userHandler.VerifyTOTP(u, later)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// the code used for the confirmation can't be used again
+	ok, err = userHandler.VerifyTOTP(u, code)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// a code of the next time step is accepted once
+	now = now.Add(totpPeriod)
+	next, err := GenerateTOTPCode(secret, now)
+	assert.NoError(t, err)
+	ok, err = userHandler.VerifyTOTP(u, next)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = userHandler.VerifyTOTP(u, next)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// recovery codes can only be used once
+	ok, err = userHandler.VerifyTOTP(u, recoveryCodes[0])
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = userHandler.VerifyTOTP(u, recoveryCodes[0])
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	err = userHandler.DisableTOTP(u, recoveryCodes[1])
+	assert.NoError(t, err)
+	ok, err = userHandler.IsTOTPEnabled(u)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestUserHandler_RecordLoginFailure(t *testing.T) {
+	store := storage.NewInMemoryUserStorer()
+	notifier := NewBufferNotifier()
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	userHandler := NewUserHandler(context.Background(), store, notifier).WithClock(func() time.Time { return now })
+	config.Opts.Lockout.Threshold = 3
+	config.Opts.Lockout.Duration = time.Hour
+	defer func() {
+		config.Opts.Lockout.Threshold = 0
+		config.Opts.Lockout.Duration = 0
+	}()
+
+	u := models.User{
+		Email:    "test@test.com",
+		Password: "password",
+	}
+	err := userHandler.Register(u)
+	assert.NoError(t, err)
+
+	delays := make([]time.Duration, 0)
+	for i := 0; i < 3; i++ {
+		delay, err := userHandler.RecordLoginFailure(u)
+		assert.NoError(t, err)
+		delays = append(delays, delay)
+	}
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second, time.Hour}, delays)
+	assert.Contains(t, notifier.Text(), "Your account has been temporarily locked")
+
+	lockedFor, err := userHandler.LockedFor(u)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Hour, lockedFor)
+
+	err = userHandler.ResetLoginFailures(u)
+	assert.NoError(t, err)
+	lockedFor, err = userHandler.LockedFor(u)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Duration(0), lockedFor)
+}
+
+func TestUserHandler_ChangeEmail(t *testing.T) {
+	store := storage.NewInMemoryUserStorer()
+	notifier := NewBufferNotifier()
+	now := time.Now()
+	userHandler := NewUserHandler(context.Background(), store, notifier).WithClock(func() time.Time { return now })
+
+	u := models.User{
+		Email:    "test@test.com",
+		Password: "password",
+	}
+	err := userHandler.Register(u)
+	assert.NoError(t, err)
+	err = userHandler.Register(models.User{Email: "taken@test.com", Password: "password"})
+	assert.NoError(t, err)
+	u.ID, err = userHandler.UserID(u)
+	assert.NoError(t, err)
+
+	err = userHandler.RequestEmailChange(models.User{ID: u.ID, Password: "wrong"}, "new@test.com")
+	assert.EqualError(t, err, "password did not match")
+	err = userHandler.RequestEmailChange(u, "taken@test.com")
+	assert.Equal(t, storage.ErrEmailTaken, err)
+	for _, invalid := range []string{
+		"",
+		"no-at-sign",
+		"new@test.com\r\nBcc: victim@test.com",
+		"new@test.com\x00",
+		"Mallory <new@test.com>",
+		"new@test.com (comment)",
+		"a@test.com, b@test.com",
+	} {
+		err = userHandler.RequestEmailChange(u, invalid)
+		assert.EqualError(t, err, "invalid email address", invalid)
+	}
+
+	err = userHandler.RequestEmailChange(u, "new@test.com")
+	assert.NoError(t, err)
+	assert.Contains(t, notifier.Last(EmailChangeRequested).Text, "A change of the email address of your Staple account to new@test.com has been requested.")
+	var code string
+	_, _ = fmt.Sscanf(notifier.Last(ConfirmEmailChange).Text, `Dear new@test.com
+Please enter the following code to confirm this as the new email address of your Staple account: %s`, &code)
+
+	_, err = userHandler.ConfirmEmailChange(u, "wrong")
+	assert.EqualError(t, err, "confirm code did not match")
+
+	// tokens issued before the change are revoked
+	now = time.Now()
+	issuedAt := now
+	ok, err := userHandler.TokenValid(u.ID, issuedAt)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	now = now.Add(time.Minute)
+	newEmail, err := userHandler.ConfirmEmailChange(u, code)
+	assert.NoError(t, err)
+	assert.Equal(t, "new@test.com", newEmail)
+
+	// the id stays the same
+	ok, err = userHandler.IsRegistered(models.User{Email: "test@test.com"})
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	id, err := userHandler.UserID(models.User{Email: newEmail})
+	assert.NoError(t, err)
+	assert.Equal(t, u.ID, id)
+	ok, err = userHandler.PasswordMatch(models.User{Email: "new@test.com", Password: "password"})
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = userHandler.TokenValid(u.ID, issuedAt)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	ok, err = userHandler.TokenValid(u.ID, now)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestUserHandler_ChangeEmail_Collision(t *testing.T) {
+	store := storage.NewInMemoryUserStorer()
+	notifier := NewBufferNotifier()
+	userHandler := NewUserHandler(context.Background(), store, notifier)
+
+	u := models.User{
+		Email:    "test@test.com",
+		Password: "password",
+	}
+	err := userHandler.Register(u)
+	assert.NoError(t, err)
+	err = userHandler.RequestEmailChange(u, "new@test.com")
+	assert.NoError(t, err)
+	storedUser, err := store.GetByEmail(u.Email)
+	assert.NoError(t, err)
+
+	// somebody registers the address before the change is confirmed
+	err = userHandler.Register(models.User{Email: "new@test.com", Password: "password"})
+	assert.NoError(t, err)
+
+	_, err = userHandler.ConfirmEmailChange(u, storedUser.EmailChangeCode)
+	assert.Equal(t, storage.ErrEmailTaken, err)
+	ok, err := userHandler.IsRegistered(u)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestUserHandler_RequestDeletion(t *testing.T) {
+	store := storage.NewInMemoryUserStorer()
+	notifier := NewBufferNotifier()
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	userHandler := NewUserHandler(context.Background(), store, notifier).WithClock(func() time.Time { return now })
+
+	u := models.User{
+		Email:    "test@test.com",
+		Password: "password",
+	}
+	err := userHandler.Register(u)
+	assert.NoError(t, err)
+
+	// without a grace period the account is deleted right away
+	deleteAfter, err := userHandler.RequestDeletion(models.User{Email: u.Email, Password: "wrong"})
+	assert.EqualError(t, err, "password did not match")
+	assert.True(t, deleteAfter.IsZero())
+	deleteAfter, err = userHandler.RequestDeletion(u)
+	assert.NoError(t, err)
+	assert.True(t, deleteAfter.IsZero())
+	ok, err := userHandler.IsRegistered(u)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.Contains(t, notifier.Text(), "Your Staple account and all your staples have been deleted.")
+
+	config.Opts.AccountDeletion.Grace = 7 * 24 * time.Hour
+	defer func() { config.Opts.AccountDeletion.Grace = 0 }()
+	err = userHandler.Register(u)
+	assert.NoError(t, err)
+	deleteAfter, err = userHandler.RequestDeletion(u)
+	assert.NoError(t, err)
+	assert.Equal(t, now.Add(7*24*time.Hour), deleteAfter)
+	ok, err = userHandler.IsRegistered(u)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// the deletion can be cancelled during the grace period
+	err = userHandler.CancelDeletion(u)
+	assert.NoError(t, err)
+	err = userHandler.CancelDeletion(u)
+	assert.EqualError(t, err, "no deletion scheduled")
+	_, err = userHandler.RequestDeletion(u)
+	assert.NoError(t, err)
+
+	now = now.Add(24 * time.Hour)
+	deleted, err := userHandler.PurgeDeletions()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, deleted)
+
+	now = now.Add(7 * 24 * time.Hour)
+	deleted, err = userHandler.PurgeDeletions()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, deleted)
+	ok, err = userHandler.IsRegistered(u)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
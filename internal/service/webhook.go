@@ -0,0 +1,435 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/staple-org/staple/internal/models"
+	"github.com/staple-org/staple/internal/storage"
+	"github.com/staple-org/staple/pkg/config"
+)
+
+// WebhookEvent is the name of an event webhooks can be called for.
+type WebhookEvent string
+
+const (
+	// WebhookStapleCreated is sent when a staple is added to the queue or the archive.
+	WebhookStapleCreated WebhookEvent = models.EventStapleCreated
+	// WebhookStapleArchived is sent when a staple is archived.
+	WebhookStapleArchived WebhookEvent = models.EventStapleArchived
+	// WebhookStapleDeleted is sent when a staple is moved to the trash.
+	WebhookStapleDeleted WebhookEvent = models.EventStapleDeleted
+	// WebhookStapleRestored is sent when a staple is taken out of the trash.
+	WebhookStapleRestored WebhookEvent = models.EventStapleRestored
+	// WebhookQueueEmpty is sent when the last staple of the queue is archived or deleted.
+	WebhookQueueEmpty WebhookEvent = models.EventQueueEmptied
+	// WebhookQuotaReached is sent when the queue reaches the maximum number of staples.
+	WebhookQuotaReached WebhookEvent = models.EventQuotaReached
+	// WebhookTest is only sent by SendTest. Webhooks can't subscribe to it.
+	WebhookTest WebhookEvent = "webhook.test"
+)
+
+// webhookEvents are the events webhooks can subscribe to.
+var webhookEvents = []WebhookEvent{
+	WebhookStapleCreated,
+	WebhookStapleArchived,
+	WebhookStapleDeleted,
+	WebhookStapleRestored,
+	WebhookQueueEmpty,
+	WebhookQuotaReached,
+}
+
+const (
+	// webhookMaxAttempts is the number of requests after which a delivery is given up.
+	webhookMaxAttempts = 8
+	// webhookBaseBackoff is the wait before the first retry. It doubles with every attempt.
+	webhookBaseBackoff = 30 * time.Second
+	// webhookMaxBackoff caps the wait between two attempts.
+	webhookMaxBackoff = 6 * time.Hour
+	// webhookTimeout bounds a single request to a webhook.
+	webhookTimeout = 10 * time.Second
+	// webhookBatchSize is the number of due deliveries attempted per run.
+	webhookBatchSize = 100
+	// webhookLease is how long claimed deliveries are hidden from other workers. It has to
+	// be longer than a batch of requests can take.
+	webhookLease = webhookBatchSize*webhookTimeout + 5*time.Minute
+	// webhookDeliveryLogSize is the number of deliveries listed per webhook.
+	webhookDeliveryLogSize = 50
+	// webhookSecretBytes is the number of random bytes of a signing secret.
+	webhookSecretBytes = 32
+	// webhookUserAgent identifies Staple to webhook receivers.
+	webhookUserAgent = "Staple webhooks (+https://github.com/staple-org/staple)"
+	// WebhookSignatureHeader carries the hex encoded HMAC-SHA256 of the body, prefixed with "sha256=".
+	WebhookSignatureHeader = "X-Staple-Signature"
+)
+
+// ErrInvalidWebhook is returned when a webhook can't be created because of its URL or events.
+var ErrInvalidWebhook = errors.New("invalid webhook")
+
+// ErrWebhookNotFound is returned when a webhook doesn't exist or belongs to another user.
+var ErrWebhookNotFound = errors.New("webhook not found")
+
+// webhookPayload is the JSON body posted to webhooks.
+type webhookPayload struct {
+	// ID identifies the event. It is the same for every webhook the event is sent to, so
+	// receivers can drop duplicates.
+	ID        string       `json:"id"`
+	Event     WebhookEvent `json:"event"`
+	CreatedAt time.Time    `json:"created_at"`
+	Data      interface{}  `json:"data"`
+}
+
+// webhookStaple is a staple as it is sent to webhooks. The id is unknown for new staples.
+type webhookStaple struct {
+	ID         int        `json:"id,omitempty"`
+	Name       string     `json:"name"`
+	Content    string     `json:"content"`
+	CreatedAt  time.Time  `json:"created_at"`
+	Archived   bool       `json:"archived"`
+	ArchivedAt *time.Time `json:"archived_at,omitempty"`
+}
+
+func newWebhookStaple(s models.Staple) webhookStaple {
+	return webhookStaple{
+		ID:         s.ID,
+		Name:       s.Name,
+		Content:    s.Content,
+		CreatedAt:  s.CreatedAt,
+		Archived:   s.Archived,
+		ArchivedAt: s.ArchivedAt,
+	}
+}
+
+// Webhooks manages the webhooks of users and delivers events to them. Events are stored
+// as deliveries first and posted by DeliverDue, so they survive restarts and failed
+// requests are retried with exponential backoff.
+type Webhooks struct {
+	store  storage.WebhookStorer
+	client *http.Client
+	clock  Clock
+	// wake is signalled when new deliveries are waiting.
+	wake chan struct{}
+}
+
+// NewWebhooks creates a webhook service. Webhooks on private and loopback addresses are
+// refused unless config.Opts.Webhooks.AllowPrivate is set.
+func NewWebhooks(store storage.WebhookStorer) Webhooks {
+	return Webhooks{
+		store:  store,
+		client: newPublicClient(config.Opts.Webhooks.AllowPrivate, webhookTimeout),
+		clock:  time.Now,
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+// WithHTTPClient returns a copy of the service which posts events with the given client.
+func (w Webhooks) WithHTTPClient(client *http.Client) Webhooks {
+	w.client = client
+	return w
+}
+
+// WithClock returns a copy of the service which uses the given clock.
+func (w Webhooks) WithClock(clock Clock) Webhooks {
+	w.clock = clock
+	return w
+}
+
+// Create adds a webhook for the given events. The returned webhook contains the secret
+// the payloads are signed with; it isn't shown again.
+func (w Webhooks) Create(user models.User, rawURL string, events []string) (models.Webhook, error) {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return models.Webhook{}, fmt.Errorf("%w: url must be an absolute http or https url", ErrInvalidWebhook)
+	}
+	if len(events) == 0 {
+		return models.Webhook{}, fmt.Errorf("%w: at least one event is required", ErrInvalidWebhook)
+	}
+	seen := make(map[string]bool, len(events))
+	valid := make([]string, 0, len(events))
+	for _, e := range events {
+		if !isWebhookEvent(WebhookEvent(e)) {
+			return models.Webhook{}, fmt.Errorf("%w: unknown event %q", ErrInvalidWebhook, e)
+		}
+		if !seen[e] {
+			seen[e] = true
+			valid = append(valid, e)
+		}
+	}
+	secret, err := randomURLSafe(webhookSecretBytes)
+	if err != nil {
+		return models.Webhook{}, err
+	}
+	return w.store.Create(models.Webhook{
+		UserID:    user.ID,
+		URL:       u.String(),
+		Events:    valid,
+		Secret:    secret,
+		CreatedAt: w.clock().UTC(),
+	})
+}
+
+// List lists the webhooks of a user without their secrets.
+func (w Webhooks) List(user models.User) ([]models.Webhook, error) {
+	hooks, err := w.store.List(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range hooks {
+		hooks[i].Secret = ""
+	}
+	return hooks, nil
+}
+
+// Delete removes a webhook and its delivery log.
+func (w Webhooks) Delete(user models.User, id int) error {
+	return w.store.Delete(user.ID, id)
+}
+
+// Deliveries returns the most recent deliveries of a webhook, the newest first.
+func (w Webhooks) Deliveries(user models.User, id int) ([]models.WebhookDelivery, error) {
+	hook, err := w.store.Get(user.ID, id)
+	if err != nil {
+		return nil, err
+	}
+	if hook == nil {
+		return nil, ErrWebhookNotFound
+	}
+	return w.store.Deliveries(hook.ID, webhookDeliveryLogSize)
+}
+
+// SendTest sends a test event to a webhook right away and returns the outcome. Failed test
+// events are retried like any other. The delivery is stored leased so DeliverDue doesn't
+// send it a second time while the first attempt is running.
+func (w Webhooks) SendTest(user models.User, id int) (models.WebhookDelivery, error) {
+	hook, err := w.store.Get(user.ID, id)
+	if err != nil {
+		return models.WebhookDelivery{}, err
+	}
+	if hook == nil {
+		return models.WebhookDelivery{}, ErrWebhookNotFound
+	}
+	payload, err := json.Marshal(webhookPayload{
+		ID:        uuid.New().String(),
+		Event:     WebhookTest,
+		CreatedAt: w.clock().UTC(),
+		Data:      map[string]string{"message": "This is a test event from Staple."},
+	})
+	if err != nil {
+		return models.WebhookDelivery{}, err
+	}
+	d, err := w.enqueue(*hook, WebhookTest, payload, webhookLease)
+	if err != nil {
+		return models.WebhookDelivery{}, err
+	}
+	return w.attempt(d, hook)
+}
+
+// SubscribeTo stores a delivery for every webhook event published on bus. The handlers are
+// synchronous so an event from the outbox is only marked as published once its deliveries
+// are stored.
+func (w Webhooks) SubscribeTo(bus EventBus) {
+	for _, e := range webhookEvents {
+		bus.Subscribe(string(e), w.handle)
+	}
+}
+
+func (w Webhooks) handle(event DomainEvent) error {
+	var data interface{}
+	switch e := event.(type) {
+	case StapleCreated:
+		data = newWebhookStaple(e.Staple)
+	case StapleArchived:
+		data = newWebhookStaple(e.Staple)
+	case StapleDeleted:
+		data = newWebhookStaple(e.Staple)
+	case StapleRestored:
+		data = newWebhookStaple(e.Staple)
+	case QueueEmptied:
+		data = map[string]int{"count": 0}
+	case QuotaReached:
+		data = map[string]int{"max_staples": e.MaxStaples, "count": e.Count}
+	default:
+		return nil
+	}
+	return w.emit(event.Meta(), WebhookEvent(event.EventName()), data)
+}
+
+// emit stores a delivery of the event for every webhook of the user which subscribed to it.
+func (w Webhooks) emit(meta EventMeta, event WebhookEvent, data interface{}) error {
+	hooks, err := w.store.List(meta.UserID)
+	if err != nil {
+		return err
+	}
+	var payload []byte
+	for _, hook := range hooks {
+		if !hook.Subscribed(string(event)) {
+			continue
+		}
+		if payload == nil {
+			if payload, err = json.Marshal(webhookPayload{ID: meta.ID, Event: event, CreatedAt: meta.OccurredAt, Data: data}); err != nil {
+				return err
+			}
+		}
+		if _, err := w.enqueue(hook, event, payload, 0); err != nil {
+			return err
+		}
+	}
+	if payload != nil {
+		select {
+		case w.wake <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// DeliverDue attempts every delivery which is due and returns how many were attempted.
+func (w Webhooks) DeliverDue() (int, error) {
+	due, err := w.store.ClaimDeliveries(w.clock().UTC(), webhookLease, webhookBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	for _, d := range due {
+		hook, err := w.store.Get(d.UserID, d.WebhookID)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := w.attempt(d, hook); err != nil {
+			config.Opts.Logger.Error().Err(err).Int("delivery", d.ID).Msg("Failed to store webhook delivery attempt")
+		}
+	}
+	return len(due), nil
+}
+
+// RunDeliveries delivers due events once per interval, and right after new events are
+// emitted, until ctx is done.
+func (w Webhooks) RunDeliveries(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for {
+			n, err := w.DeliverDue()
+			if err != nil {
+				config.Opts.Logger.Error().Err(err).Msg("Failed to deliver webhooks")
+			}
+			if err != nil || n < webhookBatchSize {
+				break
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-w.wake:
+		}
+	}
+}
+
+// enqueue stores a delivery which is due after the given delay.
+func (w Webhooks) enqueue(hook models.Webhook, event WebhookEvent, payload []byte, delay time.Duration) (models.WebhookDelivery, error) {
+	now := w.clock().UTC()
+	due := now.Add(delay)
+	return w.store.Enqueue(models.WebhookDelivery{
+		UserID:        hook.UserID,
+		WebhookID:     hook.ID,
+		Event:         string(event),
+		Payload:       string(payload),
+		NextAttemptAt: &due,
+		CreatedAt:     now,
+	})
+}
+
+// attempt posts a delivery to its webhook and stores the outcome. Deliveries whose webhook
+// was deleted are given up.
+func (w Webhooks) attempt(d models.WebhookDelivery, hook *models.Webhook) (models.WebhookDelivery, error) {
+	d.Attempts++
+	d.StatusCode = 0
+	d.LastError = ""
+	if hook == nil {
+		d.LastError = ErrWebhookNotFound.Error()
+		d.NextAttemptAt = nil
+		return d, w.store.UpdateDelivery(d)
+	}
+	status, err := w.post(*hook, d)
+	d.StatusCode = status
+	now := w.clock().UTC()
+	switch {
+	case err == nil:
+		d.DeliveredAt = &now
+		d.NextAttemptAt = nil
+	case d.Attempts >= webhookMaxAttempts:
+		d.LastError = err.Error()
+		d.NextAttemptAt = nil
+	default:
+		d.LastError = err.Error()
+		next := now.Add(webhookBackoff(d.Attempts))
+		d.NextAttemptAt = &next
+	}
+	return d, w.store.UpdateDelivery(d)
+}
+
+func (w Webhooks) post(hook models.Webhook, d models.WebhookDelivery) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewBufferString(d.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", webhookUserAgent)
+	req.Header.Set("X-Staple-Event", d.Event)
+	req.Header.Set("X-Staple-Delivery", strconv.Itoa(d.ID))
+	req.Header.Set(WebhookSignatureHeader, SignWebhookPayload(hook.Secret, []byte(d.Payload)))
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// SignWebhookPayload returns the value of the signature header for a payload. Receivers
+// compute it with their copy of the secret and compare it in constant time.
+func SignWebhookPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookBackoff is the wait after the given number of failed attempts.
+func webhookBackoff(attempts int) time.Duration {
+	wait := webhookBaseBackoff
+	for i := 1; i < attempts; i++ {
+		wait *= 2
+		if wait >= webhookMaxBackoff {
+			return webhookMaxBackoff
+		}
+	}
+	return wait
+}
+
+func isWebhookEvent(event WebhookEvent) bool {
+	for _, e := range webhookEvents {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,193 @@
+package service
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/staple-org/staple/internal/models"
+	"github.com/staple-org/staple/internal/storage"
+)
+
+// testWebhookReceiver records the events posted to it and answers with status.
+type testWebhookReceiver struct {
+	*httptest.Server
+	mu     sync.Mutex
+	status int
+	events []string
+	bodies [][]byte
+	sigs   []string
+}
+
+func newTestWebhookReceiver() *testWebhookReceiver {
+	r := &testWebhookReceiver{status: http.StatusOK}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.events = append(r.events, req.Header.Get("X-Staple-Event"))
+		r.bodies = append(r.bodies, body)
+		r.sigs = append(r.sigs, req.Header.Get(WebhookSignatureHeader))
+		w.WriteHeader(r.status)
+	}))
+	return r
+}
+
+func TestWebhooks_StapleEvents(t *testing.T) {
+	receiver := newTestWebhookReceiver()
+	defer receiver.Close()
+	webhooks := NewWebhooks(storage.NewInMemoryWebhookStorer()).WithHTTPClient(receiver.Client())
+	bus := NewEventBus()
+	webhooks.SubscribeTo(bus)
+	stapler := NewStapler(storage.NewInMemoryStapleStorer()).WithEvents(bus)
+	u := &models.User{ID: "user", MaxStaples: 2}
+
+	hook, err := webhooks.Create(*u, receiver.URL, []string{"staple.created", "staple.archived", "staple.deleted", "queue.empty", "quota.reached"})
+	assert.NoError(t, err)
+	assert.NotEmpty(t, hook.Secret)
+
+	assert.NoError(t, stapler.Create(models.Staple{Name: "first", Content: "https://example.com/1"}, u))
+	assert.NoError(t, stapler.Create(models.Staple{Name: "second", Content: "https://example.com/2"}, u))
+	list, _ := stapler.List(u)
+	assert.NoError(t, stapler.Archive(u, list[0].ID))
+	assert.NoError(t, stapler.Delete(u, list[1].ID))
+
+	n, err := webhooks.DeliverDue()
+	assert.NoError(t, err)
+	assert.Equal(t, 6, n)
+	assert.Equal(t, []string{"staple.created", "staple.created", "quota.reached", "staple.archived", "staple.deleted", "queue.empty"}, receiver.events)
+	for i, body := range receiver.bodies {
+		assert.Equal(t, SignWebhookPayload(hook.Secret, body), receiver.sigs[i])
+	}
+	var payload struct {
+		ID    string `json:"id"`
+		Event string `json:"event"`
+		Data  struct {
+			ID      int    `json:"id"`
+			Name    string `json:"name"`
+			Content string `json:"content"`
+		} `json:"data"`
+	}
+	assert.NoError(t, json.Unmarshal(receiver.bodies[3], &payload))
+	assert.Equal(t, "staple.archived", payload.Event)
+	assert.NotEmpty(t, payload.ID)
+	assert.Equal(t, "first", payload.Data.Name)
+	assert.Equal(t, list[0].ID, payload.Data.ID)
+
+	deliveries, err := webhooks.Deliveries(*u, hook.ID)
+	assert.NoError(t, err)
+	assert.Len(t, deliveries, 6)
+	for _, d := range deliveries {
+		assert.NotNil(t, d.DeliveredAt)
+		assert.Nil(t, d.NextAttemptAt)
+		assert.Equal(t, http.StatusOK, d.StatusCode)
+	}
+
+	// Only subscribed events are delivered.
+	other := &models.User{ID: "other", MaxStaples: 10}
+	_, err = webhooks.Create(*other, receiver.URL, []string{"staple.deleted"})
+	assert.NoError(t, err)
+	assert.NoError(t, stapler.Create(models.Staple{Name: "third"}, other))
+	n, err = webhooks.DeliverDue()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+}
+
+func TestWebhooks_Retry(t *testing.T) {
+	receiver := newTestWebhookReceiver()
+	defer receiver.Close()
+	receiver.status = http.StatusBadGateway
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	webhooks := NewWebhooks(storage.NewInMemoryWebhookStorer()).WithHTTPClient(receiver.Client()).WithClock(func() time.Time { return now })
+	u := models.User{ID: "user"}
+	hook, err := webhooks.Create(u, receiver.URL, []string{"queue.empty"})
+	assert.NoError(t, err)
+
+	d, err := webhooks.SendTest(u, hook.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, d.Attempts)
+	assert.Equal(t, http.StatusBadGateway, d.StatusCode)
+	assert.Equal(t, now.Add(webhookBaseBackoff), *d.NextAttemptAt)
+
+	n, err := webhooks.DeliverDue()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n, "the retry isn't due yet")
+
+	for attempt := 2; attempt <= webhookMaxAttempts; attempt++ {
+		now = now.Add(webhookMaxBackoff)
+		n, err = webhooks.DeliverDue()
+		assert.NoError(t, err)
+		assert.Equal(t, 1, n)
+	}
+	now = now.Add(webhookMaxBackoff)
+	n, err = webhooks.DeliverDue()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n, "the delivery is given up")
+	deliveries, _ := webhooks.Deliveries(u, hook.ID)
+	assert.Equal(t, webhookMaxAttempts, deliveries[0].Attempts)
+	assert.Nil(t, deliveries[0].DeliveredAt)
+	assert.Equal(t, "webhook.test", deliveries[0].Event)
+
+	_, err = webhooks.SendTest(models.User{ID: "other"}, hook.ID)
+	assert.ErrorIs(t, err, ErrWebhookNotFound)
+}
+
+func TestWebhooks_SendTest_NotDeliveredTwice(t *testing.T) {
+	received := make(chan struct{}, 1)
+	release := make(chan struct{})
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			received <- struct{}{}
+			<-release
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	webhooks := NewWebhooks(storage.NewInMemoryWebhookStorer()).WithHTTPClient(server.Client())
+	u := models.User{ID: "user"}
+	hook, err := webhooks.Create(u, server.URL, []string{"queue.empty"})
+	assert.NoError(t, err)
+
+	done := make(chan models.WebhookDelivery)
+	go func() {
+		d, err := webhooks.SendTest(u, hook.ID)
+		assert.NoError(t, err)
+		done <- d
+	}()
+	<-received
+	n, err := webhooks.DeliverDue()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n, "the test event is being sent")
+	close(release)
+	d := <-done
+	assert.Equal(t, 1, d.Attempts)
+	assert.NotNil(t, d.DeliveredAt)
+	assert.Nil(t, d.NextAttemptAt)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestWebhooks_Create_Errors(t *testing.T) {
+	webhooks := NewWebhooks(storage.NewInMemoryWebhookStorer())
+	u := models.User{ID: "user"}
+	_, err := webhooks.Create(u, "ftp://example.com/hook", []string{"staple.created"})
+	assert.ErrorIs(t, err, ErrInvalidWebhook)
+	_, err = webhooks.Create(u, "https://example.com/hook", nil)
+	assert.ErrorIs(t, err, ErrInvalidWebhook)
+	_, err = webhooks.Create(u, "https://example.com/hook", []string{"webhook.test"})
+	assert.ErrorIs(t, err, ErrInvalidWebhook)
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	assert.Equal(t, 30*time.Second, webhookBackoff(1))
+	assert.Equal(t, time.Minute, webhookBackoff(2))
+	assert.Equal(t, 4*time.Minute, webhookBackoff(4))
+	assert.Equal(t, webhookMaxBackoff, webhookBackoff(20))
+}
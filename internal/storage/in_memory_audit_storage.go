@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"sync"
+	"time"
+
+	"github.com/staple-org/staple/internal/models"
+)
+
+// InMemoryAuditStorer is a storer which uses memory as a storage backend.
+type InMemoryAuditStorer struct {
+	Err error
+	mu  *sync.Mutex
+	// entries in the order they were appended
+	entries *[]models.AuditEntry
+	nextID  *int64
+}
+
+// NewInMemoryAuditStorer creates a new in memory storage medium.
+func NewInMemoryAuditStorer() InMemoryAuditStorer {
+	var nextID int64 = 1
+	return InMemoryAuditStorer{
+		mu:      &sync.Mutex{},
+		entries: &[]models.AuditEntry{},
+		nextID:  &nextID,
+	}
+}
+
+// Append adds an entry to the log.
+func (s InMemoryAuditStorer) Append(entry models.AuditEntry) error {
+	if s.Err != nil {
+		return s.Err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry.ID = *s.nextID
+	*s.nextID++
+	*s.entries = append(*s.entries, entry)
+	return nil
+}
+
+// List returns entries of a user or every user, the newest first.
+func (s InMemoryAuditStorer) List(userID string, action string, limit int, offset int) ([]models.AuditEntry, error) {
+	if s.Err != nil {
+		return nil, s.Err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]models.AuditEntry, 0)
+	for i := len(*s.entries) - 1; i >= 0; i-- {
+		entry := (*s.entries)[i]
+		if (userID == "" || entry.UserID == userID) && (action == "" || entry.Action == action) {
+			list = append(list, entry)
+		}
+	}
+	if offset >= len(list) {
+		return list[:0], nil
+	}
+	list = list[offset:]
+	if len(list) > limit {
+		list = list[:limit]
+	}
+	return list, nil
+}
+
+// Purge removes the entries created before the given time.
+func (s InMemoryAuditStorer) Purge(before time.Time) (int64, error) {
+	if s.Err != nil {
+		return 0, s.Err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kept := make([]models.AuditEntry, 0, len(*s.entries))
+	for _, entry := range *s.entries {
+		if !entry.CreatedAt.Before(before) {
+			kept = append(kept, entry)
+		}
+	}
+	purged := int64(len(*s.entries) - len(kept))
+	*s.entries = kept
+	return purged, nil
+}
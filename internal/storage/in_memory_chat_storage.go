@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/staple-org/staple/internal/models"
+)
+
+// InMemoryChatTargetStorer is a storer which uses memory as a storage backend.
+type InMemoryChatTargetStorer struct {
+	Err error
+	mu  *sync.Mutex
+	// user id and kind as keys
+	targets map[string]map[string]models.ChatTarget
+}
+
+// NewInMemoryChatTargetStorer creates a new in memory storage medium.
+func NewInMemoryChatTargetStorer() InMemoryChatTargetStorer {
+	return InMemoryChatTargetStorer{
+		mu:      &sync.Mutex{},
+		targets: make(map[string]map[string]models.ChatTarget),
+	}
+}
+
+// Save creates or replaces the target of its kind.
+func (s InMemoryChatTargetStorer) Save(target models.ChatTarget) error {
+	if s.Err != nil {
+		return s.Err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.targets[target.UserID] == nil {
+		s.targets[target.UserID] = make(map[string]models.ChatTarget)
+	}
+	s.targets[target.UserID][target.Kind] = target
+	return nil
+}
+
+// Get retrieves the target of a kind. It returns nil if the user has none.
+func (s InMemoryChatTargetStorer) Get(userID string, kind string) (*models.ChatTarget, error) {
+	if s.Err != nil {
+		return nil, s.Err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	target, ok := s.targets[userID][kind]
+	if !ok {
+		return nil, nil
+	}
+	return &target, nil
+}
+
+// List returns the targets of a user ordered by kind.
+func (s InMemoryChatTargetStorer) List(userID string) ([]models.ChatTarget, error) {
+	if s.Err != nil {
+		return nil, s.Err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]models.ChatTarget, 0, len(s.targets[userID]))
+	for _, target := range s.targets[userID] {
+		list = append(list, target)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Kind < list[j].Kind
+	})
+	return list, nil
+}
+
+// Delete removes the target of a kind.
+func (s InMemoryChatTargetStorer) Delete(userID string, kind string) error {
+	if s.Err != nil {
+		return s.Err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.targets[userID], kind)
+	return nil
+}
@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/staple-org/staple/internal/models"
+)
+
+// InMemoryDigestStorer is a storer which uses memory as a storage backend.
+type InMemoryDigestStorer struct {
+	Err error
+	mu  *sync.Mutex
+	// user id as key
+	settings map[string]*models.DigestSettings
+}
+
+// NewInMemoryDigestStorer creates a new in memory storage medium.
+func NewInMemoryDigestStorer() InMemoryDigestStorer {
+	return InMemoryDigestStorer{
+		mu:       &sync.Mutex{},
+		settings: make(map[string]*models.DigestSettings),
+	}
+}
+
+// Get retrieves the settings of a user. It returns nil if the user has none.
+func (s InMemoryDigestStorer) Get(userID string) (*models.DigestSettings, error) {
+	if s.Err != nil {
+		return nil, s.Err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	settings, ok := s.settings[userID]
+	if !ok {
+		return nil, nil
+	}
+	ret := *settings
+	return &ret, nil
+}
+
+// Save creates or replaces the settings of a user.
+func (s InMemoryDigestStorer) Save(settings models.DigestSettings) error {
+	if s.Err != nil {
+		return s.Err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if existing, ok := s.settings[settings.UserID]; ok {
+		settings.LastDigestAt = existing.LastDigestAt
+		settings.LastReminderAt = existing.LastReminderAt
+	} else {
+		settings.LastDigestAt = nil
+		settings.LastReminderAt = nil
+	}
+	s.settings[settings.UserID] = &settings
+	return nil
+}
+
+// Enabled returns the settings of every user with a digest or a reminder.
+func (s InMemoryDigestStorer) Enabled() ([]models.DigestSettings, error) {
+	if s.Err != nil {
+		return nil, s.Err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]models.DigestSettings, 0)
+	for _, settings := range s.settings {
+		if settings.Frequency != models.DigestOff || settings.ReminderDays > 0 {
+			list = append(list, *settings)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].UserID < list[j].UserID
+	})
+	return list, nil
+}
+
+// MarkDigestSent records when the last digest was sent.
+func (s InMemoryDigestStorer) MarkDigestSent(userID string, at time.Time) error {
+	if s.Err != nil {
+		return s.Err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if settings, ok := s.settings[userID]; ok {
+		settings.LastDigestAt = &at
+	}
+	return nil
+}
+
+// MarkReminderSent records when the last reminder was sent.
+func (s InMemoryDigestStorer) MarkReminderSent(userID string, at time.Time) error {
+	if s.Err != nil {
+		return s.Err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if settings, ok := s.settings[userID]; ok {
+		settings.LastReminderAt = &at
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package storage
+
+// InMemoryIdentityStorer is a storer which uses memory as a storage backend.
+type InMemoryIdentityStorer struct {
+	Err   error
+	store map[string]string
+}
+
+// NewInMemoryIdentityStorer creates a new in memory storage medium.
+func NewInMemoryIdentityStorer() InMemoryIdentityStorer {
+	return InMemoryIdentityStorer{
+		store: make(map[string]string),
+	}
+}
+
+// Link links an external identity to a user.
+func (s InMemoryIdentityStorer) Link(issuer, subject, userID string) error {
+	if s.Err != nil {
+		return s.Err
+	}
+	s.store[issuer+" "+subject] = userID
+	return nil
+}
+
+// Find returns the id of the user linked to an external identity or an empty
+// string if the identity isn't linked.
+func (s InMemoryIdentityStorer) Find(issuer, subject string) (string, error) {
+	if s.Err != nil {
+		return "", s.Err
+	}
+	return s.store[issuer+" "+subject], nil
+}
@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/staple-org/staple/internal/models"
+)
+
+// InMemoryNotificationPreferenceStorer is a storer which uses memory as a storage backend.
+type InMemoryNotificationPreferenceStorer struct {
+	Err error
+	mu  *sync.Mutex
+	// user id and event as keys
+	prefs map[string]map[string]*models.NotificationPreference
+}
+
+// NewInMemoryNotificationPreferenceStorer creates a new in memory storage medium.
+func NewInMemoryNotificationPreferenceStorer() InMemoryNotificationPreferenceStorer {
+	return InMemoryNotificationPreferenceStorer{
+		mu:    &sync.Mutex{},
+		prefs: make(map[string]map[string]*models.NotificationPreference),
+	}
+}
+
+// List returns the stored preferences of a user ordered by event.
+func (s InMemoryNotificationPreferenceStorer) List(userID string) ([]models.NotificationPreference, error) {
+	if s.Err != nil {
+		return nil, s.Err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]models.NotificationPreference, 0, len(s.prefs[userID]))
+	for _, p := range s.prefs[userID] {
+		pref := *p
+		pref.Channels = append([]string(nil), p.Channels...)
+		list = append(list, pref)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Event < list[j].Event
+	})
+	return list, nil
+}
+
+// Save creates or replaces the given preferences of a user.
+func (s InMemoryNotificationPreferenceStorer) Save(userID string, prefs []models.NotificationPreference) error {
+	if s.Err != nil {
+		return s.Err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.prefs[userID] == nil {
+		s.prefs[userID] = make(map[string]*models.NotificationPreference)
+	}
+	for _, pref := range prefs {
+		pref := pref
+		pref.UserID = userID
+		pref.Channels = append([]string(nil), pref.Channels...)
+		pref.LastSentAt = nil
+		if existing, ok := s.prefs[userID][pref.Event]; ok {
+			pref.LastSentAt = existing.LastSentAt
+		}
+		s.prefs[userID][pref.Event] = &pref
+	}
+	return nil
+}
+
+// MarkSent records when the last notification of an event was sent.
+func (s InMemoryNotificationPreferenceStorer) MarkSent(userID string, event string, at time.Time) error {
+	if s.Err != nil {
+		return s.Err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if pref, ok := s.prefs[userID][event]; ok {
+		pref.LastSentAt = &at
+	}
+	return nil
+}
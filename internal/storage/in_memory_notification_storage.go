@@ -0,0 +1,162 @@
+package storage
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/staple-org/staple/internal/models"
+)
+
+// InMemoryNotificationStorer is a storer which uses memory as a storage backend.
+type InMemoryNotificationStorer struct {
+	Err error
+	mu  *sync.Mutex
+	// notification id as key
+	notifications map[int]*models.Notification
+}
+
+// NewInMemoryNotificationStorer creates a new in memory storage medium.
+func NewInMemoryNotificationStorer() InMemoryNotificationStorer {
+	return InMemoryNotificationStorer{
+		mu:            &sync.Mutex{},
+		notifications: make(map[int]*models.Notification),
+	}
+}
+
+// Enqueue saves a new notification and returns it with its id.
+func (s InMemoryNotificationStorer) Enqueue(n models.Notification) (models.Notification, error) {
+	if s.Err != nil {
+		return models.Notification{}, s.Err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n.ID = 1
+	for id := range s.notifications {
+		if id >= n.ID {
+			n.ID = id + 1
+		}
+	}
+	s.notifications[n.ID] = &n
+	return n, nil
+}
+
+// Claim returns up to limit due notifications, the oldest first, and postpones them by lease.
+func (s InMemoryNotificationStorer) Claim(now time.Time, lease time.Duration, limit int) ([]models.Notification, error) {
+	if s.Err != nil {
+		return nil, s.Err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]*models.Notification, 0)
+	for _, n := range s.notifications {
+		if n.NextAttemptAt != nil && !n.NextAttemptAt.After(now) {
+			list = append(list, n)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].NextAttemptAt.Before(*list[j].NextAttemptAt) ||
+			list[i].NextAttemptAt.Equal(*list[j].NextAttemptAt) && list[i].ID < list[j].ID
+	})
+	if len(list) > limit {
+		list = list[:limit]
+	}
+	ret := make([]models.Notification, 0, len(list))
+	next := now.Add(lease)
+	for _, n := range list {
+		ret = append(ret, *n)
+		n.NextAttemptAt = &next
+	}
+	return ret, nil
+}
+
+// Update saves the outcome of an attempt.
+func (s InMemoryNotificationStorer) Update(n models.Notification) error {
+	if s.Err != nil {
+		return s.Err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.notifications[n.ID]; ok {
+		s.notifications[n.ID] = &n
+	}
+	return nil
+}
+
+// Get retrieves a notification.
+func (s InMemoryNotificationStorer) Get(id int) (*models.Notification, error) {
+	if s.Err != nil {
+		return nil, s.Err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n, ok := s.notifications[id]
+	if !ok {
+		return nil, nil
+	}
+	ret := *n
+	return &ret, nil
+}
+
+// List returns notifications with the given status, or of any status if it is empty, the newest first.
+func (s InMemoryNotificationStorer) List(status string, limit int, offset int) ([]models.Notification, error) {
+	if s.Err != nil {
+		return nil, s.Err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]models.Notification, 0)
+	for _, n := range s.notifications {
+		if status == "" || n.Status() == status {
+			list = append(list, *n)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID > list[j].ID
+	})
+	if offset >= len(list) {
+		return list[:0], nil
+	}
+	list = list[offset:]
+	if len(list) > limit {
+		list = list[:limit]
+	}
+	return list, nil
+}
+
+// Redrive makes a dead notification due again with no attempts. It returns nil if there is
+// no dead notification with the id.
+func (s InMemoryNotificationStorer) Redrive(id int, now time.Time) (*models.Notification, error) {
+	if s.Err != nil {
+		return nil, s.Err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n, ok := s.notifications[id]
+	if !ok || n.DeadAt == nil {
+		return nil, nil
+	}
+	n.Attempts = 0
+	n.DeadAt = nil
+	n.LastError = ""
+	n.NextAttemptAt = &now
+	ret := *n
+	return &ret, nil
+}
+
+// Purge removes notifications sent before sentBefore and given up before deadBefore.
+func (s InMemoryNotificationStorer) Purge(sentBefore time.Time, deadBefore time.Time) (int64, error) {
+	if s.Err != nil {
+		return 0, s.Err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var purged int64
+	for id, n := range s.notifications {
+		if n.SentAt != nil && n.SentAt.Before(sentBefore) || n.DeadAt != nil && n.DeadAt.Before(deadBefore) {
+			delete(s.notifications, id)
+			purged++
+		}
+	}
+	return purged, nil
+}
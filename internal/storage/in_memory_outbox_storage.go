@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/staple-org/staple/internal/models"
+)
+
+// InMemoryOutboxStorer is a storer which uses memory as a storage backend.
+type InMemoryOutboxStorer struct {
+	Err error
+	mu  *sync.Mutex
+	// record id as key
+	records map[string]*models.OutboxRecord
+}
+
+// NewInMemoryOutboxStorer creates a new in memory storage medium.
+func NewInMemoryOutboxStorer() InMemoryOutboxStorer {
+	return InMemoryOutboxStorer{
+		mu:      &sync.Mutex{},
+		records: make(map[string]*models.OutboxRecord),
+	}
+}
+
+// Add stores a record which hasn't been published yet.
+func (s InMemoryOutboxStorer) Add(record models.OutboxRecord) error {
+	if s.Err != nil {
+		return s.Err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.records[record.ID]; !ok {
+		s.records[record.ID] = &record
+	}
+	return nil
+}
+
+// Claim returns up to limit unpublished records which failed fewer than maxAttempts
+// times and aren't claimed by another relay, the oldest first, and locks them for the lease.
+func (s InMemoryOutboxStorer) Claim(now time.Time, lease time.Duration, maxAttempts int, limit int) ([]models.OutboxRecord, error) {
+	if s.Err != nil {
+		return nil, s.Err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]*models.OutboxRecord, 0)
+	for _, r := range s.records {
+		if r.PublishedAt == nil && r.Attempts < maxAttempts && (r.LockedUntil == nil || !r.LockedUntil.After(now)) {
+			list = append(list, r)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].OccurredAt.Before(list[j].OccurredAt)
+	})
+	if len(list) > limit {
+		list = list[:limit]
+	}
+	ret := make([]models.OutboxRecord, 0, len(list))
+	until := now.Add(lease)
+	for _, r := range list {
+		r.LockedUntil = &until
+		ret = append(ret, *r)
+	}
+	return ret, nil
+}
+
+// MarkPublished records that a record has been published.
+func (s InMemoryOutboxStorer) MarkPublished(id string, at time.Time) error {
+	if s.Err != nil {
+		return s.Err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r, ok := s.records[id]; ok {
+		r.PublishedAt = &at
+	}
+	return nil
+}
+
+// MarkFailed records a failed attempt to publish a record and releases it for the next run.
+func (s InMemoryOutboxStorer) MarkFailed(id string, reason string) error {
+	if s.Err != nil {
+		return s.Err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r, ok := s.records[id]; ok {
+		r.Attempts++
+		r.LastError = reason
+		r.LockedUntil = nil
+	}
+	return nil
+}
+
+// Purge removes records published before the given time and returns how many were removed.
+func (s InMemoryOutboxStorer) Purge(publishedBefore time.Time) (int64, error) {
+	if s.Err != nil {
+		return 0, s.Err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var n int64
+	for id, r := range s.records {
+		if r.PublishedAt != nil && r.PublishedAt.Before(publishedBefore) {
+			delete(s.records, id)
+			n++
+		}
+	}
+	return n, nil
+}
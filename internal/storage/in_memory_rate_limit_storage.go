@@ -0,0 +1,64 @@
+package storage
+
+import (
+	"sync"
+	"time"
+)
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// InMemoryRateLimitStorer keeps token buckets in memory. It is only suitable for
+// a single instance of Staple.
+type InMemoryRateLimitStorer struct {
+	Err     error
+	mu      *sync.Mutex
+	buckets map[string]*bucket
+}
+
+// NewInMemoryRateLimitStorer creates a new in memory rate limit storage medium.
+func NewInMemoryRateLimitStorer() InMemoryRateLimitStorer {
+	return InMemoryRateLimitStorer{
+		mu:      &sync.Mutex{},
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// Take tries to take a token from the bucket identified by key.
+func (s InMemoryRateLimitStorer) Take(key string, rate float64, burst int, now time.Time) (bool, time.Duration, error) {
+	if s.Err != nil {
+		return false, 0, s.Err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(burst), updated: now}
+		s.buckets[key] = b
+	}
+	tokens, allowed, retryAfter := takeToken(b.tokens, b.updated, now, rate, burst)
+	b.tokens = tokens
+	if now.After(b.updated) {
+		b.updated = now
+	}
+	return allowed, retryAfter, nil
+}
+
+// Prune evicts the buckets which haven't changed since idleSince.
+func (s InMemoryRateLimitStorer) Prune(idleSince time.Time) (int64, error) {
+	if s.Err != nil {
+		return 0, s.Err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var n int64
+	for key, b := range s.buckets {
+		if b.updated.Before(idleSince) {
+			delete(s.buckets, key)
+			n++
+		}
+	}
+	return n, nil
+}
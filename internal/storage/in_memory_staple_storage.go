@@ -3,13 +3,14 @@ package storage
 import (
 	"errors"
 	"sort"
+	"time"
 
 	"github.com/staple-org/staple/internal/models"
 )
 
 // InMemoryStapleStorer is a storer which uses a map as a storage backend.
 type InMemoryStapleStorer struct {
-	// email as key
+	// user id as key
 	stapleStore map[string][]models.Staple
 	Err         error // can be set to simulate an error
 }
@@ -20,67 +21,70 @@ func NewInMemoryStapleStorer() InMemoryStapleStorer {
 }
 
 // Create will create a staple in the underlying in memory storage medium.
-func (p InMemoryStapleStorer) Create(staple models.Staple, email string) error {
-	if _, ok := p.stapleStore[email]; !ok {
-		p.stapleStore[email] = make([]models.Staple, 0)
+func (p InMemoryStapleStorer) Create(staple models.Staple, userID string) error {
+	if _, ok := p.stapleStore[userID]; !ok {
+		p.stapleStore[userID] = make([]models.Staple, 0)
 	}
-	sort.SliceStable(p.stapleStore[email], func(i, j int) bool {
-		return p.stapleStore[email][i].ID < p.stapleStore[email][j].ID
+	sort.SliceStable(p.stapleStore[userID], func(i, j int) bool {
+		return p.stapleStore[userID][i].ID < p.stapleStore[userID][j].ID
 	})
 	newID := 0
-	if len(p.stapleStore[email]) > 0 {
-		newID = p.stapleStore[email][len(p.stapleStore[email])-1].ID + 1
+	if len(p.stapleStore[userID]) > 0 {
+		newID = p.stapleStore[userID][len(p.stapleStore[userID])-1].ID + 1
 	}
 	staple.ID = newID
-	p.stapleStore[email] = append(p.stapleStore[email], staple)
+	p.stapleStore[userID] = append(p.stapleStore[userID], staple)
 	return p.Err
 }
 
-// Delete removes a staple.
-func (p InMemoryStapleStorer) Delete(email string, stapleID int) error {
-	staples := p.stapleStore[email]
-	deleteAt := -1
-	for i, s := range staples {
-		if s.ID == stapleID {
-			deleteAt = i
-			break
+// Delete moves a staple to the trash.
+func (p InMemoryStapleStorer) Delete(userID string, stapleID int) error {
+	for i, s := range p.stapleStore[userID] {
+		if s.ID == stapleID && s.DeletedAt == nil {
+			now := time.Now().UTC()
+			s.DeletedAt = &now
+			p.stapleStore[userID][i] = s
+			return p.Err
 		}
 	}
-	if deleteAt == -1 {
-		return errors.New("staple not found")
-	}
-	staples = append(staples[:deleteAt], staples[deleteAt+1:]...)
-	p.stapleStore[email] = staples
-	return p.Err
+	return errors.New("staple not found")
 }
 
 // Get retrieves a staple.
-func (p InMemoryStapleStorer) Get(email string, stapleID int) (*models.Staple, error) {
-	for _, s := range p.stapleStore[email] {
-		if s.ID == stapleID && !s.Archived {
+func (p InMemoryStapleStorer) Get(userID string, stapleID int) (*models.Staple, error) {
+	for _, s := range p.stapleStore[userID] {
+		if s.ID == stapleID && !s.Archived && s.DeletedAt == nil {
 			return &s, nil
 		}
 	}
 	return nil, p.Err
 }
 
-// Oldest will get the oldest staple that is not archived.
-func (p InMemoryStapleStorer) Oldest(email string) (*models.Staple, error) {
-	oldest := p.stapleStore[email][0]
-	for _, s := range p.stapleStore[email] {
-		if s.CreatedAt.Before(oldest.CreatedAt) {
-			oldest = s
+// Oldest will get the oldest staple that is not archived. It returns nil if the queue is empty.
+func (p InMemoryStapleStorer) Oldest(userID string) (*models.Staple, error) {
+	var oldest *models.Staple
+	for _, s := range p.stapleStore[userID] {
+		if s.Archived || s.DeletedAt != nil {
+			continue
+		}
+		if oldest == nil || s.CreatedAt.Before(oldest.CreatedAt) {
+			s := s
+			oldest = &s
 		}
 	}
-	return &oldest, p.Err
+	return oldest, p.Err
 }
 
 // Archive archives a staple.
-func (p InMemoryStapleStorer) Archive(email string, stapleID int) error {
-	for i, s := range p.stapleStore[email] {
-		if s.ID == stapleID {
+func (p InMemoryStapleStorer) Archive(userID string, stapleID int) error {
+	for i, s := range p.stapleStore[userID] {
+		if s.ID == stapleID && s.DeletedAt == nil {
+			if !s.Archived {
+				now := time.Now().UTC()
+				s.ArchivedAt = &now
+			}
 			s.Archived = true
-			p.stapleStore[email][i] = s
+			p.stapleStore[userID][i] = s
 			return p.Err
 		}
 	}
@@ -90,10 +94,10 @@ func (p InMemoryStapleStorer) Archive(email string, stapleID int) error {
 // List gets all the not archived staples for a user. List will not retrieve the content
 // since that can possibly be a large text. We only ever retrieve it when that
 // specific staple is Get.
-func (p InMemoryStapleStorer) List(email string) ([]models.Staple, error) {
+func (p InMemoryStapleStorer) List(userID string) ([]models.Staple, error) {
 	list := make([]models.Staple, 0)
-	for _, s := range p.stapleStore[email] {
-		if !s.Archived {
+	for _, s := range p.stapleStore[userID] {
+		if !s.Archived && s.DeletedAt == nil {
 			list = append(list, s)
 		}
 	}
@@ -101,12 +105,115 @@ func (p InMemoryStapleStorer) List(email string) ([]models.Staple, error) {
 }
 
 // ShowArchive will return the users archived staples ordered by id.
-func (p InMemoryStapleStorer) ShowArchive(email string) ([]models.Staple, error) {
+func (p InMemoryStapleStorer) ShowArchive(userID string) ([]models.Staple, error) {
 	list := make([]models.Staple, 0)
-	for _, s := range p.stapleStore[email] {
-		if s.Archived {
+	for _, s := range p.stapleStore[userID] {
+		if s.Archived && s.DeletedAt == nil {
 			list = append(list, s)
 		}
 	}
 	return list, p.Err
 }
+
+// All returns every staple of a user including the archived ones ordered by id.
+func (p InMemoryStapleStorer) All(userID string) ([]models.Staple, error) {
+	list := make([]models.Staple, 0, len(p.stapleStore[userID]))
+	for _, s := range p.stapleStore[userID] {
+		if s.DeletedAt == nil {
+			list = append(list, s)
+		}
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].ID < list[j].ID
+	})
+	return list, p.Err
+}
+
+// Walk calls fn for every staple of a user, the queue in FIFO order first and then the archive.
+func (p InMemoryStapleStorer) Walk(userID string, fn func(models.Staple) error) error {
+	if p.Err != nil {
+		return p.Err
+	}
+	list, _ := p.All(userID)
+	sort.SliceStable(list, func(i, j int) bool {
+		if list[i].Archived != list[j].Archived {
+			return !list[i].Archived
+		}
+		return list[i].CreatedAt.Before(list[j].CreatedAt)
+	})
+	for _, s := range list {
+		if err := fn(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RecentArchive returns up to limit archived staples, the most recently archived first.
+func (p InMemoryStapleStorer) RecentArchive(userID string, limit int) ([]models.Staple, error) {
+	list, _ := p.ShowArchive(userID)
+	sort.SliceStable(list, func(i, j int) bool {
+		a, b := list[i].ArchivedAt, list[j].ArchivedAt
+		if a == nil || b == nil {
+			if a != b {
+				return b == nil
+			}
+			return list[i].ID > list[j].ID
+		}
+		if !a.Equal(*b) {
+			return a.After(*b)
+		}
+		return list[i].ID > list[j].ID
+	})
+	if len(list) > limit {
+		list = list[:limit]
+	}
+	return list, p.Err
+}
+
+// Trash returns the staples in the trash of a user, the most recently deleted first.
+func (p InMemoryStapleStorer) Trash(userID string) ([]models.Staple, error) {
+	list := make([]models.Staple, 0)
+	for _, s := range p.stapleStore[userID] {
+		if s.DeletedAt != nil {
+			list = append(list, s)
+		}
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		if !list[i].DeletedAt.Equal(*list[j].DeletedAt) {
+			return list[i].DeletedAt.After(*list[j].DeletedAt)
+		}
+		return list[i].ID > list[j].ID
+	})
+	return list, p.Err
+}
+
+// Restore takes a staple out of the trash. It returns nil if the staple isn't in the trash.
+func (p InMemoryStapleStorer) Restore(userID string, stapleID int) (*models.Staple, error) {
+	for i, s := range p.stapleStore[userID] {
+		if s.ID == stapleID && s.DeletedAt != nil {
+			s.DeletedAt = nil
+			p.stapleStore[userID][i] = s
+			return &s, p.Err
+		}
+	}
+	return nil, p.Err
+}
+
+// PurgeTrash removes the staples of all users which were moved to the trash before the
+// given time.
+func (p InMemoryStapleStorer) PurgeTrash(deletedBefore time.Time) (int64, error) {
+	var n int64
+	for userID, staples := range p.stapleStore {
+		kept := staples[:0]
+		for _, s := range staples {
+			if s.DeletedAt != nil && s.DeletedAt.Before(deletedBefore) {
+				n++
+				continue
+			}
+			kept = append(kept, s)
+		}
+		p.stapleStore[userID] = kept
+	}
+	return n, p.Err
+}
@@ -0,0 +1,165 @@
+package storage
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/staple-org/staple/internal/models"
+)
+
+// stapleDeletion is a staple which was deleted.
+type stapleDeletion struct {
+	userID    string
+	staple    models.Staple
+	deletedAt time.Time
+}
+
+// InMemoryStatsStorer is a storer which computes statistics from an in memory staple storer.
+type InMemoryStatsStorer struct {
+	Err     error
+	mu      *sync.Mutex
+	staples InMemoryStapleStorer
+	// event id as key
+	deletions map[string]stapleDeletion
+}
+
+// NewInMemoryStatsStorer creates a new in memory storage medium for the staples of the
+// given storer.
+func NewInMemoryStatsStorer(staples InMemoryStapleStorer) InMemoryStatsStorer {
+	return InMemoryStatsStorer{
+		mu:        &sync.Mutex{},
+		staples:   staples,
+		deletions: make(map[string]stapleDeletion),
+	}
+}
+
+// RecordDeletion records a deleted staple once per event.
+func (s InMemoryStatsStorer) RecordDeletion(eventID, userID string, staple models.Staple, deletedAt time.Time) error {
+	if s.Err != nil {
+		return s.Err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.deletions[eventID]; !ok {
+		s.deletions[eventID] = stapleDeletion{userID: userID, staple: staple, deletedAt: deletedAt}
+	}
+	return nil
+}
+
+// ForgetDeletion drops the recorded deletions of a staple which was restored.
+func (s InMemoryStatsStorer) ForgetDeletion(userID string, stapleID int) error {
+	if s.Err != nil {
+		return s.Err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, d := range s.deletions {
+		if d.userID == userID && d.staple.ID == stapleID {
+			delete(s.deletions, id)
+		}
+	}
+	return nil
+}
+
+// history returns the stored and the deleted staples of a user with the time they were
+// deleted, which is zero for stored staples. Staples in the trash count as deleted.
+func (s InMemoryStatsStorer) history(userID string) ([]models.Staple, []time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var staples []models.Staple
+	for _, staple := range s.staples.stapleStore[userID] {
+		if staple.DeletedAt == nil {
+			staples = append(staples, staple)
+		}
+	}
+	deleted := make([]time.Time, len(staples))
+	for _, d := range s.deletions {
+		if d.userID == userID {
+			staples = append(staples, d.staple)
+			deleted = append(deleted, d.deletedAt)
+		}
+	}
+	return staples, deleted
+}
+
+// Activity counts the added, archived and deleted unread staples per day.
+func (s InMemoryStatsStorer) Activity(userID string, from, to time.Time, timezone *time.Location) ([]models.StapleActivity, error) {
+	if s.Err != nil {
+		return nil, s.Err
+	}
+	within := func(t time.Time) bool {
+		return !t.Before(from) && t.Before(to)
+	}
+	days := make(map[string]*models.StapleActivity)
+	day := func(t time.Time) *models.StapleActivity {
+		date := t.In(timezone).Format("2006-01-02")
+		if days[date] == nil {
+			days[date] = &models.StapleActivity{Date: date}
+		}
+		return days[date]
+	}
+	staples, deleted := s.history(userID)
+	for i, staple := range staples {
+		if within(staple.CreatedAt) {
+			day(staple.CreatedAt).Added++
+		}
+		if staple.ArchivedAt != nil && within(*staple.ArchivedAt) {
+			day(*staple.ArchivedAt).Archived++
+		}
+		if !deleted[i].IsZero() && !staple.Archived && within(deleted[i]) {
+			day(deleted[i]).DeletedUnread++
+		}
+	}
+	ret := make([]models.StapleActivity, 0, len(days))
+	for _, a := range days {
+		ret = append(ret, *a)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Date < ret[j].Date
+	})
+	return ret, nil
+}
+
+// TimeInQueue returns the average time in the queue of the staples archived in the range.
+func (s InMemoryStatsStorer) TimeInQueue(userID string, from, to time.Time) (time.Duration, error) {
+	if s.Err != nil {
+		return 0, s.Err
+	}
+	staples, _ := s.history(userID)
+	var (
+		total time.Duration
+		count int
+	)
+	for _, staple := range staples {
+		if staple.ArchivedAt == nil || staple.ArchivedAt.Before(from) || !staple.ArchivedAt.Before(to) {
+			continue
+		}
+		total += staple.ArchivedAt.Sub(staple.CreatedAt)
+		count++
+	}
+	if count == 0 {
+		return 0, nil
+	}
+	return total / time.Duration(count), nil
+}
+
+// QueueAges counts the staples of the queue by age.
+func (s InMemoryStatsStorer) QueueAges(userID string, now time.Time, bounds []time.Duration) ([]int, error) {
+	if s.Err != nil {
+		return nil, s.Err
+	}
+	counts := make([]int, len(bounds)+1)
+	staples, deleted := s.history(userID)
+	for i, staple := range staples {
+		if staple.Archived || !deleted[i].IsZero() {
+			continue
+		}
+		age := now.Sub(staple.CreatedAt)
+		bucket := sort.Search(len(bounds), func(i int) bool {
+			return age < bounds[i]
+		})
+		counts[bucket]++
+	}
+	return counts, nil
+}
@@ -0,0 +1,142 @@
+package storage
+
+import (
+	"sort"
+	"time"
+
+	"github.com/staple-org/staple/internal/models"
+)
+
+// InMemorySubscriptionStorer is a storer which uses memory as a storage backend.
+type InMemorySubscriptionStorer struct {
+	Err error
+	// subscription id as key
+	store map[int]*models.Subscription
+	seen  map[int]map[string]time.Time
+}
+
+// NewInMemorySubscriptionStorer creates a new in memory storage medium.
+func NewInMemorySubscriptionStorer() InMemorySubscriptionStorer {
+	return InMemorySubscriptionStorer{
+		store: make(map[int]*models.Subscription),
+		seen:  make(map[int]map[string]time.Time),
+	}
+}
+
+// Create saves a subscription and returns it with its id.
+func (s InMemorySubscriptionStorer) Create(sub models.Subscription) (models.Subscription, error) {
+	if s.Err != nil {
+		return models.Subscription{}, s.Err
+	}
+	id := 1
+	for _, existing := range s.store {
+		if existing.UserID == sub.UserID && existing.URL == sub.URL {
+			return models.Subscription{}, ErrSubscriptionExists
+		}
+		if existing.ID >= id {
+			id = existing.ID + 1
+		}
+	}
+	sub.ID = id
+	s.store[id] = &sub
+	s.seen[id] = make(map[string]time.Time)
+	return sub, nil
+}
+
+// Get retrieves a subscription of a user.
+func (s InMemorySubscriptionStorer) Get(userID string, id int) (*models.Subscription, error) {
+	if s.Err != nil {
+		return nil, s.Err
+	}
+	sub, ok := s.store[id]
+	if !ok || sub.UserID != userID {
+		return nil, nil
+	}
+	ret := *sub
+	return &ret, nil
+}
+
+// List returns the subscriptions of a user ordered by id.
+func (s InMemorySubscriptionStorer) List(userID string) ([]models.Subscription, error) {
+	if s.Err != nil {
+		return nil, s.Err
+	}
+	list := make([]models.Subscription, 0)
+	for _, sub := range s.store {
+		if sub.UserID == userID {
+			list = append(list, *sub)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID < list[j].ID
+	})
+	return list, nil
+}
+
+// Update saves the policy and the poll state of a subscription.
+func (s InMemorySubscriptionStorer) Update(sub models.Subscription) error {
+	if s.Err != nil {
+		return s.Err
+	}
+	if _, ok := s.store[sub.ID]; ok {
+		s.store[sub.ID] = &sub
+	}
+	return nil
+}
+
+// Delete removes a subscription and its seen entries.
+func (s InMemorySubscriptionStorer) Delete(userID string, id int) error {
+	if s.Err != nil {
+		return s.Err
+	}
+	if sub, ok := s.store[id]; ok && sub.UserID == userID {
+		delete(s.store, id)
+		delete(s.seen, id)
+	}
+	return nil
+}
+
+// Due returns all subscriptions which haven't been polled since checkedBefore.
+func (s InMemorySubscriptionStorer) Due(checkedBefore time.Time) ([]models.Subscription, error) {
+	if s.Err != nil {
+		return nil, s.Err
+	}
+	list := make([]models.Subscription, 0)
+	for _, sub := range s.store {
+		if sub.CheckedAt.Before(checkedBefore) {
+			list = append(list, *sub)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CheckedAt.Before(list[j].CheckedAt)
+	})
+	return list, nil
+}
+
+// Seen reports which of the entry keys have been seen before.
+func (s InMemorySubscriptionStorer) Seen(subscriptionID int, keys []string) (map[string]bool, error) {
+	if s.Err != nil {
+		return nil, s.Err
+	}
+	seen := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		if _, ok := s.seen[subscriptionID][k]; ok {
+			seen[k] = true
+		}
+	}
+	return seen, nil
+}
+
+// MarkSeen remembers entry keys so they aren't added again.
+func (s InMemorySubscriptionStorer) MarkSeen(subscriptionID int, keys []string, at time.Time) error {
+	if s.Err != nil {
+		return s.Err
+	}
+	if _, ok := s.seen[subscriptionID]; !ok {
+		return nil
+	}
+	for _, k := range keys {
+		s.seen[subscriptionID][k] = at
+	}
+	return nil
+}
@@ -1,12 +1,17 @@
 package storage
 
 import (
+	"time"
+
+	"github.com/google/uuid"
+
 	"github.com/staple-org/staple/internal/models"
 )
 
 // InMemoryUserStorer is a storer which uses memory as a storage backend.
 type InMemoryUserStorer struct {
-	Err   error
+	Err error
+	// user id as key
 	store map[string]*models.User
 }
 
@@ -19,37 +24,110 @@ func NewInMemoryUserStorer() InMemoryUserStorer {
 
 // Create saves a user in in memory.
 func (s InMemoryUserStorer) Create(email string, password []byte) error {
-	s.store[email] = &models.User{
+	if s.Err != nil {
+		return s.Err
+	}
+	if u, _ := s.GetByEmail(email); u != nil {
+		return ErrEmailTaken
+	}
+	id := uuid.New().String()
+	s.store[id] = &models.User{
+		ID:          id,
 		Email:       email,
 		Password:    string(password),
 		ConfirmCode: "",
 		MaxStaples:  DefaultMaxStaples,
+		// Tokens issued before the user existed must not be accepted.
+		TokensValidAfter: time.Now().UTC(),
 	}
 	return s.Err
 }
 
 // Delete deletes a user from in memory.
-func (s InMemoryUserStorer) Delete(email string) error {
+func (s InMemoryUserStorer) Delete(id string) error {
 	if s.Err != nil {
 		return s.Err
 	}
-	delete(s.store, email)
+	delete(s.store, id)
 	return s.Err
 }
 
-// Get retrieves a user.
-func (s InMemoryUserStorer) Get(email string) (*models.User, error) {
+// DueForDeletion returns the ids of users whose scheduled deletion is due.
+func (s InMemoryUserStorer) DueForDeletion(now time.Time) ([]string, error) {
 	if s.Err != nil {
 		return nil, s.Err
 	}
-	return s.store[email], s.Err
+	ids := make([]string, 0)
+	for id, u := range s.store {
+		if !u.DeleteAfter.IsZero() && !u.DeleteAfter.After(now) {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
 }
 
-// Update updates a user with a given email address.
-func (s InMemoryUserStorer) Update(email string, newUser models.User) error {
+// Get retrieves a user by id.
+func (s InMemoryUserStorer) Get(id string) (*models.User, error) {
+	if s.Err != nil {
+		return nil, s.Err
+	}
+	return s.store[id], s.Err
+}
+
+// GetByEmail retrieves a user by email address.
+func (s InMemoryUserStorer) GetByEmail(email string) (*models.User, error) {
+	if s.Err != nil {
+		return nil, s.Err
+	}
+	for _, u := range s.store {
+		if u.Email == email {
+			return u, nil
+		}
+	}
+	return nil, nil
+}
+
+// GetByFeedToken retrieves the user owning the given feed token.
+func (s InMemoryUserStorer) GetByFeedToken(token string) (*models.User, error) {
+	if s.Err != nil {
+		return nil, s.Err
+	}
+	if token == "" {
+		return nil, nil
+	}
+	for _, u := range s.store {
+		if u.FeedToken == token {
+			return u, nil
+		}
+	}
+	return nil, nil
+}
+
+// GetByInboxToken retrieves the user owning the given inbox token.
+func (s InMemoryUserStorer) GetByInboxToken(token string) (*models.User, error) {
+	if s.Err != nil {
+		return nil, s.Err
+	}
+	if token == "" {
+		return nil, nil
+	}
+	for _, u := range s.store {
+		if u.InboxToken == token {
+			return u, nil
+		}
+	}
+	return nil, nil
+}
+
+// Update updates a user with a given id.
+func (s InMemoryUserStorer) Update(id string, newUser models.User) error {
 	if s.Err != nil {
 		return s.Err
 	}
-	s.store[email] = &newUser
+	if u, _ := s.GetByEmail(newUser.Email); u != nil && u.ID != id {
+		return ErrEmailTaken
+	}
+	newUser.ID = id
+	s.store[id] = &newUser
 	return s.Err
 }
@@ -0,0 +1,180 @@
+package storage
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/staple-org/staple/internal/models"
+)
+
+// InMemoryWebhookStorer is a storer which uses memory as a storage backend.
+type InMemoryWebhookStorer struct {
+	Err error
+	mu  *sync.Mutex
+	// webhook id as key
+	hooks map[int]*models.Webhook
+	// delivery id as key
+	deliveries map[int]*models.WebhookDelivery
+}
+
+// NewInMemoryWebhookStorer creates a new in memory storage medium.
+func NewInMemoryWebhookStorer() InMemoryWebhookStorer {
+	return InMemoryWebhookStorer{
+		mu:         &sync.Mutex{},
+		hooks:      make(map[int]*models.Webhook),
+		deliveries: make(map[int]*models.WebhookDelivery),
+	}
+}
+
+// Create saves a webhook and returns it with its id.
+func (s InMemoryWebhookStorer) Create(hook models.Webhook) (models.Webhook, error) {
+	if s.Err != nil {
+		return models.Webhook{}, s.Err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hook.ID = 1
+	for _, existing := range s.hooks {
+		if existing.ID >= hook.ID {
+			hook.ID = existing.ID + 1
+		}
+	}
+	hook.Events = append([]string(nil), hook.Events...)
+	s.hooks[hook.ID] = &hook
+	return hook, nil
+}
+
+// Get retrieves a webhook of a user.
+func (s InMemoryWebhookStorer) Get(userID string, id int) (*models.Webhook, error) {
+	if s.Err != nil {
+		return nil, s.Err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hook, ok := s.hooks[id]
+	if !ok || hook.UserID != userID {
+		return nil, nil
+	}
+	ret := *hook
+	return &ret, nil
+}
+
+// List returns the webhooks of a user ordered by id.
+func (s InMemoryWebhookStorer) List(userID string) ([]models.Webhook, error) {
+	if s.Err != nil {
+		return nil, s.Err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]models.Webhook, 0)
+	for _, hook := range s.hooks {
+		if hook.UserID == userID {
+			list = append(list, *hook)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID < list[j].ID
+	})
+	return list, nil
+}
+
+// Delete removes a webhook and its deliveries.
+func (s InMemoryWebhookStorer) Delete(userID string, id int) error {
+	if s.Err != nil {
+		return s.Err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if hook, ok := s.hooks[id]; ok && hook.UserID == userID {
+		delete(s.hooks, id)
+		for did, d := range s.deliveries {
+			if d.WebhookID == id {
+				delete(s.deliveries, did)
+			}
+		}
+	}
+	return nil
+}
+
+// Enqueue saves a new delivery and returns it with its id.
+func (s InMemoryWebhookStorer) Enqueue(delivery models.WebhookDelivery) (models.WebhookDelivery, error) {
+	if s.Err != nil {
+		return models.WebhookDelivery{}, s.Err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delivery.ID = 1
+	for id := range s.deliveries {
+		if id >= delivery.ID {
+			delivery.ID = id + 1
+		}
+	}
+	s.deliveries[delivery.ID] = &delivery
+	return delivery, nil
+}
+
+// UpdateDelivery saves the outcome of a delivery attempt.
+func (s InMemoryWebhookStorer) UpdateDelivery(delivery models.WebhookDelivery) error {
+	if s.Err != nil {
+		return s.Err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.deliveries[delivery.ID]; ok {
+		s.deliveries[delivery.ID] = &delivery
+	}
+	return nil
+}
+
+// ClaimDeliveries returns up to limit deliveries whose next attempt is due, the oldest
+// first, and postpones them by the lease so concurrent workers don't send them twice.
+func (s InMemoryWebhookStorer) ClaimDeliveries(now time.Time, lease time.Duration, limit int) ([]models.WebhookDelivery, error) {
+	if s.Err != nil {
+		return nil, s.Err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]*models.WebhookDelivery, 0)
+	for _, d := range s.deliveries {
+		if d.NextAttemptAt != nil && !d.NextAttemptAt.After(now) {
+			list = append(list, d)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].NextAttemptAt.Before(*list[j].NextAttemptAt) ||
+			list[i].NextAttemptAt.Equal(*list[j].NextAttemptAt) && list[i].ID < list[j].ID
+	})
+	if len(list) > limit {
+		list = list[:limit]
+	}
+	ret := make([]models.WebhookDelivery, 0, len(list))
+	next := now.Add(lease)
+	for _, d := range list {
+		ret = append(ret, *d)
+		d.NextAttemptAt = &next
+	}
+	return ret, nil
+}
+
+// Deliveries returns up to limit deliveries of a webhook, the newest first.
+func (s InMemoryWebhookStorer) Deliveries(webhookID int, limit int) ([]models.WebhookDelivery, error) {
+	if s.Err != nil {
+		return nil, s.Err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]models.WebhookDelivery, 0)
+	for _, d := range s.deliveries {
+		if d.WebhookID == webhookID {
+			list = append(list, *d)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID > list[j].ID
+	})
+	if len(list) > limit {
+		list = list[:limit]
+	}
+	return list, nil
+}
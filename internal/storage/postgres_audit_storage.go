@@ -0,0 +1,127 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+
+	"github.com/staple-org/staple/internal/models"
+	"github.com/staple-org/staple/pkg/config"
+)
+
+// PostgresAuditStorer is a storer which uses Postgres as a storage backend.
+type PostgresAuditStorer struct{}
+
+// NewPostgresAuditStorer creates a new Postgres storage medium.
+func NewPostgresAuditStorer() PostgresAuditStorer {
+	return PostgresAuditStorer{}
+}
+
+func (s PostgresAuditStorer) connect() (*pgx.Conn, error) {
+	url := fmt.Sprintf("postgresql://%s/%s?user=%s&password=%s", config.Opts.Database.Hostname, config.Opts.Database.Database, config.Opts.Database.Username, config.Opts.Database.Password)
+	conn, err := pgx.Connect(context.Background(), url)
+	if err != nil {
+		config.Opts.Logger.Error().Err(err).Msg("Failed to connect to the database")
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Append adds an entry to the log.
+func (s PostgresAuditStorer) Append(entry models.AuditEntry) error {
+	conn, err := s.connect()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutForTransactions)
+	defer cancel()
+
+	defer conn.Close(ctx)
+	_, err = conn.Exec(ctx, "insert into audit_log(user_id, action, staple_id, detail, ip, user_agent, created_at) values($1, $2, $3, $4, $5, $6, $7)",
+		entry.UserID,
+		entry.Action,
+		entry.StapleID,
+		entry.Detail,
+		entry.IP,
+		entry.UserAgent,
+		entry.CreatedAt.UTC())
+	return err
+}
+
+// List returns entries of a user or every user, the newest first.
+func (s PostgresAuditStorer) List(userID string, action string, limit int, offset int) ([]models.AuditEntry, error) {
+	conn, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutForTransactions)
+	defer cancel()
+
+	defer conn.Close(ctx)
+	var (
+		where []string
+		args  []interface{}
+	)
+	if userID != "" {
+		args = append(args, userID)
+		where = append(where, "user_id = $"+strconv.Itoa(len(args)))
+	}
+	if action != "" {
+		args = append(args, action)
+		where = append(where, "action = $"+strconv.Itoa(len(args)))
+	}
+	sql := "select id, user_id, action, staple_id, detail, ip, user_agent, created_at from audit_log "
+	if len(where) > 0 {
+		sql += "where " + strings.Join(where, " and ") + " "
+	}
+	args = append(args, limit, offset)
+	sql += fmt.Sprintf("order by id desc limit $%d offset $%d", len(args)-1, len(args))
+	rows, err := conn.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := make([]models.AuditEntry, 0)
+	for rows.Next() {
+		var e models.AuditEntry
+		if err := rows.Scan(&e.ID, &e.UserID, &e.Action, &e.StapleID, &e.Detail, &e.IP, &e.UserAgent, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		ret = append(ret, e)
+	}
+	return ret, rows.Err()
+}
+
+// Purge removes the entries created before the given time. The audit log only allows
+// deletes in transactions which ask for it.
+func (s PostgresAuditStorer) Purge(before time.Time) (int64, error) {
+	conn, err := s.connect()
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutForTransactions)
+	defer cancel()
+
+	defer conn.Close(ctx)
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, "set local staple.audit_delete = 'on'"); err != nil {
+		return 0, err
+	}
+	tag, err := tx.Exec(ctx, "delete from audit_log where created_at < $1", before.UTC())
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v4"
+
+	"github.com/staple-org/staple/internal/models"
+	"github.com/staple-org/staple/pkg/config"
+)
+
+// PostgresChatTargetStorer is a storer which uses Postgres as a storage backend.
+type PostgresChatTargetStorer struct{}
+
+// NewPostgresChatTargetStorer creates a new Postgres storage medium.
+func NewPostgresChatTargetStorer() PostgresChatTargetStorer {
+	return PostgresChatTargetStorer{}
+}
+
+func (s PostgresChatTargetStorer) connect() (*pgx.Conn, error) {
+	url := fmt.Sprintf("postgresql://%s/%s?user=%s&password=%s", config.Opts.Database.Hostname, config.Opts.Database.Database, config.Opts.Database.Username, config.Opts.Database.Password)
+	conn, err := pgx.Connect(context.Background(), url)
+	if err != nil {
+		config.Opts.Logger.Error().Err(err).Msg("Failed to connect to the database")
+		return nil, err
+	}
+	return conn, nil
+}
+
+const chatTargetColumns = "user_id, kind, url, room, token, created_at"
+
+func scanChatTarget(row pgx.Row) (models.ChatTarget, error) {
+	var t models.ChatTarget
+	err := row.Scan(&t.UserID, &t.Kind, &t.URL, &t.Room, &t.Token, &t.CreatedAt)
+	return t, err
+}
+
+// Save creates or replaces the target of its kind.
+func (s PostgresChatTargetStorer) Save(target models.ChatTarget) error {
+	conn, err := s.connect()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutForTransactions)
+	defer cancel()
+
+	defer conn.Close(ctx)
+	_, err = conn.Exec(ctx, `insert into chat_targets(user_id, kind, url, room, token, created_at) values($1, $2, $3, $4, $5, $6)
+		on conflict (user_id, kind) do update set url = $3, room = $4, token = $5, created_at = $6`,
+		target.UserID,
+		target.Kind,
+		target.URL,
+		target.Room,
+		target.Token,
+		target.CreatedAt.UTC())
+	return err
+}
+
+// Get retrieves the target of a kind. It returns nil if the user has none.
+func (s PostgresChatTargetStorer) Get(userID string, kind string) (*models.ChatTarget, error) {
+	conn, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutForTransactions)
+	defer cancel()
+
+	defer conn.Close(ctx)
+	target, err := scanChatTarget(conn.QueryRow(ctx, "select "+chatTargetColumns+" from chat_targets where user_id = $1 and kind = $2", userID, kind))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &target, nil
+}
+
+// List returns the targets of a user ordered by kind.
+func (s PostgresChatTargetStorer) List(userID string) ([]models.ChatTarget, error) {
+	conn, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutForTransactions)
+	defer cancel()
+
+	defer conn.Close(ctx)
+	rows, err := conn.Query(ctx, "select "+chatTargetColumns+" from chat_targets where user_id = $1 order by kind", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := make([]models.ChatTarget, 0)
+	for rows.Next() {
+		target, err := scanChatTarget(rows)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, target)
+	}
+	return ret, rows.Err()
+}
+
+// Delete removes the target of a kind.
+func (s PostgresChatTargetStorer) Delete(userID string, kind string) error {
+	conn, err := s.connect()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutForTransactions)
+	defer cancel()
+
+	defer conn.Close(ctx)
+	_, err = conn.Exec(ctx, "delete from chat_targets where user_id = $1 and kind = $2", userID, kind)
+	return err
+}
@@ -0,0 +1,130 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+
+	"github.com/staple-org/staple/internal/models"
+	"github.com/staple-org/staple/pkg/config"
+)
+
+// PostgresDigestStorer is a storer which uses Postgres as a storage backend.
+type PostgresDigestStorer struct{}
+
+// NewPostgresDigestStorer creates a new Postgres storage medium.
+func NewPostgresDigestStorer() PostgresDigestStorer {
+	return PostgresDigestStorer{}
+}
+
+func (s PostgresDigestStorer) connect() (*pgx.Conn, error) {
+	url := fmt.Sprintf("postgresql://%s/%s?user=%s&password=%s", config.Opts.Database.Hostname, config.Opts.Database.Database, config.Opts.Database.Username, config.Opts.Database.Password)
+	conn, err := pgx.Connect(context.Background(), url)
+	if err != nil {
+		config.Opts.Logger.Error().Err(err).Msg("Failed to connect to the database")
+		return nil, err
+	}
+	return conn, nil
+}
+
+const digestColumns = "user_id, frequency, hour, reminder_days, timezone, quiet_start, quiet_end, last_digest_at, last_reminder_at"
+
+func scanDigestSettings(row pgx.Row) (models.DigestSettings, error) {
+	var s models.DigestSettings
+	err := row.Scan(&s.UserID, &s.Frequency, &s.Hour, &s.ReminderDays, &s.Timezone, &s.QuietStart, &s.QuietEnd, &s.LastDigestAt, &s.LastReminderAt)
+	return s, err
+}
+
+// Get retrieves the settings of a user. It returns nil if the user has none.
+func (s PostgresDigestStorer) Get(userID string) (*models.DigestSettings, error) {
+	conn, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutForTransactions)
+	defer cancel()
+
+	defer conn.Close(ctx)
+	settings, err := scanDigestSettings(conn.QueryRow(ctx, "select "+digestColumns+" from digest_settings where user_id = $1", userID))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &settings, nil
+}
+
+// Save creates or replaces the settings of a user.
+func (s PostgresDigestStorer) Save(settings models.DigestSettings) error {
+	conn, err := s.connect()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutForTransactions)
+	defer cancel()
+
+	defer conn.Close(ctx)
+	_, err = conn.Exec(ctx, `insert into digest_settings(user_id, frequency, hour, reminder_days, timezone, quiet_start, quiet_end) values($1, $2, $3, $4, $5, $6, $7)
+		on conflict (user_id) do update set frequency = $2, hour = $3, reminder_days = $4, timezone = $5, quiet_start = $6, quiet_end = $7`,
+		settings.UserID,
+		settings.Frequency,
+		settings.Hour,
+		settings.ReminderDays,
+		settings.Timezone,
+		settings.QuietStart,
+		settings.QuietEnd)
+	return err
+}
+
+// Enabled returns the settings of every user with a digest or a reminder.
+func (s PostgresDigestStorer) Enabled() ([]models.DigestSettings, error) {
+	conn, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutForTransactions)
+	defer cancel()
+
+	defer conn.Close(ctx)
+	rows, err := conn.Query(ctx, "select "+digestColumns+" from digest_settings where frequency <> $1 or reminder_days > 0 order by user_id", models.DigestOff)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := make([]models.DigestSettings, 0)
+	for rows.Next() {
+		settings, err := scanDigestSettings(rows)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, settings)
+	}
+	return ret, rows.Err()
+}
+
+// MarkDigestSent records when the last digest was sent.
+func (s PostgresDigestStorer) MarkDigestSent(userID string, at time.Time) error {
+	return s.exec("update digest_settings set last_digest_at = $1 where user_id = $2", at.UTC(), userID)
+}
+
+// MarkReminderSent records when the last reminder was sent.
+func (s PostgresDigestStorer) MarkReminderSent(userID string, at time.Time) error {
+	return s.exec("update digest_settings set last_reminder_at = $1 where user_id = $2", at.UTC(), userID)
+}
+
+func (s PostgresDigestStorer) exec(sql string, args ...interface{}) error {
+	conn, err := s.connect()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutForTransactions)
+	defer cancel()
+
+	defer conn.Close(ctx)
+	_, err = conn.Exec(ctx, sql, args...)
+	return err
+}
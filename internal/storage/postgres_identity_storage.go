@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v4"
+
+	"github.com/staple-org/staple/pkg/config"
+)
+
+// PostgresIdentityStorer is a storer which uses Postgres as a storage backend.
+type PostgresIdentityStorer struct{}
+
+// NewPostgresIdentityStorer creates a new Postgres storage medium.
+func NewPostgresIdentityStorer() PostgresIdentityStorer {
+	return PostgresIdentityStorer{}
+}
+
+func (s PostgresIdentityStorer) connect() (*pgx.Conn, error) {
+	url := fmt.Sprintf("postgresql://%s/%s?user=%s&password=%s", config.Opts.Database.Hostname, config.Opts.Database.Database, config.Opts.Database.Username, config.Opts.Database.Password)
+	conn, err := pgx.Connect(context.Background(), url)
+	if err != nil {
+		config.Opts.Logger.Error().Err(err).Msg("Failed to connect to the database")
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Link links an external identity to a user.
+func (s PostgresIdentityStorer) Link(issuer, subject, userID string) error {
+	conn, err := s.connect()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutForTransactions)
+	defer cancel()
+
+	defer conn.Close(ctx)
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, "insert into identities(issuer, subject, user_id) values($1, $2, $3) on conflict (issuer, subject) do update set user_id = excluded.user_id",
+		issuer,
+		subject,
+		userID); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// Find returns the id of the user linked to an external identity or an empty
+// string if the identity isn't linked.
+func (s PostgresIdentityStorer) Find(issuer, subject string) (string, error) {
+	conn, err := s.connect()
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutForTransactions)
+	defer cancel()
+
+	defer conn.Close(ctx)
+	var userID string
+	err = conn.QueryRow(ctx, "select user_id from identities where issuer = $1 and subject = $2", issuer, subject).Scan(&userID)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return "", nil
+		}
+		return "", err
+	}
+	return userID, nil
+}
@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+
+	"github.com/staple-org/staple/internal/models"
+	"github.com/staple-org/staple/pkg/config"
+)
+
+// PostgresNotificationPreferenceStorer is a storer which uses Postgres as a storage backend.
+type PostgresNotificationPreferenceStorer struct{}
+
+// NewPostgresNotificationPreferenceStorer creates a new Postgres storage medium.
+func NewPostgresNotificationPreferenceStorer() PostgresNotificationPreferenceStorer {
+	return PostgresNotificationPreferenceStorer{}
+}
+
+func (s PostgresNotificationPreferenceStorer) connect() (*pgx.Conn, error) {
+	url := fmt.Sprintf("postgresql://%s/%s?user=%s&password=%s", config.Opts.Database.Hostname, config.Opts.Database.Database, config.Opts.Database.Username, config.Opts.Database.Password)
+	conn, err := pgx.Connect(context.Background(), url)
+	if err != nil {
+		config.Opts.Logger.Error().Err(err).Msg("Failed to connect to the database")
+		return nil, err
+	}
+	return conn, nil
+}
+
+// List returns the stored preferences of a user ordered by event.
+func (s PostgresNotificationPreferenceStorer) List(userID string) ([]models.NotificationPreference, error) {
+	conn, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutForTransactions)
+	defer cancel()
+
+	defer conn.Close(ctx)
+	rows, err := conn.Query(ctx, "select user_id, event, channels, frequency, last_sent_at from notification_preferences where user_id = $1 order by event", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := make([]models.NotificationPreference, 0)
+	for rows.Next() {
+		var pref models.NotificationPreference
+		if err := rows.Scan(&pref.UserID, &pref.Event, &pref.Channels, &pref.Frequency, &pref.LastSentAt); err != nil {
+			return nil, err
+		}
+		ret = append(ret, pref)
+	}
+	return ret, rows.Err()
+}
+
+// Save creates or replaces the given preferences of a user.
+func (s PostgresNotificationPreferenceStorer) Save(userID string, prefs []models.NotificationPreference) error {
+	conn, err := s.connect()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutForTransactions)
+	defer cancel()
+
+	defer conn.Close(ctx)
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	for _, pref := range prefs {
+		if _, err := tx.Exec(ctx, `insert into notification_preferences(user_id, event, channels, frequency) values($1, $2, $3, $4)
+			on conflict (user_id, event) do update set channels = $3, frequency = $4`,
+			userID,
+			pref.Event,
+			pref.Channels,
+			pref.Frequency); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+// MarkSent records when the last notification of an event was sent.
+func (s PostgresNotificationPreferenceStorer) MarkSent(userID string, event string, at time.Time) error {
+	conn, err := s.connect()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutForTransactions)
+	defer cancel()
+
+	defer conn.Close(ctx)
+	_, err = conn.Exec(ctx, "update notification_preferences set last_sent_at = $1 where user_id = $2 and event = $3", at.UTC(), userID, event)
+	return err
+}
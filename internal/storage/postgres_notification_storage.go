@@ -0,0 +1,186 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+
+	"github.com/staple-org/staple/internal/models"
+	"github.com/staple-org/staple/pkg/config"
+)
+
+// PostgresNotificationStorer is a storer which uses Postgres as a storage backend.
+type PostgresNotificationStorer struct{}
+
+// NewPostgresNotificationStorer creates a new Postgres storage medium.
+func NewPostgresNotificationStorer() PostgresNotificationStorer {
+	return PostgresNotificationStorer{}
+}
+
+func (s PostgresNotificationStorer) connect() (*pgx.Conn, error) {
+	url := fmt.Sprintf("postgresql://%s/%s?user=%s&password=%s", config.Opts.Database.Hostname, config.Opts.Database.Database, config.Opts.Database.Username, config.Opts.Database.Password)
+	conn, err := pgx.Connect(context.Background(), url)
+	if err != nil {
+		config.Opts.Logger.Error().Err(err).Msg("Failed to connect to the database")
+		return nil, err
+	}
+	return conn, nil
+}
+
+const notificationColumns = "id, email, event, channel, payload, attempts, next_attempt_at, sent_at, dead_at, last_error, created_at"
+
+func scanNotification(row pgx.Row) (models.Notification, error) {
+	var n models.Notification
+	err := row.Scan(&n.ID, &n.Email, &n.Event, &n.Channel, &n.Payload, &n.Attempts, &n.NextAttemptAt, &n.SentAt, &n.DeadAt, &n.LastError, &n.CreatedAt)
+	return n, err
+}
+
+// Enqueue saves a new notification and returns it with its id.
+func (s PostgresNotificationStorer) Enqueue(n models.Notification) (models.Notification, error) {
+	conn, err := s.connect()
+	if err != nil {
+		return models.Notification{}, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutForTransactions)
+	defer cancel()
+
+	defer conn.Close(ctx)
+	err = conn.QueryRow(ctx, "insert into notifications(email, event, channel, payload, attempts, next_attempt_at, created_at) values($1, $2, $3, $4, $5, $6, $7) returning id",
+		n.Email,
+		n.Event,
+		n.Channel,
+		n.Payload,
+		n.Attempts,
+		n.NextAttemptAt,
+		n.CreatedAt.UTC()).Scan(&n.ID)
+	return n, err
+}
+
+// Claim returns up to limit due notifications and postpones them by lease. Rows claimed by
+// another worker at the same time are skipped.
+func (s PostgresNotificationStorer) Claim(now time.Time, lease time.Duration, limit int) ([]models.Notification, error) {
+	return s.notifications(`update notifications set next_attempt_at = $2 where id in (
+		select id from notifications where next_attempt_at <= $1 order by next_attempt_at, id limit $3 for update skip locked
+	) returning `+notificationColumns, now.UTC(), now.Add(lease).UTC(), limit)
+}
+
+// Update saves the outcome of an attempt.
+func (s PostgresNotificationStorer) Update(n models.Notification) error {
+	conn, err := s.connect()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutForTransactions)
+	defer cancel()
+
+	defer conn.Close(ctx)
+	_, err = conn.Exec(ctx, "update notifications set attempts = $1, next_attempt_at = $2, sent_at = $3, dead_at = $4, last_error = $5, payload = $6 where id = $7",
+		n.Attempts,
+		n.NextAttemptAt,
+		n.SentAt,
+		n.DeadAt,
+		n.LastError,
+		n.Payload,
+		n.ID)
+	return err
+}
+
+// Get retrieves a notification.
+func (s PostgresNotificationStorer) Get(id int) (*models.Notification, error) {
+	conn, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutForTransactions)
+	defer cancel()
+
+	defer conn.Close(ctx)
+	n, err := scanNotification(conn.QueryRow(ctx, "select "+notificationColumns+" from notifications where id = $1", id))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &n, nil
+}
+
+// List returns notifications with the given status, or of any status if it is empty, the newest first.
+func (s PostgresNotificationStorer) List(status string, limit int, offset int) ([]models.Notification, error) {
+	where := ""
+	switch status {
+	case models.NotificationPending:
+		where = "where sent_at is null and dead_at is null "
+	case models.NotificationSent:
+		where = "where sent_at is not null "
+	case models.NotificationDead:
+		where = "where dead_at is not null "
+	}
+	return s.notifications("select "+notificationColumns+" from notifications "+where+"order by id desc limit $1 offset $2", limit, offset)
+}
+
+// Redrive makes a dead notification due again with no attempts. It returns nil if there is
+// no dead notification with the id.
+func (s PostgresNotificationStorer) Redrive(id int, now time.Time) (*models.Notification, error) {
+	conn, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutForTransactions)
+	defer cancel()
+
+	defer conn.Close(ctx)
+	n, err := scanNotification(conn.QueryRow(ctx, "update notifications set attempts = 0, dead_at = null, last_error = '', next_attempt_at = $1 where id = $2 and dead_at is not null returning "+notificationColumns, now.UTC(), id))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &n, nil
+}
+
+// Purge removes notifications sent before sentBefore and given up before deadBefore.
+func (s PostgresNotificationStorer) Purge(sentBefore time.Time, deadBefore time.Time) (int64, error) {
+	conn, err := s.connect()
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutForTransactions)
+	defer cancel()
+
+	defer conn.Close(ctx)
+	tag, err := conn.Exec(ctx, "delete from notifications where sent_at < $1 or dead_at < $2", sentBefore.UTC(), deadBefore.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+func (s PostgresNotificationStorer) notifications(sql string, args ...interface{}) ([]models.Notification, error) {
+	conn, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutForTransactions)
+	defer cancel()
+
+	defer conn.Close(ctx)
+	rows, err := conn.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := make([]models.Notification, 0)
+	for rows.Next() {
+		n, err := scanNotification(rows)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, n)
+	}
+	return ret, rows.Err()
+}
@@ -0,0 +1,152 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+
+	"github.com/staple-org/staple/internal/models"
+	"github.com/staple-org/staple/pkg/config"
+)
+
+// PostgresOutboxStorer is a storer which uses Postgres as a storage backend.
+type PostgresOutboxStorer struct{}
+
+// NewPostgresOutboxStorer creates a new Postgres storage medium.
+func NewPostgresOutboxStorer() PostgresOutboxStorer {
+	return PostgresOutboxStorer{}
+}
+
+func (s PostgresOutboxStorer) connect() (*pgx.Conn, error) {
+	url := fmt.Sprintf("postgresql://%s/%s?user=%s&password=%s", config.Opts.Database.Hostname, config.Opts.Database.Database, config.Opts.Database.Username, config.Opts.Database.Password)
+	conn, err := pgx.Connect(context.Background(), url)
+	if err != nil {
+		config.Opts.Logger.Error().Err(err).Msg("Failed to connect to the database")
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Add stores a record which hasn't been published yet.
+func (s PostgresOutboxStorer) Add(record models.OutboxRecord) error {
+	conn, err := s.connect()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutForTransactions)
+	defer cancel()
+
+	defer conn.Close(ctx)
+	_, err = conn.Exec(ctx, "insert into event_outbox(id, name, user_id, payload, occurred_at) values($1, $2, $3, $4, $5) on conflict do nothing",
+		record.ID,
+		record.Name,
+		record.UserID,
+		string(record.Payload),
+		record.OccurredAt.UTC())
+	return err
+}
+
+// Claim returns up to limit unpublished records which failed fewer than maxAttempts
+// times and aren't claimed by another relay, the oldest first, and locks them for the lease.
+func (s PostgresOutboxStorer) Claim(now time.Time, lease time.Duration, maxAttempts int, limit int) ([]models.OutboxRecord, error) {
+	conn, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutForTransactions)
+	defer cancel()
+
+	defer conn.Close(ctx)
+	rows, err := conn.Query(ctx, `update event_outbox set locked_until = $2 where id in (
+		select id from event_outbox where published_at is null and attempts < $3 and (locked_until is null or locked_until <= $1) order by occurred_at limit $4 for update skip locked
+	) returning id, name, user_id, payload, occurred_at, attempts, last_error, locked_until`, now.UTC(), now.Add(lease).UTC(), maxAttempts, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := make([]models.OutboxRecord, 0)
+	for rows.Next() {
+		var (
+			r       models.OutboxRecord
+			payload string
+		)
+		if err := rows.Scan(&r.ID, &r.Name, &r.UserID, &payload, &r.OccurredAt, &r.Attempts, &r.LastError, &r.LockedUntil); err != nil {
+			return nil, err
+		}
+		r.Payload = []byte(payload)
+		ret = append(ret, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].OccurredAt.Before(ret[j].OccurredAt)
+	})
+	return ret, nil
+}
+
+// MarkPublished records that a record has been published.
+func (s PostgresOutboxStorer) MarkPublished(id string, at time.Time) error {
+	conn, err := s.connect()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutForTransactions)
+	defer cancel()
+
+	defer conn.Close(ctx)
+	_, err = conn.Exec(ctx, "update event_outbox set published_at = $1 where id = $2", at.UTC(), id)
+	return err
+}
+
+// MarkFailed records a failed attempt to publish a record and releases it for the next run.
+func (s PostgresOutboxStorer) MarkFailed(id string, reason string) error {
+	conn, err := s.connect()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutForTransactions)
+	defer cancel()
+
+	defer conn.Close(ctx)
+	_, err = conn.Exec(ctx, "update event_outbox set attempts = attempts + 1, last_error = $1, locked_until = null where id = $2", reason, id)
+	return err
+}
+
+// Purge removes records published before the given time and returns how many were removed.
+func (s PostgresOutboxStorer) Purge(publishedBefore time.Time) (int64, error) {
+	conn, err := s.connect()
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutForTransactions)
+	defer cancel()
+
+	defer conn.Close(ctx)
+	tag, err := conn.Exec(ctx, "delete from event_outbox where published_at < $1", publishedBefore.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// recordEvent adds an event to the outbox inside the transaction of the change which
+// caused it. The payload is encoded the way the service encodes the event body.
+func recordEvent(ctx context.Context, tx pgx.Tx, name, userID string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, "insert into event_outbox(id, name, user_id, payload, occurred_at) values($1, $2, $3, $4, $5)",
+		uuid.New().String(),
+		name,
+		userID,
+		string(data),
+		time.Now().UTC())
+	return err
+}
@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+
+	"github.com/staple-org/staple/pkg/config"
+)
+
+// PostgresRateLimitStorer keeps token buckets in Postgres so all replicas of Staple
+// share the same limits.
+type PostgresRateLimitStorer struct{}
+
+// NewPostgresRateLimitStorer creates a new Postgres rate limit storage medium.
+func NewPostgresRateLimitStorer() PostgresRateLimitStorer {
+	return PostgresRateLimitStorer{}
+}
+
+func (p PostgresRateLimitStorer) connect() (*pgx.Conn, error) {
+	url := fmt.Sprintf("postgresql://%s/%s?user=%s&password=%s", config.Opts.Database.Hostname, config.Opts.Database.Database, config.Opts.Database.Username, config.Opts.Database.Password)
+	conn, err := pgx.Connect(context.Background(), url)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Take tries to take a token from the bucket identified by key. The bucket row is locked
+// for the duration of the transaction.
+func (p PostgresRateLimitStorer) Take(key string, rate float64, burst int, now time.Time) (bool, time.Duration, error) {
+	conn, err := p.connect()
+	if err != nil {
+		return false, 0, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutForTransactions)
+	defer cancel()
+
+	defer conn.Close(ctx)
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return false, 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, "insert into rate_limits(key, tokens, updated_at) values($1, $2, $3) on conflict (key) do nothing",
+		key,
+		float64(burst),
+		now); err != nil {
+		return false, 0, err
+	}
+	var (
+		tokens    float64
+		updatedAt time.Time
+	)
+	if err := tx.QueryRow(ctx, "select tokens, updated_at from rate_limits where key = $1 for update", key).Scan(&tokens, &updatedAt); err != nil {
+		return false, 0, err
+	}
+	tokens, allowed, retryAfter := takeToken(tokens, updatedAt, now, rate, burst)
+	if now.After(updatedAt) {
+		updatedAt = now
+	}
+	if _, err := tx.Exec(ctx, "update rate_limits set tokens = $1, updated_at = $2 where key = $3", tokens, updatedAt, key); err != nil {
+		return false, 0, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return false, 0, err
+	}
+	return allowed, retryAfter, nil
+}
+
+// Prune removes the buckets which haven't changed since idleSince.
+func (p PostgresRateLimitStorer) Prune(idleSince time.Time) (int64, error) {
+	conn, err := p.connect()
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutForTransactions)
+	defer cancel()
+
+	defer conn.Close(ctx)
+	tag, err := conn.Exec(ctx, "delete from rate_limits where updated_at < $1", idleSince)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
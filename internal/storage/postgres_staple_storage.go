@@ -2,6 +2,7 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"time"
 
@@ -12,13 +13,32 @@ import (
 )
 
 // PostgresStapleStorer is a storer which uses Postgres as a storage backend.
-type PostgresStapleStorer struct{}
+type PostgresStapleStorer struct {
+	outbox bool
+}
 
 // NewPostgresStapleStorer creates a new Postgres storage medium.
 func NewPostgresStapleStorer() PostgresStapleStorer {
 	return PostgresStapleStorer{}
 }
 
+// WithOutbox returns a copy of the storer which records created, archived, deleted and
+// restored staples in the event outbox in the same transaction.
+func (p PostgresStapleStorer) WithOutbox() PostgresStapleStorer {
+	p.outbox = true
+	return p
+}
+
+// RecordsEvents reports whether changes are recorded in the event outbox.
+func (p PostgresStapleStorer) RecordsEvents() bool {
+	return p.outbox
+}
+
+// stapleEvent is the body of the staple events in the outbox.
+type stapleEvent struct {
+	Staple models.Staple `json:"staple"`
+}
+
 func (p PostgresStapleStorer) connect() (*pgx.Conn, error) {
 	url := fmt.Sprintf("postgresql://%s/%s?user=%s&password=%s", config.Opts.Database.Hostname, config.Opts.Database.Database, config.Opts.Database.Username, config.Opts.Database.Password)
 	conn, err := pgx.Connect(context.Background(), url)
@@ -29,7 +49,7 @@ func (p PostgresStapleStorer) connect() (*pgx.Conn, error) {
 }
 
 // Create will create a staple in the underlying postgres storage medium.
-func (p PostgresStapleStorer) Create(staple models.Staple, email string) error {
+func (p PostgresStapleStorer) Create(staple models.Staple, userID string) error {
 	conn, err := p.connect()
 	if err != nil {
 		return err
@@ -44,19 +64,25 @@ func (p PostgresStapleStorer) Create(staple models.Staple, email string) error {
 	}
 	defer tx.Rollback(ctx)
 
-	if _, err := tx.Exec(ctx, "insert into staples(name, content, archived, created_at, user_email) values($1, $2, $3, $4, $5)",
+	if err := tx.QueryRow(ctx, "insert into staples(name, content, archived, created_at, archived_at, user_id) values($1, $2, $3, $4, $5, $6) returning id",
 		staple.Name,
 		staple.Content,
 		staple.Archived,
 		staple.CreatedAt,
-		email); err != nil {
+		staple.ArchivedAt,
+		userID).Scan(&staple.ID); err != nil {
 		return err
 	}
+	if p.outbox {
+		if err := recordEvent(ctx, tx, models.EventStapleCreated, userID, stapleEvent{Staple: staple}); err != nil {
+			return err
+		}
+	}
 	return tx.Commit(ctx)
 }
 
-// Delete removes a staple.
-func (p PostgresStapleStorer) Delete(email string, stapleID int) error {
+// Delete moves a staple to the trash. Staples which are in the trash already are left alone.
+func (p PostgresStapleStorer) Delete(userID string, stapleID int) error {
 	conn, err := p.connect()
 	if err != nil {
 		return err
@@ -71,14 +97,30 @@ func (p PostgresStapleStorer) Delete(email string, stapleID int) error {
 	}
 	defer tx.Rollback(ctx)
 
-	if _, err := tx.Exec(ctx, "delete from staples where id = $1 and user_email = $2", stapleID, email); err != nil {
+	var staple models.Staple
+	if err := tx.QueryRow(ctx, "update staples set deleted_at = $3 where id = $1 and user_id = $2 and deleted_at is null returning name, id, content, archived, created_at, archived_at, deleted_at", stapleID, userID, time.Now().UTC()).Scan(
+		&staple.Name,
+		&staple.ID,
+		&staple.Content,
+		&staple.Archived,
+		&staple.CreatedAt,
+		&staple.ArchivedAt,
+		&staple.DeletedAt); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil
+		}
 		return err
 	}
+	if p.outbox {
+		if err := recordEvent(ctx, tx, models.EventStapleDeleted, userID, stapleEvent{Staple: staple}); err != nil {
+			return err
+		}
+	}
 	return tx.Commit(ctx)
 }
 
 // Get retrieves a staple.
-func (p PostgresStapleStorer) Get(email string, stapleID int) (*models.Staple, error) {
+func (p PostgresStapleStorer) Get(userID string, stapleID int) (*models.Staple, error) {
 	conn, err := p.connect()
 	if err != nil {
 		return nil, err
@@ -97,17 +139,16 @@ func (p PostgresStapleStorer) Get(email string, stapleID int) (*models.Staple, e
 		name, content string
 		archived      bool
 		createdAt     time.Time
+		archivedAt    *time.Time
 	)
-	if err := tx.QueryRow(ctx, "select name, id, content, archived, created_at from staples where user_email = $1 and id = $2", email, stapleID).Scan(
+	if err := tx.QueryRow(ctx, "select name, id, content, archived, created_at, archived_at from staples where user_id = $1 and id = $2 and deleted_at is null", userID, stapleID).Scan(
 		&name,
 		&id,
 		&content,
 		&archived,
-		&createdAt); err != nil {
-		return nil, err
-	}
-	if err != nil {
-		if err.Error() == "no rows in result set" {
+		&createdAt,
+		&archivedAt); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
 			return nil, nil
 		}
 		return nil, err
@@ -116,16 +157,18 @@ func (p PostgresStapleStorer) Get(email string, stapleID int) (*models.Staple, e
 		return nil, err
 	}
 	return &models.Staple{
-		Name:      name,
-		ID:        id,
-		Content:   content,
-		Archived:  archived,
-		CreatedAt: createdAt,
+		Name:       name,
+		ID:         id,
+		Content:    content,
+		Archived:   archived,
+		CreatedAt:  createdAt,
+		ArchivedAt: archivedAt,
 	}, nil
 }
 
-// Oldest will get the oldest staple that is not archived.
-func (p PostgresStapleStorer) Oldest(email string) (*models.Staple, error) {
+// Oldest will get the oldest staple that is not archived, the head of the queue.
+// It returns nil if the queue is empty.
+func (p PostgresStapleStorer) Oldest(userID string) (*models.Staple, error) {
 	conn, err := p.connect()
 	if err != nil {
 		return nil, err
@@ -134,59 +177,65 @@ func (p PostgresStapleStorer) Oldest(email string) (*models.Staple, error) {
 	defer cancel()
 
 	defer conn.Close(ctx)
-	tx, err := conn.Begin(ctx)
-	if err != nil {
-		return nil, err
-	}
-	defer tx.Rollback(ctx)
-	var (
-		id            int
-		name, content string
-		archived      bool
-		createdAt     time.Time
-	)
-	if err := tx.QueryRow(ctx, "select name, id, content, archived, created_at from staples s1 where created_at = (select MIN(created_at) from staples s2 where s2.id = s1.id and s2.user_email = $1 and s2.archived = false)", email).Scan(
-		&name,
-		&id,
-		&content,
-		&archived,
-		&createdAt); err != nil {
-		return nil, err
-	}
-	if err != nil {
-		if err.Error() == "no rows in result set" {
+	staple := models.Staple{}
+	if err := conn.QueryRow(ctx, "select name, id, content, archived, created_at from staples where user_id = $1 and archived = false and deleted_at is null order by created_at, id limit 1", userID).Scan(
+		&staple.Name,
+		&staple.ID,
+		&staple.Content,
+		&staple.Archived,
+		&staple.CreatedAt); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
 			return nil, nil
 		}
 		return nil, err
 	}
-	if err := tx.Commit(ctx); err != nil {
-		return nil, err
-	}
-	return &models.Staple{
-		Name:      name,
-		ID:        id,
-		Content:   content,
-		Archived:  archived,
-		CreatedAt: createdAt,
-	}, nil
+	return &staple, nil
 }
 
 // Archive archives a staple.
-func (p PostgresStapleStorer) Archive(email string, stapleID int) error {
+func (p PostgresStapleStorer) Archive(userID string, stapleID int) error {
 	conn, err := p.connect()
 	if err != nil {
 		return err
 	}
-	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutForTransactions)
+	defer cancel()
+
 	defer conn.Close(ctx)
-	_, err = conn.Exec(ctx, "update staples set archived = true where user_email = $1 and id = $2", email, stapleID)
-	return err
+	if !p.outbox {
+		_, err = conn.Exec(ctx, "update staples set archived = true, archived_at = coalesce(archived_at, $3) where user_id = $1 and id = $2 and deleted_at is null", userID, stapleID, time.Now().UTC())
+		return err
+	}
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	// Only staples which weren't archived yet cause an event.
+	var staple models.Staple
+	if err := tx.QueryRow(ctx, "update staples set archived = true, archived_at = $3 where user_id = $1 and id = $2 and archived = false and deleted_at is null returning name, id, content, archived, created_at, archived_at", userID, stapleID, time.Now().UTC()).Scan(
+		&staple.Name,
+		&staple.ID,
+		&staple.Content,
+		&staple.Archived,
+		&staple.CreatedAt,
+		&staple.ArchivedAt); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil
+		}
+		return err
+	}
+	if err := recordEvent(ctx, tx, models.EventStapleArchived, userID, stapleEvent{Staple: staple}); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
 }
 
 // List gets all the not archived staples for a user. List will not retrieve the content
 // since that can possibly be a large text. We only ever retrieve it when that
 // specific staple is Get.
-func (p PostgresStapleStorer) List(email string) ([]models.Staple, error) {
+func (p PostgresStapleStorer) List(userID string) ([]models.Staple, error) {
 	conn, err := p.connect()
 	if err != nil {
 		return nil, err
@@ -201,7 +250,7 @@ func (p PostgresStapleStorer) List(email string) ([]models.Staple, error) {
 	}
 	defer tx.Rollback(ctx)
 
-	rows, err := tx.Query(ctx, "select name, id, archived, created_at from staples where user_email=$1 and archived = false", email)
+	rows, err := tx.Query(ctx, "select name, id, archived, created_at from staples where user_id=$1 and archived = false and deleted_at is null", userID)
 	if err != nil {
 		return nil, err
 	}
@@ -221,7 +270,7 @@ func (p PostgresStapleStorer) List(email string) ([]models.Staple, error) {
 }
 
 // ShowArchive will return the users archived staples ordered by id.
-func (p PostgresStapleStorer) ShowArchive(email string) ([]models.Staple, error) {
+func (p PostgresStapleStorer) ShowArchive(userID string) ([]models.Staple, error) {
 	conn, err := p.connect()
 	if err != nil {
 		return nil, err
@@ -236,7 +285,7 @@ func (p PostgresStapleStorer) ShowArchive(email string) ([]models.Staple, error)
 	}
 	defer tx.Rollback(ctx)
 
-	rows, err := tx.Query(ctx, "select name, id, archived, created_at from staples where user_email=$1 and archived = true order by id", email)
+	rows, err := tx.Query(ctx, "select name, id, archived, created_at from staples where user_id=$1 and archived = true and deleted_at is null order by id", userID)
 	if err != nil {
 		return nil, err
 	}
@@ -254,3 +303,190 @@ func (p PostgresStapleStorer) ShowArchive(email string) ([]models.Staple, error)
 	}
 	return ret, nil
 }
+
+// All returns every staple of a user including the archived ones and their content
+// ordered by id.
+func (p PostgresStapleStorer) All(userID string) ([]models.Staple, error) {
+	conn, err := p.connect()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutForTransactions)
+	defer cancel()
+
+	defer conn.Close(ctx)
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx, "select name, id, content, archived, created_at, archived_at from staples where user_id=$1 and deleted_at is null order by id", userID)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]models.Staple, 0)
+	for rows.Next() {
+		staple := models.Staple{}
+		err = rows.Scan(&staple.Name, &staple.ID, &staple.Content, &staple.Archived, &staple.CreatedAt, &staple.ArchivedAt)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, staple)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// Walk calls fn for every staple of a user including the content, the queue in FIFO order
+// first and then the archive. Rows are read one by one so large archives aren't loaded
+// into memory at once. An error returned by fn stops the walk.
+func (p PostgresStapleStorer) Walk(userID string, fn func(models.Staple) error) error {
+	conn, err := p.connect()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutForStreaming)
+	defer cancel()
+
+	defer conn.Close(ctx)
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx, "select name, id, content, archived, created_at, archived_at from staples where user_id=$1 and deleted_at is null order by archived, created_at, id", userID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		staple := models.Staple{}
+		if err := rows.Scan(&staple.Name, &staple.ID, &staple.Content, &staple.Archived, &staple.CreatedAt, &staple.ArchivedAt); err != nil {
+			return err
+		}
+		if err := fn(staple); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// RecentArchive returns up to limit archived staples including their content, the most
+// recently archived first. Staples archived before archived_at existed come last.
+func (p PostgresStapleStorer) RecentArchive(userID string, limit int) ([]models.Staple, error) {
+	conn, err := p.connect()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutForTransactions)
+	defer cancel()
+
+	defer conn.Close(ctx)
+	rows, err := conn.Query(ctx, "select name, id, content, archived, created_at, archived_at from staples where user_id = $1 and archived = true and deleted_at is null order by archived_at desc nulls last, id desc limit $2", userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := make([]models.Staple, 0)
+	for rows.Next() {
+		staple := models.Staple{}
+		if err := rows.Scan(&staple.Name, &staple.ID, &staple.Content, &staple.Archived, &staple.CreatedAt, &staple.ArchivedAt); err != nil {
+			return nil, err
+		}
+		ret = append(ret, staple)
+	}
+	return ret, rows.Err()
+}
+
+// Trash returns the staples in the trash of a user including their content, the most
+// recently deleted first.
+func (p PostgresStapleStorer) Trash(userID string) ([]models.Staple, error) {
+	conn, err := p.connect()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutForTransactions)
+	defer cancel()
+
+	defer conn.Close(ctx)
+	rows, err := conn.Query(ctx, "select name, id, content, archived, created_at, archived_at, deleted_at from staples where user_id = $1 and deleted_at is not null order by deleted_at desc, id desc", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := make([]models.Staple, 0)
+	for rows.Next() {
+		staple := models.Staple{}
+		if err := rows.Scan(&staple.Name, &staple.ID, &staple.Content, &staple.Archived, &staple.CreatedAt, &staple.ArchivedAt, &staple.DeletedAt); err != nil {
+			return nil, err
+		}
+		ret = append(ret, staple)
+	}
+	return ret, rows.Err()
+}
+
+// Restore takes a staple out of the trash. It keeps its creation time, so a staple of the
+// queue is back at its old position.
+func (p PostgresStapleStorer) Restore(userID string, stapleID int) (*models.Staple, error) {
+	conn, err := p.connect()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutForTransactions)
+	defer cancel()
+
+	defer conn.Close(ctx)
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	var staple models.Staple
+	if err := tx.QueryRow(ctx, "update staples set deleted_at = null where id = $1 and user_id = $2 and deleted_at is not null returning name, id, content, archived, created_at, archived_at", stapleID, userID).Scan(
+		&staple.Name,
+		&staple.ID,
+		&staple.Content,
+		&staple.Archived,
+		&staple.CreatedAt,
+		&staple.ArchivedAt); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if p.outbox {
+		if err := recordEvent(ctx, tx, models.EventStapleRestored, userID, stapleEvent{Staple: staple}); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return &staple, nil
+}
+
+// PurgeTrash removes the staples of all users which were moved to the trash before the
+// given time and returns how many were removed.
+func (p PostgresStapleStorer) PurgeTrash(deletedBefore time.Time) (int64, error) {
+	conn, err := p.connect()
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutForTransactions)
+	defer cancel()
+
+	defer conn.Close(ctx)
+	tag, err := conn.Exec(ctx, "delete from staples where deleted_at < $1", deletedBefore.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
@@ -0,0 +1,159 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+
+	"github.com/staple-org/staple/internal/models"
+	"github.com/staple-org/staple/pkg/config"
+)
+
+// PostgresStatsStorer is a storer which computes statistics in Postgres.
+type PostgresStatsStorer struct{}
+
+// NewPostgresStatsStorer creates a new Postgres storage medium.
+func NewPostgresStatsStorer() PostgresStatsStorer {
+	return PostgresStatsStorer{}
+}
+
+func (s PostgresStatsStorer) connect() (*pgx.Conn, error) {
+	url := fmt.Sprintf("postgresql://%s/%s?user=%s&password=%s", config.Opts.Database.Hostname, config.Opts.Database.Database, config.Opts.Database.Username, config.Opts.Database.Password)
+	conn, err := pgx.Connect(context.Background(), url)
+	if err != nil {
+		config.Opts.Logger.Error().Err(err).Msg("Failed to connect to the database")
+		return nil, err
+	}
+	return conn, nil
+}
+
+// stapleHistory is every stored and deleted staple of the user $1. Staples in the trash
+// are recorded as deletions already.
+const stapleHistory = `with history as (
+	select created_at, archived, archived_at, null::timestamp as deleted_at from staples where user_id = $1 and deleted_at is null
+	union all
+	select created_at, archived, archived_at, deleted_at from staple_deletions where user_id = $1
+) `
+
+// RecordDeletion records a deleted staple once per event. Deletions of users which don't
+// exist anymore are dropped.
+func (s PostgresStatsStorer) RecordDeletion(eventID, userID string, staple models.Staple, deletedAt time.Time) error {
+	conn, err := s.connect()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutForTransactions)
+	defer cancel()
+
+	defer conn.Close(ctx)
+	_, err = conn.Exec(ctx, `insert into staple_deletions(event_id, user_id, staple_id, created_at, archived, archived_at, deleted_at)
+		select $1, $2, $3, $4, $5, $6, $7 where exists (select 1 from users where id = $2)
+		on conflict (event_id) do nothing`,
+		eventID,
+		userID,
+		staple.ID,
+		staple.CreatedAt.UTC(),
+		staple.Archived,
+		staple.ArchivedAt,
+		deletedAt.UTC())
+	return err
+}
+
+// ForgetDeletion drops the recorded deletions of a staple which was restored.
+func (s PostgresStatsStorer) ForgetDeletion(userID string, stapleID int) error {
+	conn, err := s.connect()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutForTransactions)
+	defer cancel()
+
+	defer conn.Close(ctx)
+	_, err = conn.Exec(ctx, "delete from staple_deletions where user_id = $1 and staple_id = $2", userID, stapleID)
+	return err
+}
+
+// Activity counts the added, archived and deleted unread staples per day.
+func (s PostgresStatsStorer) Activity(userID string, from, to time.Time, timezone *time.Location) ([]models.StapleActivity, error) {
+	conn, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutForTransactions)
+	defer cancel()
+
+	defer conn.Close(ctx)
+	rows, err := conn.Query(ctx, stapleHistory+`, activity as (
+		select created_at as at, 1 as added, 0 as archived, 0 as deleted_unread from history where created_at >= $2 and created_at < $3
+		union all
+		select archived_at, 0, 1, 0 from history where archived_at >= $2 and archived_at < $3
+		union all
+		select deleted_at, 0, 0, 1 from history where not archived and deleted_at >= $2 and deleted_at < $3
+	)
+	select to_char((at at time zone 'UTC') at time zone $4::text, 'YYYY-MM-DD') as day, sum(added), sum(archived), sum(deleted_unread)
+	from activity group by day order by day`, userID, from.UTC(), to.UTC(), timezone.String())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := make([]models.StapleActivity, 0)
+	for rows.Next() {
+		var a models.StapleActivity
+		if err := rows.Scan(&a.Date, &a.Added, &a.Archived, &a.DeletedUnread); err != nil {
+			return nil, err
+		}
+		ret = append(ret, a)
+	}
+	return ret, rows.Err()
+}
+
+// TimeInQueue returns the average time in the queue of the staples archived in the range.
+func (s PostgresStatsStorer) TimeInQueue(userID string, from, to time.Time) (time.Duration, error) {
+	conn, err := s.connect()
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutForTransactions)
+	defer cancel()
+
+	defer conn.Close(ctx)
+	var seconds float64
+	if err := conn.QueryRow(ctx, stapleHistory+`select coalesce(extract(epoch from avg(archived_at - created_at)), 0)::float8
+		from history where archived_at >= $2 and archived_at < $3`, userID, from.UTC(), to.UTC()).Scan(&seconds); err != nil {
+		return 0, err
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// QueueAges counts the staples of the queue by age.
+func (s PostgresStatsStorer) QueueAges(userID string, now time.Time, bounds []time.Duration) ([]int, error) {
+	conn, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutForTransactions)
+	defer cancel()
+
+	defer conn.Close(ctx)
+	thresholds := make([]float64, len(bounds))
+	for i, b := range bounds {
+		thresholds[i] = b.Seconds()
+	}
+	rows, err := conn.Query(ctx, `select width_bucket(extract(epoch from $2::timestamp - created_at)::float8, $3::float8[]) as bucket, count(*)
+		from staples where user_id = $1 and archived = false and deleted_at is null group by bucket`, userID, now.UTC(), thresholds)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := make([]int, len(bounds)+1)
+	for rows.Next() {
+		var bucket, count int
+		if err := rows.Scan(&bucket, &count); err != nil {
+			return nil, err
+		}
+		counts[bucket] = count
+	}
+	return counts, rows.Err()
+}
@@ -0,0 +1,223 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+
+	"github.com/staple-org/staple/internal/models"
+	"github.com/staple-org/staple/pkg/config"
+)
+
+// PostgresSubscriptionStorer is a storer which uses Postgres as a storage backend.
+type PostgresSubscriptionStorer struct{}
+
+// NewPostgresSubscriptionStorer creates a new Postgres storage medium.
+func NewPostgresSubscriptionStorer() PostgresSubscriptionStorer {
+	return PostgresSubscriptionStorer{}
+}
+
+func (s PostgresSubscriptionStorer) connect() (*pgx.Conn, error) {
+	url := fmt.Sprintf("postgresql://%s/%s?user=%s&password=%s", config.Opts.Database.Hostname, config.Opts.Database.Database, config.Opts.Database.Username, config.Opts.Database.Password)
+	conn, err := pgx.Connect(context.Background(), url)
+	if err != nil {
+		config.Opts.Logger.Error().Err(err).Msg("Failed to connect to the database")
+		return nil, err
+	}
+	return conn, nil
+}
+
+const subscriptionColumns = "id, user_id, url, title, policy, etag, last_modified, checked_at, last_error, created_at"
+
+func scanSubscription(row pgx.Row) (models.Subscription, error) {
+	var (
+		sub       models.Subscription
+		checkedAt *time.Time
+	)
+	if err := row.Scan(&sub.ID, &sub.UserID, &sub.URL, &sub.Title, &sub.Policy, &sub.ETag, &sub.LastModified, &checkedAt, &sub.LastError, &sub.CreatedAt); err != nil {
+		return models.Subscription{}, err
+	}
+	if checkedAt != nil {
+		sub.CheckedAt = *checkedAt
+	}
+	return sub, nil
+}
+
+// Create saves a subscription and returns it with its id.
+func (s PostgresSubscriptionStorer) Create(sub models.Subscription) (models.Subscription, error) {
+	conn, err := s.connect()
+	if err != nil {
+		return models.Subscription{}, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutForTransactions)
+	defer cancel()
+
+	defer conn.Close(ctx)
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return models.Subscription{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	if err := tx.QueryRow(ctx, "insert into subscriptions(user_id, url, title, policy, etag, last_modified, checked_at, last_error, created_at) values($1, $2, $3, $4, $5, $6, $7, $8, $9) returning id",
+		sub.UserID,
+		sub.URL,
+		sub.Title,
+		sub.Policy,
+		sub.ETag,
+		sub.LastModified,
+		nullTime(sub.CheckedAt),
+		sub.LastError,
+		sub.CreatedAt).Scan(&sub.ID); err != nil {
+		if isUniqueViolation(err) {
+			return models.Subscription{}, ErrSubscriptionExists
+		}
+		return models.Subscription{}, err
+	}
+	return sub, tx.Commit(ctx)
+}
+
+// Get retrieves a subscription of a user.
+func (s PostgresSubscriptionStorer) Get(userID string, id int) (*models.Subscription, error) {
+	conn, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutForTransactions)
+	defer cancel()
+
+	defer conn.Close(ctx)
+	sub, err := scanSubscription(conn.QueryRow(ctx, "select "+subscriptionColumns+" from subscriptions where user_id = $1 and id = $2", userID, id))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &sub, nil
+}
+
+// List returns the subscriptions of a user ordered by id.
+func (s PostgresSubscriptionStorer) List(userID string) ([]models.Subscription, error) {
+	return s.query("select "+subscriptionColumns+" from subscriptions where user_id = $1 order by id", userID)
+}
+
+// Due returns all subscriptions which haven't been polled since checkedBefore, the
+// ones which waited longest first.
+func (s PostgresSubscriptionStorer) Due(checkedBefore time.Time) ([]models.Subscription, error) {
+	return s.query("select "+subscriptionColumns+" from subscriptions where checked_at is null or checked_at < $1 order by checked_at nulls first", checkedBefore.UTC())
+}
+
+func (s PostgresSubscriptionStorer) query(sql string, args ...interface{}) ([]models.Subscription, error) {
+	conn, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutForTransactions)
+	defer cancel()
+
+	defer conn.Close(ctx)
+	rows, err := conn.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := make([]models.Subscription, 0)
+	for rows.Next() {
+		sub, err := scanSubscription(rows)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, sub)
+	}
+	return ret, rows.Err()
+}
+
+// Update saves the policy and the poll state of a subscription.
+func (s PostgresSubscriptionStorer) Update(sub models.Subscription) error {
+	conn, err := s.connect()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutForTransactions)
+	defer cancel()
+
+	defer conn.Close(ctx)
+	_, err = conn.Exec(ctx, "update subscriptions set title=$1, policy=$2, etag=$3, last_modified=$4, checked_at=$5, last_error=$6 where id=$7",
+		sub.Title,
+		sub.Policy,
+		sub.ETag,
+		sub.LastModified,
+		nullTime(sub.CheckedAt),
+		sub.LastError,
+		sub.ID)
+	return err
+}
+
+// Delete removes a subscription and its seen entries.
+func (s PostgresSubscriptionStorer) Delete(userID string, id int) error {
+	conn, err := s.connect()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutForTransactions)
+	defer cancel()
+
+	defer conn.Close(ctx)
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, "delete from subscription_entries where subscription_id = (select id from subscriptions where id = $1 and user_id = $2)", id, userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, "delete from subscriptions where id = $1 and user_id = $2", id, userID); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// Seen reports which of the entry keys have been seen before.
+func (s PostgresSubscriptionStorer) Seen(subscriptionID int, keys []string) (map[string]bool, error) {
+	conn, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutForTransactions)
+	defer cancel()
+
+	defer conn.Close(ctx)
+	rows, err := conn.Query(ctx, "select key from subscription_entries where subscription_id = $1 and key = any($2)", subscriptionID, keys)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	seen := make(map[string]bool, len(keys))
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		seen[key] = true
+	}
+	return seen, rows.Err()
+}
+
+// MarkSeen remembers entry keys so they aren't added again.
+func (s PostgresSubscriptionStorer) MarkSeen(subscriptionID int, keys []string, at time.Time) error {
+	conn, err := s.connect()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutForTransactions)
+	defer cancel()
+
+	defer conn.Close(ctx)
+	_, err = conn.Exec(ctx, "insert into subscription_entries(subscription_id, key, seen_at) select $1, unnest($2::text[]), $3 on conflict do nothing", subscriptionID, keys, at.UTC())
+	return err
+}
@@ -2,8 +2,12 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"time"
 
+	"github.com/google/uuid"
+	"github.com/jackc/pgconn"
 	"github.com/jackc/pgx/v4"
 
 	"github.com/staple-org/staple/internal/models"
@@ -40,19 +44,25 @@ func (s PostgresUserStorer) Create(email string, password []byte) error {
 	}
 	defer tx.Rollback(ctx)
 
-	if _, err := tx.Exec(ctx, "insert into users(email, password, confirm_code, max_staples) values($1, $2, $3, $4)",
+	if _, err := tx.Exec(ctx, "insert into users(id, email, password, confirm_code, max_staples, tokens_valid_after) values($1, $2, $3, $4, $5, $6)",
+		uuid.New().String(),
 		email,
 		password,
 		"",
-		DefaultMaxStaples); err != nil {
+		DefaultMaxStaples,
+		time.Now().UTC()); err != nil {
+		if isUniqueViolation(err) {
+			return ErrEmailTaken
+		}
 		return err
 	}
 
 	return tx.Commit(ctx)
 }
 
-// Delete deletes a user from the db.
-func (s PostgresUserStorer) Delete(email string) error {
+// Delete deletes a user and everything that belongs to them in a single transaction.
+// Tokens of the user are rejected from then on because the user no longer exists.
+func (s PostgresUserStorer) Delete(id string) error {
 	conn, err := s.connect()
 	if err != nil {
 		return err
@@ -68,16 +78,106 @@ func (s PostgresUserStorer) Delete(email string) error {
 	}
 	defer tx.Rollback(ctx)
 
-	if _, err = tx.Exec(ctx, "delete from users where email = $1",
-		email); err != nil {
+	var email, pendingEmail string
+	if err := tx.QueryRow(ctx, "select email, pending_email from users where id = $1 for update", id).Scan(&email, &pendingEmail); err != nil {
+		if err == pgx.ErrNoRows {
+			return nil
+		}
+		return err
+	}
+	// The audit log only allows deletes in transactions which ask for it.
+	if _, err := tx.Exec(ctx, "set local staple.audit_delete = 'on'"); err != nil {
+		return err
+	}
+	for _, q := range []string{
+		"delete from staples where user_id = $1",
+		"delete from identities where user_id = $1",
+		"delete from subscription_entries where subscription_id in (select id from subscriptions where user_id = $1)",
+		"delete from subscriptions where user_id = $1",
+		"delete from webhook_deliveries where user_id = $1",
+		"delete from webhooks where user_id = $1",
+		"delete from event_outbox where user_id = $1",
+		"delete from digest_settings where user_id = $1",
+		"delete from notification_preferences where user_id = $1",
+		"delete from chat_targets where user_id = $1",
+		"delete from staple_deletions where user_id = $1",
+		"delete from audit_log where user_id = $1",
+	} {
+		if _, err := tx.Exec(ctx, q, id); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(ctx, "delete from rate_limits where key = $1", "email:"+email); err != nil {
+		return err
+	}
+	// Notifications are addressed by email. Their payloads can hold passwords and codes.
+	if _, err := tx.Exec(ctx, "delete from notifications where email = $1 or (email = $2 and $2 <> '')", email, pendingEmail); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, "delete from users where id = $1", id); err != nil {
 		return err
 	}
 
 	return tx.Commit(ctx)
 }
 
-// Get retrieves a user.
-func (s PostgresUserStorer) Get(email string) (*models.User, error) {
+// DueForDeletion returns the ids of users whose scheduled deletion is due.
+func (s PostgresUserStorer) DueForDeletion(now time.Time) ([]string, error) {
+	conn, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutForTransactions)
+	defer cancel()
+
+	defer conn.Close(ctx)
+	rows, err := conn.Query(ctx, "select id from users where delete_after is not null and delete_after <= $1", now.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := make([]string, 0)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// Get retrieves a user by id.
+func (s PostgresUserStorer) Get(id string) (*models.User, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		// Not a valid id, so it can't exist.
+		return nil, nil
+	}
+	return s.get("id", id)
+}
+
+// GetByEmail retrieves a user by email address.
+func (s PostgresUserStorer) GetByEmail(email string) (*models.User, error) {
+	return s.get("email", email)
+}
+
+// GetByFeedToken retrieves the user owning the given feed token.
+func (s PostgresUserStorer) GetByFeedToken(token string) (*models.User, error) {
+	if token == "" {
+		return nil, nil
+	}
+	return s.get("feed_token", token)
+}
+
+// GetByInboxToken retrieves the user owning the given inbox token.
+func (s PostgresUserStorer) GetByInboxToken(token string) (*models.User, error) {
+	if token == "" {
+		return nil, nil
+	}
+	return s.get("inbox_token", token)
+}
+
+func (s PostgresUserStorer) get(column string, value string) (*models.User, error) {
 	conn, err := s.connect()
 	if err != nil {
 		return nil, err
@@ -87,10 +187,25 @@ func (s PostgresUserStorer) Get(email string) (*models.User, error) {
 
 	defer conn.Close(ctx)
 	var (
-		storedEmail string
-		password    []byte
-		confirmCode string
-		maxStaples  int
+		id            string
+		storedEmail   string
+		password      []byte
+		confirmCode   string
+		maxStaples    int
+		totpSecret    string
+		totpEnabled   bool
+		recoveryCodes []string
+		totpLastStep  int64
+		failedLogins  int
+		lockedUntil   *time.Time
+		pendingEmail  string
+		changeCode    string
+		changeExpires *time.Time
+		validAfter    *time.Time
+		deleteAfter   *time.Time
+		feedToken     *string
+		inboxToken    *string
+		locale        string
 	)
 	tx, err := conn.Begin(ctx)
 	if err != nil {
@@ -98,7 +213,8 @@ func (s PostgresUserStorer) Get(email string) (*models.User, error) {
 	}
 	defer tx.Rollback(ctx)
 
-	err = tx.QueryRow(ctx, "select email, password, confirm_code, max_staples from users where email = $1", email).Scan(&storedEmail, &password, &confirmCode, &maxStaples)
+	// column is never user input.
+	err = tx.QueryRow(ctx, "select id, email, password, confirm_code, max_staples, totp_secret, totp_enabled, recovery_codes, totp_last_step, failed_logins, locked_until, pending_email, email_change_code, email_change_expires, tokens_valid_after, delete_after, feed_token, inbox_token, locale from users where "+column+" = $1", value).Scan(&id, &storedEmail, &password, &confirmCode, &maxStaples, &totpSecret, &totpEnabled, &recoveryCodes, &totpLastStep, &failedLogins, &lockedUntil, &pendingEmail, &changeCode, &changeExpires, &validAfter, &deleteAfter, &feedToken, &inboxToken, &locale)
 	if err != nil {
 		if err.Error() == "no rows in result set" {
 			return nil, nil
@@ -108,15 +224,45 @@ func (s PostgresUserStorer) Get(email string) (*models.User, error) {
 	if err := tx.Commit(ctx); err != nil {
 		return nil, err
 	}
-	return &models.User{
-		Email:       storedEmail,
-		Password:    string(password),
-		ConfirmCode: confirmCode,
-		MaxStaples:  maxStaples}, nil
+	user := &models.User{
+		ID:              id,
+		Email:           storedEmail,
+		Password:        string(password),
+		ConfirmCode:     confirmCode,
+		MaxStaples:      maxStaples,
+		TOTPSecret:      totpSecret,
+		TOTPEnabled:     totpEnabled,
+		RecoveryCodes:   recoveryCodes,
+		TOTPLastStep:    totpLastStep,
+		FailedLogins:    failedLogins,
+		PendingEmail:    pendingEmail,
+		EmailChangeCode: changeCode,
+		Locale:          locale,
+	}
+	if lockedUntil != nil {
+		user.LockedUntil = *lockedUntil
+	}
+	if changeExpires != nil {
+		user.EmailChangeExpires = *changeExpires
+	}
+	if validAfter != nil {
+		user.TokensValidAfter = *validAfter
+	}
+	if deleteAfter != nil {
+		user.DeleteAfter = *deleteAfter
+	}
+	if feedToken != nil {
+		user.FeedToken = *feedToken
+	}
+	if inboxToken != nil {
+		user.InboxToken = *inboxToken
+	}
+	return user, nil
 }
 
-// Update updates a user with a given email address.
-func (s PostgresUserStorer) Update(email string, newUser models.User) error {
+// Update updates a user with a given id. Changing the email address fails with
+// ErrEmailTaken if it belongs to another user.
+func (s PostgresUserStorer) Update(id string, newUser models.User) error {
 	conn, err := s.connect()
 	if err != nil {
 		return err
@@ -131,18 +277,62 @@ func (s PostgresUserStorer) Update(email string, newUser models.User) error {
 	}
 	defer tx.Rollback(ctx) // this is safe to call even if commit is called first.
 
-	if _, err = tx.Exec(ctx, "update users set email=$1, password=$2, confirm_code=$3, max_staples=$4 where email=$5",
+	if err := updateUser(ctx, tx, id, newUser); err != nil {
+		if isUniqueViolation(err) {
+			return ErrEmailTaken
+		}
+		return err
+	}
+	err = tx.Commit(ctx)
+	return err
+}
+
+func updateUser(ctx context.Context, tx pgx.Tx, id string, newUser models.User) error {
+	_, err := tx.Exec(ctx, "update users set email=$1, password=$2, confirm_code=$3, max_staples=$4, totp_secret=$5, totp_enabled=$6, recovery_codes=$7, totp_last_step=$8, failed_logins=$9, locked_until=$10, pending_email=$11, email_change_code=$12, email_change_expires=$13, tokens_valid_after=$14, delete_after=$15, feed_token=$16, inbox_token=$17, locale=$18 where id=$19",
 		newUser.Email,
 		newUser.Password,
 		newUser.ConfirmCode,
 		newUser.MaxStaples,
-		email); err != nil {
-		return err
-	}
-	err = tx.Commit(ctx)
+		newUser.TOTPSecret,
+		newUser.TOTPEnabled,
+		newUser.RecoveryCodes,
+		newUser.TOTPLastStep,
+		newUser.FailedLogins,
+		nullTime(newUser.LockedUntil),
+		newUser.PendingEmail,
+		newUser.EmailChangeCode,
+		nullTime(newUser.EmailChangeExpires),
+		nullTime(newUser.TokensValidAfter),
+		nullTime(newUser.DeleteAfter),
+		nullString(newUser.FeedToken),
+		nullString(newUser.InboxToken),
+		newUser.Locale,
+		id)
 	return err
 }
 
+// isUniqueViolation reports whether err was caused by a unique constraint.
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
+
+// nullTime stores zero times as null.
+func nullTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// nullString stores empty strings as null so they don't collide in unique columns.
+func nullString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
 func (s PostgresUserStorer) connect() (*pgx.Conn, error) {
 	url := fmt.Sprintf("postgresql://%s/%s?user=%s&password=%s", config.Opts.Database.Hostname, config.Opts.Database.Database, config.Opts.Database.Username, config.Opts.Database.Password)
 	conn, err := pgx.Connect(context.Background(), url)
@@ -0,0 +1,220 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+
+	"github.com/staple-org/staple/internal/models"
+	"github.com/staple-org/staple/pkg/config"
+)
+
+// PostgresWebhookStorer is a storer which uses Postgres as a storage backend.
+type PostgresWebhookStorer struct{}
+
+// NewPostgresWebhookStorer creates a new Postgres storage medium.
+func NewPostgresWebhookStorer() PostgresWebhookStorer {
+	return PostgresWebhookStorer{}
+}
+
+func (s PostgresWebhookStorer) connect() (*pgx.Conn, error) {
+	url := fmt.Sprintf("postgresql://%s/%s?user=%s&password=%s", config.Opts.Database.Hostname, config.Opts.Database.Database, config.Opts.Database.Username, config.Opts.Database.Password)
+	conn, err := pgx.Connect(context.Background(), url)
+	if err != nil {
+		config.Opts.Logger.Error().Err(err).Msg("Failed to connect to the database")
+		return nil, err
+	}
+	return conn, nil
+}
+
+const (
+	webhookColumns  = "id, user_id, url, events, secret, created_at"
+	deliveryColumns = "id, user_id, webhook_id, event, payload, attempts, next_attempt_at, delivered_at, status_code, last_error, created_at"
+)
+
+func scanWebhook(row pgx.Row) (models.Webhook, error) {
+	var hook models.Webhook
+	err := row.Scan(&hook.ID, &hook.UserID, &hook.URL, &hook.Events, &hook.Secret, &hook.CreatedAt)
+	return hook, err
+}
+
+func scanDelivery(row pgx.Row) (models.WebhookDelivery, error) {
+	var d models.WebhookDelivery
+	err := row.Scan(&d.ID, &d.UserID, &d.WebhookID, &d.Event, &d.Payload, &d.Attempts, &d.NextAttemptAt, &d.DeliveredAt, &d.StatusCode, &d.LastError, &d.CreatedAt)
+	return d, err
+}
+
+// Create saves a webhook and returns it with its id.
+func (s PostgresWebhookStorer) Create(hook models.Webhook) (models.Webhook, error) {
+	conn, err := s.connect()
+	if err != nil {
+		return models.Webhook{}, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutForTransactions)
+	defer cancel()
+
+	defer conn.Close(ctx)
+	err = conn.QueryRow(ctx, "insert into webhooks(user_id, url, events, secret, created_at) values($1, $2, $3, $4, $5) returning id",
+		hook.UserID,
+		hook.URL,
+		hook.Events,
+		hook.Secret,
+		hook.CreatedAt).Scan(&hook.ID)
+	return hook, err
+}
+
+// Get retrieves a webhook of a user.
+func (s PostgresWebhookStorer) Get(userID string, id int) (*models.Webhook, error) {
+	conn, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutForTransactions)
+	defer cancel()
+
+	defer conn.Close(ctx)
+	hook, err := scanWebhook(conn.QueryRow(ctx, "select "+webhookColumns+" from webhooks where user_id = $1 and id = $2", userID, id))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &hook, nil
+}
+
+// List returns the webhooks of a user ordered by id.
+func (s PostgresWebhookStorer) List(userID string) ([]models.Webhook, error) {
+	conn, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutForTransactions)
+	defer cancel()
+
+	defer conn.Close(ctx)
+	rows, err := conn.Query(ctx, "select "+webhookColumns+" from webhooks where user_id = $1 order by id", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := make([]models.Webhook, 0)
+	for rows.Next() {
+		hook, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, hook)
+	}
+	return ret, rows.Err()
+}
+
+// Delete removes a webhook and its deliveries.
+func (s PostgresWebhookStorer) Delete(userID string, id int) error {
+	conn, err := s.connect()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutForTransactions)
+	defer cancel()
+
+	defer conn.Close(ctx)
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, "delete from webhook_deliveries where webhook_id = $1 and user_id = $2", id, userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, "delete from webhooks where id = $1 and user_id = $2", id, userID); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// Enqueue saves a new delivery and returns it with its id.
+func (s PostgresWebhookStorer) Enqueue(d models.WebhookDelivery) (models.WebhookDelivery, error) {
+	conn, err := s.connect()
+	if err != nil {
+		return models.WebhookDelivery{}, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutForTransactions)
+	defer cancel()
+
+	defer conn.Close(ctx)
+	err = conn.QueryRow(ctx, "insert into webhook_deliveries(user_id, webhook_id, event, payload, attempts, next_attempt_at, delivered_at, status_code, last_error, created_at) values($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) returning id",
+		d.UserID,
+		d.WebhookID,
+		d.Event,
+		d.Payload,
+		d.Attempts,
+		d.NextAttemptAt,
+		d.DeliveredAt,
+		d.StatusCode,
+		d.LastError,
+		d.CreatedAt).Scan(&d.ID)
+	return d, err
+}
+
+// UpdateDelivery saves the outcome of a delivery attempt.
+func (s PostgresWebhookStorer) UpdateDelivery(d models.WebhookDelivery) error {
+	conn, err := s.connect()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutForTransactions)
+	defer cancel()
+
+	defer conn.Close(ctx)
+	_, err = conn.Exec(ctx, "update webhook_deliveries set attempts=$1, next_attempt_at=$2, delivered_at=$3, status_code=$4, last_error=$5 where id=$6",
+		d.Attempts,
+		d.NextAttemptAt,
+		d.DeliveredAt,
+		d.StatusCode,
+		d.LastError,
+		d.ID)
+	return err
+}
+
+// ClaimDeliveries returns up to limit deliveries whose next attempt is due, the oldest
+// first, and postpones them by the lease so concurrent workers don't send them twice.
+func (s PostgresWebhookStorer) ClaimDeliveries(now time.Time, lease time.Duration, limit int) ([]models.WebhookDelivery, error) {
+	return s.deliveries(`update webhook_deliveries set next_attempt_at = $2 where id in (
+		select id from webhook_deliveries where next_attempt_at <= $1 order by next_attempt_at, id limit $3 for update skip locked
+	) returning `+deliveryColumns, now.UTC(), now.Add(lease).UTC(), limit)
+}
+
+// Deliveries returns up to limit deliveries of a webhook, the newest first.
+func (s PostgresWebhookStorer) Deliveries(webhookID int, limit int) ([]models.WebhookDelivery, error) {
+	return s.deliveries("select "+deliveryColumns+" from webhook_deliveries where webhook_id = $1 order by id desc limit $2", webhookID, limit)
+}
+
+func (s PostgresWebhookStorer) deliveries(sql string, args ...interface{}) ([]models.WebhookDelivery, error) {
+	conn, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutForTransactions)
+	defer cancel()
+
+	defer conn.Close(ctx)
+	rows, err := conn.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := make([]models.WebhookDelivery, 0)
+	for rows.Next() {
+		d, err := scanDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, d)
+	}
+	return ret, rows.Err()
+}
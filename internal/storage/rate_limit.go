@@ -0,0 +1,24 @@
+package storage
+
+import (
+	"math"
+	"time"
+)
+
+// takeToken refills a token bucket which last changed at last and tries to take a single token from it.
+// It returns the new number of tokens, whether a token could be taken and, if not, the time
+// until the next token becomes available.
+func takeToken(tokens float64, last, now time.Time, rate float64, burst int) (float64, bool, time.Duration) {
+	elapsed := now.Sub(last).Seconds()
+	if elapsed > 0 {
+		tokens = math.Min(float64(burst), tokens+elapsed*rate)
+	}
+	if tokens >= 1 {
+		return tokens - 1, true, 0
+	}
+	if rate <= 0 {
+		return tokens, false, time.Duration(math.MaxInt64)
+	}
+	wait := time.Duration((1 - tokens) / rate * float64(time.Second))
+	return tokens, false, wait
+}
@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"errors"
 	"time"
 
 	"github.com/staple-org/staple/internal/models"
@@ -9,23 +10,164 @@ import (
 const (
 	// timeout for all transactions
 	timeoutForTransactions = 1 * time.Minute
+	// timeout for reads which are streamed to a client, such as exports of large archives
+	timeoutForStreaming = 30 * time.Minute
 )
 
-// StapleStorer defines a set of functions for storing staples.
+// ErrEmailTaken is returned when an email address already belongs to another user.
+var ErrEmailTaken = errors.New("email address is already in use")
+
+// ErrSubscriptionExists is returned when a user subscribes to the same feed twice.
+var ErrSubscriptionExists = errors.New("already subscribed to this feed")
+
+// StapleStorer defines a set of functions for storing staples. Staples belong to
+// the user with the given user id. Delete moves a staple to the trash, which every other
+// function except Trash, Restore and PurgeTrash ignores. Restore returns nil if the staple
+// isn't in the trash.
 type StapleStorer interface {
-	Create(staple models.Staple, email string) error
-	Delete(email string, stapleID int) error
-	Get(email string, stapleID int) (*models.Staple, error)
-	List(email string) ([]models.Staple, error)
-	Archive(email string, stapleID int) error
-	Oldest(email string) (*models.Staple, error)
-	ShowArchive(email string) ([]models.Staple, error)
+	Create(staple models.Staple, userID string) error
+	Delete(userID string, stapleID int) error
+	Get(userID string, stapleID int) (*models.Staple, error)
+	List(userID string) ([]models.Staple, error)
+	Archive(userID string, stapleID int) error
+	Oldest(userID string) (*models.Staple, error)
+	ShowArchive(userID string) ([]models.Staple, error)
+	All(userID string) ([]models.Staple, error)
+	Walk(userID string, fn func(models.Staple) error) error
+	RecentArchive(userID string, limit int) ([]models.Staple, error)
+	Trash(userID string) ([]models.Staple, error)
+	Restore(userID string, stapleID int) (*models.Staple, error)
+	PurgeTrash(deletedBefore time.Time) (int64, error)
 }
 
-// UserStorer defines a set of functions for storing users.
+// UserStorer defines a set of functions for storing users. Users are identified
+// by their id. GetByEmail is used to find users during login.
 type UserStorer interface {
 	Create(email string, password []byte) error
-	Delete(email string) error
-	Get(email string) (*models.User, error)
-	Update(email string, newUser models.User) error
+	Delete(id string) error
+	Get(id string) (*models.User, error)
+	GetByEmail(email string) (*models.User, error)
+	GetByFeedToken(token string) (*models.User, error)
+	GetByInboxToken(token string) (*models.User, error)
+	Update(id string, newUser models.User) error
+	DueForDeletion(now time.Time) ([]string, error)
+}
+
+// RateLimitStorer defines a set of functions for storing rate limit token buckets.
+// Prune removes the buckets which haven't changed since idleSince.
+type RateLimitStorer interface {
+	Take(key string, rate float64, burst int, now time.Time) (ok bool, retryAfter time.Duration, err error)
+	Prune(idleSince time.Time) (int64, error)
+}
+
+// IdentityStorer defines a set of functions for storing links between external
+// identities and users.
+type IdentityStorer interface {
+	Link(issuer, subject, userID string) error
+	Find(issuer, subject string) (userID string, err error)
+}
+
+// SubscriptionStorer defines a set of functions for storing feed subscriptions and the
+// entries which have been seen already.
+type SubscriptionStorer interface {
+	Create(sub models.Subscription) (models.Subscription, error)
+	Get(userID string, id int) (*models.Subscription, error)
+	List(userID string) ([]models.Subscription, error)
+	Update(sub models.Subscription) error
+	Delete(userID string, id int) error
+	Due(checkedBefore time.Time) ([]models.Subscription, error)
+	Seen(subscriptionID int, keys []string) (map[string]bool, error)
+	MarkSeen(subscriptionID int, keys []string, at time.Time) error
+}
+
+// WebhookStorer defines a set of functions for storing webhooks and their deliveries.
+type WebhookStorer interface {
+	Create(hook models.Webhook) (models.Webhook, error)
+	Get(userID string, id int) (*models.Webhook, error)
+	List(userID string) ([]models.Webhook, error)
+	Delete(userID string, id int) error
+	Enqueue(delivery models.WebhookDelivery) (models.WebhookDelivery, error)
+	UpdateDelivery(delivery models.WebhookDelivery) error
+	ClaimDeliveries(now time.Time, lease time.Duration, limit int) ([]models.WebhookDelivery, error)
+	Deliveries(webhookID int, limit int) ([]models.WebhookDelivery, error)
+}
+
+// OutboxStorer defines a set of functions for the transactional outbox of domain events.
+// Storers which implement EventRecorder add records in the same transaction as their
+// changes; Add is for events which aren't tied to a change. Claim hides the records it
+// returns from other relays until the lease is over or they are marked.
+type OutboxStorer interface {
+	Add(record models.OutboxRecord) error
+	Claim(now time.Time, lease time.Duration, maxAttempts int, limit int) ([]models.OutboxRecord, error)
+	MarkPublished(id string, at time.Time) error
+	MarkFailed(id string, reason string) error
+	Purge(publishedBefore time.Time) (int64, error)
+}
+
+// NotificationStorer defines a set of functions for the outbox of notifications.
+// Claim postpones the notifications it returns by the lease, so concurrent workers don't
+// send them twice; the lease also retries notifications of a worker which stopped.
+type NotificationStorer interface {
+	Enqueue(n models.Notification) (models.Notification, error)
+	Claim(now time.Time, lease time.Duration, limit int) ([]models.Notification, error)
+	Update(n models.Notification) error
+	Get(id int) (*models.Notification, error)
+	List(status string, limit int, offset int) ([]models.Notification, error)
+	Redrive(id int, now time.Time) (*models.Notification, error)
+	Purge(sentBefore time.Time, deadBefore time.Time) (int64, error)
+}
+
+// AuditStorer defines a set of functions for the append-only audit log. List returns the
+// newest entries first; an empty userID or action matches every user or action. Purge is
+// the only way entries are removed.
+type AuditStorer interface {
+	Append(entry models.AuditEntry) error
+	List(userID string, action string, limit int, offset int) ([]models.AuditEntry, error)
+	Purge(before time.Time) (int64, error)
+}
+
+// DigestStorer defines a set of functions for storing the digest settings of users.
+// Save doesn't change the times of the last digest and reminder.
+type DigestStorer interface {
+	Get(userID string) (*models.DigestSettings, error)
+	Save(settings models.DigestSettings) error
+	Enabled() ([]models.DigestSettings, error)
+	MarkDigestSent(userID string, at time.Time) error
+	MarkReminderSent(userID string, at time.Time) error
+}
+
+// StatsStorer computes the reading statistics of users from the timestamps of their staples.
+// Deleted staples are recorded so they still count; RecordDeletion ignores an event id it
+// has seen before and ForgetDeletion drops the deletions of a restored staple. Times are between from, inclusive, and to, exclusive. Activity returns
+// the days with any activity in the given timezone, the oldest first. QueueAges splits the
+// queue at the given ages and returns len(bounds)+1 counts, the youngest first.
+type StatsStorer interface {
+	RecordDeletion(eventID, userID string, staple models.Staple, deletedAt time.Time) error
+	ForgetDeletion(userID string, stapleID int) error
+	Activity(userID string, from, to time.Time, timezone *time.Location) ([]models.StapleActivity, error)
+	TimeInQueue(userID string, from, to time.Time) (time.Duration, error)
+	QueueAges(userID string, now time.Time, bounds []time.Duration) ([]int, error)
+}
+
+// NotificationPreferenceStorer defines a set of functions for storing the notification
+// preferences of users. Save creates or replaces the given preferences and keeps the time
+// of the last notification of their events.
+type NotificationPreferenceStorer interface {
+	List(userID string) ([]models.NotificationPreference, error)
+	Save(userID string, prefs []models.NotificationPreference) error
+	MarkSent(userID string, event string, at time.Time) error
+}
+
+// ChatTargetStorer defines a set of functions for storing the chat targets of users. A user
+// has at most one target of every kind; Save replaces it.
+type ChatTargetStorer interface {
+	Save(target models.ChatTarget) error
+	Get(userID string, kind string) (*models.ChatTarget, error)
+	List(userID string) ([]models.ChatTarget, error)
+	Delete(userID string, kind string) error
+}
+
+// EventRecorder is implemented by storers which can record their changes in the outbox.
+type EventRecorder interface {
+	RecordsEvents() bool
 }
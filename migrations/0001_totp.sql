@@ -0,0 +1,6 @@
+-- Optional TOTP two-factor authentication with single-use codes and recovery codes.
+alter table users add column totp_secret text not null default '';
+alter table users add column totp_enabled bool not null default false;
+alter table users add column recovery_codes text[];
+-- The time step of the last accepted code, so codes can't be replayed.
+alter table users add column totp_last_step bigint not null default 0;
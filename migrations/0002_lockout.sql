@@ -0,0 +1,5 @@
+-- Accounts are locked for a while after repeated failed logins.
+alter table users add column failed_logins int not null default 0;
+alter table users add column locked_until timestamp;
+-- Token buckets of the rate limiter when it is backed by Postgres.
+create table rate_limits (key varchar(512) primary key, tokens double precision, updated_at timestamp);
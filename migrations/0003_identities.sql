@@ -0,0 +1,3 @@
+-- Links between OpenID Connect identities and users. 0005_user_ids.sql replaces user_email
+-- with the user id.
+create table identities (issuer text, subject text, user_email varchar(255), primary key (issuer, subject));
@@ -0,0 +1,8 @@
+-- Email changes are confirmed with a code sent to the new address. Tokens issued before
+-- tokens_valid_after are revoked.
+alter table users add column pending_email text not null default '';
+alter table users add column email_change_code text not null default '';
+alter table users add column email_change_expires timestamp;
+alter table users add column tokens_valid_after timestamp;
+-- Duplicate email addresses have to be merged by hand before this succeeds.
+alter table users add constraint users_email_key unique (email);
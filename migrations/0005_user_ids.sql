@@ -0,0 +1,26 @@
+-- Introduces stable user ids. Staples and identities reference users by id
+-- instead of by email so an email address can change without touching other rows.
+-- gen_random_uuid() is built in since Postgres 13; older versions need pgcrypto.
+begin;
+
+alter table users add column id uuid;
+update users set id = gen_random_uuid() where id is null;
+alter table users alter column id set default gen_random_uuid();
+alter table users alter column id set not null;
+alter table users add primary key (id);
+
+alter table staples add column user_id uuid references users(id) on delete cascade;
+update staples s set user_id = u.id from users u where u.email = s.user_email;
+-- Staples of users which no longer exist can't be reached by anyone.
+delete from staples where user_id is null;
+alter table staples alter column user_id set not null;
+alter table staples drop column user_email;
+create index staples_user_id_idx on staples (user_id);
+
+alter table identities add column user_id uuid references users(id) on delete cascade;
+update identities i set user_id = u.id from users u where u.email = i.user_email;
+delete from identities where user_id is null;
+alter table identities alter column user_id set not null;
+alter table identities drop column user_email;
+
+commit;
@@ -0,0 +1,2 @@
+-- Accounts can be scheduled for deletion after a grace period.
+alter table users add column delete_after timestamp;
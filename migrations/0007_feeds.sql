@@ -0,0 +1,4 @@
+-- Personal feeds are addressed by a secret token per user.
+alter table users add column feed_token text unique;
+-- The archive feed is ordered by the time staples were archived.
+alter table staples add column archived_at timestamp;
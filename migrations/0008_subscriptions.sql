@@ -0,0 +1,4 @@
+-- Feed subscriptions add new entries of external feeds to the queue.
+create table subscriptions (id serial primary key, user_id uuid not null references users(id) on delete cascade, url text not null, title text not null default '', policy varchar(16) not null, etag text not null default '', last_modified text not null default '', checked_at timestamp, last_error text not null default '', created_at timestamp not null, unique (user_id, url));
+-- Entries which have been seen already, keyed by their guid or url.
+create table subscription_entries (subscription_id int not null references subscriptions(id) on delete cascade, key text not null, seen_at timestamp not null, primary key (subscription_id, key));
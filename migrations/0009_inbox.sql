@@ -0,0 +1,2 @@
+-- Staples can be mailed to a secret address per user.
+alter table users add column inbox_token text unique;
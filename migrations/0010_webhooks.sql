@@ -0,0 +1,5 @@
+-- Webhooks are called with signed payloads when staple events happen.
+create table webhooks (id serial primary key, user_id uuid not null references users(id) on delete cascade, url text not null, events text[] not null, secret text not null, created_at timestamp not null);
+-- Every event sent to a webhook. Pending deliveries have a next_attempt_at.
+create table webhook_deliveries (id serial primary key, user_id uuid not null references users(id) on delete cascade, webhook_id int not null references webhooks(id) on delete cascade, event varchar(64) not null, payload text not null, attempts int not null default 0, next_attempt_at timestamp, delivered_at timestamp, status_code int not null default 0, last_error text not null default '', created_at timestamp not null);
+create index webhook_deliveries_due on webhook_deliveries (next_attempt_at) where next_attempt_at is not null;
@@ -0,0 +1,3 @@
+-- Domain events recorded in the same transaction as the change which caused them.
+create table event_outbox (id uuid primary key, name varchar(64) not null, user_id uuid not null, payload text not null, occurred_at timestamp not null, attempts int not null default 0, last_error text not null default '', published_at timestamp);
+create index event_outbox_pending on event_outbox (occurred_at) where published_at is null;
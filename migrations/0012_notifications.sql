@@ -0,0 +1,4 @@
+-- Notification mails waiting to be sent. Pending notifications have a next_attempt_at;
+-- notifications which were given up have a dead_at.
+create table notifications (id serial primary key, email varchar(255) not null, event varchar(64) not null, payload text not null, attempts int not null default 0, next_attempt_at timestamp, sent_at timestamp, dead_at timestamp, last_error text not null default '', created_at timestamp not null);
+create index notifications_due on notifications (next_attempt_at) where next_attempt_at is not null;
@@ -0,0 +1,2 @@
+-- Opt-in queue digests and reading reminders. Hours are local to the timezone.
+create table digest_settings (user_id uuid primary key references users(id) on delete cascade, frequency varchar(16) not null default 'off', hour int not null default 8, reminder_days int not null default 0, timezone text not null default 'UTC', quiet_start int not null default 0, quiet_end int not null default 0, last_digest_at timestamp, last_reminder_at timestamp);
@@ -0,0 +1,4 @@
+-- Notifications are sent through channels; everything sent so far was email.
+alter table notifications add column channel varchar(32) not null default 'email';
+-- Per event notification preferences of users. Events without a row use the defaults.
+create table notification_preferences (user_id uuid not null references users(id) on delete cascade, event varchar(64) not null, channels text[] not null, frequency varchar(16) not null, last_sent_at timestamp, primary key (user_id, event));
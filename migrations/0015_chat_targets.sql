@@ -0,0 +1,2 @@
+-- Chat targets of the slack, discord and matrix notification channels. One per kind and user.
+create table chat_targets (user_id uuid not null references users(id) on delete cascade, kind varchar(16) not null, url text not null, room text not null default '', token text not null default '', created_at timestamp not null, primary key (user_id, kind));
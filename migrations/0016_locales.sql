@@ -0,0 +1,2 @@
+-- The language of a user's notifications. Empty means English.
+alter table users add column locale varchar(16) not null default '';
@@ -0,0 +1,4 @@
+-- Deleted staples, so they still count in the reading statistics.
+create table staple_deletions (event_id uuid primary key, user_id uuid not null references users(id) on delete cascade, staple_id int not null, created_at timestamp not null, archived bool not null, archived_at timestamp, deleted_at timestamp not null);
+create index staple_deletions_user on staple_deletions (user_id, deleted_at);
+create index if not exists staples_user on staples (user_id, created_at);
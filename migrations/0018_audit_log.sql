@@ -0,0 +1,6 @@
+-- The append-only audit log of account and staple actions. Entries are only removed by the
+-- retention policy and with their account.
+create table audit_log (id bigserial primary key, user_id uuid not null, action varchar(32) not null, staple_id int not null default 0, detail text not null default '', ip varchar(64) not null default '', user_agent text not null default '', created_at timestamp not null);
+create index audit_log_user on audit_log (user_id, id);
+create index audit_log_created on audit_log (created_at);
+create rule audit_log_append_only as on update to audit_log do instead nothing;
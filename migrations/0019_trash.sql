@@ -0,0 +1,3 @@
+-- Deleted staples are kept in the trash until they are restored or purged.
+alter table staples add column deleted_at timestamp;
+create index staples_trash on staples (deleted_at) where deleted_at is not null;
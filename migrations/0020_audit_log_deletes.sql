@@ -0,0 +1,12 @@
+-- The audit log rejects updates, and deletes unless the transaction sets staple.audit_delete,
+-- which only the retention purge and the deletion of an account do.
+drop rule audit_log_append_only on audit_log;
+create function audit_log_protect() returns trigger as $$
+begin
+	if tg_op = 'DELETE' and current_setting('staple.audit_delete', true) = 'on' then
+		return old;
+	end if;
+	raise exception 'audit_log is append-only';
+end;
+$$ language plpgsql;
+create trigger audit_log_append_only before update or delete on audit_log for each row execute function audit_log_protect();
@@ -0,0 +1,2 @@
+-- Relays claim outbox records with a lease so that several instances don't publish the same record.
+alter table event_outbox add column locked_until timestamp;
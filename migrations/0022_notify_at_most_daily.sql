@@ -0,0 +1,2 @@
+-- The daily notification frequency is called at-most-daily since it drops further notifications of the day.
+update notification_preferences set frequency = 'at-most-daily' where frequency = 'daily';
@@ -0,0 +1,107 @@
+package pkg
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/staple-org/staple/internal/models"
+	"github.com/staple-org/staple/internal/service"
+	"github.com/staple-org/staple/pkg/config"
+)
+
+const (
+	// adminDefaultPageSize is the number of entries listed when no limit is given.
+	adminDefaultPageSize = 50
+	// adminMaxPageSize is the largest limit which is accepted.
+	adminMaxPageSize = 500
+)
+
+// AdminAuth only lets requests through which carry the admin token as a bearer token.
+// User tokens are not accepted.
+func AdminAuth(adminToken string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			auth := c.Request().Header.Get(echo.HeaderAuthorization)
+			token := strings.TrimPrefix(auth, "Bearer ")
+			if adminToken == "" || token == auth || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+				return echo.ErrUnauthorized
+			}
+			return next(c)
+		}
+	}
+}
+
+// pagination reads the limit and offset query parameters.
+func pagination(c echo.Context) (limit int, offset int, err error) {
+	limit = adminDefaultPageSize
+	if v := c.QueryParam("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > adminMaxPageSize {
+			return 0, 0, errors.New("limit must be between 1 and " + strconv.Itoa(adminMaxPageSize))
+		}
+	}
+	if v := c.QueryParam("offset"); v != "" {
+		offset, err = strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return 0, 0, errors.New("offset must not be negative")
+		}
+	}
+	return limit, offset, nil
+}
+
+// ListNotifications lists the notification outbox, the newest first. The following query
+// parameters are used: status (pending, sent or dead), limit and offset.
+// Payloads are not included since they can contain codes and passwords.
+func ListNotifications(outbox service.NotificationOutbox) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		status := c.QueryParam("status")
+		switch status {
+		case "", models.NotificationPending, models.NotificationSent, models.NotificationDead:
+		default:
+			apiError := config.APIError("invalid status", http.StatusBadRequest, errors.New("status must be pending, sent or dead"))
+			return c.JSON(http.StatusBadRequest, apiError)
+		}
+		limit, offset, err := pagination(c)
+		if err != nil {
+			apiError := config.APIError("invalid pagination", http.StatusBadRequest, err)
+			return c.JSON(http.StatusBadRequest, apiError)
+		}
+		notifications, err := outbox.List(status, limit, offset)
+		if err != nil {
+			apiError := config.APIError("failed to list notifications", http.StatusInternalServerError, err)
+			return c.JSON(http.StatusInternalServerError, apiError)
+		}
+		var list = struct {
+			Notifications []models.Notification `json:"notifications"`
+		}{
+			Notifications: notifications,
+		}
+		return c.JSON(http.StatusOK, list)
+	}
+}
+
+// RedriveNotification sends a notification which was given up again.
+func RedriveNotification(outbox service.NotificationOutbox) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			apiError := config.APIError("invalid id", http.StatusBadRequest, err)
+			return c.JSON(http.StatusBadRequest, apiError)
+		}
+		n, err := outbox.Redrive(id)
+		switch {
+		case errors.Is(err, service.ErrNotificationNotFound):
+			apiError := config.APIError("failed to re-drive notification", http.StatusNotFound, err)
+			return c.JSON(http.StatusNotFound, apiError)
+		case err != nil:
+			apiError := config.APIError("failed to re-drive notification", http.StatusInternalServerError, err)
+			return c.JSON(http.StatusInternalServerError, apiError)
+		}
+		return c.JSON(http.StatusOK, n)
+	}
+}
@@ -0,0 +1,107 @@
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/staple-org/staple/internal/models"
+	"github.com/staple-org/staple/internal/service"
+	"github.com/staple-org/staple/internal/storage"
+)
+
+type failingNotifier struct{}
+
+func (failingNotifier) Notify(string, service.Event, string) error {
+	return errors.New("mail provider is down")
+}
+
+func TestAdminAuth(t *testing.T) {
+	e := echo.New()
+	handler := AdminAuth("admin-secret")(func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	})
+	for auth, want := range map[string]error{
+		"":                    echo.ErrUnauthorized,
+		"admin-secret":        echo.ErrUnauthorized,
+		"Bearer wrong":        echo.ErrUnauthorized,
+		"Bearer admin-secret": nil,
+	} {
+		req := httptest.NewRequest(echo.GET, "/rest/api/1/admin/notifications", nil)
+		req.Header.Set("Authorization", auth)
+		rec := httptest.NewRecorder()
+		assert.Equal(t, want, handler(e.NewContext(req, rec)), auth)
+	}
+
+	// Without a token nobody is an admin.
+	req := httptest.NewRequest(echo.GET, "/rest/api/1/admin/notifications", nil)
+	req.Header.Set("Authorization", "Bearer ")
+	err := AdminAuth("")(handler)(e.NewContext(req, httptest.NewRecorder()))
+	assert.Equal(t, echo.ErrUnauthorized, err)
+}
+
+func TestNotificationAdminHandlers(t *testing.T) {
+	outbox := service.NewNotificationOutbox(storage.NewInMemoryNotificationStorer(), failingNotifier{}).WithMaxAttempts(1)
+	require.NoError(t, outbox.Notify("test@test.com", service.PasswordReset, "new-password"))
+	require.NoError(t, outbox.Notify("test@test.com", service.Welcome, ""))
+	_, err := outbox.SendDue(1)
+	require.NoError(t, err)
+	e := echo.New()
+
+	request := func(method, target string, handler echo.HandlerFunc, id string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetParamNames("id")
+		c.SetParamValues(id)
+		assert.NoError(t, handler(c))
+		return rec
+	}
+
+	rec := request(echo.GET, "/rest/api/1/admin/notifications?status=dead&limit=1", ListNotifications(outbox), "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NotContains(t, rec.Body.String(), "new-password", "payloads are never returned")
+	var list struct {
+		Notifications []models.Notification `json:"notifications"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &list))
+	require.Len(t, list.Notifications, 1)
+	assert.Equal(t, string(service.Welcome), list.Notifications[0].Event)
+	assert.Equal(t, "mail provider is down", list.Notifications[0].LastError)
+	welcome := strconv.Itoa(list.Notifications[0].ID)
+
+	rec = request(echo.GET, "/rest/api/1/admin/notifications?status=dead&offset=1", ListNotifications(outbox), "")
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &list))
+	require.Len(t, list.Notifications, 1)
+	assert.Equal(t, string(service.PasswordReset), list.Notifications[0].Event)
+
+	rec = request(echo.GET, "/rest/api/1/admin/notifications?status=lost", ListNotifications(outbox), "")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = request(echo.GET, "/rest/api/1/admin/notifications?limit=0", ListNotifications(outbox), "")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	// Secret payloads are dropped once given up, so they can't be re-driven.
+	id := strconv.Itoa(list.Notifications[0].ID)
+	rec = request(echo.POST, "/rest/api/1/admin/notifications/"+id+"/redrive", RedriveNotification(outbox), id)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	id = welcome
+	rec = request(echo.POST, "/rest/api/1/admin/notifications/"+id+"/redrive", RedriveNotification(outbox), id)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var n models.Notification
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &n))
+	assert.Equal(t, 0, n.Attempts)
+	assert.NotNil(t, n.NextAttemptAt)
+
+	rec = request(echo.POST, "/rest/api/1/admin/notifications/"+id+"/redrive", RedriveNotification(outbox), id)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	rec = request(echo.POST, "/rest/api/1/admin/notifications/x/redrive", RedriveNotification(outbox), "x")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
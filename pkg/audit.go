@@ -0,0 +1,102 @@
+package pkg
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/labstack/echo/v4"
+
+	"github.com/staple-org/staple/internal/models"
+	"github.com/staple-org/staple/internal/service"
+	"github.com/staple-org/staple/pkg/config"
+)
+
+// auditContextKey is the key of the audit entries of a request in the echo context.
+const auditContextKey = "audit"
+
+// audit notes an entry for the audit log of a user. It is recorded with the IP address and
+// the user agent of the request by the Audit middleware once the handler returned.
+func audit(c echo.Context, entry models.AuditEntry) {
+	entries, _ := c.Get(auditContextKey).([]models.AuditEntry)
+	c.Set(auditContextKey, append(entries, entry))
+}
+
+// Audit records the entries which the handlers noted with audit in the audit log with the
+// address clientIP extracts, so clients can't choose it with a header of their own. Failing
+// to record an entry doesn't fail the request; it is logged instead.
+func Audit(log service.AuditLog, clientIP echo.IPExtractor) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			err := next(c)
+			entries, _ := c.Get(auditContextKey).([]models.AuditEntry)
+			for _, entry := range entries {
+				entry.IP = clientIP(c.Request())
+				entry.UserAgent = c.Request().UserAgent()
+				if err := log.Record(entry); err != nil {
+					config.Opts.Logger.Error().Err(err).Str("action", entry.Action).Msg("Failed to record audit entry")
+				}
+			}
+			return err
+		}
+	}
+}
+
+// ListActivity lists the audit log of the user, the newest first. The following query
+// parameters are used: limit and offset.
+func ListActivity(log service.AuditLog) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token, err := GetToken(c)
+		if err != nil {
+			return err
+		}
+		claims := token.Claims.(jwt.MapClaims)
+		userID := claims["sub"].(string)
+		userModel := &models.User{
+			ID: userID,
+		}
+		limit, offset, err := pagination(c)
+		if err != nil {
+			apiError := config.APIError("invalid pagination", http.StatusBadRequest, err)
+			return c.JSON(http.StatusBadRequest, apiError)
+		}
+		entries, err := log.List(*userModel, limit, offset)
+		if err != nil {
+			apiError := config.APIError("failed to list activity", http.StatusInternalServerError, err)
+			return c.JSON(http.StatusInternalServerError, apiError)
+		}
+		var list = struct {
+			Activity []models.AuditEntry `json:"activity"`
+		}{
+			Activity: entries,
+		}
+		return c.JSON(http.StatusOK, list)
+	}
+}
+
+// ListAllActivity lists the audit log of every user, the newest first. The following query
+// parameters are used: user_id, action, limit and offset.
+func ListAllActivity(log service.AuditLog) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		limit, offset, err := pagination(c)
+		if err != nil {
+			apiError := config.APIError("invalid pagination", http.StatusBadRequest, err)
+			return c.JSON(http.StatusBadRequest, apiError)
+		}
+		entries, err := log.ListAll(c.QueryParam("user_id"), c.QueryParam("action"), limit, offset)
+		switch {
+		case errors.Is(err, service.ErrInvalidAuditEntry):
+			apiError := config.APIError("failed to list activity", http.StatusBadRequest, err)
+			return c.JSON(http.StatusBadRequest, apiError)
+		case err != nil:
+			apiError := config.APIError("failed to list activity", http.StatusInternalServerError, err)
+			return c.JSON(http.StatusInternalServerError, apiError)
+		}
+		var list = struct {
+			Activity []models.AuditEntry `json:"activity"`
+		}{
+			Activity: entries,
+		}
+		return c.JSON(http.StatusOK, list)
+	}
+}
@@ -0,0 +1,88 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/staple-org/staple/internal/models"
+	"github.com/staple-org/staple/internal/service"
+	"github.com/staple-org/staple/internal/storage"
+	"github.com/staple-org/staple/pkg/config"
+)
+
+func TestAudit(t *testing.T) {
+	userHandler := service.NewUserHandler(context.Background(), storage.NewInMemoryUserStorer(), service.NewBufferNotifier())
+	stapler := service.NewStapler(storage.NewInMemoryStapleStorer())
+	limiter := service.NewTokenBucketLimiter(storage.NewInMemoryRateLimitStorer(), 60, 100)
+	log := service.NewAuditLog(storage.NewInMemoryAuditStorer())
+	config.Opts.GlobalTokenKey = "test"
+	e := echo.New()
+	e.Use(Audit(log, echo.ExtractIPDirect()))
+	e.POST("/get-token", TokenHandler(userHandler, limiter))
+	e.POST("/staple", AddStaple(stapler, userHandler))
+	e.DELETE("/staple/:id", DeleteStaple(stapler))
+	e.GET("/user/activity", ListActivity(log))
+	e.GET("/admin/activity", ListAllActivity(log))
+
+	testUser := models.User{Email: "test@test.com", Password: "password", MaxStaples: 25}
+	require.NoError(t, userHandler.Register(testUser))
+	id, err := userHandler.UserID(testUser)
+	require.NoError(t, err)
+	tok, err := generateToken(id)
+	require.NoError(t, err)
+
+	request := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+tok)
+		req.Header.Set("User-Agent", "staple-cli/1.0")
+		// Clients can't choose the recorded address.
+		req.Header.Set("X-Real-IP", "203.0.113.9")
+		req.Header.Set("X-Forwarded-For", "203.0.113.9")
+		req.RemoteAddr = "198.51.100.7:4321"
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	assert.Equal(t, http.StatusOK, request(echo.POST, "/get-token", `{"email": "test@test.com", "password": "password"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, request(echo.POST, "/get-token", `{"email": "test@test.com", "password": "wrong"}`).Code)
+	assert.Equal(t, http.StatusOK, request(echo.POST, "/staple", `{"name": "to be deleted", "content": "https://staple.test"}`).Code)
+	assert.Equal(t, http.StatusOK, request(echo.DELETE, "/staple/0", "").Code)
+	// Unknown users and failed requests aren't recorded.
+	assert.Equal(t, http.StatusBadRequest, request(echo.POST, "/get-token", `{"email": "nobody@test.com", "password": "password"}`).Code)
+
+	rec := request(echo.GET, "/user/activity?limit=10", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var list struct {
+		Activity []models.AuditEntry `json:"activity"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &list))
+	require.Len(t, list.Activity, 4)
+	assert.Equal(t, models.AuditStapleDeleted, list.Activity[0].Action)
+	assert.Equal(t, "to be deleted", list.Activity[0].Detail)
+	assert.Equal(t, models.AuditStapleCreated, list.Activity[1].Action)
+	assert.Equal(t, models.AuditLoginFailed, list.Activity[2].Action)
+	assert.Equal(t, models.AuditLogin, list.Activity[3].Action)
+	assert.Equal(t, "password", list.Activity[3].Detail)
+	assert.Equal(t, "198.51.100.7", list.Activity[3].IP)
+	assert.Equal(t, "staple-cli/1.0", list.Activity[3].UserAgent)
+	assert.Equal(t, id, list.Activity[3].UserID)
+
+	assert.Equal(t, http.StatusBadRequest, request(echo.GET, "/user/activity?limit=0", "").Code)
+
+	rec = request(echo.GET, "/admin/activity?action=login_failed", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &list))
+	require.Len(t, list.Activity, 1)
+	assert.Equal(t, models.AuditLoginFailed, list.Activity[0].Action)
+	assert.Equal(t, http.StatusBadRequest, request(echo.GET, "/admin/activity?action=sneeze", "").Code)
+}
@@ -2,7 +2,6 @@ package pkg
 
 import (
 	"errors"
-	"fmt"
 	"net/http"
 	"strings"
 	"time"
@@ -15,8 +14,17 @@ import (
 	"github.com/staple-org/staple/pkg/config"
 )
 
+const (
+	// mfaChallengePurpose marks a token as a two-factor challenge.
+	mfaChallengePurpose = "mfa"
+	// mfaChallengeExpiry is the time a user has to provide a TOTP code after a successful password login.
+	mfaChallengeExpiry = 5 * time.Minute
+	// tokenExpiry is the lifetime of a token. Rotated keys have to stay valid for at least this long.
+	tokenExpiry = 72 * time.Hour
+)
+
 // TokenHandler creates a JWT token for a given user.
-func TokenHandler(userHandler service.UserHandlerer) echo.HandlerFunc {
+func TokenHandler(userHandler service.UserHandlerer, limiter service.RateLimiter) echo.HandlerFunc {
 	return func(c echo.Context) error {
 
 		// Get the nickname for the token.
@@ -31,14 +39,26 @@ func TokenHandler(userHandler service.UserHandlerer) echo.HandlerFunc {
 				"message": "Invalid username or password",
 			})
 		}
+		if handled, err := limitEmail(c, limiter, user.Email); handled {
+			return err
+		}
 
 		if ok, _ := userHandler.IsRegistered(*user); !ok {
 			return c.JSON(http.StatusBadRequest, map[string]string{
 				"message": "user not found",
 			})
 		}
+		if handled, err := rejectLocked(c, userHandler, *user); handled {
+			return err
+		}
 
 		if ok, err := userHandler.PasswordMatch(*user); !ok {
+			if _, err := userHandler.RecordLoginFailure(*user); err != nil {
+				config.Opts.Logger.Error().Err(err).Msg("Failed to record login failure")
+			}
+			if id, err := userHandler.UserID(*user); err == nil {
+				audit(c, models.AuditEntry{UserID: id, Action: models.AuditLoginFailed, Detail: "password"})
+			}
 			return c.JSON(http.StatusBadRequest, map[string]string{
 				"message": "username or password mismatch",
 			})
@@ -47,21 +67,112 @@ func TokenHandler(userHandler service.UserHandlerer) echo.HandlerFunc {
 				"message": "error while getting password: " + err.Error(),
 			})
 		}
-		// Create token
-		token := jwt.New(jwt.SigningMethodHS256)
 
-		// Set claims
+		id, err := userHandler.UserID(*user)
+		if err != nil {
+			config.Opts.Logger.Error().Err(err).Msg("Failed to get user id.")
+			return err
+		}
+		if ok, err := userHandler.IsTOTPEnabled(*user); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"message": "error while checking two-factor authentication: " + err.Error(),
+			})
+		} else if ok {
+			challenge, err := generateChallengeToken(id, user.Email)
+			if err != nil {
+				config.Opts.Logger.Error().Err(err).Msg("Failed to generate challenge token.")
+				return err
+			}
+			return c.JSON(http.StatusOK, map[string]interface{}{
+				"mfa_required": true,
+				"challenge":    challenge,
+			})
+		}
+
+		if err := userHandler.ResetLoginFailures(*user); err != nil {
+			config.Opts.Logger.Error().Err(err).Msg("Failed to reset login failures")
+		}
+		t, err := generateToken(id)
+		if err != nil {
+			config.Opts.Logger.Error().Err(err).Msg("Failed to generate token.")
+			return err
+		}
+		audit(c, models.AuditEntry{UserID: id, Action: models.AuditLogin, Detail: "password"})
+		notifyLogin(c, userHandler, id)
+
+		return c.JSON(http.StatusOK, map[string]string{
+			"token": t,
+		})
+	}
+}
+
+// MFATokenHandler exchanges a challenge token issued by TokenHandler and a valid TOTP
+// or recovery code for a regular JWT token.
+func MFATokenHandler(userHandler service.UserHandlerer, limiter service.RateLimiter) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var mfa = struct {
+			Challenge string `json:"challenge"`
+			Code      string `json:"code"`
+		}{}
+		if err := c.Bind(&mfa); err != nil {
+			config.Opts.Logger.Error().Err(err).Msg("Failed to bind challenge")
+			return err
+		}
+		if mfa.Challenge == "" || mfa.Code == "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"message": "invalid challenge or code",
+			})
+		}
+		token, err := parseToken(mfa.Challenge)
+		if err != nil {
+			return c.JSON(http.StatusUnauthorized, map[string]string{
+				"message": "invalid challenge",
+			})
+		}
 		claims := token.Claims.(jwt.MapClaims)
-		claims["email"] = user.Email // from context
-		claims["admin"] = true
-		claims["exp"] = time.Now().Add(time.Hour * 72).Unix()
+		if claims["purpose"] != mfaChallengePurpose {
+			return c.JSON(http.StatusUnauthorized, map[string]string{
+				"message": "invalid challenge",
+			})
+		}
+		id, _ := claims["sub"].(string)
+		email, _ := claims["email"].(string)
+		if id == "" || email == "" {
+			return c.JSON(http.StatusUnauthorized, map[string]string{
+				"message": "invalid challenge",
+			})
+		}
+		user := models.User{ID: id}
+		if handled, err := limitEmail(c, limiter, email); handled {
+			return err
+		}
+		if handled, err := rejectLocked(c, userHandler, user); handled {
+			return err
+		}
+		if ok, err := userHandler.VerifyTOTP(user, mfa.Code); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"message": "error while verifying code: " + err.Error(),
+			})
+		} else if !ok {
+			if _, err := userHandler.RecordLoginFailure(user); err != nil {
+				config.Opts.Logger.Error().Err(err).Msg("Failed to record login failure")
+			}
+			audit(c, models.AuditEntry{UserID: id, Action: models.AuditLoginFailed, Detail: "totp"})
+			return c.JSON(http.StatusUnauthorized, map[string]string{
+				"message": "invalid code",
+			})
+		}
+		if err := userHandler.ResetLoginFailures(user); err != nil {
+			config.Opts.Logger.Error().Err(err).Msg("Failed to reset login failures")
+		}
 
-		// Generate encoded token and send it as response.
-		t, err := token.SignedString([]byte(config.Opts.GlobalTokenKey))
+		t, err := generateToken(id)
 		if err != nil {
 			config.Opts.Logger.Error().Err(err).Msg("Failed to generate token.")
 			return err
 		}
+		audit(c, models.AuditEntry{UserID: id, Action: models.AuditLogin, Detail: "totp"})
+		notifyLogin(c, userHandler, id)
 
 		return c.JSON(http.StatusOK, map[string]string{
 			"token": t,
@@ -69,6 +180,73 @@ func TokenHandler(userHandler service.UserHandlerer) echo.HandlerFunc {
 	}
 }
 
+// rejectLocked responds with 429 if the user is currently locked out. If so, the response has
+// already been written and handled is true.
+func rejectLocked(c echo.Context, userHandler service.UserHandlerer, user models.User) (handled bool, err error) {
+	lockedFor, err := userHandler.LockedFor(user)
+	if err != nil {
+		return true, c.JSON(http.StatusInternalServerError, map[string]string{
+			"message": "error while checking account lock: " + err.Error(),
+		})
+	}
+	if lockedFor > 0 {
+		return true, tooManyRequests(c, "account temporarily locked", lockedFor)
+	}
+	return false, nil
+}
+
+// notifyLogin informs the user about a successful login. Failing to do so doesn't fail the login.
+func notifyLogin(c echo.Context, userHandler service.UserHandlerer, id string) {
+	if err := userHandler.NotifyLogin(models.User{ID: id}, c.RealIP()); err != nil {
+		config.Opts.Logger.Error().Err(err).Msg("Failed to notify about the login")
+	}
+}
+
+// tokenKeySet signs and verifies tokens. If it isn't set the global token key is used.
+var tokenKeySet *service.KeySet
+
+// tokenKeys returns the key set used for tokens.
+func tokenKeys() *service.KeySet {
+	if tokenKeySet != nil {
+		return tokenKeySet
+	}
+	return service.NewHMACKeySet(config.Opts.GlobalTokenKey)
+}
+
+// tokenKeyFunc provides the verification key of a token for the JWT middleware.
+func tokenKeyFunc(token *jwt.Token) (interface{}, error) {
+	return tokenKeys().KeyFunc(token)
+}
+
+// generateToken creates a signed token for the user with the given id.
+func generateToken(id string) (string, error) {
+	now := time.Now()
+	return tokenKeys().Sign(jwt.MapClaims{
+		"sub":   id,
+		"admin": true,
+		"iat":   now.Unix(),
+		"exp":   now.Add(tokenExpiry).Unix(),
+	})
+}
+
+// generateChallengeToken creates a short lived token which can only be exchanged for a
+// real token together with a valid TOTP code.
+// The email is kept so the rate limit by email applies to the second step as well.
+func generateChallengeToken(id, email string) (string, error) {
+	return generatePurposeToken(mfaChallengePurpose, mfaChallengeExpiry, jwt.MapClaims{
+		"sub":   id,
+		"email": email,
+	})
+}
+
+// generatePurposeToken creates a short lived token for a single purpose. Such tokens
+// are rejected by GetToken.
+func generatePurposeToken(purpose string, expiry time.Duration, claims jwt.MapClaims) (string, error) {
+	claims["purpose"] = purpose
+	claims["exp"] = time.Now().Add(expiry).Unix()
+	return tokenKeys().Sign(claims)
+}
+
 // GetToken gets the JWT token from the echo context
 func GetToken(c echo.Context) (*jwt.Token, error) {
 	// Get the token
@@ -78,20 +256,68 @@ func GetToken(c echo.Context) (*jwt.Token, error) {
 		return nil, errors.New("unauthorized")
 	}
 	jwtString := split[1]
-	// Parse token
-	token, err := jwt.Parse(jwtString, func(token *jwt.Token) (interface{}, error) {
-		signingMethodError := fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		switch token.Method.(type) {
-		case *jwt.SigningMethodHMAC:
-			return []byte(config.Opts.GlobalTokenKey), nil
-		default:
-			return nil, signingMethodError
-		}
-	})
+	token, err := parseToken(jwtString)
 	if err != nil {
 		config.Opts.Logger.Error().Err(err).Msg("Failed to get token")
 		return nil, err
 	}
+	// Challenge tokens are only valid for completing a two-factor login.
+	if claims, ok := token.Claims.(jwt.MapClaims); ok && claims["purpose"] != nil {
+		return nil, errors.New("unauthorized")
+	}
 
 	return token, nil
 }
+
+// parseToken parses and validates a raw token string.
+func parseToken(jwtString string) (*jwt.Token, error) {
+	return jwt.Parse(jwtString, tokenKeyFunc)
+}
+
+// RejectRevokedTokens is a middleware which runs after the JWT middleware. It rejects tokens of
+// users which no longer exist and tokens which were issued before they were revoked.
+func RejectRevokedTokens(userHandler service.UserHandlerer) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			token, ok := c.Get("user").(*jwt.Token)
+			if !ok {
+				return echo.ErrUnauthorized
+			}
+			claims, ok := token.Claims.(jwt.MapClaims)
+			if !ok || claims["purpose"] != nil {
+				return echo.ErrUnauthorized
+			}
+			id, _ := claims["sub"].(string)
+			if id == "" {
+				return echo.ErrUnauthorized
+			}
+			var issuedAt int64
+			if iat, ok := claims["iat"].(float64); ok {
+				issuedAt = int64(iat)
+			}
+			valid, err := userHandler.TokenValid(id, time.Unix(issuedAt, 0))
+			if err != nil {
+				config.Opts.Logger.Error().Err(err).Msg("Failed to validate token")
+				return echo.ErrInternalServerError
+			}
+			if !valid {
+				return echo.ErrUnauthorized
+			}
+			return next(c)
+		}
+	}
+}
+
+// JWKS publishes the public keys which verify Staple tokens so other services can
+// verify them as well.
+func JWKS() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var jwks = struct {
+			Keys []service.JSONWebKey `json:"keys"`
+		}{
+			Keys: tokenKeys().JWKS(),
+		}
+		c.Response().Header().Set("Cache-Control", "public, max-age=300")
+		return c.JSON(http.StatusOK, jwks)
+	}
+}
@@ -0,0 +1,269 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/staple-org/staple/internal/models"
+	"github.com/staple-org/staple/internal/service"
+	"github.com/staple-org/staple/internal/storage"
+	"github.com/staple-org/staple/pkg/config"
+)
+
+func TestTokenHandler_MFA(t *testing.T) {
+	inMemoryUserStore := storage.NewInMemoryUserStorer()
+	notifier := service.NewBufferNotifier()
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	userHandler := service.NewUserHandler(context.Background(), inMemoryUserStore, notifier).WithClock(func() time.Time { return now })
+	config.Opts.GlobalTokenKey = "test"
+	limiter := service.NewTokenBucketLimiter(storage.NewInMemoryRateLimitStorer(), 60, 100)
+
+	e := echo.New()
+	testUser := models.User{
+		Email:    "test@test.com",
+		Password: "password",
+	}
+	err := userHandler.Register(testUser)
+	assert.NoError(t, err)
+	secret, _, err := userHandler.EnrollTOTP(testUser)
+	assert.NoError(t, err)
+	code, err := service.GenerateTOTPCode(secret, now)
+	assert.NoError(t, err)
+	_, err = userHandler.ConfirmTOTP(testUser, code)
+	assert.NoError(t, err)
+
+	t.Run("password login returns a challenge", func(tt *testing.T) {
+		req := httptest.NewRequest(echo.POST, "/rest/api/1/get-token", bytes.NewBuffer([]byte(`{"email": "test@test.com", "password": "password"}`)))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		err := TokenHandler(userHandler, limiter)(c)
+		assert.NoError(tt, err)
+		assert.Equal(tt, http.StatusOK, rec.Code)
+		var resp struct {
+			MFARequired bool   `json:"mfa_required"`
+			Challenge   string `json:"challenge"`
+			Token       string `json:"token"`
+		}
+		err = json.Unmarshal(rec.Body.Bytes(), &resp)
+		assert.NoError(tt, err)
+		assert.True(tt, resp.MFARequired)
+		assert.NotEmpty(tt, resp.Challenge)
+		assert.Empty(tt, resp.Token)
+
+		// the challenge can't be used as a token
+		req = httptest.NewRequest(echo.GET, "/rest/api/1/staple", nil)
+		req.Header.Set("Authorization", "Bearer "+resp.Challenge)
+		c = e.NewContext(req, httptest.NewRecorder())
+		_, err = GetToken(c)
+		assert.EqualError(tt, err, "unauthorized")
+
+		// invalid code
+		body, _ := json.Marshal(map[string]string{"challenge": resp.Challenge, "code": "000000"})
+		req = httptest.NewRequest(echo.POST, "/rest/api/1/get-token/mfa", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec = httptest.NewRecorder()
+		c = e.NewContext(req, rec)
+		err = MFATokenHandler(userHandler, limiter)(c)
+		assert.NoError(tt, err)
+		assert.Equal(tt, http.StatusUnauthorized, rec.Code)
+
+		// the code used for the confirmation can't be used again
+		now = now.Add(time.Second)
+		body, _ = json.Marshal(map[string]string{"challenge": resp.Challenge, "code": code})
+		req = httptest.NewRequest(echo.POST, "/rest/api/1/get-token/mfa", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec = httptest.NewRecorder()
+		err = MFATokenHandler(userHandler, limiter)(e.NewContext(req, rec))
+		assert.NoError(tt, err)
+		assert.Equal(tt, http.StatusUnauthorized, rec.Code)
+
+		// wait for the delay after the failed attempt to pass and use the next code
+		now = now.Add(30 * time.Second)
+		code, err := service.GenerateTOTPCode(secret, now)
+		assert.NoError(tt, err)
+
+		// valid code
+		body, _ = json.Marshal(map[string]string{"challenge": resp.Challenge, "code": code})
+		req = httptest.NewRequest(echo.POST, "/rest/api/1/get-token/mfa", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec = httptest.NewRecorder()
+		c = e.NewContext(req, rec)
+		err = MFATokenHandler(userHandler, limiter)(c)
+		assert.NoError(tt, err)
+		assert.Equal(tt, http.StatusOK, rec.Code)
+		var token struct {
+			Token string `json:"token"`
+		}
+		err = json.Unmarshal(rec.Body.Bytes(), &token)
+		assert.NoError(tt, err)
+		assert.NotEmpty(tt, token.Token)
+		assert.Contains(tt, notifier.Last(service.NewLogin).Text, "Someone just logged in to your Staple account from 192.0.2.1.")
+
+		req = httptest.NewRequest(echo.GET, "/rest/api/1/staple", nil)
+		req.Header.Set("Authorization", "Bearer "+token.Token)
+		c = e.NewContext(req, httptest.NewRecorder())
+		_, err = GetToken(c)
+		assert.NoError(tt, err)
+	})
+}
+
+func TestTokenHandler_Lockout(t *testing.T) {
+	inMemoryUserStore := storage.NewInMemoryUserStorer()
+	notifier := service.NewBufferNotifier()
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	userHandler := service.NewUserHandler(context.Background(), inMemoryUserStore, notifier).WithClock(clock)
+	limiter := service.NewTokenBucketLimiter(storage.NewInMemoryRateLimitStorer(), 60, 100).WithClock(clock)
+	config.Opts.GlobalTokenKey = "test"
+
+	e := echo.New()
+	err := userHandler.Register(models.User{Email: "test@test.com", Password: "password"})
+	assert.NoError(t, err)
+
+	login := func(password string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]string{"email": "test@test.com", "password": password})
+		req := httptest.NewRequest(echo.POST, "/rest/api/1/get-token", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		err := TokenHandler(userHandler, limiter)(c)
+		assert.NoError(t, err)
+		return rec
+	}
+
+	rec := login("wrong")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	// the correct password is rejected during the delay
+	rec = login("password")
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "1", rec.Header().Get("Retry-After"))
+
+	now = now.Add(time.Second)
+	rec = login("password")
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestRateLimitByIP(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	limiter := service.NewTokenBucketLimiter(storage.NewInMemoryRateLimitStorer(), 6, 2).WithClock(func() time.Time { return now })
+	e := echo.New()
+	handler := RateLimitByIP(limiter)(func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	})
+	codes := make([]int, 0)
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest(echo.POST, "/rest/api/1/get-token", nil)
+		rec := httptest.NewRecorder()
+		err := handler(e.NewContext(req, rec))
+		assert.NoError(t, err)
+		codes = append(codes, rec.Code)
+		if rec.Code == http.StatusTooManyRequests {
+			assert.Equal(t, "10", rec.Header().Get("Retry-After"))
+		}
+	}
+	assert.Equal(t, []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests}, codes)
+}
+
+func TestJWKS(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	tokenKeySet = service.NewKeySet(time.Hour, service.SigningKey{
+		ID:      "key-1",
+		Method:  jwt.SigningMethodEdDSA,
+		Private: private,
+		Public:  public,
+		Created: time.Now(),
+	})
+	defer func() { tokenKeySet = nil }()
+
+	e := echo.New()
+	tok, err := generateToken("user-1")
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(echo.GET, "/.well-known/jwks.json", nil)
+	rec := httptest.NewRecorder()
+	err = JWKS()(e.NewContext(req, rec))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var jwks struct {
+		Keys []service.JSONWebKey `json:"keys"`
+	}
+	err = json.Unmarshal(rec.Body.Bytes(), &jwks)
+	assert.NoError(t, err)
+	assert.Len(t, jwks.Keys, 1)
+	assert.Equal(t, "key-1", jwks.Keys[0].Kid)
+	assert.Equal(t, "EdDSA", jwks.Keys[0].Alg)
+
+	// another service can verify the token with the published key only
+	x, err := base64.RawURLEncoding.DecodeString(jwks.Keys[0].X)
+	assert.NoError(t, err)
+	parsed, err := jwt.Parse(tok, func(token *jwt.Token) (interface{}, error) {
+		return ed25519.PublicKey(x), nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "user-1", parsed.Claims.(jwt.MapClaims)["sub"])
+
+	// tokens signed with the old shared key are rejected
+	config.Opts.GlobalTokenKey = "test"
+	legacy, err := service.NewHMACKeySet("test").Sign(jwt.MapClaims{"sub": "user-1"})
+	assert.NoError(t, err)
+	_, err = parseToken(legacy)
+	assert.Error(t, err)
+}
+
+func TestRejectRevokedTokens(t *testing.T) {
+	inMemoryUserStore := storage.NewInMemoryUserStorer()
+	userHandler := service.NewUserHandler(context.Background(), inMemoryUserStore, service.NewBufferNotifier())
+	config.Opts.GlobalTokenKey = "test"
+	err := userHandler.Register(models.User{Email: "test@test.com", Password: "password"})
+	assert.NoError(t, err)
+	id, err := userHandler.UserID(models.User{Email: "test@test.com"})
+	assert.NoError(t, err)
+
+	e := echo.New()
+	handler := RejectRevokedTokens(userHandler)(func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	})
+	call := func(claims jwt.MapClaims) error {
+		raw, err := tokenKeys().Sign(claims)
+		assert.NoError(t, err)
+		token, err := parseToken(raw)
+		assert.NoError(t, err)
+		c := e.NewContext(httptest.NewRequest(echo.GET, "/rest/api/1/staple", nil), httptest.NewRecorder())
+		c.Set("user", token)
+		return handler(c)
+	}
+
+	tok, err := generateToken(id)
+	assert.NoError(t, err)
+	token, err := parseToken(tok)
+	assert.NoError(t, err)
+	assert.NoError(t, call(token.Claims.(jwt.MapClaims)))
+
+	// issued before the user was registered
+	err = call(jwt.MapClaims{"sub": id, "iat": time.Now().Add(-time.Hour).Unix()})
+	assert.Equal(t, echo.ErrUnauthorized, err)
+	// user no longer exists
+	err = call(jwt.MapClaims{"sub": "1b9d6bcd-bbfd-4b2d-9b5d-ab8dfbbd4bed", "iat": time.Now().Unix()})
+	assert.Equal(t, echo.ErrUnauthorized, err)
+	// tokens from before user ids carry only the email
+	err = call(jwt.MapClaims{"email": "test@test.com", "iat": time.Now().Unix()})
+	assert.Equal(t, echo.ErrUnauthorized, err)
+	// challenge tokens
+	err = call(jwt.MapClaims{"sub": id, "iat": time.Now().Unix(), "purpose": "mfa"})
+	assert.Equal(t, echo.ErrUnauthorized, err)
+}
@@ -0,0 +1,124 @@
+package pkg
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/labstack/echo/v4"
+
+	"github.com/staple-org/staple/internal/models"
+	"github.com/staple-org/staple/internal/service"
+	"github.com/staple-org/staple/pkg/config"
+)
+
+// ListChats lists the chat targets of the user. Access tokens are not included.
+func ListChats(chats service.Chats) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token, err := GetToken(c)
+		if err != nil {
+			return err
+		}
+		claims := token.Claims.(jwt.MapClaims)
+		userID := claims["sub"].(string)
+		userModel := &models.User{
+			ID: userID,
+		}
+		targets, err := chats.List(*userModel)
+		if err != nil {
+			apiError := config.APIError("failed to list chats", http.StatusInternalServerError, err)
+			return c.JSON(http.StatusInternalServerError, apiError)
+		}
+		var list = struct {
+			Chats []models.ChatTarget `json:"chats"`
+		}{
+			Chats: targets,
+		}
+		return c.JSON(http.StatusOK, list)
+	}
+}
+
+// SetChat adds or replaces the chat target of a kind. The following properties are used:
+// kind (slack, discord or matrix), url, and for matrix room and token.
+func SetChat(chats service.Chats) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token, err := GetToken(c)
+		if err != nil {
+			return err
+		}
+		claims := token.Claims.(jwt.MapClaims)
+		userID := claims["sub"].(string)
+		userModel := &models.User{
+			ID: userID,
+		}
+		var request = struct {
+			Kind  string `json:"kind"`
+			URL   string `json:"url"`
+			Room  string `json:"room"`
+			Token string `json:"token"`
+		}{}
+		if err := c.Bind(&request); err != nil {
+			return err
+		}
+		target, err := chats.Set(*userModel, models.ChatTarget{
+			Kind:  request.Kind,
+			URL:   request.URL,
+			Room:  request.Room,
+			Token: request.Token,
+		})
+		switch {
+		case errors.Is(err, service.ErrInvalidChatTarget):
+			apiError := config.APIError("failed to set chat", http.StatusBadRequest, err)
+			return c.JSON(http.StatusBadRequest, apiError)
+		case err != nil:
+			apiError := config.APIError("failed to set chat", http.StatusInternalServerError, err)
+			return c.JSON(http.StatusInternalServerError, apiError)
+		}
+		return c.JSON(http.StatusOK, target)
+	}
+}
+
+// DeleteChat removes the chat target of a kind.
+func DeleteChat(chats service.Chats) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token, err := GetToken(c)
+		if err != nil {
+			return err
+		}
+		claims := token.Claims.(jwt.MapClaims)
+		userID := claims["sub"].(string)
+		userModel := &models.User{
+			ID: userID,
+		}
+		if err := chats.Delete(*userModel, c.Param("kind")); err != nil {
+			apiError := config.APIError("failed to delete chat", http.StatusInternalServerError, err)
+			return c.JSON(http.StatusInternalServerError, apiError)
+		}
+		return c.NoContent(http.StatusOK)
+	}
+}
+
+// TestChat posts a test message to the chat target of a kind right away.
+func TestChat(chats service.Chats) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token, err := GetToken(c)
+		if err != nil {
+			return err
+		}
+		claims := token.Claims.(jwt.MapClaims)
+		userID := claims["sub"].(string)
+		userModel := &models.User{
+			ID: userID,
+		}
+		err = chats.SendTest(*userModel, c.Param("kind"))
+		switch {
+		case errors.Is(err, service.ErrChatTargetNotFound):
+			apiError := config.APIError("failed to send test message", http.StatusNotFound, err)
+			return c.JSON(http.StatusNotFound, apiError)
+		case err != nil:
+			apiError := config.APIError("failed to send test message", http.StatusBadGateway, err)
+			return c.JSON(http.StatusBadGateway, apiError)
+		}
+		return c.NoContent(http.StatusOK)
+	}
+}
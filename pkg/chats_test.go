@@ -0,0 +1,79 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/staple-org/staple/internal/models"
+	"github.com/staple-org/staple/internal/service"
+	"github.com/staple-org/staple/internal/storage"
+	"github.com/staple-org/staple/pkg/config"
+)
+
+func TestChatHandlers(t *testing.T) {
+	var posted map[string]string
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewDecoder(r.Body).Decode(&posted)
+	}))
+	defer receiver.Close()
+	userStore := storage.NewInMemoryUserStorer()
+	userHandler := service.NewUserHandler(context.Background(), userStore, service.NewBufferNotifier())
+	chats := service.NewChats(storage.NewInMemoryChatTargetStorer(), userStore).WithHTTPClient(receiver.Client())
+	config.Opts.GlobalTokenKey = "test"
+	e := echo.New()
+
+	testUser := models.User{Email: "test@test.com", Password: "password"}
+	err := userHandler.Register(testUser)
+	assert.NoError(t, err)
+	testUser.ID, err = userHandler.UserID(testUser)
+	assert.NoError(t, err)
+	tok, err := generateToken(testUser.ID)
+	assert.NoError(t, err)
+
+	request := func(method, body string, handler echo.HandlerFunc, kind string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/rest/api/1/user/chats", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+tok)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		if kind != "" {
+			c.SetParamNames("kind")
+			c.SetParamValues(kind)
+		}
+		assert.NoError(t, handler(c))
+		return rec
+	}
+
+	rec := request(echo.POST, `{"kind": "matrix", "url": "https://matrix.staple.test", "room": "!room:staple.test", "token": "secret"}`, SetChat(chats), "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NotContains(t, rec.Body.String(), "secret")
+	rec = request(echo.POST, `{"kind": "slack", "url": "`+receiver.URL+`"}`, SetChat(chats), "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	rec = request(echo.POST, `{"kind": "irc", "url": "https://irc.staple.test"}`, SetChat(chats), "")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = request(echo.GET, "", ListChats(chats), "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var list struct {
+		Chats []models.ChatTarget `json:"chats"`
+	}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &list))
+	assert.Len(t, list.Chats, 2)
+	assert.NotContains(t, rec.Body.String(), "secret")
+
+	rec = request(echo.POST, "", TestChat(chats), "slack")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "*Staple*\nThis is a test message from Staple.", posted["text"])
+
+	rec = request(echo.DELETE, "", DeleteChat(chats), "slack")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	rec = request(echo.POST, "", TestChat(chats), "slack")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
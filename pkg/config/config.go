@@ -2,6 +2,7 @@ package config
 
 import (
 	"errors"
+	"time"
 
 	"github.com/rs/zerolog"
 )
@@ -15,7 +16,18 @@ type Config struct {
 	Port           string
 	Hostname       string
 	GlobalTokenKey string
-	Database       struct {
+	AdminToken     string
+	// TrustedProxies is a comma separated list of the CIDR ranges of proxies whose
+	// X-Forwarded-For header is trusted. Without it the address of the connection is used.
+	TrustedProxies string
+	TokenKeys      struct {
+		// Dir contains PEM encoded Ed25519 or RSA private keys named <kid>.pem.
+		Dir              string
+		RotationInterval time.Duration
+		// Grace is how long a key keeps verifying tokens after it has been superseded.
+		Grace time.Duration
+	}
+	Database struct {
 		Hostname string
 		Username string
 		Password string
@@ -24,6 +36,97 @@ type Config struct {
 	Mailer struct {
 		Domain string
 		APIKey string
+		// TemplateDir overrides the embedded mail templates with files of the same name.
+		TemplateDir string
+	}
+	Notifications struct {
+		// Workers is the number of notifications sent at the same time.
+		Workers int
+		// MaxAttempts is the number of attempts after which a notification is given up.
+		MaxAttempts int
+		// Interval is how often failed notifications are retried. Zero disables sending.
+		Interval time.Duration
+	}
+	Digests struct {
+		// Interval is how often due digests and reminders are sent. Zero disables them.
+		Interval time.Duration
+	}
+	SMTP struct {
+		// Host selects the SMTP notifier over Mailgun when set.
+		Host     string
+		Port     int
+		Username string
+		Password string
+		// Security is "starttls", "tls" or "none".
+		Security string
+		// From defaults to no-reply@<hostname>.
+		From string
+	}
+	RateLimit struct {
+		// Backend is either "memory" or "postgres".
+		Backend   string
+		PerMinute int
+		Burst     int
+	}
+	OIDC struct {
+		Issuer        string
+		ClientID      string
+		ClientSecret  string
+		RedirectURL   string
+		AutoProvision bool
+	}
+	Lockout struct {
+		// Threshold is the number of failed attempts after which an account is locked.
+		Threshold int
+		Duration  time.Duration
+	}
+	PasswordPolicy struct {
+		MinLength int
+		// MinClasses is the number of character classes a password has to contain.
+		MinClasses int
+		// BreachedDir contains Have I Been Pwned range files named <PREFIX>.txt.
+		BreachedDir string
+	}
+	Audit struct {
+		// Retention is how long audit entries are kept. Zero keeps them forever.
+		Retention time.Duration
+	}
+	Trash struct {
+		// Retention is how long deleted staples are kept in the trash. Zero keeps them forever.
+		Retention time.Duration
+	}
+	AccountDeletion struct {
+		// Grace is the time during which a requested deletion can be cancelled. Zero deletes immediately.
+		Grace time.Duration
+	}
+	Subscriptions struct {
+		// Interval is how often subscribed feeds are polled. Zero disables polling.
+		Interval time.Duration
+		// AllowPrivate allows feeds on loopback and private addresses.
+		AllowPrivate bool
+	}
+	Events struct {
+		// Outbox records created, archived, deleted and restored staples in the event outbox
+		// in the same transaction and publishes them from there, so none of them is lost if
+		// the process stops. User events and the queue.empty and quota.reached events are
+		// still published right after the change.
+		Outbox bool
+	}
+	Webhooks struct {
+		// Interval is how often failed webhook deliveries are retried.
+		Interval time.Duration
+		// AllowPrivate allows webhooks on loopback and private addresses.
+		AllowPrivate bool
+	}
+	Inbound struct {
+		// Listen is the address of the SMTP listener for inbox addresses. Empty disables it.
+		Listen string
+		// Domain is the domain part of the inbox addresses. It defaults to the hostname.
+		Domain string
+		// MaxSize is the maximum size of a mail in bytes.
+		MaxSize int64
+		// MaxConns is the maximum number of connections served at the same time.
+		MaxConns int
 	}
 	DevMode bool
 	Logger  zerolog.Logger
@@ -0,0 +1,65 @@
+package pkg
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/labstack/echo/v4"
+
+	"github.com/staple-org/staple/internal/models"
+	"github.com/staple-org/staple/internal/service"
+	"github.com/staple-org/staple/pkg/config"
+)
+
+// GetDigestSettings returns the digest and reminder settings of the user.
+func GetDigestSettings(digests service.Digests) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token, err := GetToken(c)
+		if err != nil {
+			return err
+		}
+		claims := token.Claims.(jwt.MapClaims)
+		userID := claims["sub"].(string)
+		userModel := &models.User{
+			ID: userID,
+		}
+		settings, err := digests.Settings(*userModel)
+		if err != nil {
+			apiError := config.APIError("failed to get digest settings", http.StatusInternalServerError, err)
+			return c.JSON(http.StatusInternalServerError, apiError)
+		}
+		return c.JSON(http.StatusOK, settings)
+	}
+}
+
+// UpdateDigestSettings replaces the digest and reminder settings of the user. The following
+// properties are used: frequency (off, daily or weekly), hour, reminder_days, timezone,
+// quiet_start and quiet_end.
+func UpdateDigestSettings(digests service.Digests) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token, err := GetToken(c)
+		if err != nil {
+			return err
+		}
+		claims := token.Claims.(jwt.MapClaims)
+		userID := claims["sub"].(string)
+		userModel := &models.User{
+			ID: userID,
+		}
+		var request models.DigestSettings
+		if err := c.Bind(&request); err != nil {
+			return err
+		}
+		settings, err := digests.UpdateSettings(*userModel, request)
+		switch {
+		case errors.Is(err, service.ErrInvalidDigestSettings):
+			apiError := config.APIError("failed to update digest settings", http.StatusBadRequest, err)
+			return c.JSON(http.StatusBadRequest, apiError)
+		case err != nil:
+			apiError := config.APIError("failed to update digest settings", http.StatusInternalServerError, err)
+			return c.JSON(http.StatusInternalServerError, apiError)
+		}
+		return c.JSON(http.StatusOK, settings)
+	}
+}
@@ -0,0 +1,67 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/staple-org/staple/internal/models"
+	"github.com/staple-org/staple/internal/service"
+	"github.com/staple-org/staple/internal/storage"
+	"github.com/staple-org/staple/pkg/config"
+)
+
+func TestDigestSettingsHandlers(t *testing.T) {
+	notifier := service.NewBufferNotifier()
+	userHandler := service.NewUserHandler(context.Background(), storage.NewInMemoryUserStorer(), notifier)
+	stapler := service.NewStapler(storage.NewInMemoryStapleStorer())
+	digests := service.NewDigests(storage.NewInMemoryDigestStorer(), stapler, userHandler, notifier)
+	config.Opts.GlobalTokenKey = "test"
+	e := echo.New()
+
+	testUser := models.User{Email: "test@test.com", Password: "password"}
+	err := userHandler.Register(testUser)
+	assert.NoError(t, err)
+	testUser.ID, err = userHandler.UserID(testUser)
+	assert.NoError(t, err)
+	tok, err := generateToken(testUser.ID)
+	assert.NoError(t, err)
+
+	request := func(method, body string, handler echo.HandlerFunc) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/rest/api/1/user/digest", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+tok)
+		rec := httptest.NewRecorder()
+		assert.NoError(t, handler(e.NewContext(req, rec)))
+		return rec
+	}
+
+	rec := request(echo.GET, "", GetDigestSettings(digests))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var settings models.DigestSettings
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &settings))
+	assert.Equal(t, models.DigestOff, settings.Frequency)
+	assert.Equal(t, "UTC", settings.Timezone)
+
+	rec = request(echo.POST, `{"frequency": "weekly", "hour": 7, "timezone": "America/New_York", "quiet_start": 22, "quiet_end": 6, "reminder_days": 5}`, UpdateDigestSettings(digests))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	rec = request(echo.GET, "", GetDigestSettings(digests))
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &settings))
+	assert.Equal(t, models.DigestSettings{
+		Frequency:    models.DigestWeekly,
+		Hour:         7,
+		Timezone:     "America/New_York",
+		QuietStart:   22,
+		QuietEnd:     6,
+		ReminderDays: 5,
+	}, settings)
+
+	rec = request(echo.POST, `{"frequency": "weekly", "timezone": "Nowhere"}`, UpdateDigestSettings(digests))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
@@ -0,0 +1,66 @@
+package pkg
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/staple-org/staple/internal/models"
+	"github.com/staple-org/staple/internal/service"
+	"github.com/staple-org/staple/internal/storage"
+)
+
+// Export runs the export subcommand which writes the staples of a user straight from
+// the database. It is meant for admins and uses the database flags of the server.
+//
+//	staple --staple-db-hostname db export --email user@example.com --format html --output staples.html
+func Export(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	email := fs.String("email", "", "--email user@example.com")
+	userID := fs.String("user-id", "", "--user-id 2f1d3c4e-...")
+	format := fs.String("format", string(service.ExportJSON), "--format json|csv|html|markdown")
+	scope := fs.String("scope", string(service.ExportAll), "--scope queue|archive|all")
+	output := fs.String("output", "", "--output staples.json (defaults to stdout)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if (*email == "") == (*userID == "") {
+		return errors.New("exactly one of --email or --user-id is required")
+	}
+	if _, _, err := service.ValidateExport(service.ExportFormat(*format), service.ExportScope(*scope)); err != nil {
+		return err
+	}
+
+	users := storage.NewPostgresUserStorer()
+	var (
+		user *models.User
+		err  error
+	)
+	if *userID != "" {
+		user, err = users.Get(*userID)
+	} else {
+		user, err = users.GetByEmail(*email)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to find user: %w", err)
+	}
+	if user == nil {
+		return errors.New("user not found")
+	}
+
+	stapler := service.NewStapler(storage.NewPostgresStapleStorer())
+	if *output == "" {
+		return stapler.Export(user, service.ExportFormat(*format), service.ExportScope(*scope), stdout)
+	}
+	f, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	if err := stapler.Export(user, service.ExportFormat(*format), service.ExportScope(*scope), f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
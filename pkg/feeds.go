@@ -0,0 +1,173 @@
+package pkg
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/labstack/echo/v4"
+
+	"github.com/staple-org/staple/internal/models"
+	"github.com/staple-org/staple/internal/service"
+	"github.com/staple-org/staple/pkg/config"
+)
+
+// feedFormat is the syndication format a feed is rendered in.
+type feedFormat string
+
+const (
+	atomFormat feedFormat = "atom"
+	rssFormat  feedFormat = "rss"
+)
+
+// StapleFeed serves a personal feed of the user owning the token in the URL. Feeds are
+// public so readers can poll them; the token is the only secret. Responses carry an ETag
+// and a Last-Modified header so readers can poll with conditional requests. The newest
+// entry can be older than the one a reader saw before, for example when a restored or
+// imported staple becomes the head of the queue. Last-Modified is left out then, so the
+// reader isn't told that its older copy is still current.
+func StapleFeed(userHandler service.UserHandlerer, stapler service.Staplerer, kind service.FeedKind, format feedFormat) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user, err := userHandler.FeedUser(c.Param("token"))
+		if err != nil {
+			apiError := config.APIError("failed to get feed", http.StatusInternalServerError, err)
+			return c.JSON(http.StatusInternalServerError, apiError)
+		}
+		if user == nil {
+			apiError := config.APIError("feed not found", http.StatusNotFound, nil)
+			return c.JSON(http.StatusNotFound, apiError)
+		}
+		feed, err := service.BuildFeed(stapler, user, kind)
+		if err != nil {
+			apiError := config.APIError("failed to get feed", http.StatusInternalServerError, err)
+			return c.JSON(http.StatusInternalServerError, apiError)
+		}
+
+		self := requestBaseURL(c) + c.Request().URL.Path
+		var (
+			buf         bytes.Buffer
+			contentType string
+		)
+		if format == rssFormat {
+			contentType = "application/rss+xml; charset=utf-8"
+			err = feed.WriteRSS(&buf, self)
+		} else {
+			contentType = "application/atom+xml; charset=utf-8"
+			err = feed.WriteAtom(&buf, self)
+		}
+		if err != nil {
+			apiError := config.APIError("failed to render feed", http.StatusInternalServerError, err)
+			return c.JSON(http.StatusInternalServerError, apiError)
+		}
+
+		sum := sha256.Sum256(buf.Bytes())
+		etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+		header := c.Response().Header()
+		header.Set("ETag", etag)
+		header.Set("Cache-Control", "private, no-cache")
+		lastModified := feed.Updated
+		if since, err := http.ParseTime(c.Request().Header.Get(echo.HeaderIfModifiedSince)); err == nil && lastModified.Truncate(time.Second).Before(since) {
+			lastModified = time.Time{}
+		}
+		if !lastModified.IsZero() {
+			header.Set(echo.HeaderLastModified, lastModified.UTC().Format(http.TimeFormat))
+		}
+		if notModified(c.Request(), etag, lastModified) {
+			return c.NoContent(http.StatusNotModified)
+		}
+		return c.Blob(http.StatusOK, contentType, buf.Bytes())
+	}
+}
+
+// notModified evaluates the conditional headers of a request. If-None-Match takes
+// precedence over If-Modified-Since as required by RFC 7232.
+func notModified(r *http.Request, etag string, lastModified time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == etag || candidate == "*" {
+				return true
+			}
+		}
+		return false
+	}
+	if lastModified.IsZero() {
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get(echo.HeaderIfModifiedSince))
+	if err != nil {
+		return false
+	}
+	return !lastModified.Truncate(time.Second).After(since)
+}
+
+// feedURLs are the addresses of the personal feeds of a user.
+type feedURLs struct {
+	NextAtom    string `json:"next_atom"`
+	NextRSS     string `json:"next_rss"`
+	ArchiveAtom string `json:"archive_atom"`
+	ArchiveRSS  string `json:"archive_rss"`
+}
+
+func newFeedURLs(c echo.Context, token string) feedURLs {
+	base := requestBaseURL(c) + "/feeds/" + token
+	return feedURLs{
+		NextAtom:    base + "/next.atom",
+		NextRSS:     base + "/next.rss",
+		ArchiveAtom: base + "/archive.atom",
+		ArchiveRSS:  base + "/archive.rss",
+	}
+}
+
+// GetFeeds returns the URLs of the personal feeds of the user.
+func GetFeeds(userHandler service.UserHandlerer) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token, err := GetToken(c)
+		if err != nil {
+			return err
+		}
+		claims := token.Claims.(jwt.MapClaims)
+		userID := claims["sub"].(string)
+		userModel := &models.User{
+			ID: userID,
+		}
+		feedToken, err := userHandler.FeedToken(*userModel)
+		if err != nil {
+			apiError := config.APIError("failed to get feeds", http.StatusInternalServerError, err)
+			return c.JSON(http.StatusInternalServerError, apiError)
+		}
+		return c.JSON(http.StatusOK, newFeedURLs(c, feedToken))
+	}
+}
+
+// RegenerateFeeds replaces the feed token of the user, for example after a feed URL
+// leaked. The old URLs stop working.
+func RegenerateFeeds(userHandler service.UserHandlerer) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token, err := GetToken(c)
+		if err != nil {
+			return err
+		}
+		claims := token.Claims.(jwt.MapClaims)
+		userID := claims["sub"].(string)
+		userModel := &models.User{
+			ID: userID,
+		}
+		feedToken, err := userHandler.RegenerateFeedToken(*userModel)
+		if err != nil {
+			apiError := config.APIError("failed to regenerate feeds", http.StatusInternalServerError, err)
+			return c.JSON(http.StatusInternalServerError, apiError)
+		}
+		audit(c, models.AuditEntry{UserID: userID, Action: models.AuditTokenCreated, Detail: "feeds"})
+		return c.JSON(http.StatusOK, newFeedURLs(c, feedToken))
+	}
+}
+
+// requestBaseURL returns the scheme and host the request was made to.
+func requestBaseURL(c echo.Context) string {
+	return c.Scheme() + "://" + c.Request().Host
+}
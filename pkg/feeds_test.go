@@ -0,0 +1,107 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/staple-org/staple/internal/models"
+	"github.com/staple-org/staple/internal/service"
+	"github.com/staple-org/staple/internal/storage"
+	"github.com/staple-org/staple/pkg/config"
+)
+
+func TestStapleFeed(t *testing.T) {
+	userHandler := service.NewUserHandler(context.Background(), storage.NewInMemoryUserStorer(), service.NewBufferNotifier())
+	stapler := service.NewStapler(storage.NewInMemoryStapleStorer())
+	config.Opts.GlobalTokenKey = "test"
+	e := echo.New()
+
+	testUser := models.User{Email: "test@test.com", Password: "password"}
+	err := userHandler.Register(testUser)
+	assert.NoError(t, err)
+	testUser.ID, err = userHandler.UserID(testUser)
+	assert.NoError(t, err)
+	testUser.MaxStaples = 25
+	err = stapler.Create(models.Staple{Name: "Head", Content: "https://example.com/head", CreatedAt: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}, &testUser)
+	assert.NoError(t, err)
+	err = stapler.Create(models.Staple{Name: "Tail", Content: "https://example.com/tail", CreatedAt: time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)}, &testUser)
+	assert.NoError(t, err)
+	tok, err := generateToken(testUser.ID)
+	assert.NoError(t, err)
+
+	getFeeds := func(handler echo.HandlerFunc, method string) feedURLs {
+		req := httptest.NewRequest(method, "/rest/api/1/user/feeds", nil)
+		req.Header.Set("Authorization", "Bearer "+tok)
+		rec := httptest.NewRecorder()
+		assert.NoError(t, handler(e.NewContext(req, rec)))
+		assert.Equal(t, http.StatusOK, rec.Code)
+		var urls feedURLs
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &urls))
+		return urls
+	}
+	serve := func(url string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(echo.GET, url, nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		parts := strings.Split(req.URL.Path, "/")
+		c.SetParamNames("token")
+		c.SetParamValues(parts[2])
+		assert.NoError(t, StapleFeed(userHandler, stapler, service.FeedNext, atomFormat)(c))
+		return rec
+	}
+
+	urls := getFeeds(GetFeeds(userHandler), echo.GET)
+	assert.Equal(t, urls, getFeeds(GetFeeds(userHandler), echo.GET), "the token is stable")
+	assert.True(t, strings.HasPrefix(urls.NextAtom, "http://example.com/feeds/"))
+
+	rec := serve(urls.NextAtom, nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/atom+xml; charset=utf-8", rec.Header().Get(echo.HeaderContentType))
+	assert.Contains(t, rec.Body.String(), "https://example.com/head")
+	assert.NotContains(t, rec.Body.String(), "https://example.com/tail")
+	etag := rec.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+	assert.Equal(t, "Wed, 01 Jan 2020 00:00:00 GMT", rec.Header().Get(echo.HeaderLastModified))
+
+	rec = serve(urls.NextAtom, http.Header{"If-None-Match": {etag}})
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+	rec = serve(urls.NextAtom, http.Header{"If-Modified-Since": {"Wed, 01 Jan 2020 00:00:00 GMT"}})
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+	rec = serve(urls.NextAtom, http.Header{"If-Modified-Since": {"Tue, 31 Dec 2019 00:00:00 GMT"}})
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	assert.NoError(t, stapler.Archive(&testUser, 0))
+	rec = serve(urls.NextAtom, http.Header{"If-None-Match": {etag}})
+	assert.Equal(t, http.StatusOK, rec.Code, "archiving the head changes the feed")
+	assert.Contains(t, rec.Body.String(), "https://example.com/tail")
+	lastModified := rec.Header().Get(echo.HeaderLastModified)
+	assert.Equal(t, "Thu, 02 Jan 2020 00:00:00 GMT", lastModified)
+
+	// an older staple becoming the head moves the newest entry back in time
+	err = stapler.Create(models.Staple{Name: "Older", Content: "https://example.com/older", CreatedAt: time.Date(2019, 12, 1, 0, 0, 0, 0, time.UTC)}, &testUser)
+	assert.NoError(t, err)
+	rec = serve(urls.NextAtom, http.Header{"If-Modified-Since": {lastModified}})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "https://example.com/older")
+	assert.Empty(t, rec.Header().Get(echo.HeaderLastModified))
+	rec = serve(urls.NextAtom, nil)
+	assert.Equal(t, "Sun, 01 Dec 2019 00:00:00 GMT", rec.Header().Get(echo.HeaderLastModified))
+
+	regenerated := getFeeds(RegenerateFeeds(userHandler), echo.POST)
+	assert.NotEqual(t, urls, regenerated)
+	rec = serve(urls.NextAtom, nil)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	rec = serve(regenerated.NextAtom, nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
@@ -0,0 +1,431 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/labstack/echo/v4"
+
+	"github.com/staple-org/staple/internal/models"
+	"github.com/staple-org/staple/internal/service"
+	"github.com/staple-org/staple/pkg/config"
+)
+
+const (
+	// inboundCommandTimeout is how long the server waits for the next command.
+	inboundCommandTimeout = 5 * time.Minute
+	// inboundMaxRecipients limits the recipients of a single mail.
+	inboundMaxRecipients = 10
+	// defaultInboundMaxSize is used if no maximum message size is configured.
+	defaultInboundMaxSize = 10 << 20
+	// defaultInboundMaxConns is used if no maximum number of connections is configured.
+	defaultInboundMaxConns = 100
+	// inboundMaxLineLength bounds a line of a command or a message. RFC 5321 only allows
+	// 1000 characters, but mail in the wild has longer lines.
+	inboundMaxLineLength = 64 << 10
+)
+
+// errLineTooLong is returned by a lineLimitReader once a line is longer than its limit.
+var errLineTooLong = errors.New("line too long")
+
+// lineLimitReader fails once a line of the underlying reader is longer than max bytes, so
+// a client can't make the server buffer an endless line. The error is returned by every
+// read which follows.
+type lineLimitReader struct {
+	r   io.Reader
+	max int
+	n   int
+	err error
+}
+
+func (l *lineLimitReader) Read(p []byte) (int, error) {
+	if l.err != nil {
+		return 0, l.err
+	}
+	n, err := l.r.Read(p)
+	for i, b := range p[:n] {
+		if b == '\n' {
+			l.n = 0
+			continue
+		}
+		l.n++
+		if l.n > l.max {
+			l.err = errLineTooLong
+			return i, l.err
+		}
+	}
+	return n, err
+}
+
+// InboundSMTPServer is a minimal SMTP server which accepts mail for the secret inbox
+// addresses of users and turns every mail into a staple. It doesn't relay mail and
+// rejects every recipient which isn't an inbox address.
+type InboundSMTPServer struct {
+	// Domain is the domain part of the inbox addresses.
+	Domain string
+	// MaxSize is the maximum size of a message in bytes.
+	MaxSize int64
+	// MaxConns is the maximum number of connections served at the same time. Connections
+	// beyond it are refused with 421.
+	MaxConns int
+
+	users   service.UserHandlerer
+	stapler service.Staplerer
+
+	mu        sync.Mutex
+	listener  net.Listener
+	conns     map[net.Conn]struct{}
+	waitGroup sync.WaitGroup
+}
+
+// NewInboundSMTPServer creates a server for inbox addresses at domain.
+func NewInboundSMTPServer(domain string, users service.UserHandlerer, stapler service.Staplerer) *InboundSMTPServer {
+	return &InboundSMTPServer{
+		Domain:   strings.ToLower(domain),
+		MaxSize:  defaultInboundMaxSize,
+		MaxConns: defaultInboundMaxConns,
+		users:    users,
+		stapler:  stapler,
+		conns:    make(map[net.Conn]struct{}),
+	}
+}
+
+// ListenAndServe listens on addr and serves until ctx is done.
+func (s *InboundSMTPServer) ListenAndServe(ctx context.Context, addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		s.Close()
+	}()
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l until it is closed.
+func (s *InboundSMTPServer) Serve(l net.Listener) error {
+	s.mu.Lock()
+	s.listener = l
+	s.mu.Unlock()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		s.mu.Lock()
+		if len(s.conns) >= s.MaxConns {
+			s.mu.Unlock()
+			_ = conn.SetDeadline(time.Now().Add(time.Second))
+			_, _ = fmt.Fprintf(conn, "421 4.3.2 %s Too many connections, try again later\r\n", s.Domain)
+			conn.Close()
+			continue
+		}
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+		s.waitGroup.Add(1)
+		go func() {
+			defer s.waitGroup.Done()
+			s.handle(conn)
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// Close stops accepting connections, closes the open ones and waits for their handlers.
+func (s *InboundSMTPServer) Close() error {
+	s.mu.Lock()
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.waitGroup.Wait()
+	return err
+}
+
+// inboundSession is the state of a single SMTP conversation.
+type inboundSession struct {
+	helo string
+	// mail is set by MAIL FROM. The sender itself can be empty for bounces.
+	mail       bool
+	from       string
+	recipients []*models.User
+	// accepted holds the ids of the recipients.
+	accepted map[string]bool
+}
+
+func (s *InboundSMTPServer) handle(conn net.Conn) {
+	defer conn.Close()
+	tp := textproto.NewConn(struct {
+		io.Reader
+		io.WriteCloser
+	}{&lineLimitReader{r: conn, max: inboundMaxLineLength}, conn})
+	reply := func(code int, msg string) bool {
+		return tp.PrintfLine("%d %s", code, msg) == nil
+	}
+	if !reply(220, s.Domain+" ESMTP Staple") {
+		return
+	}
+	session := &inboundSession{}
+	for {
+		_ = conn.SetDeadline(time.Now().Add(inboundCommandTimeout))
+		line, err := tp.ReadLine()
+		if errors.Is(err, errLineTooLong) {
+			reply(500, "5.5.2 Line too long")
+			return
+		}
+		if err != nil {
+			return
+		}
+		verb, arg := line, ""
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			verb, arg = line[:i], strings.TrimSpace(line[i+1:])
+		}
+		switch strings.ToUpper(verb) {
+		case "HELO":
+			session = &inboundSession{helo: arg}
+			reply(250, s.Domain)
+		case "EHLO":
+			session = &inboundSession{helo: arg}
+			_ = tp.PrintfLine("250-%s", s.Domain)
+			_ = tp.PrintfLine("250-SIZE %d", s.MaxSize)
+			_ = tp.PrintfLine("250-8BITMIME")
+			reply(250, "ENHANCEDSTATUSCODES")
+		case "MAIL":
+			if session.helo == "" {
+				reply(503, "5.5.1 Send HELO or EHLO first")
+				continue
+			}
+			from, ok := smtpPath(arg, "FROM:")
+			if !ok {
+				reply(501, "5.5.4 Syntax: MAIL FROM:<address>")
+				continue
+			}
+			session.mail = true
+			session.from = from
+			session.recipients = nil
+			session.accepted = make(map[string]bool)
+			reply(250, "2.1.0 OK")
+		case "RCPT":
+			if !session.mail {
+				reply(503, "5.5.1 Send MAIL first")
+				continue
+			}
+			rcpt, ok := smtpPath(arg, "TO:")
+			if !ok {
+				reply(501, "5.5.4 Syntax: RCPT TO:<address>")
+				continue
+			}
+			if len(session.recipients) >= inboundMaxRecipients {
+				reply(452, "4.5.3 Too many recipients")
+				continue
+			}
+			user, err := s.recipient(rcpt)
+			if err != nil {
+				config.Opts.Logger.Error().Err(err).Msg("Failed to look up inbox recipient.")
+				reply(451, "4.3.0 Temporary failure, try again later")
+				continue
+			}
+			if user == nil {
+				reply(550, "5.1.1 No such mailbox")
+				continue
+			}
+			// Subaddresses of the same inbox get a single staple.
+			if session.accepted[user.ID] {
+				reply(250, "2.1.5 OK")
+				continue
+			}
+			// Full queues are refused per recipient, so the others still get the staple.
+			queued, err := s.stapler.List(user)
+			if err != nil {
+				config.Opts.Logger.Error().Err(err).Msg("Failed to check the queue of an inbox recipient.")
+				reply(451, "4.3.0 Temporary failure, try again later")
+				continue
+			}
+			if len(queued) >= user.MaxStaples {
+				reply(552, "5.2.2 Queue is full")
+				continue
+			}
+			session.recipients = append(session.recipients, user)
+			session.accepted[user.ID] = true
+			reply(250, "2.1.5 OK")
+		case "DATA":
+			if len(session.recipients) == 0 {
+				reply(503, "5.5.1 Send RCPT first")
+				continue
+			}
+			if !reply(354, "Start mail input; end with <CRLF>.<CRLF>") {
+				return
+			}
+			code, msg := s.deliver(session, tp.DotReader())
+			reply(code, msg)
+			session = &inboundSession{helo: session.helo}
+		case "RSET":
+			session = &inboundSession{helo: session.helo}
+			reply(250, "2.0.0 OK")
+		case "NOOP":
+			reply(250, "2.0.0 OK")
+		case "VRFY":
+			reply(252, "2.5.0 Cannot verify")
+		case "QUIT":
+			reply(221, "2.0.0 Bye")
+			return
+		default:
+			reply(502, "5.5.2 Command not implemented")
+		}
+	}
+}
+
+// recipient returns the user owning an inbox address or nil if the address is unknown.
+func (s *InboundSMTPServer) recipient(address string) (*models.User, error) {
+	at := strings.LastIndexByte(address, '@')
+	if at < 0 || !strings.EqualFold(address[at+1:], s.Domain) {
+		return nil, nil
+	}
+	// Subaddresses like token+newsletter@domain belong to the same inbox.
+	local := address[:at]
+	if plus := strings.IndexByte(local, '+'); plus >= 0 {
+		local = local[:plus]
+	}
+	return s.users.InboxUser(local)
+}
+
+// deliver reads the message and creates a staple for every recipient. Once a staple was
+// created the mail is accepted even if it fails for a later recipient, since the sender
+// would deliver it to every recipient again; the failures are logged.
+func (s *InboundSMTPServer) deliver(session *inboundSession, r io.Reader) (int, string) {
+	data, err := io.ReadAll(io.LimitReader(r, s.MaxSize+1))
+	if errors.Is(err, errLineTooLong) {
+		return 500, "5.5.2 Line too long"
+	}
+	if err != nil {
+		return 451, "4.3.0 Failed to read message"
+	}
+	if int64(len(data)) > s.MaxSize {
+		// Drain the rest so the connection stays usable.
+		_, _ = io.Copy(io.Discard, r)
+		return 552, "5.3.4 Message too big"
+	}
+	staple, err := service.ParseInboundMail(bytes.NewReader(data), time.Now().UTC())
+	if err != nil {
+		return 554, "5.6.0 " + strings.ReplaceAll(err.Error(), "\n", " ")
+	}
+	created := 0
+	for _, user := range session.recipients {
+		err := s.stapler.Create(staple, user)
+		if err == nil {
+			created++
+			continue
+		}
+		config.Opts.Logger.Error().Err(err).Str("user_id", user.ID).Msg("Failed to create staple from mail.")
+		if created > 0 {
+			continue
+		}
+		// Nothing was created yet, so the sender can safely try again.
+		var full *service.QueueFullError
+		if errors.As(err, &full) {
+			return 552, "5.2.2 Queue is full"
+		}
+		return 451, "4.3.0 Temporary failure, try again later"
+	}
+	return 250, fmt.Sprintf("2.0.0 Stapled %q", staple.Name)
+}
+
+// smtpPath extracts the address of a MAIL FROM or RCPT TO argument. Parameters after
+// the path such as SIZE are ignored.
+func smtpPath(arg, prefix string) (string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", false
+	}
+	path := strings.TrimSpace(arg[len(prefix):])
+	if i := strings.IndexByte(path, ' '); i >= 0 {
+		path = path[:i]
+	}
+	if !strings.HasPrefix(path, "<") || !strings.HasSuffix(path, ">") {
+		return "", false
+	}
+	return path[1 : len(path)-1], true
+}
+
+// inboxDomain is the domain part of inbox addresses.
+func inboxDomain() string {
+	if config.Opts.Inbound.Domain != "" {
+		return config.Opts.Inbound.Domain
+	}
+	return config.Opts.Hostname
+}
+
+// GetInbox returns the secret address staples can be mailed to. It answers 404 if this
+// server doesn't accept mail.
+func GetInbox(userHandler service.UserHandlerer) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token, err := GetToken(c)
+		if err != nil {
+			return err
+		}
+		claims := token.Claims.(jwt.MapClaims)
+		userID := claims["sub"].(string)
+		userModel := &models.User{
+			ID: userID,
+		}
+		if config.Opts.Inbound.Listen == "" {
+			apiError := config.APIError("mail to staple is not enabled", http.StatusNotFound, nil)
+			return c.JSON(http.StatusNotFound, apiError)
+		}
+		inboxToken, err := userHandler.InboxToken(*userModel)
+		if err != nil {
+			apiError := config.APIError("failed to get inbox", http.StatusInternalServerError, err)
+			return c.JSON(http.StatusInternalServerError, apiError)
+		}
+		return c.JSON(http.StatusOK, map[string]string{
+			"address": inboxToken + "@" + inboxDomain(),
+		})
+	}
+}
+
+// RegenerateInbox replaces the inbox address of the user. Mail to the old address is rejected.
+func RegenerateInbox(userHandler service.UserHandlerer) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token, err := GetToken(c)
+		if err != nil {
+			return err
+		}
+		claims := token.Claims.(jwt.MapClaims)
+		userID := claims["sub"].(string)
+		userModel := &models.User{
+			ID: userID,
+		}
+		if config.Opts.Inbound.Listen == "" {
+			apiError := config.APIError("mail to staple is not enabled", http.StatusNotFound, nil)
+			return c.JSON(http.StatusNotFound, apiError)
+		}
+		inboxToken, err := userHandler.RegenerateInboxToken(*userModel)
+		if err != nil {
+			apiError := config.APIError("failed to regenerate inbox", http.StatusInternalServerError, err)
+			return c.JSON(http.StatusInternalServerError, apiError)
+		}
+		audit(c, models.AuditEntry{UserID: userID, Action: models.AuditTokenCreated, Detail: "inbox"})
+		return c.JSON(http.StatusOK, map[string]string{
+			"address": inboxToken + "@" + inboxDomain(),
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package pkg
+
+import (
+	"context"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/staple-org/staple/internal/models"
+	"github.com/staple-org/staple/internal/service"
+	"github.com/staple-org/staple/internal/storage"
+)
+
+func TestInboundSMTPServer(t *testing.T) {
+	userHandler := service.NewUserHandler(context.Background(), storage.NewInMemoryUserStorer(), service.NewBufferNotifier())
+	stapler := service.NewStapler(storage.NewInMemoryStapleStorer())
+	testUser := models.User{Email: "test@test.com", Password: "password"}
+	err := userHandler.Register(testUser)
+	assert.NoError(t, err)
+	testUser.ID, err = userHandler.UserID(testUser)
+	assert.NoError(t, err)
+	assert.NoError(t, userHandler.SetMaximumStaples(testUser, 1))
+	inbox, err := userHandler.InboxToken(testUser)
+	assert.NoError(t, err)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	server := NewInboundSMTPServer("in.example.com", userHandler, stapler)
+	go func() { _ = server.Serve(l) }()
+	defer server.Close()
+
+	send := func(rcpt, body string) error {
+		c, err := smtp.Dial(l.Addr().String())
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		if err := c.Hello("client.example.com"); err != nil {
+			return err
+		}
+		if err := c.Mail("me@example.com"); err != nil {
+			return err
+		}
+		if err := c.Rcpt(rcpt); err != nil {
+			return err
+		}
+		w, err := c.Data()
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write([]byte(body)); err != nil {
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+		return c.Quit()
+	}
+	code := func(err error) int {
+		var tpErr *textproto.Error
+		if assert.ErrorAs(t, err, &tpErr) {
+			return tpErr.Code
+		}
+		return 0
+	}
+
+	err = send("nobody@in.example.com", "Subject: x\r\n\r\nx\r\n")
+	assert.Equal(t, 550, code(err))
+	err = send(inbox+"@elsewhere.example.com", "Subject: x\r\n\r\nx\r\n")
+	assert.Equal(t, 550, code(err))
+
+	err = send(inbox+"+news@IN.example.com", "Subject: Read later\r\n\r\nSee https://example.com/article\r\n")
+	assert.NoError(t, err)
+	next, err := stapler.GetNext(&models.User{ID: testUser.ID})
+	assert.NoError(t, err)
+	assert.Equal(t, "Read later", next.Name)
+	assert.Equal(t, "https://example.com/article", next.Content)
+
+	err = send(inbox+"@in.example.com", "Subject: One too many\r\n\r\nhttps://example.com/2\r\n")
+	assert.Equal(t, 552, code(err))
+
+	// A regenerated inbox rejects mail to the old address.
+	_, err = userHandler.RegenerateInboxToken(testUser)
+	assert.NoError(t, err)
+	err = send(inbox+"@in.example.com", "Subject: x\r\n\r\nx\r\n")
+	assert.Equal(t, 550, code(err))
+}
+
+func TestInboundSMTPServer_Limits(t *testing.T) {
+	userHandler := service.NewUserHandler(context.Background(), storage.NewInMemoryUserStorer(), service.NewBufferNotifier())
+	stapler := service.NewStapler(storage.NewInMemoryStapleStorer())
+	inboxes := make([]string, 0, 2)
+	users := make([]*models.User, 0, 2)
+	for _, email := range []string{"roomy@test.com", "full@test.com"} {
+		u := models.User{Email: email, Password: "password"}
+		assert.NoError(t, userHandler.Register(u))
+		id, err := userHandler.UserID(u)
+		assert.NoError(t, err)
+		u.ID = id
+		inbox, err := userHandler.InboxToken(u)
+		assert.NoError(t, err)
+		inboxes = append(inboxes, inbox)
+		users = append(users, &models.User{ID: id})
+	}
+	assert.NoError(t, userHandler.SetMaximumStaples(models.User{ID: users[1].ID, Email: "full@test.com"}, 1))
+	assert.NoError(t, stapler.Create(models.Staple{Name: "already there"}, &models.User{ID: users[1].ID, MaxStaples: 1}))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	server := NewInboundSMTPServer("in.example.com", userHandler, stapler)
+	server.MaxConns = 1
+	go func() { _ = server.Serve(l) }()
+	defer server.Close()
+
+	conn, err := textproto.Dial("tcp", l.Addr().String())
+	assert.NoError(t, err)
+	defer conn.Close()
+	cmd := func(expect int, format string, args ...interface{}) {
+		id, err := conn.Cmd(format, args...)
+		assert.NoError(t, err)
+		conn.StartResponse(id)
+		defer conn.EndResponse(id)
+		_, _, err = conn.ReadResponse(expect)
+		assert.NoError(t, err, format)
+	}
+	_, _, err = conn.ReadResponse(220)
+	assert.NoError(t, err)
+
+	// Further connections are refused.
+	other, err := textproto.Dial("tcp", l.Addr().String())
+	assert.NoError(t, err)
+	_, _, err = other.ReadResponse(220)
+	var tpErr *textproto.Error
+	if assert.ErrorAs(t, err, &tpErr) {
+		assert.Equal(t, 421, tpErr.Code)
+	}
+	other.Close()
+
+	// A full queue is refused before the message is sent, the other recipient gets it once.
+	cmd(250, "HELO client.example.com")
+	cmd(250, "MAIL FROM:<me@example.com>")
+	cmd(250, "RCPT TO:<%s@in.example.com>", inboxes[0])
+	cmd(250, "RCPT TO:<%s+news@in.example.com>", inboxes[0])
+	cmd(552, "RCPT TO:<%s@in.example.com>", inboxes[1])
+	cmd(354, "DATA")
+	cmd(250, "Subject: Shared\r\n\r\nhttps://example.com/shared\r\n.")
+	list, err := stapler.List(users[0])
+	assert.NoError(t, err)
+	assert.Len(t, list, 1)
+
+	// An endless line closes the connection.
+	cmd(500, "NOOP %s", strings.Repeat("x", inboundMaxLineLength))
+	_, err = conn.ReadLine()
+	assert.Error(t, err)
+}
@@ -0,0 +1,92 @@
+package pkg
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/labstack/echo/v4"
+
+	"github.com/staple-org/staple/internal/i18n"
+	"github.com/staple-org/staple/internal/models"
+	"github.com/staple-org/staple/internal/service"
+	"github.com/staple-org/staple/pkg/config"
+)
+
+// LocalizedJSONSerializer translates the message of API errors into the language the
+// request asks for with Accept-Language. The error itself stays in English.
+type LocalizedJSONSerializer struct {
+	echo.DefaultJSONSerializer
+}
+
+// Serialize encodes i as JSON, translating it first if it is a config.Message.
+func (s LocalizedJSONSerializer) Serialize(c echo.Context, i interface{}, indent string) error {
+	if m, ok := i.(config.Message); ok {
+		locale := i18n.Negotiate(c.Request().Header.Get("Accept-Language"))
+		m.Message = i18n.Translate(locale, m.Message)
+		c.Response().Header().Set("Content-Language", locale)
+		c.Response().Header().Add(echo.HeaderVary, "Accept-Language")
+		i = m
+	}
+	return s.DefaultJSONSerializer.Serialize(c, i, indent)
+}
+
+// SetLocale changes the language of the user's notifications. The following property is
+// used: locale, such as de.
+func SetLocale(userHandler service.UserHandlerer) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token, err := GetToken(c)
+		if err != nil {
+			return err
+		}
+		claims := token.Claims.(jwt.MapClaims)
+		userID := claims["sub"].(string)
+		userModel := &models.User{
+			ID: userID,
+		}
+		var request = struct {
+			Locale string `json:"locale"`
+		}{}
+		if err := c.Bind(&request); err != nil {
+			return err
+		}
+		err = userHandler.SetLocale(*userModel, request.Locale)
+		switch {
+		case errors.Is(err, service.ErrUnsupportedLocale):
+			apiError := config.APIError("unsupported locale", http.StatusBadRequest, err)
+			return c.JSON(http.StatusBadRequest, apiError)
+		case err != nil:
+			apiError := config.APIError("failed to set locale", http.StatusInternalServerError, err)
+			return c.JSON(http.StatusInternalServerError, apiError)
+		}
+		return c.NoContent(http.StatusOK)
+	}
+}
+
+// GetLocale returns the language of the user's notifications and the supported languages.
+func GetLocale(userHandler service.UserHandlerer) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token, err := GetToken(c)
+		if err != nil {
+			return err
+		}
+		claims := token.Claims.(jwt.MapClaims)
+		userID := claims["sub"].(string)
+		userModel := &models.User{
+			ID: userID,
+		}
+		locale, err := userHandler.GetLocale(*userModel)
+		if err != nil {
+			apiError := config.APIError("failed to get locale", http.StatusInternalServerError, err)
+			return c.JSON(http.StatusInternalServerError, apiError)
+		}
+		var response = struct {
+			Locale    string   `json:"locale"`
+			Supported []string `json:"supported"`
+		}{
+			Locale:    locale,
+			Supported: i18n.Locales(),
+		}
+		return c.JSON(http.StatusOK, response)
+	}
+}
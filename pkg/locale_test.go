@@ -0,0 +1,118 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/staple-org/staple/internal/i18n"
+	"github.com/staple-org/staple/internal/models"
+	"github.com/staple-org/staple/internal/service"
+	"github.com/staple-org/staple/internal/storage"
+	"github.com/staple-org/staple/pkg/config"
+)
+
+func TestLocalizedJSONSerializer(t *testing.T) {
+	e := echo.New()
+	e.JSONSerializer = LocalizedJSONSerializer{}
+	handler := func(c echo.Context) error {
+		return c.JSON(http.StatusNotFound, config.APIError("staple not found", http.StatusNotFound, nil))
+	}
+
+	for header, want := range map[string]string{
+		"de-AT,de;q=0.9,en;q=0.5": "Staple nicht gefunden",
+		"fr":                      "staple not found",
+		"":                        "staple not found",
+	} {
+		req := httptest.NewRequest(echo.GET, "/", nil)
+		req.Header.Set("Accept-Language", header)
+		rec := httptest.NewRecorder()
+		assert.NoError(t, handler(e.NewContext(req, rec)))
+		var m config.Message
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &m))
+		assert.Equal(t, want, m.Message, header)
+	}
+
+	// Other responses are left alone.
+	req := httptest.NewRequest(echo.GET, "/", nil)
+	req.Header.Set("Accept-Language", "de")
+	rec := httptest.NewRecorder()
+	assert.NoError(t, e.NewContext(req, rec).JSON(http.StatusOK, map[string]string{"message": "staple not found"}))
+	assert.Contains(t, rec.Body.String(), "staple not found")
+	assert.Empty(t, rec.Header().Get("Content-Language"))
+}
+
+// Every API error message needs a translation in every locale.
+func TestAPIErrorTranslations(t *testing.T) {
+	files, err := filepath.Glob("*.go")
+	assert.NoError(t, err)
+	literal := regexp.MustCompile(`(?:config\.APIError|tooManyRequests)\((?:c, )?"([^"]+)"`)
+	for _, file := range files {
+		if strings.HasSuffix(file, "_test.go") {
+			continue
+		}
+		src, err := os.ReadFile(file)
+		assert.NoError(t, err)
+		for _, m := range literal.FindAllStringSubmatch(string(src), -1) {
+			// Messages with a dynamic part can't be translated.
+			if strings.HasSuffix(m[1], ": ") {
+				continue
+			}
+			for _, locale := range i18n.Locales()[1:] {
+				assert.NotEqual(t, m[1], i18n.Translate(locale, m[1]), "%s: %q has no %s translation", file, m[1], locale)
+			}
+		}
+	}
+}
+
+func TestLocaleHandlers(t *testing.T) {
+	userHandler := service.NewUserHandler(context.Background(), storage.NewInMemoryUserStorer(), service.NewBufferNotifier())
+	config.Opts.GlobalTokenKey = "test"
+	e := echo.New()
+
+	testUser := models.User{Email: "test@test.com", Password: "password"}
+	err := userHandler.Register(testUser)
+	assert.NoError(t, err)
+	testUser.ID, err = userHandler.UserID(testUser)
+	assert.NoError(t, err)
+	tok, err := generateToken(testUser.ID)
+	assert.NoError(t, err)
+
+	request := func(method, body string, handler echo.HandlerFunc) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/rest/api/1/user/locale", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+tok)
+		rec := httptest.NewRecorder()
+		assert.NoError(t, handler(e.NewContext(req, rec)))
+		return rec
+	}
+	var response struct {
+		Locale    string   `json:"locale"`
+		Supported []string `json:"supported"`
+	}
+
+	rec := request(echo.GET, "", GetLocale(userHandler))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+	assert.Equal(t, "en", response.Locale)
+	assert.Contains(t, response.Supported, "de")
+
+	rec = request(echo.POST, `{"locale": "de-CH"}`, SetLocale(userHandler))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	rec = request(echo.GET, "", GetLocale(userHandler))
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+	assert.Equal(t, "de", response.Locale)
+
+	rec = request(echo.POST, `{"locale": "klingon"}`, SetLocale(userHandler))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
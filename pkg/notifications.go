@@ -0,0 +1,74 @@
+package pkg
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/labstack/echo/v4"
+
+	"github.com/staple-org/staple/internal/models"
+	"github.com/staple-org/staple/internal/service"
+	"github.com/staple-org/staple/pkg/config"
+)
+
+// notificationPreferences is the response of the notification preference endpoints.
+type notificationPreferences struct {
+	Channels    []string                        `json:"channels"`
+	Preferences []models.NotificationPreference `json:"preferences"`
+}
+
+// GetNotificationPreferences returns the notification preferences of the user for every
+// event and the channels which can be chosen.
+func GetNotificationPreferences(dispatcher service.NotificationDispatcher) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token, err := GetToken(c)
+		if err != nil {
+			return err
+		}
+		claims := token.Claims.(jwt.MapClaims)
+		userID := claims["sub"].(string)
+		userModel := &models.User{
+			ID: userID,
+		}
+		prefs, err := dispatcher.Preferences(*userModel)
+		if err != nil {
+			apiError := config.APIError("failed to get notification preferences", http.StatusInternalServerError, err)
+			return c.JSON(http.StatusInternalServerError, apiError)
+		}
+		return c.JSON(http.StatusOK, notificationPreferences{Channels: dispatcher.Channels(), Preferences: prefs})
+	}
+}
+
+// UpdateNotificationPreferences changes the notification preferences of the user for the
+// given events. The following property is used: preferences, a list of event, channels and
+// frequency (immediate, at-most-daily or off). Security events can't be turned off.
+func UpdateNotificationPreferences(dispatcher service.NotificationDispatcher) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token, err := GetToken(c)
+		if err != nil {
+			return err
+		}
+		claims := token.Claims.(jwt.MapClaims)
+		userID := claims["sub"].(string)
+		userModel := &models.User{
+			ID: userID,
+		}
+		var request = struct {
+			Preferences []models.NotificationPreference `json:"preferences"`
+		}{}
+		if err := c.Bind(&request); err != nil {
+			return err
+		}
+		prefs, err := dispatcher.UpdatePreferences(*userModel, request.Preferences)
+		switch {
+		case errors.Is(err, service.ErrInvalidNotificationPreferences):
+			apiError := config.APIError("failed to update notification preferences", http.StatusBadRequest, err)
+			return c.JSON(http.StatusBadRequest, apiError)
+		case err != nil:
+			apiError := config.APIError("failed to update notification preferences", http.StatusInternalServerError, err)
+			return c.JSON(http.StatusInternalServerError, apiError)
+		}
+		return c.JSON(http.StatusOK, notificationPreferences{Channels: dispatcher.Channels(), Preferences: prefs})
+	}
+}
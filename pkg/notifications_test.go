@@ -0,0 +1,65 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/staple-org/staple/internal/models"
+	"github.com/staple-org/staple/internal/service"
+	"github.com/staple-org/staple/internal/storage"
+	"github.com/staple-org/staple/pkg/config"
+)
+
+func TestNotificationPreferenceHandlers(t *testing.T) {
+	notifier := service.NewBufferNotifier()
+	userStore := storage.NewInMemoryUserStorer()
+	dispatcher := service.NewNotificationDispatcher(storage.NewInMemoryNotificationPreferenceStorer(), userStore, service.Channels{service.ChannelEmail: notifier})
+	userHandler := service.NewUserHandler(context.Background(), userStore, dispatcher)
+	config.Opts.GlobalTokenKey = "test"
+	e := echo.New()
+
+	testUser := models.User{Email: "test@test.com", Password: "password"}
+	err := userHandler.Register(testUser)
+	assert.NoError(t, err)
+	testUser.ID, err = userHandler.UserID(testUser)
+	assert.NoError(t, err)
+	tok, err := generateToken(testUser.ID)
+	assert.NoError(t, err)
+
+	request := func(method, body string, handler echo.HandlerFunc) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/rest/api/1/user/notifications", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+tok)
+		rec := httptest.NewRecorder()
+		assert.NoError(t, handler(e.NewContext(req, rec)))
+		return rec
+	}
+	var response struct {
+		Channels    []string                        `json:"channels"`
+		Preferences []models.NotificationPreference `json:"preferences"`
+	}
+
+	rec := request(echo.GET, "", GetNotificationPreferences(dispatcher))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+	assert.Equal(t, []string{"email"}, response.Channels)
+	assert.Equal(t, "welcome", response.Preferences[0].Event)
+	assert.Equal(t, models.NotifyImmediately, response.Preferences[0].Frequency)
+
+	rec = request(echo.POST, `{"preferences": [{"event": "queue-digest", "frequency": "off"}]}`, UpdateNotificationPreferences(dispatcher))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+	assert.Equal(t, "queue-digest", response.Preferences[1].Event)
+	assert.Equal(t, models.NotifyOff, response.Preferences[1].Frequency)
+
+	// Security events can't be turned off.
+	rec = request(echo.POST, `{"preferences": [{"event": "password-reset", "frequency": "off"}]}`, UpdateNotificationPreferences(dispatcher))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
@@ -0,0 +1,146 @@
+package pkg
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/labstack/echo/v4"
+
+	"github.com/staple-org/staple/internal/models"
+	"github.com/staple-org/staple/internal/service"
+	"github.com/staple-org/staple/pkg/config"
+)
+
+const (
+	// oidcStatePurpose marks a token as holding the state of an OpenID Connect login.
+	oidcStatePurpose = "oidc"
+	// oidcStateExpiry is the time a user has to log in at the identity provider.
+	oidcStateExpiry = 10 * time.Minute
+	// oidcCookie holds the signed state, nonce and PKCE verifier during a login.
+	oidcCookie = "staple_oidc"
+)
+
+// OIDCLogin redirects the user to the identity provider. The state, nonce and PKCE verifier
+// are kept in a signed cookie so any replica can handle the callback.
+func OIDCLogin(auth service.OIDCAuthenticator) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		state, err := service.NewPKCEVerifier()
+		if err != nil {
+			return err
+		}
+		nonce, err := service.NewPKCEVerifier()
+		if err != nil {
+			return err
+		}
+		verifier, err := service.NewPKCEVerifier()
+		if err != nil {
+			return err
+		}
+		redirect, err := auth.AuthCodeURL(state, nonce, verifier)
+		if err != nil {
+			config.Opts.Logger.Error().Err(err).Msg("Failed to discover identity provider")
+			apiError := config.APIError("identity provider unavailable", http.StatusBadGateway, err)
+			return c.JSON(http.StatusBadGateway, apiError)
+		}
+		cookie, err := generatePurposeToken(oidcStatePurpose, oidcStateExpiry, jwt.MapClaims{
+			"state":    state,
+			"nonce":    nonce,
+			"verifier": verifier,
+		})
+		if err != nil {
+			return err
+		}
+		c.SetCookie(&http.Cookie{
+			Name:     oidcCookie,
+			Value:    cookie,
+			Path:     "/",
+			MaxAge:   int(oidcStateExpiry.Seconds()),
+			HttpOnly: true,
+			Secure:   c.IsTLS(),
+			SameSite: http.SameSiteLaxMode,
+		})
+		return c.Redirect(http.StatusFound, redirect)
+	}
+}
+
+// OIDCCallback completes the login at the identity provider and issues a Staple token.
+// Locked users are rejected, and users with two-factor authentication get a challenge
+// for MFATokenHandler like after a password login.
+func OIDCCallback(auth service.OIDCAuthenticator, userHandler service.UserHandlerer) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if e := c.QueryParam("error"); e != "" {
+			apiError := config.APIError("identity provider returned an error: "+e, http.StatusUnauthorized, nil)
+			return c.JSON(http.StatusUnauthorized, apiError)
+		}
+		cookie, err := c.Cookie(oidcCookie)
+		if err != nil {
+			apiError := config.APIError("missing login state", http.StatusBadRequest, nil)
+			return c.JSON(http.StatusBadRequest, apiError)
+		}
+		// The state is single use.
+		c.SetCookie(&http.Cookie{Name: oidcCookie, Path: "/", MaxAge: -1})
+		token, err := parseToken(cookie.Value)
+		if err != nil {
+			apiError := config.APIError("invalid login state", http.StatusBadRequest, err)
+			return c.JSON(http.StatusBadRequest, apiError)
+		}
+		claims := token.Claims.(jwt.MapClaims)
+		state, _ := claims["state"].(string)
+		nonce, _ := claims["nonce"].(string)
+		verifier, _ := claims["verifier"].(string)
+		if claims["purpose"] != oidcStatePurpose || state == "" || state != c.QueryParam("state") {
+			apiError := config.APIError("invalid login state", http.StatusBadRequest, nil)
+			return c.JSON(http.StatusBadRequest, apiError)
+		}
+		code := c.QueryParam("code")
+		if code == "" {
+			apiError := config.APIError("missing code", http.StatusBadRequest, nil)
+			return c.JSON(http.StatusBadRequest, apiError)
+		}
+		idToken, err := auth.Exchange(code, verifier, nonce)
+		if err != nil {
+			config.Opts.Logger.Error().Err(err).Msg("Failed to exchange code")
+			apiError := config.APIError("failed to verify identity", http.StatusUnauthorized, err)
+			return c.JSON(http.StatusUnauthorized, apiError)
+		}
+		user, err := auth.Login(*idToken)
+		if err != nil {
+			apiError := config.APIError("failed to log in", http.StatusForbidden, err)
+			return c.JSON(http.StatusForbidden, apiError)
+		}
+		if handled, err := rejectLocked(c, userHandler, *user); handled {
+			return err
+		}
+		if ok, err := userHandler.IsTOTPEnabled(*user); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"message": "error while checking two-factor authentication: " + err.Error(),
+			})
+		} else if ok {
+			profile, err := userHandler.Profile(*user)
+			if err != nil {
+				config.Opts.Logger.Error().Err(err).Msg("Failed to get user.")
+				return err
+			}
+			challenge, err := generateChallengeToken(user.ID, profile.Email)
+			if err != nil {
+				config.Opts.Logger.Error().Err(err).Msg("Failed to generate challenge token.")
+				return err
+			}
+			return c.JSON(http.StatusOK, map[string]interface{}{
+				"mfa_required": true,
+				"challenge":    challenge,
+			})
+		}
+		t, err := generateToken(user.ID)
+		if err != nil {
+			config.Opts.Logger.Error().Err(err).Msg("Failed to generate token.")
+			return err
+		}
+		audit(c, models.AuditEntry{UserID: user.ID, Action: models.AuditLogin, Detail: "oidc"})
+		notifyLogin(c, userHandler, user.ID)
+		return c.JSON(http.StatusOK, map[string]string{
+			"token": t,
+		})
+	}
+}
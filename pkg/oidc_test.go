@@ -0,0 +1,240 @@
+package pkg
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/staple-org/staple/internal/models"
+	"github.com/staple-org/staple/internal/service"
+	"github.com/staple-org/staple/internal/storage"
+	"github.com/staple-org/staple/pkg/config"
+)
+
+// mockOIDCProvider is a minimal OpenID Connect provider which issues a code for a single
+// authorization request.
+type mockOIDCProvider struct {
+	server    *httptest.Server
+	key       *rsa.PrivateKey
+	challenge string
+	nonce     string
+	email     string
+}
+
+func newMockOIDCProvider(t *testing.T) *mockOIDCProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockOIDCProvider{key: key, email: "test@test.com"}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 m.server.URL,
+			"authorization_endpoint": m.server.URL + "/authorize",
+			"token_endpoint":         m.server.URL + "/token",
+			"jwks_uri":               m.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "test",
+				"alg": "RS256",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("code") != "good-code" || service.PKCEChallenge(r.FormValue("code_verifier")) != m.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+			"iss":            m.server.URL,
+			"sub":            "subject-1",
+			"aud":            "staple",
+			"exp":            time.Now().Add(time.Minute).Unix(),
+			"nonce":          m.nonce,
+			"email":          m.email,
+			"email_verified": true,
+		})
+		token.Header["kid"] = "test"
+		idToken, err := token.SignedString(key)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"id_token": idToken, "token_type": "Bearer"})
+	})
+	m.server = httptest.NewServer(mux)
+	return m
+}
+
+func TestOIDCLogin(t *testing.T) {
+	provider := newMockOIDCProvider(t)
+	defer provider.server.Close()
+	config.Opts.GlobalTokenKey = "test"
+
+	// Provisioned users get a random password which doesn't have to satisfy the policy.
+	userHandler := service.NewUserHandler(context.Background(), storage.NewInMemoryUserStorer(), service.NewBufferNotifier()).
+		WithPasswordPolicy(service.PasswordPolicy{MinLength: 40, MinClasses: 4})
+	e := echo.New()
+
+	login := func(auth service.OIDCAuthenticator, state string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(echo.GET, "/rest/api/1/oidc/login", nil)
+		rec := httptest.NewRecorder()
+		err := OIDCLogin(auth)(e.NewContext(req, rec))
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusFound, rec.Code)
+		location, err := url.Parse(rec.Header().Get("Location"))
+		assert.NoError(t, err)
+		assert.Equal(t, "S256", location.Query().Get("code_challenge_method"))
+		provider.challenge = location.Query().Get("code_challenge")
+		provider.nonce = location.Query().Get("nonce")
+		if state == "" {
+			state = location.Query().Get("state")
+		}
+
+		req = httptest.NewRequest(echo.GET, "/rest/api/1/oidc/callback?code=good-code&state="+url.QueryEscape(state), nil)
+		for _, cookie := range rec.Result().Cookies() {
+			req.AddCookie(cookie)
+		}
+		rec = httptest.NewRecorder()
+		err = OIDCCallback(auth, userHandler)(e.NewContext(req, rec))
+		assert.NoError(t, err)
+		return rec
+	}
+
+	t.Run("unknown users are rejected without auto provisioning", func(tt *testing.T) {
+		auth := service.NewOIDCAuthenticator(service.OIDCConfig{
+			Issuer:      provider.server.URL,
+			ClientID:    "staple",
+			RedirectURL: "http://localhost/rest/api/1/oidc/callback",
+		}, provider.server.Client(), storage.NewInMemoryIdentityStorer(), userHandler)
+		rec := login(auth, "")
+		assert.Equal(tt, http.StatusForbidden, rec.Code)
+	})
+
+	t.Run("state mismatch", func(tt *testing.T) {
+		auth := service.NewOIDCAuthenticator(service.OIDCConfig{
+			Issuer:        provider.server.URL,
+			ClientID:      "staple",
+			RedirectURL:   "http://localhost/rest/api/1/oidc/callback",
+			AutoProvision: true,
+		}, provider.server.Client(), storage.NewInMemoryIdentityStorer(), userHandler)
+		rec := login(auth, "forged")
+		assert.Equal(tt, http.StatusBadRequest, rec.Code)
+	})
+
+	t.Run("wrong audience", func(tt *testing.T) {
+		auth := service.NewOIDCAuthenticator(service.OIDCConfig{
+			Issuer:        provider.server.URL,
+			ClientID:      "other-client",
+			RedirectURL:   "http://localhost/rest/api/1/oidc/callback",
+			AutoProvision: true,
+		}, provider.server.Client(), storage.NewInMemoryIdentityStorer(), userHandler)
+		rec := login(auth, "")
+		assert.Equal(tt, http.StatusUnauthorized, rec.Code)
+	})
+
+	t.Run("auto provisioning and linking", func(tt *testing.T) {
+		identities := storage.NewInMemoryIdentityStorer()
+		auth := service.NewOIDCAuthenticator(service.OIDCConfig{
+			Issuer:        provider.server.URL,
+			ClientID:      "staple",
+			RedirectURL:   "http://localhost/rest/api/1/oidc/callback",
+			AutoProvision: true,
+		}, provider.server.Client(), identities, userHandler)
+		rec := login(auth, "")
+		assert.Equal(tt, http.StatusOK, rec.Code)
+		var resp struct {
+			Token string `json:"token"`
+		}
+		err := json.Unmarshal(rec.Body.Bytes(), &resp)
+		assert.NoError(tt, err)
+		token, err := parseToken(resp.Token)
+		assert.NoError(tt, err)
+		id, err := userHandler.UserID(models.User{Email: "test@test.com"})
+		assert.NoError(tt, err)
+		assert.NotEmpty(tt, id)
+		assert.Equal(tt, id, token.Claims.(jwt.MapClaims)["sub"])
+		linked, err := identities.Find(provider.server.URL, "subject-1")
+		assert.NoError(tt, err)
+		assert.Equal(tt, id, linked)
+
+		// the linked identity keeps working even if the email at the provider changes
+		provider.email = "changed@test.com"
+		rec = login(auth, "")
+		assert.Equal(tt, http.StatusOK, rec.Code)
+		err = json.Unmarshal(rec.Body.Bytes(), &resp)
+		assert.NoError(tt, err)
+		token, err = parseToken(resp.Token)
+		assert.NoError(tt, err)
+		assert.Equal(tt, id, token.Claims.(jwt.MapClaims)["sub"])
+	})
+
+	newAuth := func() service.OIDCAuthenticator {
+		provider.email = "test@test.com"
+		return service.NewOIDCAuthenticator(service.OIDCConfig{
+			Issuer:      provider.server.URL,
+			ClientID:    "staple",
+			RedirectURL: "http://localhost/rest/api/1/oidc/callback",
+		}, provider.server.Client(), storage.NewInMemoryIdentityStorer(), userHandler)
+	}
+	user := models.User{Email: "test@test.com"}
+
+	t.Run("locked users are rejected", func(tt *testing.T) {
+		config.Opts.Lockout.Threshold = 1
+		config.Opts.Lockout.Duration = time.Hour
+		defer func() {
+			config.Opts.Lockout.Threshold = 0
+			config.Opts.Lockout.Duration = 0
+		}()
+		_, err := userHandler.RecordLoginFailure(user)
+		assert.NoError(tt, err)
+		rec := login(newAuth(), "")
+		assert.Equal(tt, http.StatusTooManyRequests, rec.Code)
+		assert.NotContains(tt, rec.Body.String(), "token")
+		assert.NoError(tt, userHandler.ResetLoginFailures(user))
+	})
+
+	t.Run("two-factor users get a challenge", func(tt *testing.T) {
+		secret, _, err := userHandler.EnrollTOTP(user)
+		assert.NoError(tt, err)
+		code, err := service.GenerateTOTPCode(secret, time.Now())
+		assert.NoError(tt, err)
+		_, err = userHandler.ConfirmTOTP(user, code)
+		assert.NoError(tt, err)
+
+		rec := login(newAuth(), "")
+		assert.Equal(tt, http.StatusOK, rec.Code)
+		var resp struct {
+			MFARequired bool   `json:"mfa_required"`
+			Challenge   string `json:"challenge"`
+			Token       string `json:"token"`
+		}
+		err = json.Unmarshal(rec.Body.Bytes(), &resp)
+		assert.NoError(tt, err)
+		assert.True(tt, resp.MFARequired)
+		assert.NotEmpty(tt, resp.Challenge)
+		assert.Empty(tt, resp.Token)
+		token, err := parseToken(resp.Challenge)
+		assert.NoError(tt, err)
+		assert.Equal(tt, "test@test.com", token.Claims.(jwt.MapClaims)["email"])
+	})
+}
@@ -0,0 +1,78 @@
+package pkg
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/staple-org/staple/internal/service"
+	"github.com/staple-org/staple/pkg/config"
+)
+
+// clientIPExtractor returns how the address of a client is determined. X-Forwarded-For is
+// only followed through the given comma separated CIDR ranges of trusted proxies; without
+// any the address of the connection is used, since clients can send any header they like.
+func clientIPExtractor(trustedProxies string) (echo.IPExtractor, error) {
+	if strings.TrimSpace(trustedProxies) == "" {
+		return echo.ExtractIPDirect(), nil
+	}
+	options := []echo.TrustOption{echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false)}
+	for _, cidr := range strings.Split(trustedProxies, ",") {
+		_, ipRange, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy range %q: %w", cidr, err)
+		}
+		options = append(options, echo.TrustIPRange(ipRange))
+	}
+	return echo.ExtractIPFromXFFHeader(options...), nil
+}
+
+// RateLimitByIP rejects requests from an IP address which made too many requests.
+func RateLimitByIP(limiter service.RateLimiter) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			ok, retryAfter, err := limiter.Allow("ip:" + c.RealIP())
+			if err != nil {
+				config.Opts.Logger.Error().Err(err).Msg("Failed to check rate limit")
+				apiError := config.APIError("failed to check rate limit", http.StatusInternalServerError, err)
+				return c.JSON(http.StatusInternalServerError, apiError)
+			}
+			if !ok {
+				return tooManyRequests(c, "too many requests", retryAfter)
+			}
+			return next(c)
+		}
+	}
+}
+
+// limitEmail checks the rate limit for a given email address. If the request isn't allowed
+// the response has already been written and handled is true.
+func limitEmail(c echo.Context, limiter service.RateLimiter, email string) (handled bool, err error) {
+	ok, retryAfter, err := limiter.Allow("email:" + email)
+	if err != nil {
+		config.Opts.Logger.Error().Err(err).Msg("Failed to check rate limit")
+		apiError := config.APIError("failed to check rate limit", http.StatusInternalServerError, err)
+		return true, c.JSON(http.StatusInternalServerError, apiError)
+	}
+	if !ok {
+		return true, tooManyRequests(c, "too many requests", retryAfter)
+	}
+	return false, nil
+}
+
+// tooManyRequests responds with 429 and a Retry-After header in seconds.
+func tooManyRequests(c echo.Context, message string, retryAfter time.Duration) error {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	c.Response().Header().Set("Retry-After", strconv.Itoa(seconds))
+	apiError := config.APIError(message, http.StatusTooManyRequests, nil)
+	return c.JSON(http.StatusTooManyRequests, apiError)
+}
@@ -0,0 +1,31 @@
+package pkg
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientIPExtractor(t *testing.T) {
+	req := httptest.NewRequest("POST", "/rest/api/1/get-token", nil)
+	req.RemoteAddr = "10.0.0.2:1234"
+	req.Header.Set("X-Forwarded-For", "203.0.113.9, 198.51.100.7")
+	req.Header.Set("X-Real-IP", "203.0.113.9")
+
+	// Without trusted proxies the headers are ignored.
+	direct, err := clientIPExtractor("")
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.2", direct(req))
+
+	// Only trusted proxies are skipped.
+	trusted, err := clientIPExtractor("10.0.0.0/8, 198.51.100.0/24")
+	assert.NoError(t, err)
+	assert.Equal(t, "203.0.113.9", trusted(req))
+	proxyOnly, err := clientIPExtractor("10.0.0.0/8")
+	assert.NoError(t, err)
+	assert.Equal(t, "198.51.100.7", proxyOnly(req))
+
+	_, err = clientIPExtractor("10.0.0.0")
+	assert.Error(t, err)
+}
@@ -7,6 +7,7 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/rs/zerolog"
 
@@ -19,14 +20,58 @@ import (
 	"github.com/staple-org/staple/pkg/config"
 )
 
+const (
+	// accountDeletionPurgeInterval is how often accounts whose deletion is due are purged.
+	accountDeletionPurgeInterval = time.Hour
+	// outboxRelayInterval is how often the event outbox is published.
+	outboxRelayInterval = 5 * time.Second
+	// rateLimitPruneInterval is how often idle rate limit buckets are removed.
+	rateLimitPruneInterval = 10 * time.Minute
+	// auditRetentionInterval is how often audit entries older than the retention are purged.
+	auditRetentionInterval = time.Hour
+	// trashPurgeInterval is how often staples older than the trash retention are purged.
+	trashPurgeInterval = time.Hour
+)
+
 // Serve starts the Stapler API server.
 func Serve() error {
 	// Echo instance
 	e := echo.New()
+	// API error messages are translated into the language of the request.
+	e.JSONSerializer = LocalizedJSONSerializer{}
 	// Register the template renderer
 
-	// Setup Global Token Key
-	if config.Opts.GlobalTokenKey == "" {
+	// Setup Logger
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+	zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	if config.Opts.Debug {
+		zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	}
+	config.Opts.Logger = zerolog.New(os.Stdout)
+
+	// Setup token signing keys
+	ctx := context.Background()
+	switch {
+	case config.Opts.TokenKeys.Dir != "":
+		keys, err := service.LoadKeySet(config.Opts.TokenKeys.Dir, config.Opts.TokenKeys.Grace)
+		if err != nil {
+			return err
+		}
+		if config.Opts.TokenKeys.RotationInterval > 0 {
+			if _, err := keys.RotateIfOlderThan(config.Opts.TokenKeys.RotationInterval); err != nil {
+				return err
+			}
+			go keys.RunRotation(ctx, config.Opts.TokenKeys.RotationInterval)
+		} else if _, err := keys.SigningKey(); err != nil {
+			return fmt.Errorf("no token signing key found in %s: %w", config.Opts.TokenKeys.Dir, err)
+		}
+		if config.Opts.TokenKeys.Grace < tokenExpiry {
+			config.Opts.Logger.Warn().Dur("grace", config.Opts.TokenKeys.Grace).Msg("Token key grace period is shorter than the token lifetime; rotated keys will invalidate tokens early.")
+		}
+		tokenKeySet = keys
+	case config.Opts.GlobalTokenKey != "":
+		config.Opts.Logger.Warn().Msg("Signing tokens with the shared global token key. Consider --token-key-dir instead.")
+	case config.Opts.DevMode:
 		config.Opts.Logger.Info().Msg("Please set a global secret key... Randomly generating one for now...")
 		b := make([]byte, 32)
 		_, err := rand.Read(b)
@@ -35,60 +80,251 @@ func Serve() error {
 		}
 		state := base64.StdEncoding.EncodeToString(b)
 		config.Opts.GlobalTokenKey = state
+	default:
+		return errors.New("either --token-key-dir or --token-key must be set outside of dev mode")
 	}
 
-	// Setup Logger
-	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
-	zerolog.SetGlobalLevel(zerolog.InfoLevel)
-	if config.Opts.Debug {
-		zerolog.SetGlobalLevel(zerolog.DebugLevel)
-	}
-	config.Opts.Logger = zerolog.New(os.Stdout)
-
 	if e := config.Opts.Logger.Debug(); e.Enabled() {
 		config.Opts.Logger.Debug().Interface("config", config.Opts).Msg("Debugging enabled...")
 	}
 
 	config.Opts.Logger.Info().Msg("Starting listener...")
 
+	ipExtractor, err := clientIPExtractor(config.Opts.TrustedProxies)
+	if err != nil {
+		return err
+	}
+	e.IPExtractor = ipExtractor
+
 	// Middleware
 	e.Use(middleware.Logger())
 	e.Use(middleware.Recover())
 	e.Use(middleware.CORS())
+	// Handlers note account and staple actions for the audit log.
+	auditLog := service.NewAuditLog(storage.NewPostgresAuditStorer()).WithRetention(config.Opts.Audit.Retention)
+	e.Use(Audit(auditLog, ipExtractor))
+
+	// Side effects subscribe to the events of users and staples.
+	events := service.NewEventBus()
 
 	// Register a user.
-	ctx := context.Background()
 	postgresUserStorer := storage.NewPostgresUserStorer()
-	emailNotifier := service.NewEmailNotifier()
-	userHandler := service.NewUserHandler(ctx, postgresUserStorer, emailNotifier)
+	mailRenderer, err := service.NewMailRenderer(config.Opts.Mailer.TemplateDir)
+	if err != nil {
+		return err
+	}
+	// Mails are rendered in the language of their recipient.
+	mailRenderer = mailRenderer.WithUsers(postgresUserStorer)
+	var notifier service.Notifier = service.NewEmailNotifier().WithRenderer(mailRenderer)
+	if config.Opts.SMTP.Host != "" {
+		from := config.Opts.SMTP.From
+		if from == "" {
+			from = "no-reply@" + config.Opts.Hostname
+		}
+		smtpNotifier, err := service.NewSMTPNotifier(service.SMTPConfig{
+			Host:     config.Opts.SMTP.Host,
+			Port:     config.Opts.SMTP.Port,
+			Username: config.Opts.SMTP.Username,
+			Password: config.Opts.SMTP.Password,
+			Security: service.SMTPSecurity(config.Opts.SMTP.Security),
+			From:     from,
+		})
+		if err != nil {
+			return err
+		}
+		defer smtpNotifier.Close()
+		notifier = smtpNotifier.WithRenderer(mailRenderer)
+	}
+	// Notifications are stored and sent in the background, so a failing mail provider
+	// doesn't fail the requests.
+	notifications := service.NewNotificationOutbox(storage.NewPostgresNotificationStorer(), notifier).WithMaxAttempts(config.Opts.Notifications.MaxAttempts)
+	// Users can have notifications posted to their chats as well.
+	chats := service.NewChats(storage.NewPostgresChatTargetStorer(), postgresUserStorer)
+	for _, kind := range service.ChatKinds {
+		notifications = notifications.WithChannel(kind, chats.Notifier(kind))
+	}
+	// Every event is routed to the channels the user chose for it.
+	dispatcher := service.NewNotificationDispatcher(storage.NewPostgresNotificationPreferenceStorer(), postgresUserStorer, notifications, service.ChatKinds...)
+	passwordPolicy := service.PasswordPolicy{
+		MinLength:  config.Opts.PasswordPolicy.MinLength,
+		MinClasses: config.Opts.PasswordPolicy.MinClasses,
+	}
+	if config.Opts.PasswordPolicy.BreachedDir != "" {
+		passwordPolicy.Breaches = service.NewHIBPChecker(config.Opts.PasswordPolicy.BreachedDir)
+	}
+	userHandler := service.NewUserHandler(ctx, postgresUserStorer, dispatcher).WithPasswordPolicy(passwordPolicy).WithEvents(events)
 	api := "/rest/api/1"
 
+	// Rate limit the authentication endpoints by IP and by email.
+	var rateLimitStorer storage.RateLimitStorer
+	switch config.Opts.RateLimit.Backend {
+	case "postgres":
+		rateLimitStorer = storage.NewPostgresRateLimitStorer()
+	case "memory", "":
+		rateLimitStorer = storage.NewInMemoryRateLimitStorer()
+	default:
+		return fmt.Errorf("unknown rate limit backend: %s", config.Opts.RateLimit.Backend)
+	}
+	limiter := service.NewTokenBucketLimiter(rateLimitStorer, config.Opts.RateLimit.PerMinute, config.Opts.RateLimit.Burst)
+	limitByIP := RateLimitByIP(limiter)
+	go limiter.RunPruning(ctx, rateLimitPruneInterval)
+
+	// Public keys to verify tokens.
+	e.GET("/.well-known/jwks.json", JWKS())
+
 	e.POST(api+"/register", RegisterUser(userHandler))
 	// Generate a token for a given username.
-	e.POST(api+"/get-token", TokenHandler(userHandler))
+	e.POST(api+"/get-token", TokenHandler(userHandler, limiter), limitByIP)
+	// Exchange a two-factor challenge and code for a token.
+	e.POST(api+"/get-token/mfa", MFATokenHandler(userHandler, limiter), limitByIP)
+
+	// Log in with an external OpenID Connect identity provider.
+	if config.Opts.OIDC.Issuer != "" {
+		oidc := service.NewOIDCAuthenticator(service.OIDCConfig{
+			Issuer:        config.Opts.OIDC.Issuer,
+			ClientID:      config.Opts.OIDC.ClientID,
+			ClientSecret:  config.Opts.OIDC.ClientSecret,
+			RedirectURL:   config.Opts.OIDC.RedirectURL,
+			AutoProvision: config.Opts.OIDC.AutoProvision,
+		}, nil, storage.NewPostgresIdentityStorer(), userHandler)
+		e.GET(api+"/oidc/login", OIDCLogin(oidc), limitByIP)
+		e.GET(api+"/oidc/callback", OIDCCallback(oidc, userHandler), limitByIP)
+	}
 
 	// Reset Password Flow
-	e.POST(api+"/reset", ResetPassword(userHandler))
-	e.POST(api+"/verify", VerfiyConfirmCode(userHandler))
+	e.POST(api+"/reset", ResetPassword(userHandler, limiter), limitByIP)
+	e.POST(api+"/verify", VerfiyConfirmCode(userHandler, limiter), limitByIP)
 
 	//gob.Register(map[string]interface{}{})
 	postgresStapleStorer := storage.NewPostgresStapleStorer()
-	stapler := service.NewStapler(postgresStapleStorer)
+	if config.Opts.Events.Outbox {
+		postgresStapleStorer = postgresStapleStorer.WithOutbox()
+	}
+	stapler := service.NewStapler(postgresStapleStorer).WithEvents(events).WithTrashRetention(config.Opts.Trash.Retention)
+	webhooks := service.NewWebhooks(storage.NewPostgresWebhookStorer())
+	webhooks.SubscribeTo(events)
+	stats := service.NewStats(storage.NewPostgresStatsStorer())
+	stats.SubscribeTo(events)
 
 	// REST api group
-	g := e.Group(api+"/staple", middleware.JWT([]byte(config.Opts.GlobalTokenKey)))
+	requireToken := middleware.JWTWithConfig(middleware.JWTConfig{KeyFunc: tokenKeyFunc})
+	rejectRevoked := RejectRevokedTokens(userHandler)
+	g := e.Group(api+"/staple", requireToken, rejectRevoked)
 	g.POST("", AddStaple(stapler, userHandler))
 	g.POST("/:id/archive", ArchiveStaple(stapler))
 	g.GET("/:id", GetStaple(stapler))
 	g.GET("/next", GetNext(stapler))
 	g.DELETE("/:id", DeleteStaple(stapler))
 	g.GET("/archive", ShowArchive(stapler))
+	g.GET("/trash", ListTrash(stapler))
+	g.POST("/:id/restore", RestoreStaple(stapler, userHandler))
 	g.GET("", ListStaples(stapler))
+	importer := service.NewImporter(stapler)
+	g.POST("/import", ImportStaples(importer, userHandler))
+	g.GET("/import/:id", GetImportJob(importer))
+	g.GET("/export", ExportStaples(stapler))
 
-	u := e.Group(api+"/user", middleware.JWT([]byte(config.Opts.GlobalTokenKey)))
+	u := e.Group(api+"/user", requireToken, rejectRevoked)
 	u.POST("/change-password", ChangePassword(userHandler))
 	u.POST("/max-staples", SetMaximumStaples(userHandler))
 	u.GET("/max-staples", GetMaximumStaples(userHandler))
+	u.GET("/locale", GetLocale(userHandler))
+	u.POST("/locale", SetLocale(userHandler))
+	u.POST("/totp/enroll", EnrollTOTP(userHandler))
+	u.POST("/totp/confirm", ConfirmTOTP(userHandler))
+	u.POST("/totp/disable", DisableTOTP(userHandler))
+	u.POST("/change-email", ChangeEmail(userHandler))
+	u.POST("/change-email/confirm", ConfirmEmailChange(userHandler))
+	u.POST("/delete", DeleteAccount(userHandler))
+	u.POST("/delete/cancel", CancelAccountDeletion(userHandler))
+	u.GET("/feeds", GetFeeds(userHandler))
+	u.POST("/feeds", RegenerateFeeds(userHandler))
+	u.GET("/inbox", GetInbox(userHandler))
+	u.POST("/inbox", RegenerateInbox(userHandler))
+	subscriber := service.NewSubscriber(storage.NewPostgresSubscriptionStorer(), stapler, userHandler)
+	digests := service.NewDigests(storage.NewPostgresDigestStorer(), stapler, userHandler, dispatcher)
+	u.GET("/export", ExportAccount(userHandler, stapler, digests, dispatcher, chats, webhooks, subscriber))
+	u.GET("/subscriptions", ListSubscriptions(subscriber))
+	u.POST("/subscriptions", Subscribe(subscriber))
+	u.PATCH("/subscriptions/:id", UpdateSubscription(subscriber))
+	u.DELETE("/subscriptions/:id", Unsubscribe(subscriber))
+	u.GET("/digest", GetDigestSettings(digests))
+	u.POST("/digest", UpdateDigestSettings(digests))
+	u.GET("/stats", GetStats(stats))
+	u.GET("/activity", ListActivity(auditLog))
+	u.GET("/notifications", GetNotificationPreferences(dispatcher))
+	u.POST("/notifications", UpdateNotificationPreferences(dispatcher))
+	u.GET("/chats", ListChats(chats))
+	u.POST("/chats", SetChat(chats))
+	u.DELETE("/chats/:kind", DeleteChat(chats))
+	u.POST("/chats/:kind/test", TestChat(chats))
+	u.GET("/webhooks", ListWebhooks(webhooks))
+	u.POST("/webhooks", CreateWebhook(webhooks))
+	u.DELETE("/webhooks/:id", DeleteWebhook(webhooks))
+	u.GET("/webhooks/:id/deliveries", ListWebhookDeliveries(webhooks))
+	u.POST("/webhooks/:id/test", TestWebhook(webhooks))
+
+	// Admin endpoints are authenticated by the admin token instead of user tokens.
+	if config.Opts.AdminToken != "" {
+		a := e.Group(api+"/admin", AdminAuth(config.Opts.AdminToken))
+		a.GET("/notifications", ListNotifications(notifications))
+		a.POST("/notifications/:id/redrive", RedriveNotification(notifications))
+		a.GET("/activity", ListAllActivity(auditLog))
+	}
+
+	// Personal feeds are authenticated by the secret token in the URL.
+	e.GET("/feeds/:token/next.atom", StapleFeed(userHandler, stapler, service.FeedNext, atomFormat))
+	e.GET("/feeds/:token/next.rss", StapleFeed(userHandler, stapler, service.FeedNext, rssFormat))
+	e.GET("/feeds/:token/archive.atom", StapleFeed(userHandler, stapler, service.FeedArchive, atomFormat))
+	e.GET("/feeds/:token/archive.rss", StapleFeed(userHandler, stapler, service.FeedArchive, rssFormat))
+
+	// Delete accounts whose grace period has passed.
+	if config.Opts.AccountDeletion.Grace > 0 {
+		go userHandler.RunDeletionPurge(ctx, accountDeletionPurgeInterval)
+	}
+	// Purge audit entries older than the retention.
+	if config.Opts.Audit.Retention > 0 {
+		go auditLog.RunRetention(ctx, auditRetentionInterval)
+	}
+	// Purge staples which have been in the trash for longer than the retention.
+	if config.Opts.Trash.Retention > 0 {
+		go stapler.RunTrashPurge(ctx, trashPurgeInterval)
+	}
+	// Add new entries of subscribed feeds to the queues.
+	if config.Opts.Subscriptions.Interval > 0 {
+		go subscriber.RunPolling(ctx, config.Opts.Subscriptions.Interval)
+	}
+	// Publish the events recorded in the outbox.
+	if config.Opts.Events.Outbox {
+		go service.NewOutboxRelay(storage.NewPostgresOutboxStorer(), events).RunRelay(ctx, outboxRelayInterval)
+	}
+	// Send notifications and retry failed ones.
+	if config.Opts.Notifications.Interval > 0 {
+		go notifications.RunWorkers(ctx, config.Opts.Notifications.Workers, config.Opts.Notifications.Interval)
+	}
+	// Send queue digests and reading reminders.
+	if config.Opts.Digests.Interval > 0 {
+		go digests.RunScheduler(ctx, config.Opts.Digests.Interval)
+	}
+	// Post webhook events and retry failed deliveries.
+	if config.Opts.Webhooks.Interval > 0 {
+		go webhooks.RunDeliveries(ctx, config.Opts.Webhooks.Interval)
+	}
+	// Accept mail for inbox addresses.
+	if config.Opts.Inbound.Listen != "" {
+		inbound := NewInboundSMTPServer(inboxDomain(), userHandler, stapler)
+		if config.Opts.Inbound.MaxSize > 0 {
+			inbound.MaxSize = config.Opts.Inbound.MaxSize
+		}
+		if config.Opts.Inbound.MaxConns > 0 {
+			inbound.MaxConns = config.Opts.Inbound.MaxConns
+		}
+		go func() {
+			if err := inbound.ListenAndServe(ctx, config.Opts.Inbound.Listen); err != nil {
+				config.Opts.Logger.Error().Err(err).Msg("Inbound SMTP listener stopped.")
+			}
+		}()
+	}
 
 	hostPort := fmt.Sprintf("%s:%s", config.Opts.Hostname, config.Opts.Port)
 	// Start TLS with certificate paths
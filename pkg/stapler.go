@@ -2,8 +2,13 @@ package pkg
 
 import (
 	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt"
@@ -24,9 +29,9 @@ func AddStaple(stapler service.Staplerer, userHandler service.UserHandlerer) ech
 			return err
 		}
 		claims := token.Claims.(jwt.MapClaims)
-		email := claims["email"].(string)
+		userID := claims["sub"].(string)
 		userModel := &models.User{
-			Email: email,
+			ID: userID,
 		}
 		maximumStaples, err := userHandler.GetMaximumStaples(*userModel)
 		if err != nil {
@@ -40,12 +45,16 @@ func AddStaple(stapler service.Staplerer, userHandler service.UserHandlerer) ech
 			apiError := config.APIError("failed to bind body", http.StatusInternalServerError, err)
 			return c.JSON(http.StatusInternalServerError, apiError)
 		}
+		// New staples always go to the queue, whatever the body says.
+		staple.Archived = false
+		staple.ArchivedAt = nil
 		staple.CreatedAt = time.Now().UTC()
 		err = stapler.Create(*staple, userModel)
 		if err != nil {
 			apiError := config.APIError("Unable to create staple for user.", http.StatusInternalServerError, err)
 			return c.JSON(http.StatusInternalServerError, apiError)
 		}
+		audit(c, models.AuditEntry{UserID: userID, Action: models.AuditStapleCreated, Detail: staple.Name})
 		return c.NoContent(http.StatusOK)
 	}
 }
@@ -58,9 +67,9 @@ func GetNext(staple service.Staplerer) echo.HandlerFunc {
 			return err
 		}
 		claims := token.Claims.(jwt.MapClaims)
-		email := claims["email"].(string)
+		userID := claims["sub"].(string)
 		userModel := &models.User{
-			Email: email,
+			ID: userID,
 		}
 		s, err := staple.GetNext(userModel)
 		if err != nil {
@@ -84,9 +93,9 @@ func GetStaple(stapler service.Staplerer) echo.HandlerFunc {
 			return err
 		}
 		claims := token.Claims.(jwt.MapClaims)
-		email := claims["email"].(string)
+		userID := claims["sub"].(string)
 		userModel := &models.User{
-			Email: email,
+			ID: userID,
 		}
 		id := c.Param("id")
 		if id == "" {
@@ -124,9 +133,9 @@ func ListStaples(stapler service.Staplerer) echo.HandlerFunc {
 			return err
 		}
 		claims := token.Claims.(jwt.MapClaims)
-		email := claims["email"].(string)
+		userID := claims["sub"].(string)
 		userModel := &models.User{
-			Email: email,
+			ID: userID,
 		}
 		s, err := stapler.List(userModel)
 		if err != nil {
@@ -150,9 +159,9 @@ func ShowArchive(stapler service.Staplerer) echo.HandlerFunc {
 			return err
 		}
 		claims := token.Claims.(jwt.MapClaims)
-		email := claims["email"].(string)
+		userID := claims["sub"].(string)
 		userModel := &models.User{
-			Email: email,
+			ID: userID,
 		}
 		s, err := stapler.ShowArchive(userModel)
 		if err != nil {
@@ -168,7 +177,7 @@ func ShowArchive(stapler service.Staplerer) echo.HandlerFunc {
 	}
 }
 
-// DeleteStaple deteles a staple with a given ID.
+// DeleteStaple moves a staple with a given ID to the trash.
 func DeleteStaple(stapler service.Staplerer) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		// Get user ID from context.. Call delete.
@@ -177,9 +186,9 @@ func DeleteStaple(stapler service.Staplerer) echo.HandlerFunc {
 			return err
 		}
 		claims := token.Claims.(jwt.MapClaims)
-		email := claims["email"].(string)
+		userID := claims["sub"].(string)
 		userModel := &models.User{
-			Email: email,
+			ID: userID,
 		}
 		id := c.Param("id")
 		if id == "" {
@@ -190,11 +199,20 @@ func DeleteStaple(stapler service.Staplerer) echo.HandlerFunc {
 			apiError := config.APIError("failed to convert id to number", http.StatusInternalServerError, err)
 			return c.JSON(http.StatusInternalServerError, apiError)
 		}
+		// The name is kept in the audit log so it is clear what was deleted.
+		s, err := stapler.Get(userModel, n)
+		if err != nil {
+			apiError := config.APIError("Unable to delete staple.", http.StatusInternalServerError, err)
+			return c.JSON(http.StatusInternalServerError, apiError)
+		}
 		err = stapler.Delete(userModel, n)
 		if err != nil {
 			apiError := config.APIError("Unable to delete staple.", http.StatusInternalServerError, err)
 			return c.JSON(http.StatusInternalServerError, apiError)
 		}
+		if s != nil {
+			audit(c, models.AuditEntry{UserID: userID, Action: models.AuditStapleDeleted, StapleID: n, Detail: s.Name})
+		}
 		return c.NoContent(http.StatusOK)
 	}
 }
@@ -208,9 +226,9 @@ func ArchiveStaple(stapler service.Staplerer) echo.HandlerFunc {
 			return err
 		}
 		claims := token.Claims.(jwt.MapClaims)
-		email := claims["email"].(string)
+		userID := claims["sub"].(string)
 		userModel := &models.User{
-			Email: email,
+			ID: userID,
 		}
 		id := c.Param("id")
 		if id == "" {
@@ -226,6 +244,205 @@ func ArchiveStaple(stapler service.Staplerer) echo.HandlerFunc {
 			apiError := config.APIError("Unable to delete staple.", http.StatusInternalServerError, err)
 			return c.JSON(http.StatusInternalServerError, apiError)
 		}
+		audit(c, models.AuditEntry{UserID: userID, Action: models.AuditStapleArchived, StapleID: n})
 		return c.NoContent(http.StatusOK)
 	}
 }
+
+// ListTrash returns the staples in the trash of a user, the most recently deleted first.
+func ListTrash(stapler service.Staplerer) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token, err := GetToken(c)
+		if err != nil {
+			return err
+		}
+		claims := token.Claims.(jwt.MapClaims)
+		userID := claims["sub"].(string)
+		userModel := &models.User{
+			ID: userID,
+		}
+		s, err := stapler.Trash(userModel)
+		if err != nil {
+			apiError := config.APIError("failed to list the trash", http.StatusInternalServerError, err)
+			return c.JSON(http.StatusInternalServerError, apiError)
+		}
+		var staples = struct {
+			Staples []models.Staple `json:"staples"`
+		}{
+			Staples: s,
+		}
+		return c.JSON(http.StatusOK, staples)
+	}
+}
+
+// RestoreStaple takes a staple with a given ID out of the trash and returns it. A staple of
+// the queue can't be restored into a full queue.
+func RestoreStaple(stapler service.Staplerer, userHandler service.UserHandlerer) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token, err := GetToken(c)
+		if err != nil {
+			return err
+		}
+		claims := token.Claims.(jwt.MapClaims)
+		userID := claims["sub"].(string)
+		userModel := &models.User{
+			ID: userID,
+		}
+		n, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			apiError := config.APIError("invalid id", http.StatusBadRequest, err)
+			return c.JSON(http.StatusBadRequest, apiError)
+		}
+		maximumStaples, err := userHandler.GetMaximumStaples(*userModel)
+		if err != nil {
+			apiError := config.APIError("failed to get maximum staples for user", http.StatusInternalServerError, err)
+			return c.JSON(http.StatusInternalServerError, apiError)
+		}
+		userModel.MaxStaples = maximumStaples
+		staple, err := stapler.Restore(userModel, n)
+		var full *service.QueueFullError
+		switch {
+		case errors.Is(err, service.ErrNotInTrash):
+			apiError := config.APIError("staple not found in the trash", http.StatusNotFound, err)
+			return c.JSON(http.StatusNotFound, apiError)
+		case errors.As(err, &full):
+			apiError := config.APIError("failed to restore staple", http.StatusConflict, err)
+			return c.JSON(http.StatusConflict, apiError)
+		case err != nil:
+			apiError := config.APIError("failed to restore staple", http.StatusInternalServerError, err)
+			return c.JSON(http.StatusInternalServerError, apiError)
+		}
+		audit(c, models.AuditEntry{UserID: userID, Action: models.AuditStapleRestored, StapleID: n, Detail: staple.Name})
+		return c.JSON(http.StatusOK, staple)
+	}
+}
+
+// maxImportSize is the largest file which can be imported.
+const maxImportSize = 10 << 20
+
+// ImportStaples starts importing an export of another service in the background. The file is
+// either the request body or the "file" field of a multipart form. The response contains the
+// import job whose progress can be followed with GetImportJob.
+func ImportStaples(importer *service.Importer, userHandler service.UserHandlerer) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token, err := GetToken(c)
+		if err != nil {
+			return err
+		}
+		claims := token.Claims.(jwt.MapClaims)
+		userID := claims["sub"].(string)
+		userModel := &models.User{
+			ID: userID,
+		}
+		maximumStaples, err := userHandler.GetMaximumStaples(*userModel)
+		if err != nil {
+			apiError := config.APIError("failed to get maximum staples for user", http.StatusInternalServerError, err)
+			return c.JSON(http.StatusInternalServerError, apiError)
+		}
+		userModel.MaxStaples = maximumStaples
+
+		format := service.ImportFormat(c.QueryParam("format"))
+		var body io.Reader = c.Request().Body
+		if strings.HasPrefix(c.Request().Header.Get(echo.HeaderContentType), echo.MIMEMultipartForm) {
+			file, err := c.FormFile("file")
+			if err != nil {
+				apiError := config.APIError("missing file", http.StatusBadRequest, err)
+				return c.JSON(http.StatusBadRequest, apiError)
+			}
+			if format == service.ImportAuto {
+				format = importFormatFromFilename(file.Filename)
+			}
+			f, err := file.Open()
+			if err != nil {
+				apiError := config.APIError("failed to open file", http.StatusBadRequest, err)
+				return c.JSON(http.StatusBadRequest, apiError)
+			}
+			defer f.Close()
+			body = f
+		}
+		data, err := ioutil.ReadAll(io.LimitReader(body, maxImportSize+1))
+		if err != nil {
+			apiError := config.APIError("failed to read file", http.StatusBadRequest, err)
+			return c.JSON(http.StatusBadRequest, apiError)
+		}
+		if len(data) > maxImportSize {
+			apiError := config.APIError("file is too large", http.StatusRequestEntityTooLarge, nil)
+			return c.JSON(http.StatusRequestEntityTooLarge, apiError)
+		}
+
+		job, err := importer.Start(*userModel, format, data, service.OverflowPolicy(c.QueryParam("overflow")))
+		if err != nil {
+			apiError := config.APIError("failed to import file", http.StatusBadRequest, err)
+			return c.JSON(http.StatusBadRequest, apiError)
+		}
+		c.Response().Header().Set(echo.HeaderLocation, c.Request().URL.Path+"/"+job.ID)
+		return c.JSON(http.StatusAccepted, job)
+	}
+}
+
+// GetImportJob returns the progress and the error report of an import.
+func GetImportJob(importer *service.Importer) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token, err := GetToken(c)
+		if err != nil {
+			return err
+		}
+		claims := token.Claims.(jwt.MapClaims)
+		userID := claims["sub"].(string)
+		userModel := &models.User{
+			ID: userID,
+		}
+		job, ok := importer.Job(*userModel, c.Param("id"))
+		if !ok {
+			apiError := config.APIError("import not found", http.StatusNotFound, nil)
+			return c.JSON(http.StatusNotFound, apiError)
+		}
+		return c.JSON(http.StatusOK, job)
+	}
+}
+
+// ExportStaples streams the staples of the user as a file download. The format query
+// parameter is one of json, csv, html or markdown and the scope one of queue, archive or all.
+func ExportStaples(stapler service.Staplerer) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token, err := GetToken(c)
+		if err != nil {
+			return err
+		}
+		claims := token.Claims.(jwt.MapClaims)
+		userID := claims["sub"].(string)
+		userModel := &models.User{
+			ID: userID,
+		}
+		format, scope, err := service.ValidateExport(service.ExportFormat(c.QueryParam("format")), service.ExportScope(c.QueryParam("scope")))
+		if err != nil {
+			apiError := config.APIError("invalid export parameters", http.StatusBadRequest, err)
+			return c.JSON(http.StatusBadRequest, apiError)
+		}
+
+		filename := fmt.Sprintf("staples-%s-%s.%s", scope, time.Now().UTC().Format("2006-01-02"), format.Extension())
+		c.Response().Header().Set(echo.HeaderContentType, format.ContentType())
+		c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="%s"`, filename))
+		c.Response().WriteHeader(http.StatusOK)
+		// The status has been sent already, so the connection is aborted to show the
+		// client that the file is incomplete.
+		if err := stapler.Export(userModel, format, scope, c.Response()); err != nil {
+			config.Opts.Logger.Error().Err(err).Str("user_id", userID).Msg("Failed to export staples.")
+			panic(http.ErrAbortHandler)
+		}
+		return nil
+	}
+}
+
+// importFormatFromFilename guesses the import format from the extension of an uploaded file.
+func importFormatFromFilename(name string) service.ImportFormat {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".html", ".htm":
+		return service.ImportHTML
+	case ".csv":
+		return service.ImportCSV
+	case ".json":
+		return service.ImportJSON
+	}
+	return service.ImportAuto
+}
@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"io/ioutil"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -25,6 +27,7 @@ func TestListStaples(t *testing.T) {
 	stapleHandler := service.NewStapler(inMemoryStapleStore)
 	e := echo.New()
 	testUser := models.User{
+		ID:          "5f0b7a9e-8e3c-4c1e-9a57-2d0f4c3b6a11",
 		Email:       "test@test.com",
 		Password:    "password",
 		ConfirmCode: "",
@@ -44,7 +47,7 @@ func TestListStaples(t *testing.T) {
 
 	// Set claims
 	claims := token.Claims.(jwt.MapClaims)
-	claims["email"] = testUser.Email // from context
+	claims["sub"] = testUser.ID // from context
 	claims["admin"] = true
 	claims["exp"] = time.Now().Add(time.Hour * 72).Unix()
 
@@ -92,6 +95,7 @@ func TestAddStaples(t *testing.T) {
 		MaxStaples:  25,
 	}
 	userHandler.Register(testUser)
+	testUser.ID, _ = userHandler.UserID(testUser)
 
 	config.Opts.GlobalTokenKey = "test"
 	// Create token
@@ -99,7 +103,7 @@ func TestAddStaples(t *testing.T) {
 
 	// Set claims
 	claims := token.Claims.(jwt.MapClaims)
-	claims["email"] = testUser.Email // from context
+	claims["sub"] = testUser.ID // from context
 	claims["admin"] = true
 	claims["exp"] = time.Now().Add(time.Hour * 72).Unix()
 
@@ -142,6 +146,21 @@ func TestAddStaples(t *testing.T) {
 		assert.Equal(tt, "testcreate", staple.Staple.Name)
 		assert.Equal(tt, "testcontent", staple.Staple.Content)
 	})
+	t.Run("new staples can't skip the queue", func(tt *testing.T) {
+		req := httptest.NewRequest(echo.POST, "/rest/api/1/staple", bytes.NewBuffer([]byte(`{"name": "archived", "content":"testcontent", "archived": true}`)))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+tok)
+		rec := httptest.NewRecorder()
+		err = AddStaple(stapleHandler, userHandler)(e.NewContext(req, rec))
+		assert.NoError(tt, err)
+		assert.Equal(tt, http.StatusOK, rec.Code)
+		archive, err := stapleHandler.ShowArchive(&testUser)
+		assert.NoError(tt, err)
+		assert.Empty(tt, archive)
+		queue, err := stapleHandler.List(&testUser)
+		assert.NoError(tt, err)
+		assert.Len(tt, queue, 2)
+	})
 }
 
 func TestDeleteStaples(t *testing.T) {
@@ -149,6 +168,7 @@ func TestDeleteStaples(t *testing.T) {
 	stapleHandler := service.NewStapler(inMemoryStapleStore)
 	e := echo.New()
 	testUser := models.User{
+		ID:          "5f0b7a9e-8e3c-4c1e-9a57-2d0f4c3b6a11",
 		Email:       "test@test.com",
 		Password:    "password",
 		ConfirmCode: "",
@@ -168,7 +188,7 @@ func TestDeleteStaples(t *testing.T) {
 
 	// Set claims
 	claims := token.Claims.(jwt.MapClaims)
-	claims["email"] = testUser.Email // from context
+	claims["sub"] = testUser.ID // from context
 	claims["admin"] = true
 	claims["exp"] = time.Now().Add(time.Hour * 72).Unix()
 
@@ -211,6 +231,7 @@ func TestArchiveStaples(t *testing.T) {
 	stapleHandler := service.NewStapler(inMemoryStapleStore)
 	e := echo.New()
 	testUser := models.User{
+		ID:          "5f0b7a9e-8e3c-4c1e-9a57-2d0f4c3b6a11",
 		Email:       "test@test.com",
 		Password:    "password",
 		ConfirmCode: "",
@@ -230,7 +251,7 @@ func TestArchiveStaples(t *testing.T) {
 
 	// Set claims
 	claims := token.Claims.(jwt.MapClaims)
-	claims["email"] = testUser.Email // from context
+	claims["sub"] = testUser.ID // from context
 	claims["admin"] = true
 	claims["exp"] = time.Now().Add(time.Hour * 72).Unix()
 
@@ -288,3 +309,185 @@ func TestArchiveStaples(t *testing.T) {
 		assert.Equal(tt, "TestContent", list.Staples[0].Content)
 	})
 }
+
+func TestImportStaples(t *testing.T) {
+	inMemoryUserStore := storage.NewInMemoryUserStorer()
+	userHandler := service.NewUserHandler(context.Background(), inMemoryUserStore, service.NewBufferNotifier())
+	stapler := service.NewStapler(storage.NewInMemoryStapleStorer())
+	importer := service.NewImporter(stapler)
+	config.Opts.GlobalTokenKey = "test"
+	e := echo.New()
+
+	testUser := models.User{Email: "test@test.com", Password: "password"}
+	err := userHandler.Register(testUser)
+	assert.NoError(t, err)
+	testUser.ID, err = userHandler.UserID(testUser)
+	assert.NoError(t, err)
+	tok, err := generateToken(testUser.ID)
+	assert.NoError(t, err)
+
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	part, err := form.CreateFormFile("file", "pocket.csv")
+	assert.NoError(t, err)
+	_, err = part.Write([]byte("title,url,time_added,tags,status\nRead later,https://example.com,1500000000,,unread\n"))
+	assert.NoError(t, err)
+	assert.NoError(t, form.Close())
+
+	req := httptest.NewRequest(echo.POST, "/rest/api/1/staple/import", body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+tok)
+	rec := httptest.NewRecorder()
+	err = ImportStaples(importer, userHandler)(e.NewContext(req, rec))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+	var job service.ImportJob
+	err = json.Unmarshal(rec.Body.Bytes(), &job)
+	assert.NoError(t, err)
+	assert.Equal(t, "/rest/api/1/staple/import/"+job.ID, rec.Header().Get(echo.HeaderLocation))
+
+	assert.Eventually(t, func() bool {
+		req := httptest.NewRequest(echo.GET, "/rest/api/1/staple/import/"+job.ID, nil)
+		req.Header.Set("Authorization", "Bearer "+tok)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetParamNames("id")
+		c.SetParamValues(job.ID)
+		if err := GetImportJob(importer)(c); err != nil || rec.Code != http.StatusOK {
+			return false
+		}
+		_ = json.Unmarshal(rec.Body.Bytes(), &job)
+		return job.Status == service.ImportDone
+	}, time.Second, 5*time.Millisecond)
+	assert.Equal(t, 1, job.Queued)
+
+	testUser.MaxStaples = 25
+	next, err := stapler.GetNext(&testUser)
+	assert.NoError(t, err)
+	assert.Equal(t, "Read later", next.Name)
+	assert.Equal(t, time.Unix(1500000000, 0).UTC(), next.CreatedAt)
+}
+
+func TestExportStaples(t *testing.T) {
+	stapler := service.NewStapler(storage.NewInMemoryStapleStorer())
+	config.Opts.GlobalTokenKey = "test"
+	e := echo.New()
+	testUser := models.User{ID: "5f0b7a9e-8e3c-4c1e-9a57-2d0f4c3b6a11", MaxStaples: 25}
+	err := stapler.Create(models.Staple{Name: "Queued", Content: "https://example.com/queued", CreatedAt: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}, &testUser)
+	assert.NoError(t, err)
+	err = stapler.CreateArchived(models.Staple{Name: "Done", Content: "https://example.com/done", CreatedAt: time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)}, &testUser)
+	assert.NoError(t, err)
+	tok, err := generateToken(testUser.ID)
+	assert.NoError(t, err)
+
+	t.Run("netscape bookmark file of the archive", func(tt *testing.T) {
+		req := httptest.NewRequest(echo.GET, "/rest/api/1/staple/export?format=html&scope=archive", nil)
+		req.Header.Set("Authorization", "Bearer "+tok)
+		rec := httptest.NewRecorder()
+		err := ExportStaples(stapler)(e.NewContext(req, rec))
+		assert.NoError(tt, err)
+		assert.Equal(tt, http.StatusOK, rec.Code)
+		assert.Equal(tt, "text/html; charset=utf-8", rec.Header().Get(echo.HeaderContentType))
+		assert.Contains(tt, rec.Header().Get(echo.HeaderContentDisposition), `.html"`)
+		assert.Contains(tt, rec.Body.String(), "<!DOCTYPE NETSCAPE-Bookmark-file-1>")
+		assert.Contains(tt, rec.Body.String(), "https://example.com/done")
+		assert.NotContains(tt, rec.Body.String(), "https://example.com/queued")
+	})
+	t.Run("json by default", func(tt *testing.T) {
+		req := httptest.NewRequest(echo.GET, "/rest/api/1/staple/export", nil)
+		req.Header.Set("Authorization", "Bearer "+tok)
+		rec := httptest.NewRecorder()
+		err := ExportStaples(stapler)(e.NewContext(req, rec))
+		assert.NoError(tt, err)
+		assert.Equal(tt, http.StatusOK, rec.Code)
+		var staples []models.Staple
+		assert.NoError(tt, json.Unmarshal(rec.Body.Bytes(), &staples))
+		assert.Len(tt, staples, 2)
+	})
+	t.Run("unknown format", func(tt *testing.T) {
+		req := httptest.NewRequest(echo.GET, "/rest/api/1/staple/export?format=pdf", nil)
+		req.Header.Set("Authorization", "Bearer "+tok)
+		rec := httptest.NewRecorder()
+		err := ExportStaples(stapler)(e.NewContext(req, rec))
+		assert.NoError(tt, err)
+		assert.Equal(tt, http.StatusBadRequest, rec.Code)
+	})
+	t.Run("failures abort the download", func(tt *testing.T) {
+		store := storage.NewInMemoryStapleStorer()
+		store.Err = errors.New("connection lost")
+		req := httptest.NewRequest(echo.GET, "/rest/api/1/staple/export", nil)
+		req.Header.Set("Authorization", "Bearer "+tok)
+		assert.PanicsWithValue(tt, http.ErrAbortHandler, func() {
+			_ = ExportStaples(service.NewStapler(store))(e.NewContext(req, httptest.NewRecorder()))
+		})
+	})
+}
+
+func TestTrash(t *testing.T) {
+	inMemoryStapleStore := storage.NewInMemoryStapleStorer()
+	stapleHandler := service.NewStapler(inMemoryStapleStore)
+	inMemoryUserStore := storage.NewInMemoryUserStorer()
+	notifier := service.NewBufferNotifier()
+	userHandler := service.NewUserHandler(context.Background(), inMemoryUserStore, notifier)
+
+	e := echo.New()
+	testUser := models.User{
+		Email:      "test@test.com",
+		Password:   "password",
+		MaxStaples: 25,
+	}
+	userHandler.Register(testUser)
+	testUser.ID, _ = userHandler.UserID(testUser)
+	assert.NoError(t, stapleHandler.Create(models.Staple{Name: "mis-click", Content: "content", CreatedAt: time.Date(1981, 3, 28, 0, 0, 0, 0, time.UTC)}, &testUser))
+
+	config.Opts.GlobalTokenKey = "test"
+	token := jwt.New(jwt.SigningMethodHS256)
+	claims := token.Claims.(jwt.MapClaims)
+	claims["sub"] = testUser.ID
+	claims["exp"] = time.Now().Add(time.Hour * 72).Unix()
+	tok, err := token.SignedString([]byte(config.Opts.GlobalTokenKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	call := func(method, target string, id string, handler echo.HandlerFunc) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		req.Header.Set("Authorization", "Bearer "+tok)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		if id != "" {
+			c.SetParamNames("id")
+			c.SetParamValues(id)
+		}
+		assert.NoError(t, handler(c))
+		return rec
+	}
+
+	rec := call(echo.DELETE, "/rest/api/1/staple/0", "0", DeleteStaple(stapleHandler))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	rec = call(echo.GET, "/rest/api/1/staple/trash", "", ListTrash(stapleHandler))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var trash struct {
+		Staples []models.Staple `json:"staples"`
+	}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &trash))
+	if assert.Len(t, trash.Staples, 1) {
+		assert.Equal(t, "mis-click", trash.Staples[0].Name)
+		assert.NotNil(t, trash.Staples[0].DeletedAt)
+	}
+
+	rec = call(echo.POST, "/rest/api/1/staple/0/restore", "0", RestoreStaple(stapleHandler, userHandler))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var restored models.Staple
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &restored))
+	assert.Equal(t, "mis-click", restored.Name)
+	assert.Equal(t, "content", restored.Content)
+	rec = call(echo.GET, "/rest/api/1/staple/next", "", GetNext(stapleHandler))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "mis-click")
+
+	rec = call(echo.POST, "/rest/api/1/staple/0/restore", "0", RestoreStaple(stapleHandler, userHandler))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	rec = call(echo.POST, "/rest/api/1/staple/x/restore", "x", RestoreStaple(stapleHandler, userHandler))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
@@ -0,0 +1,44 @@
+package pkg
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/labstack/echo/v4"
+
+	"github.com/staple-org/staple/internal/models"
+	"github.com/staple-org/staple/internal/service"
+	"github.com/staple-org/staple/pkg/config"
+)
+
+// GetStats returns the reading statistics of the user. The following query parameters are
+// used: from and to (inclusive dates such as 2020-02-17), period (day or week) and timezone.
+func GetStats(stats service.Stats) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token, err := GetToken(c)
+		if err != nil {
+			return err
+		}
+		claims := token.Claims.(jwt.MapClaims)
+		userID := claims["sub"].(string)
+		userModel := &models.User{
+			ID: userID,
+		}
+		ret, err := stats.Get(*userModel, service.StatsRange{
+			From:     c.QueryParam("from"),
+			To:       c.QueryParam("to"),
+			Period:   c.QueryParam("period"),
+			Timezone: c.QueryParam("timezone"),
+		})
+		switch {
+		case errors.Is(err, service.ErrInvalidStatsRange):
+			apiError := config.APIError("failed to get statistics", http.StatusBadRequest, err)
+			return c.JSON(http.StatusBadRequest, apiError)
+		case err != nil:
+			apiError := config.APIError("failed to get statistics", http.StatusInternalServerError, err)
+			return c.JSON(http.StatusInternalServerError, apiError)
+		}
+		return c.JSON(http.StatusOK, ret)
+	}
+}
@@ -0,0 +1,51 @@
+package pkg
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/staple-org/staple/internal/models"
+	"github.com/staple-org/staple/internal/service"
+	"github.com/staple-org/staple/internal/storage"
+	"github.com/staple-org/staple/pkg/config"
+)
+
+func TestGetStats(t *testing.T) {
+	staples := storage.NewInMemoryStapleStorer()
+	stats := service.NewStats(storage.NewInMemoryStatsStorer(staples)).WithClock(func() time.Time {
+		return time.Date(2020, 2, 19, 10, 0, 0, 0, time.UTC)
+	})
+	config.Opts.GlobalTokenKey = "test"
+	e := echo.New()
+	tok, err := generateToken("user")
+	assert.NoError(t, err)
+	archivedAt := time.Date(2020, 2, 18, 12, 0, 0, 0, time.UTC)
+	assert.NoError(t, staples.Create(models.Staple{Name: "read", CreatedAt: archivedAt.Add(-48 * time.Hour), Archived: true, ArchivedAt: &archivedAt}, "user"))
+
+	request := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(echo.GET, "/rest/api/1/user/stats?"+query, nil)
+		req.Header.Set("Authorization", "Bearer "+tok)
+		rec := httptest.NewRecorder()
+		assert.NoError(t, GetStats(stats)(e.NewContext(req, rec)))
+		return rec
+	}
+
+	rec := request("from=2020-02-17&to=2020-02-19&period=week")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var got models.StapleStats
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &got))
+	assert.Equal(t, []models.StapleActivity{{Date: "2020-02-17", Archived: 1}}, got.Activity)
+	assert.Equal(t, int64(48*60*60), got.AverageSecondsInQueue)
+	assert.Equal(t, 1, got.CurrentStreak)
+
+	rec = request("from=2020-02-19&to=2020-02-17")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = request("period=month")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
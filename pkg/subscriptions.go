@@ -0,0 +1,135 @@
+package pkg
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/labstack/echo/v4"
+
+	"github.com/staple-org/staple/internal/models"
+	"github.com/staple-org/staple/internal/service"
+	"github.com/staple-org/staple/internal/storage"
+	"github.com/staple-org/staple/pkg/config"
+)
+
+// ListSubscriptions lists the feeds the user subscribed to.
+func ListSubscriptions(subscriber service.Subscriber) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token, err := GetToken(c)
+		if err != nil {
+			return err
+		}
+		claims := token.Claims.(jwt.MapClaims)
+		userID := claims["sub"].(string)
+		userModel := &models.User{
+			ID: userID,
+		}
+		subs, err := subscriber.Subscriptions(*userModel)
+		if err != nil {
+			apiError := config.APIError("failed to list subscriptions", http.StatusInternalServerError, err)
+			return c.JSON(http.StatusInternalServerError, apiError)
+		}
+		var subscriptions = struct {
+			Subscriptions []models.Subscription `json:"subscriptions"`
+		}{
+			Subscriptions: subs,
+		}
+		return c.JSON(http.StatusOK, subscriptions)
+	}
+}
+
+// Subscribe subscribes the user to an RSS, Atom or JSON Feed. The following properties are used:
+// url, policy (wait, skip or archive)
+func Subscribe(subscriber service.Subscriber) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token, err := GetToken(c)
+		if err != nil {
+			return err
+		}
+		claims := token.Claims.(jwt.MapClaims)
+		userID := claims["sub"].(string)
+		userModel := &models.User{
+			ID: userID,
+		}
+		var request = struct {
+			URL    string `json:"url"`
+			Policy string `json:"policy"`
+		}{}
+		if err := c.Bind(&request); err != nil {
+			return err
+		}
+		sub, err := subscriber.Subscribe(*userModel, request.URL, service.SubscriptionPolicy(request.Policy))
+		switch {
+		case errors.Is(err, service.ErrInvalidFeed):
+			apiError := config.APIError("failed to subscribe", http.StatusBadRequest, err)
+			return c.JSON(http.StatusBadRequest, apiError)
+		case errors.Is(err, storage.ErrSubscriptionExists):
+			apiError := config.APIError("failed to subscribe", http.StatusConflict, err)
+			return c.JSON(http.StatusConflict, apiError)
+		case err != nil:
+			apiError := config.APIError("failed to subscribe", http.StatusInternalServerError, err)
+			return c.JSON(http.StatusInternalServerError, apiError)
+		}
+		return c.JSON(http.StatusCreated, sub)
+	}
+}
+
+// UpdateSubscription changes the policy of a subscription. The following properties are used:
+// policy (wait, skip or archive)
+func UpdateSubscription(subscriber service.Subscriber) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token, err := GetToken(c)
+		if err != nil {
+			return err
+		}
+		claims := token.Claims.(jwt.MapClaims)
+		userID := claims["sub"].(string)
+		userModel := &models.User{
+			ID: userID,
+		}
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			apiError := config.APIError("invalid id", http.StatusBadRequest, err)
+			return c.JSON(http.StatusBadRequest, apiError)
+		}
+		var request = struct {
+			Policy string `json:"policy"`
+		}{}
+		if err := c.Bind(&request); err != nil {
+			return err
+		}
+		sub, err := subscriber.SetPolicy(*userModel, id, service.SubscriptionPolicy(request.Policy))
+		if err != nil {
+			apiError := config.APIError("failed to update subscription", http.StatusBadRequest, err)
+			return c.JSON(http.StatusBadRequest, apiError)
+		}
+		return c.JSON(http.StatusOK, sub)
+	}
+}
+
+// Unsubscribe removes a subscription. Staples added from the feed are kept.
+func Unsubscribe(subscriber service.Subscriber) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token, err := GetToken(c)
+		if err != nil {
+			return err
+		}
+		claims := token.Claims.(jwt.MapClaims)
+		userID := claims["sub"].(string)
+		userModel := &models.User{
+			ID: userID,
+		}
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			apiError := config.APIError("invalid id", http.StatusBadRequest, err)
+			return c.JSON(http.StatusBadRequest, apiError)
+		}
+		if err := subscriber.Unsubscribe(*userModel, id); err != nil {
+			apiError := config.APIError("failed to unsubscribe", http.StatusInternalServerError, err)
+			return c.JSON(http.StatusInternalServerError, apiError)
+		}
+		return c.NoContent(http.StatusOK)
+	}
+}
@@ -0,0 +1,66 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/staple-org/staple/internal/models"
+	"github.com/staple-org/staple/internal/service"
+	"github.com/staple-org/staple/internal/storage"
+	"github.com/staple-org/staple/pkg/config"
+)
+
+func TestSubscribe(t *testing.T) {
+	feed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"version": "https://jsonfeed.org/version/1.1", "title": "Blog", "items": []}`)
+	}))
+	defer feed.Close()
+	userHandler := service.NewUserHandler(context.Background(), storage.NewInMemoryUserStorer(), service.NewBufferNotifier())
+	stapler := service.NewStapler(storage.NewInMemoryStapleStorer())
+	subscriber := service.NewSubscriber(storage.NewInMemorySubscriptionStorer(), stapler, userHandler).WithHTTPClient(feed.Client())
+	config.Opts.GlobalTokenKey = "test"
+	e := echo.New()
+
+	testUser := models.User{Email: "test@test.com", Password: "password"}
+	err := userHandler.Register(testUser)
+	assert.NoError(t, err)
+	testUser.ID, err = userHandler.UserID(testUser)
+	assert.NoError(t, err)
+	tok, err := generateToken(testUser.ID)
+	assert.NoError(t, err)
+
+	subscribe := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(echo.POST, "/rest/api/1/user/subscriptions", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+tok)
+		rec := httptest.NewRecorder()
+		assert.NoError(t, Subscribe(subscriber)(e.NewContext(req, rec)))
+		return rec
+	}
+	rec := subscribe(`{"url": "` + feed.URL + `", "policy": "archive"}`)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	rec = subscribe(`{"url": "` + feed.URL + `"}`)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	rec = subscribe(`{"url": "not a url"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	req := httptest.NewRequest(echo.GET, "/rest/api/1/user/subscriptions", nil)
+	req.Header.Set("Authorization", "Bearer "+tok)
+	rec = httptest.NewRecorder()
+	assert.NoError(t, ListSubscriptions(subscriber)(e.NewContext(req, rec)))
+	var list struct {
+		Subscriptions []models.Subscription `json:"subscriptions"`
+	}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &list))
+	assert.Len(t, list.Subscriptions, 1)
+	assert.Equal(t, "Blog", list.Subscriptions[0].Title)
+	assert.Equal(t, "archive", list.Subscriptions[0].Policy)
+}
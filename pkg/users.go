@@ -1,14 +1,19 @@
 package pkg
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
+	"sort"
 	"strconv"
+	"time"
 
 	"github.com/golang-jwt/jwt"
 	"github.com/labstack/echo/v4"
 
 	"github.com/staple-org/staple/internal/models"
 	"github.com/staple-org/staple/internal/service"
+	"github.com/staple-org/staple/internal/storage"
 	"github.com/staple-org/staple/pkg/config"
 )
 
@@ -36,12 +41,33 @@ func RegisterUser(userHandler service.UserHandlerer) echo.HandlerFunc {
 				"error": err.Error(),
 			})
 		}
-		return userHandler.Register(*user)
+		err = userHandler.Register(*user)
+		if handled, err := rejectWeakPassword(c, err); handled {
+			return err
+		}
+		return err
 	}
 }
 
+// rejectWeakPassword responds with 400 and the list of violations if err is a password
+// policy error. If so, the response has already been written and handled is true.
+func rejectWeakPassword(c echo.Context, err error) (handled bool, _ error) {
+	var policyErr *service.PasswordPolicyError
+	if !errors.As(err, &policyErr) {
+		return false, nil
+	}
+	var resp = struct {
+		config.Message
+		Violations []service.PasswordViolation `json:"violations"`
+	}{
+		Message:    config.APIError("password does not meet the requirements", http.StatusBadRequest, err),
+		Violations: policyErr.Violations,
+	}
+	return true, c.JSON(http.StatusBadRequest, resp)
+}
+
 // ResetPassword takes a user handler and resets a user's password delievered from the token.
-func ResetPassword(userHandler service.UserHandlerer) echo.HandlerFunc {
+func ResetPassword(userHandler service.UserHandlerer, limiter service.RateLimiter) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		user := &models.User{}
 		err := c.Bind(user)
@@ -54,6 +80,9 @@ func ResetPassword(userHandler service.UserHandlerer) echo.HandlerFunc {
 				"message": "invalid email",
 			})
 		}
+		if handled, err := limitEmail(c, limiter, user.Email); handled {
+			return err
+		}
 		if ok, err := userHandler.IsRegistered(*user); !ok {
 			return c.JSON(http.StatusBadRequest, map[string]string{
 				"message": "User not found",
@@ -75,9 +104,9 @@ func ChangePassword(userHandler service.UserHandlerer) echo.HandlerFunc {
 			return err
 		}
 		claims := token.Claims.(jwt.MapClaims)
-		email := claims["email"].(string)
+		userID := claims["sub"].(string)
 		userModel := &models.User{
-			Email: email,
+			ID: userID,
 		}
 
 		var password = struct {
@@ -87,15 +116,15 @@ func ChangePassword(userHandler service.UserHandlerer) echo.HandlerFunc {
 		if err != nil {
 			return err
 		}
-		if password.Password == "" {
-			apiError := config.APIError("password is empty", http.StatusBadRequest, nil)
-			return c.JSON(http.StatusBadRequest, apiError)
-		}
 		err = userHandler.ChangePassword(*userModel, password.Password)
+		if handled, err := rejectWeakPassword(c, err); handled {
+			return err
+		}
 		if err != nil {
 			apiError := config.APIError("failed to change password", http.StatusInternalServerError, nil)
 			return c.JSON(http.StatusInternalServerError, apiError)
 		}
+		audit(c, models.AuditEntry{UserID: userID, Action: models.AuditPasswordChanged})
 		return c.NoContent(http.StatusOK)
 	}
 }
@@ -108,9 +137,9 @@ func SetMaximumStaples(userHandler service.UserHandlerer) echo.HandlerFunc {
 			return err
 		}
 		claims := token.Claims.(jwt.MapClaims)
-		email := claims["email"].(string)
+		userID := claims["sub"].(string)
 		userModel := &models.User{
-			Email: email,
+			ID: userID,
 		}
 
 		var maxStaples = struct {
@@ -146,9 +175,9 @@ func GetMaximumStaples(userHandler service.UserHandlerer) echo.HandlerFunc {
 			return err
 		}
 		claims := token.Claims.(jwt.MapClaims)
-		email := claims["email"].(string)
+		userID := claims["sub"].(string)
 		userModel := &models.User{
-			Email: email,
+			ID: userID,
 		}
 		staples, err := userHandler.GetMaximumStaples(*userModel)
 		if err != nil {
@@ -167,7 +196,7 @@ func GetMaximumStaples(userHandler service.UserHandlerer) echo.HandlerFunc {
 }
 
 // VerfiyConfirmCode verifies a confirm link generated by a reset password action.
-func VerfiyConfirmCode(userHandler service.UserHandlerer) echo.HandlerFunc {
+func VerfiyConfirmCode(userHandler service.UserHandlerer, limiter service.RateLimiter) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		// Get the nickname for the token.
 		var confirm = struct {
@@ -183,6 +212,9 @@ func VerfiyConfirmCode(userHandler service.UserHandlerer) echo.HandlerFunc {
 				"message": "invalid email or code",
 			})
 		}
+		if handled, err := limitEmail(c, limiter, confirm.Email); handled {
+			return err
+		}
 
 		user := models.User{Email: confirm.Email, ConfirmCode: confirm.Code}
 		if ok, err := userHandler.IsRegistered(user); !ok {
@@ -194,12 +226,384 @@ func VerfiyConfirmCode(userHandler service.UserHandlerer) echo.HandlerFunc {
 				"error": err.Error(),
 			})
 		}
+		if handled, err := rejectLocked(c, userHandler, user); handled {
+			return err
+		}
 		if ok, err := userHandler.VerifyConfirmCode(user); err != nil {
+			if _, err := userHandler.RecordLoginFailure(user); err != nil {
+				config.Opts.Logger.Error().Err(err).Msg("Failed to record confirm code failure")
+			}
+			if id, err := userHandler.UserID(user); err == nil {
+				audit(c, models.AuditEntry{UserID: id, Action: models.AuditLoginFailed, Detail: "confirm code"})
+			}
 			apiError := config.APIError("error while confirming link", http.StatusBadRequest, err)
 			return c.JSON(http.StatusBadRequest, apiError)
 		} else if ok {
+			if id, err := userHandler.UserID(user); err == nil {
+				audit(c, models.AuditEntry{UserID: id, Action: models.AuditPasswordChanged, Detail: "reset"})
+			}
 			return c.NoContent(http.StatusOK)
 		}
 		return c.NoContent(http.StatusBadRequest)
 	}
 }
+
+// EnrollTOTP starts two-factor authentication enrolment and returns the secret
+// and an otpauth URI for authenticator apps.
+func EnrollTOTP(userHandler service.UserHandlerer) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token, err := GetToken(c)
+		if err != nil {
+			return err
+		}
+		claims := token.Claims.(jwt.MapClaims)
+		userID := claims["sub"].(string)
+		userModel := &models.User{
+			ID: userID,
+		}
+		secret, uri, err := userHandler.EnrollTOTP(*userModel)
+		if err != nil {
+			apiError := config.APIError("failed to enroll two-factor authentication", http.StatusBadRequest, err)
+			return c.JSON(http.StatusBadRequest, apiError)
+		}
+		var enrolment = struct {
+			Secret string `json:"secret"`
+			URI    string `json:"uri"`
+		}{
+			Secret: secret,
+			URI:    uri,
+		}
+		return c.JSON(http.StatusOK, enrolment)
+	}
+}
+
+// ConfirmTOTP enables two-factor authentication with the first valid code and
+// returns the recovery codes.
+func ConfirmTOTP(userHandler service.UserHandlerer) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token, err := GetToken(c)
+		if err != nil {
+			return err
+		}
+		claims := token.Claims.(jwt.MapClaims)
+		userID := claims["sub"].(string)
+		userModel := &models.User{
+			ID: userID,
+		}
+		var code = struct {
+			Code string `json:"code"`
+		}{}
+		if err := c.Bind(&code); err != nil {
+			return err
+		}
+		if code.Code == "" {
+			apiError := config.APIError("code is empty", http.StatusBadRequest, nil)
+			return c.JSON(http.StatusBadRequest, apiError)
+		}
+		recoveryCodes, err := userHandler.ConfirmTOTP(*userModel, code.Code)
+		if err != nil {
+			apiError := config.APIError("failed to confirm two-factor authentication", http.StatusBadRequest, err)
+			return c.JSON(http.StatusBadRequest, apiError)
+		}
+		var recovery = struct {
+			RecoveryCodes []string `json:"recovery_codes"`
+		}{
+			RecoveryCodes: recoveryCodes,
+		}
+		return c.JSON(http.StatusOK, recovery)
+	}
+}
+
+// DisableTOTP turns off two-factor authentication given a valid code or recovery code.
+func DisableTOTP(userHandler service.UserHandlerer) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token, err := GetToken(c)
+		if err != nil {
+			return err
+		}
+		claims := token.Claims.(jwt.MapClaims)
+		userID := claims["sub"].(string)
+		userModel := &models.User{
+			ID: userID,
+		}
+		var code = struct {
+			Code string `json:"code"`
+		}{}
+		if err := c.Bind(&code); err != nil {
+			return err
+		}
+		if code.Code == "" {
+			apiError := config.APIError("code is empty", http.StatusBadRequest, nil)
+			return c.JSON(http.StatusBadRequest, apiError)
+		}
+		if err := userHandler.DisableTOTP(*userModel, code.Code); err != nil {
+			apiError := config.APIError("failed to disable two-factor authentication", http.StatusBadRequest, err)
+			return c.JSON(http.StatusBadRequest, apiError)
+		}
+		return c.NoContent(http.StatusOK)
+	}
+}
+
+// ChangeEmail requests a change of the account's email address. The new address has to be
+// confirmed with the code which is sent to it.
+func ChangeEmail(userHandler service.UserHandlerer) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token, err := GetToken(c)
+		if err != nil {
+			return err
+		}
+		claims := token.Claims.(jwt.MapClaims)
+		userID := claims["sub"].(string)
+
+		var change = struct {
+			Email    string `json:"email"`
+			Password string `json:"password"`
+		}{}
+		if err := c.Bind(&change); err != nil {
+			return err
+		}
+		if change.Email == "" || change.Password == "" {
+			apiError := config.APIError("email or password is empty", http.StatusBadRequest, nil)
+			return c.JSON(http.StatusBadRequest, apiError)
+		}
+		userModel := &models.User{
+			ID:       userID,
+			Password: change.Password,
+		}
+		err = userHandler.RequestEmailChange(*userModel, change.Email)
+		if errors.Is(err, storage.ErrEmailTaken) {
+			apiError := config.APIError("email address is already in use", http.StatusConflict, err)
+			return c.JSON(http.StatusConflict, apiError)
+		} else if err != nil {
+			apiError := config.APIError("failed to change email", http.StatusBadRequest, err)
+			return c.JSON(http.StatusBadRequest, apiError)
+		}
+		return c.NoContent(http.StatusOK)
+	}
+}
+
+// ConfirmEmailChange completes the change of the email address. All previous tokens are
+// revoked and a new token is returned.
+func ConfirmEmailChange(userHandler service.UserHandlerer) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token, err := GetToken(c)
+		if err != nil {
+			return err
+		}
+		claims := token.Claims.(jwt.MapClaims)
+		userID := claims["sub"].(string)
+		userModel := &models.User{
+			ID: userID,
+		}
+
+		var code = struct {
+			Code string `json:"code"`
+		}{}
+		if err := c.Bind(&code); err != nil {
+			return err
+		}
+		if code.Code == "" {
+			apiError := config.APIError("code is empty", http.StatusBadRequest, nil)
+			return c.JSON(http.StatusBadRequest, apiError)
+		}
+		_, err = userHandler.ConfirmEmailChange(*userModel, code.Code)
+		if errors.Is(err, storage.ErrEmailTaken) {
+			apiError := config.APIError("email address is already in use", http.StatusConflict, err)
+			return c.JSON(http.StatusConflict, apiError)
+		} else if err != nil {
+			apiError := config.APIError("failed to confirm email change", http.StatusBadRequest, err)
+			return c.JSON(http.StatusBadRequest, apiError)
+		}
+		t, err := generateToken(userModel.ID)
+		if err != nil {
+			config.Opts.Logger.Error().Err(err).Msg("Failed to generate token.")
+			return err
+		}
+		audit(c, models.AuditEntry{UserID: userID, Action: models.AuditTokenCreated, Detail: "email change"})
+		return c.JSON(http.StatusOK, map[string]string{
+			"token": t,
+		})
+	}
+}
+
+// ExportAccount returns a complete archive of the account as a JSON file. Webhook secrets,
+// chat access tokens and the feed and inbox tokens are left out.
+func ExportAccount(userHandler service.UserHandlerer, stapler service.Staplerer, digests service.Digests, dispatcher service.NotificationDispatcher, chats service.Chats, webhooks service.Webhooks, subscriber service.Subscriber) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token, err := GetToken(c)
+		if err != nil {
+			return err
+		}
+		claims := token.Claims.(jwt.MapClaims)
+		userID := claims["sub"].(string)
+		userModel := &models.User{
+			ID: userID,
+		}
+
+		profile, err := userHandler.Profile(*userModel)
+		if err != nil {
+			apiError := config.APIError("failed to get user", http.StatusInternalServerError, err)
+			return c.JSON(http.StatusInternalServerError, apiError)
+		}
+		staples, err := stapler.All(userModel)
+		if err != nil {
+			apiError := config.APIError("failed to get staples", http.StatusInternalServerError, err)
+			return c.JSON(http.StatusInternalServerError, apiError)
+		}
+		queue := make([]models.Staple, 0)
+		archive := make([]models.Staple, 0)
+		for _, s := range staples {
+			if s.Archived {
+				archive = append(archive, s)
+			} else {
+				queue = append(queue, s)
+			}
+		}
+		sort.SliceStable(queue, func(i, j int) bool {
+			return queue[i].CreatedAt.Before(queue[j].CreatedAt)
+		})
+		trash, err := stapler.Trash(userModel)
+		if err != nil {
+			apiError := config.APIError("failed to get staples", http.StatusInternalServerError, err)
+			return c.JSON(http.StatusInternalServerError, apiError)
+		}
+		digest, err := digests.Settings(*userModel)
+		if err != nil {
+			apiError := config.APIError("failed to get digest settings", http.StatusInternalServerError, err)
+			return c.JSON(http.StatusInternalServerError, apiError)
+		}
+		prefs, err := dispatcher.Preferences(*userModel)
+		if err != nil {
+			apiError := config.APIError("failed to get notification preferences", http.StatusInternalServerError, err)
+			return c.JSON(http.StatusInternalServerError, apiError)
+		}
+		targets, err := chats.List(*userModel)
+		if err != nil {
+			apiError := config.APIError("failed to list chats", http.StatusInternalServerError, err)
+			return c.JSON(http.StatusInternalServerError, apiError)
+		}
+		hooks, err := webhooks.List(*userModel)
+		if err != nil {
+			apiError := config.APIError("failed to list webhooks", http.StatusInternalServerError, err)
+			return c.JSON(http.StatusInternalServerError, apiError)
+		}
+		subs, err := subscriber.Subscriptions(*userModel)
+		if err != nil {
+			apiError := config.APIError("failed to list subscriptions", http.StatusInternalServerError, err)
+			return c.JSON(http.StatusInternalServerError, apiError)
+		}
+
+		type exportProfile struct {
+			ID           string     `json:"id"`
+			Email        string     `json:"email"`
+			PendingEmail string     `json:"pending_email,omitempty"`
+			DeleteAfter  *time.Time `json:"delete_after,omitempty"`
+		}
+		type exportSettings struct {
+			MaxStaples    int                             `json:"max_staples"`
+			TOTPEnabled   bool                            `json:"totp_enabled"`
+			Locale        string                          `json:"locale"`
+			FeedsEnabled  bool                            `json:"feeds_enabled"`
+			InboxEnabled  bool                            `json:"inbox_enabled"`
+			Digest        models.DigestSettings           `json:"digest"`
+			Notifications []models.NotificationPreference `json:"notifications"`
+		}
+		var export = struct {
+			ExportedAt    time.Time             `json:"exported_at"`
+			Profile       exportProfile         `json:"profile"`
+			Settings      exportSettings        `json:"settings"`
+			Chats         []models.ChatTarget   `json:"chats"`
+			Webhooks      []models.Webhook      `json:"webhooks"`
+			Subscriptions []models.Subscription `json:"subscriptions"`
+			Queue         []models.Staple       `json:"queue"`
+			Archive       []models.Staple       `json:"archive"`
+			Trash         []models.Staple       `json:"trash"`
+		}{
+			ExportedAt: time.Now().UTC(),
+			Profile: exportProfile{
+				ID:           profile.ID,
+				Email:        profile.Email,
+				PendingEmail: profile.PendingEmail,
+			},
+			Settings: exportSettings{
+				MaxStaples:    profile.MaxStaples,
+				TOTPEnabled:   profile.TOTPEnabled,
+				Locale:        profile.Locale,
+				FeedsEnabled:  profile.FeedToken != "",
+				InboxEnabled:  profile.InboxToken != "",
+				Digest:        digest,
+				Notifications: prefs,
+			},
+			Chats:         targets,
+			Webhooks:      hooks,
+			Subscriptions: subs,
+			Queue:         queue,
+			Archive:       archive,
+			Trash:         trash,
+		}
+		if !profile.DeleteAfter.IsZero() {
+			export.Profile.DeleteAfter = &profile.DeleteAfter
+		}
+		c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="staple-export-%s.json"`, export.ExportedAt.Format("2006-01-02")))
+		return c.JSON(http.StatusOK, export)
+	}
+}
+
+// DeleteAccount deletes the account and all its data. If a grace period is configured the
+// deletion is scheduled instead and can be cancelled until then.
+func DeleteAccount(userHandler service.UserHandlerer) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token, err := GetToken(c)
+		if err != nil {
+			return err
+		}
+		claims := token.Claims.(jwt.MapClaims)
+		userID := claims["sub"].(string)
+
+		var password = struct {
+			Password string `json:"password"`
+		}{}
+		if err := c.Bind(&password); err != nil {
+			return err
+		}
+		if password.Password == "" {
+			apiError := config.APIError("password is empty", http.StatusBadRequest, nil)
+			return c.JSON(http.StatusBadRequest, apiError)
+		}
+		userModel := &models.User{
+			ID:       userID,
+			Password: password.Password,
+		}
+		deleteAfter, err := userHandler.RequestDeletion(*userModel)
+		if err != nil {
+			apiError := config.APIError("failed to delete account", http.StatusBadRequest, err)
+			return c.JSON(http.StatusBadRequest, apiError)
+		}
+		if deleteAfter.IsZero() {
+			return c.NoContent(http.StatusOK)
+		}
+		return c.JSON(http.StatusAccepted, map[string]time.Time{
+			"delete_after": deleteAfter,
+		})
+	}
+}
+
+// CancelAccountDeletion cancels a scheduled deletion of the account.
+func CancelAccountDeletion(userHandler service.UserHandlerer) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token, err := GetToken(c)
+		if err != nil {
+			return err
+		}
+		claims := token.Claims.(jwt.MapClaims)
+		userID := claims["sub"].(string)
+		userModel := &models.User{
+			ID: userID,
+		}
+		if err := userHandler.CancelDeletion(*userModel); err != nil {
+			apiError := config.APIError("failed to cancel deletion", http.StatusBadRequest, err)
+			return c.JSON(http.StatusBadRequest, apiError)
+		}
+		return c.NoContent(http.StatusOK)
+	}
+}
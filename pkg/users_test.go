@@ -0,0 +1,174 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/staple-org/staple/internal/models"
+	"github.com/staple-org/staple/internal/service"
+	"github.com/staple-org/staple/internal/storage"
+	"github.com/staple-org/staple/pkg/config"
+)
+
+func TestRegisterUser_PasswordPolicy(t *testing.T) {
+	inMemoryUserStore := storage.NewInMemoryUserStorer()
+	userHandler := service.NewUserHandler(context.Background(), inMemoryUserStore, service.NewBufferNotifier()).
+		WithPasswordPolicy(service.PasswordPolicy{MinLength: 12, MinClasses: 2})
+	e := echo.New()
+	register := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(echo.POST, "/rest/api/1/register", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		err := RegisterUser(userHandler)(e.NewContext(req, rec))
+		assert.NoError(t, err)
+		return rec
+	}
+
+	rec := register(`{"email": "test@test.com", "password": "password"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	var resp struct {
+		Message    string                      `json:"message"`
+		Violations []service.PasswordViolation `json:"violations"`
+	}
+	err := json.Unmarshal(rec.Body.Bytes(), &resp)
+	assert.NoError(t, err)
+	assert.Equal(t, "password does not meet the requirements", resp.Message)
+	assert.Len(t, resp.Violations, 2)
+	assert.Equal(t, service.ViolationTooShort, resp.Violations[0].Code)
+	assert.Equal(t, service.ViolationTooFewClasses, resp.Violations[1].Code)
+	ok, err := userHandler.IsRegistered(models.User{Email: "test@test.com"})
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	rec = register(`{"email": "test@test.com", "password": "long enough passphrase 1"}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	ok, err = userHandler.IsRegistered(models.User{Email: "test@test.com"})
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestExportAccount(t *testing.T) {
+	inMemoryUserStore := storage.NewInMemoryUserStorer()
+	userHandler := service.NewUserHandler(context.Background(), inMemoryUserStore, service.NewBufferNotifier())
+	stapler := service.NewStapler(storage.NewInMemoryStapleStorer())
+	config.Opts.GlobalTokenKey = "test"
+
+	testUser := models.User{Email: "test@test.com", Password: "password"}
+	err := userHandler.Register(testUser)
+	assert.NoError(t, err)
+	testUser.ID, err = userHandler.UserID(testUser)
+	assert.NoError(t, err)
+	testUser.MaxStaples = 25
+	for i, name := range []string{"second", "first", "archived", "trashed"} {
+		err = stapler.Create(models.Staple{
+			Name:      name,
+			Content:   name + " content",
+			CreatedAt: time.Date(2020, 1, 3-i, 0, 0, 0, 0, time.UTC),
+		}, &testUser)
+		assert.NoError(t, err)
+	}
+	err = stapler.Archive(&testUser, 2)
+	assert.NoError(t, err)
+	err = stapler.Delete(&testUser, 3)
+	assert.NoError(t, err)
+
+	assert.NoError(t, userHandler.SetLocale(testUser, "de"))
+	_, err = userHandler.RegenerateFeedToken(testUser)
+	assert.NoError(t, err)
+	digests := service.NewDigests(storage.NewInMemoryDigestStorer(), stapler, userHandler, service.NewBufferNotifier())
+	_, err = digests.UpdateSettings(testUser, models.DigestSettings{Frequency: models.DigestWeekly, Hour: 7, ReminderDays: 3, Timezone: "Europe/Berlin"})
+	assert.NoError(t, err)
+	dispatcher := service.NewNotificationDispatcher(storage.NewInMemoryNotificationPreferenceStorer(), inMemoryUserStore, service.Channels{}, models.ChatSlack)
+	_, err = dispatcher.UpdatePreferences(testUser, []models.NotificationPreference{{Event: "queue-digest", Channels: []string{models.ChatSlack}, Frequency: models.NotifyImmediately}})
+	assert.NoError(t, err)
+	chats := service.NewChats(storage.NewInMemoryChatTargetStorer(), inMemoryUserStore)
+	_, err = chats.Set(testUser, models.ChatTarget{Kind: models.ChatMatrix, URL: "https://matrix.example.com", Room: "!room:example.com", Token: "matrix-token"})
+	assert.NoError(t, err)
+	webhooks := service.NewWebhooks(storage.NewInMemoryWebhookStorer())
+	hook, err := webhooks.Create(testUser, "https://example.com/hook", []string{"staple.created"})
+	assert.NoError(t, err)
+	subscriptionStore := storage.NewInMemorySubscriptionStorer()
+	_, err = subscriptionStore.Create(models.Subscription{UserID: testUser.ID, URL: "https://example.com/feed.xml", Policy: "wait"})
+	assert.NoError(t, err)
+	subscriber := service.NewSubscriber(subscriptionStore, stapler, userHandler)
+
+	tok, err := generateToken(testUser.ID)
+	assert.NoError(t, err)
+	req := httptest.NewRequest(echo.GET, "/rest/api/1/user/export", nil)
+	req.Header.Set("Authorization", "Bearer "+tok)
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+	err = ExportAccount(userHandler, stapler, digests, dispatcher, chats, webhooks, subscriber)(c)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Header().Get(echo.HeaderContentDisposition), "attachment")
+
+	var export struct {
+		Profile struct {
+			ID       string `json:"id"`
+			Email    string `json:"email"`
+			Password string `json:"password"`
+		} `json:"profile"`
+		Settings struct {
+			MaxStaples    int                             `json:"max_staples"`
+			Locale        string                          `json:"locale"`
+			FeedsEnabled  bool                            `json:"feeds_enabled"`
+			InboxEnabled  bool                            `json:"inbox_enabled"`
+			Digest        models.DigestSettings           `json:"digest"`
+			Notifications []models.NotificationPreference `json:"notifications"`
+		} `json:"settings"`
+		Chats         []models.ChatTarget   `json:"chats"`
+		Webhooks      []models.Webhook      `json:"webhooks"`
+		Subscriptions []models.Subscription `json:"subscriptions"`
+		Queue         []models.Staple       `json:"queue"`
+		Archive       []models.Staple       `json:"archive"`
+		Trash         []models.Staple       `json:"trash"`
+	}
+	err = json.Unmarshal(rec.Body.Bytes(), &export)
+	assert.NoError(t, err)
+	assert.Equal(t, testUser.ID, export.Profile.ID)
+	assert.Equal(t, "test@test.com", export.Profile.Email)
+	assert.Empty(t, export.Profile.Password)
+	assert.Equal(t, 25, export.Settings.MaxStaples)
+	assert.Equal(t, "de", export.Settings.Locale)
+	assert.True(t, export.Settings.FeedsEnabled)
+	assert.False(t, export.Settings.InboxEnabled)
+	assert.Equal(t, models.DigestWeekly, export.Settings.Digest.Frequency)
+	assert.Equal(t, 3, export.Settings.Digest.ReminderDays)
+	assert.Equal(t, "Europe/Berlin", export.Settings.Digest.Timezone)
+	channels := map[string][]string{}
+	for _, p := range export.Settings.Notifications {
+		channels[p.Event] = p.Channels
+	}
+	assert.Equal(t, []string{models.ChatSlack}, channels["queue-digest"])
+	assert.Equal(t, []string{service.ChannelEmail}, channels["welcome"])
+	if assert.Len(t, export.Chats, 1) {
+		assert.Equal(t, "https://matrix.example.com", export.Chats[0].URL)
+	}
+	if assert.Len(t, export.Webhooks, 1) {
+		assert.Equal(t, hook.ID, export.Webhooks[0].ID)
+		assert.Empty(t, export.Webhooks[0].Secret)
+	}
+	if assert.Len(t, export.Subscriptions, 1) {
+		assert.Equal(t, "https://example.com/feed.xml", export.Subscriptions[0].URL)
+	}
+	assert.NotContains(t, rec.Body.String(), "matrix-token")
+	assert.NotContains(t, rec.Body.String(), hook.Secret)
+	assert.Len(t, export.Queue, 2)
+	assert.Equal(t, "first", export.Queue[0].Name)
+	assert.Equal(t, "first content", export.Queue[0].Content)
+	assert.Len(t, export.Archive, 1)
+	assert.Equal(t, "archived", export.Archive[0].Name)
+	if assert.Len(t, export.Trash, 1) {
+		assert.Equal(t, "trashed", export.Trash[0].Name)
+		assert.Equal(t, "trashed content", export.Trash[0].Content)
+	}
+}
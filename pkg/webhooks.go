@@ -0,0 +1,165 @@
+package pkg
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/labstack/echo/v4"
+
+	"github.com/staple-org/staple/internal/models"
+	"github.com/staple-org/staple/internal/service"
+	"github.com/staple-org/staple/pkg/config"
+)
+
+// ListWebhooks lists the webhooks of the user. Secrets are not included.
+func ListWebhooks(webhooks service.Webhooks) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token, err := GetToken(c)
+		if err != nil {
+			return err
+		}
+		claims := token.Claims.(jwt.MapClaims)
+		userID := claims["sub"].(string)
+		userModel := &models.User{
+			ID: userID,
+		}
+		hooks, err := webhooks.List(*userModel)
+		if err != nil {
+			apiError := config.APIError("failed to list webhooks", http.StatusInternalServerError, err)
+			return c.JSON(http.StatusInternalServerError, apiError)
+		}
+		var list = struct {
+			Webhooks []models.Webhook `json:"webhooks"`
+		}{
+			Webhooks: hooks,
+		}
+		return c.JSON(http.StatusOK, list)
+	}
+}
+
+// CreateWebhook adds a webhook. The following properties are used:
+// url, events (staple.created, staple.archived, staple.deleted, staple.restored, queue.empty,
+// quota.reached)
+// The response contains the signing secret, which isn't shown again.
+func CreateWebhook(webhooks service.Webhooks) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token, err := GetToken(c)
+		if err != nil {
+			return err
+		}
+		claims := token.Claims.(jwt.MapClaims)
+		userID := claims["sub"].(string)
+		userModel := &models.User{
+			ID: userID,
+		}
+		var request = struct {
+			URL    string   `json:"url"`
+			Events []string `json:"events"`
+		}{}
+		if err := c.Bind(&request); err != nil {
+			return err
+		}
+		hook, err := webhooks.Create(*userModel, request.URL, request.Events)
+		switch {
+		case errors.Is(err, service.ErrInvalidWebhook):
+			apiError := config.APIError("failed to create webhook", http.StatusBadRequest, err)
+			return c.JSON(http.StatusBadRequest, apiError)
+		case err != nil:
+			apiError := config.APIError("failed to create webhook", http.StatusInternalServerError, err)
+			return c.JSON(http.StatusInternalServerError, apiError)
+		}
+		return c.JSON(http.StatusCreated, hook)
+	}
+}
+
+// DeleteWebhook removes a webhook and its delivery log.
+func DeleteWebhook(webhooks service.Webhooks) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token, err := GetToken(c)
+		if err != nil {
+			return err
+		}
+		claims := token.Claims.(jwt.MapClaims)
+		userID := claims["sub"].(string)
+		userModel := &models.User{
+			ID: userID,
+		}
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			apiError := config.APIError("invalid id", http.StatusBadRequest, err)
+			return c.JSON(http.StatusBadRequest, apiError)
+		}
+		if err := webhooks.Delete(*userModel, id); err != nil {
+			apiError := config.APIError("failed to delete webhook", http.StatusInternalServerError, err)
+			return c.JSON(http.StatusInternalServerError, apiError)
+		}
+		return c.NoContent(http.StatusOK)
+	}
+}
+
+// ListWebhookDeliveries returns the most recent deliveries of a webhook, the newest first.
+func ListWebhookDeliveries(webhooks service.Webhooks) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token, err := GetToken(c)
+		if err != nil {
+			return err
+		}
+		claims := token.Claims.(jwt.MapClaims)
+		userID := claims["sub"].(string)
+		userModel := &models.User{
+			ID: userID,
+		}
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			apiError := config.APIError("invalid id", http.StatusBadRequest, err)
+			return c.JSON(http.StatusBadRequest, apiError)
+		}
+		deliveries, err := webhooks.Deliveries(*userModel, id)
+		switch {
+		case errors.Is(err, service.ErrWebhookNotFound):
+			apiError := config.APIError("failed to list deliveries", http.StatusNotFound, err)
+			return c.JSON(http.StatusNotFound, apiError)
+		case err != nil:
+			apiError := config.APIError("failed to list deliveries", http.StatusInternalServerError, err)
+			return c.JSON(http.StatusInternalServerError, apiError)
+		}
+		var list = struct {
+			Deliveries []models.WebhookDelivery `json:"deliveries"`
+		}{
+			Deliveries: deliveries,
+		}
+		return c.JSON(http.StatusOK, list)
+	}
+}
+
+// TestWebhook sends a webhook.test event to a webhook right away and returns the delivery.
+func TestWebhook(webhooks service.Webhooks) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token, err := GetToken(c)
+		if err != nil {
+			return err
+		}
+		claims := token.Claims.(jwt.MapClaims)
+		userID := claims["sub"].(string)
+		userModel := &models.User{
+			ID: userID,
+		}
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			apiError := config.APIError("invalid id", http.StatusBadRequest, err)
+			return c.JSON(http.StatusBadRequest, apiError)
+		}
+		delivery, err := webhooks.SendTest(*userModel, id)
+		switch {
+		case errors.Is(err, service.ErrWebhookNotFound):
+			apiError := config.APIError("failed to send test event", http.StatusNotFound, err)
+			return c.JSON(http.StatusNotFound, apiError)
+		case err != nil:
+			apiError := config.APIError("failed to send test event", http.StatusInternalServerError, err)
+			return c.JSON(http.StatusInternalServerError, apiError)
+		}
+		return c.JSON(http.StatusOK, delivery)
+	}
+}
@@ -0,0 +1,79 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/staple-org/staple/internal/models"
+	"github.com/staple-org/staple/internal/service"
+	"github.com/staple-org/staple/internal/storage"
+	"github.com/staple-org/staple/pkg/config"
+)
+
+func TestWebhookHandlers(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+	webhooks := service.NewWebhooks(storage.NewInMemoryWebhookStorer()).WithHTTPClient(receiver.Client())
+	config.Opts.GlobalTokenKey = "test"
+	e := echo.New()
+	tok, err := generateToken("9d0a9cf4-7c43-4ad5-a6d3-3f0c8e1c2c55")
+	assert.NoError(t, err)
+
+	request := func(method, path, body string, handler echo.HandlerFunc, id int) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+tok)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetParamNames("id")
+		c.SetParamValues(strconv.Itoa(id))
+		assert.NoError(t, handler(c))
+		return rec
+	}
+
+	rec := request(echo.POST, "/rest/api/1/user/webhooks", `{"url": "`+receiver.URL+`", "events": ["sometimes"]}`, CreateWebhook(webhooks), 0)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = request(echo.POST, "/rest/api/1/user/webhooks", `{"url": "`+receiver.URL+`", "events": ["staple.created"]}`, CreateWebhook(webhooks), 0)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	var hook models.Webhook
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &hook))
+	assert.NotEmpty(t, hook.Secret)
+
+	rec = request(echo.GET, "/rest/api/1/user/webhooks", "", ListWebhooks(webhooks), 0)
+	var list struct {
+		Webhooks []models.Webhook `json:"webhooks"`
+	}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &list))
+	assert.Len(t, list.Webhooks, 1)
+	assert.Empty(t, list.Webhooks[0].Secret, "the secret is only shown once")
+
+	rec = request(echo.POST, "/rest/api/1/user/webhooks/:id/test", "", TestWebhook(webhooks), hook.ID)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var delivery models.WebhookDelivery
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &delivery))
+	assert.Equal(t, http.StatusNoContent, delivery.StatusCode)
+	assert.NotNil(t, delivery.DeliveredAt)
+
+	rec = request(echo.GET, "/rest/api/1/user/webhooks/:id/deliveries", "", ListWebhookDeliveries(webhooks), hook.ID)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var deliveries struct {
+		Deliveries []models.WebhookDelivery `json:"deliveries"`
+	}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &deliveries))
+	assert.Len(t, deliveries.Deliveries, 1)
+	assert.Equal(t, "webhook.test", deliveries.Deliveries[0].Event)
+
+	rec = request(echo.DELETE, "/rest/api/1/user/webhooks/:id", "", DeleteWebhook(webhooks), hook.ID)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	rec = request(echo.GET, "/rest/api/1/user/webhooks/:id/deliveries", "", ListWebhookDeliveries(webhooks), hook.ID)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
@@ -1,6 +1,36 @@
-create table users (email varchar(255), password text, confirm_code text, max_staples int);
-create table staples (name varchar(255), id serial, content text, created_at timestamp, archived bool, user_email varchar(255));
+create table users (id uuid primary key default gen_random_uuid(), email varchar(255) unique, password text, confirm_code text, max_staples int, totp_secret text not null default '', totp_enabled bool not null default false, recovery_codes text[], totp_last_step bigint not null default 0, failed_logins int not null default 0, locked_until timestamp, pending_email text not null default '', email_change_code text not null default '', email_change_expires timestamp, tokens_valid_after timestamp, delete_after timestamp, feed_token text unique, inbox_token text unique, locale varchar(16) not null default '');
+create table rate_limits (key varchar(512) primary key, tokens double precision, updated_at timestamp);
+create table identities (issuer text, subject text, user_id uuid not null references users(id) on delete cascade, primary key (issuer, subject));
+create table staples (name varchar(255), id serial, content text, created_at timestamp, archived bool, archived_at timestamp, deleted_at timestamp, user_id uuid not null references users(id) on delete cascade);
+create table subscriptions (id serial primary key, user_id uuid not null references users(id) on delete cascade, url text not null, title text not null default '', policy varchar(16) not null, etag text not null default '', last_modified text not null default '', checked_at timestamp, last_error text not null default '', created_at timestamp not null, unique (user_id, url));
+create table subscription_entries (subscription_id int not null references subscriptions(id) on delete cascade, key text not null, seen_at timestamp not null, primary key (subscription_id, key));
+create table webhooks (id serial primary key, user_id uuid not null references users(id) on delete cascade, url text not null, events text[] not null, secret text not null, created_at timestamp not null);
+create table webhook_deliveries (id serial primary key, user_id uuid not null references users(id) on delete cascade, webhook_id int not null references webhooks(id) on delete cascade, event varchar(64) not null, payload text not null, attempts int not null default 0, next_attempt_at timestamp, delivered_at timestamp, status_code int not null default 0, last_error text not null default '', created_at timestamp not null);
+create index webhook_deliveries_due on webhook_deliveries (next_attempt_at) where next_attempt_at is not null;
+create table event_outbox (id uuid primary key, name varchar(64) not null, user_id uuid not null, payload text not null, occurred_at timestamp not null, attempts int not null default 0, last_error text not null default '', published_at timestamp, locked_until timestamp);
+create index event_outbox_pending on event_outbox (occurred_at) where published_at is null;
+create table notifications (id serial primary key, email varchar(255) not null, event varchar(64) not null, channel varchar(32) not null default 'email', payload text not null, attempts int not null default 0, next_attempt_at timestamp, sent_at timestamp, dead_at timestamp, last_error text not null default '', created_at timestamp not null);
+create index notifications_due on notifications (next_attempt_at) where next_attempt_at is not null;
+create table digest_settings (user_id uuid primary key references users(id) on delete cascade, frequency varchar(16) not null default 'off', hour int not null default 8, reminder_days int not null default 0, timezone text not null default 'UTC', quiet_start int not null default 0, quiet_end int not null default 0, last_digest_at timestamp, last_reminder_at timestamp);
+create table notification_preferences (user_id uuid not null references users(id) on delete cascade, event varchar(64) not null, channels text[] not null, frequency varchar(16) not null, last_sent_at timestamp, primary key (user_id, event));
+create table chat_targets (user_id uuid not null references users(id) on delete cascade, kind varchar(16) not null, url text not null, room text not null default '', token text not null default '', created_at timestamp not null, primary key (user_id, kind));
+create table staple_deletions (event_id uuid primary key, user_id uuid not null references users(id) on delete cascade, staple_id int not null, created_at timestamp not null, archived bool not null, archived_at timestamp, deleted_at timestamp not null);
+create index staple_deletions_user on staple_deletions (user_id, deleted_at);
+create index staples_user on staples (user_id, created_at);
+create table audit_log (id bigserial primary key, user_id uuid not null, action varchar(32) not null, staple_id int not null default 0, detail text not null default '', ip varchar(64) not null default '', user_agent text not null default '', created_at timestamp not null);
+create index audit_log_user on audit_log (user_id, id);
+create index audit_log_created on audit_log (created_at);
+create function audit_log_protect() returns trigger as $$
+begin
+	if tg_op = 'DELETE' and current_setting('staple.audit_delete', true) = 'on' then
+		return old;
+	end if;
+	raise exception 'audit_log is append-only';
+end;
+$$ language plpgsql;
+create trigger audit_log_append_only before update or delete on audit_log for each row execute function audit_log_protect();
+create index staples_trash on staples (deleted_at) where deleted_at is not null;
 create user staple with password 'password123';
 create database staples;
 GRANT ALL PRIVILEGES ON DATABASE staples TO staple;
-ALTER USER staple WITH SUPERUSER;
\ No newline at end of file
+ALTER USER staple WITH SUPERUSER;